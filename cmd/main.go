@@ -2,6 +2,11 @@ package main
 
 import (
 	"os"
+	"time"
+	"bytes"
+	"io/ioutil"
+	"fmt"
+	"errors"
 	"path/filepath"
 	"github.com/spf13/viper"
 	log "github.com/sirupsen/logrus"
@@ -11,7 +16,12 @@ import (
 	"github.com/knwng/ppgi/pkg/runtime"
 	log_utils "github.com/knwng/ppgi/pkg/log"
 	intersect_runtime "github.com/knwng/ppgi/pkg/intersect"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
 	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/voprf"
+	"github.com/knwng/ppgi/pkg/algorithms/multiparty"
+	"github.com/knwng/ppgi/pkg/algorithms/padding"
 )
 
 type Options struct {
@@ -24,7 +34,7 @@ func init() {
 
 func main() {
 	var options Options
-	_, err := flags.Parse(&options)
+	args, err := flags.Parse(&options)
 	checkErrOrFail(err)
 
 	configFile, err := filepath.Abs(options.ConfigFile)
@@ -42,6 +52,13 @@ func main() {
 		checkErrOrFail(log_utils.SetLog(logFile, options.Verbose))
 	}
 
+	// `ppgi -c host.yaml keygen [file]` writes a new host key to file, or to
+	// algorithm.key_file if it's not given, and exits
+	if len(args) > 0 && args[0] == "keygen" {
+		keygen(config, args[1:])
+		return
+	}
+
 	// initialize kv
 	var kv runtime.KV
 	kvType := config.GetString("kv.type")
@@ -54,28 +71,25 @@ func main() {
 		log.Fatalf("Unsupported kv type: %s", kvType)
 	}
 
-	// initialize mq producer and consumer
+	// `ppgi -c host.yaml reset-tampered` clears the tampered flag of peer, so
+	// data is sent to it again, and exits
+	if len(args) > 0 && args[0] == "reset-tampered" {
+		resetTampered(kv)
+		return
+	}
+
+	// initialize mq producer and consumer, multi-party PSI creates its own
+	// ones from the party list
+	algorithmType := config.GetString("algorithm.type")
 	var producer runtime.Producer
 	var consumer runtime.Consumer
-	mqURL := config.GetString("mq.url")
-	mqInTopic := config.GetString("mq.in_topic")
-	mqOutTopic := config.GetString("mq.out_topic")
-	mqType := config.GetString("mq.type")
-
-	switch mqType {
-	case "pulsar":
-		schema, err := runtime.ReadSchema(config.GetString("mq.schema"))
-		if err != nil {
-			log.Fatalf("Read schema file failed, err: %s", err)
-		}
-		if producer, err = runtime.NewPulsarProducer(mqURL, mqOutTopic, &schema); err != nil {
-			log.Fatalf("Initialize pulsar producer failed, err: %s", err)
+	if algorithmType != "multiparty" {
+		if producer, err = newProducer(config, kv, config.GetString("mq.out_topic")); err != nil {
+			log.Fatalf("Initialize mq producer failed, err: %s", err)
 		}
-		if consumer, err = runtime.NewPulsarConsumer(mqURL, mqInTopic, &schema); err != nil {
-			log.Fatalf("Initialize pulsar consumer failed, err: %s", err)
+		if consumer, err = newConsumer(config, kv, config.GetString("mq.in_topic")); err != nil {
+			log.Fatalf("Initialize mq consumer failed, err: %s", err)
 		}
-	default:
-		log.Fatalf("Unsupported mq type: %s", mqType)
 	}
 
 	// initialize nebula graph client
@@ -90,33 +104,498 @@ func main() {
 	}
 
 	// initialize runtime
-	algorithmType := config.GetString("algorithm.type")
 	role := config.GetString("role")
+	interval := config.GetInt("graph.fetch_interval")
+	timeout := config.GetInt("conn_timeout")
+	graphDefinition := config.GetString("graph.graph_definition")
+	mode := config.GetString("algorithm.mode")
 
 	var intersectRuntime intersect_runtime.Intersecter
 	switch algorithmType {
 	case "rsa":
-		intersect, err := rsa_blind.NewRSABlindIntersect(
-			config.GetInt("algorithm.key_bits"),
-			config.GetString("algorithm.first_hash"),
-			config.GetString("algorithm.second_hash"),
-			role)
+		keys, err := loadKeyRing(config, role)
+		if err != nil {
+			log.Fatalf("Initialize RSA Intersection failed, err: %s", err)
+		}
+		firstHash, secondHash, err := getHashers(config, "algorithm.first_hash", "algorithm.second_hash")
 		if err != nil {
 			log.Fatalf("Initialize RSA Intersection failed, err: %s", err)
 		}
-		interval := config.GetInt("graph.fetch_interval")
-		timeout := config.GetInt("conn_timeout")
-		graphDefinition := config.GetString("graph.graph_definition")
-		intersectRuntime, err = intersect_runtime.NewRSABlindRuntime(role, interval,
+		keys.SetHashers(firstHash, secondHash)
+		if config.IsSet("algorithm.workers") {
+			keys.SetWorkers(config.GetInt("algorithm.workers"))
+		}
+		if fdhName := config.GetString("algorithm.fdh"); len(fdhName) > 0 {
+			fdh, err := rsa_blind.NewFullDomainHash(fdhName, config.GetString("algorithm.fdh_tag"))
+			if err != nil {
+				log.Fatalf("Initialize RSA Intersection failed, err: %s", err)
+			}
+			keys.SetFullDomainHash(fdh)
+		}
+		rsaRuntime, err := intersect_runtime.NewRSABlindRuntime(role, interval,
+			timeout, keys, mode, producer, consumer, kv, nebula, graphDefinition)
+		if err != nil {
+			log.Fatalf("Initialize runtime failed, err: %s", err)
+		}
+		if config.IsSet("algorithm.padding") {
+			var paddingConfig padding.Config
+			if err = config.UnmarshalKey("algorithm.padding", &paddingConfig); err != nil {
+				log.Fatalf("Read padding config failed, err: %s", err)
+			}
+			p, err := padding.NewPadding(paddingConfig)
+			if err != nil {
+				log.Fatalf("Initialize padding failed, err: %s", err)
+			}
+			rsaRuntime.SetPadding(p)
+		}
+		if err = rsaRuntime.SetExchange(config.GetString("algorithm.exchange")); err != nil {
+			log.Fatalf("Initialize runtime failed, err: %s", err)
+		}
+		if config.IsSet("algorithm.canaries") {
+			if err = rsaRuntime.SetCanaries(config.GetStringSlice("algorithm.canaries")); err != nil {
+				log.Fatalf("Initialize canaries failed, err: %s", err)
+			}
+		}
+		if config.GetBool("algorithm.commitment.enabled") {
+			proofRate := 1.0
+			if config.IsSet("algorithm.commitment.proof_rate") {
+				proofRate = config.GetFloat64("algorithm.commitment.proof_rate")
+			}
+			if err = rsaRuntime.SetCommitment(proofRate); err != nil {
+				log.Fatalf("Initialize commitment failed, err: %s", err)
+			}
+		}
+		rsaRuntime.SetFilterParams(uint64(config.GetInt64("algorithm.filter_capacity")),
+			config.GetFloat64("algorithm.filter_fp_rate"))
+		intersectRuntime = rsaRuntime
+	case "ecdh":
+		_, secondHash, err := getHashers(config, "", "algorithm.second_hash")
+		if err != nil {
+			log.Fatalf("Initialize ECDH Intersection failed, err: %s", err)
+		}
+		intersect, err := loadECDHKey(config, secondHash)
+		if err != nil {
+			log.Fatalf("Initialize ECDH Intersection failed, err: %s", err)
+		}
+		ecdhRuntime, err := intersect_runtime.NewECDHRuntime(role, interval,
+			timeout, intersect, mode, producer, consumer, kv, nebula, graphDefinition)
+		if err != nil {
+			log.Fatalf("Initialize runtime failed, err: %s", err)
+		}
+		ecdhRuntime.SetThreshold(config.GetInt("algorithm.threshold"))
+		if config.IsSet("algorithm.label") {
+			var labelSource graph.ValueSource
+			if err = config.UnmarshalKey("algorithm.label", &labelSource); err != nil {
+				log.Fatalf("Read label source failed, err: %s", err)
+			}
+			ecdhRuntime.SetLabelSource(&labelSource)
+		}
+		intersectRuntime = ecdhRuntime
+	case "voprf":
+		intersect, err := loadVOPRFKey(config, role, "algorithm.key_file")
+		if err != nil {
+			log.Fatalf("Initialize VOPRF Intersection failed, err: %s", err)
+		}
+		voprfRuntime, err := intersect_runtime.NewVOPRFRuntime(role, interval,
 			timeout, intersect, producer, consumer, kv, nebula, graphDefinition)
 		if err != nil {
 			log.Fatalf("Initialize runtime failed, err: %s", err)
 		}
+		if role == "host" && config.IsSet("algorithm.previous_key_file") {
+			previous, err := loadVOPRFKey(config, role, "algorithm.previous_key_file")
+			if err != nil {
+				log.Fatalf("Load the previous VOPRF key failed, err: %s", err)
+			}
+			if err = voprfRuntime.SetPreviousKey(previous); err != nil {
+				log.Fatalf("Sign the rotation of VOPRF key failed, err: %s", err)
+			}
+		}
+		intersectRuntime = voprfRuntime
+	case "sum":
+		secondHash, err := getSecondHash(config)
+		if err != nil {
+			log.Fatalf("Initialize ECDH Intersection failed, err: %s", err)
+		}
+		intersect, err := ecdh.NewECDHIntersect(config.GetString("algorithm.curve"), secondHash)
+		if err != nil {
+			log.Fatalf("Initialize ECDH Intersection failed, err: %s", err)
+		}
+		var valueSource graph.ValueSource
+		if err = config.UnmarshalKey("algorithm.value", &valueSource); err != nil {
+			log.Fatalf("Read value source failed, err: %s", err)
+		}
+		keyBits := 2048
+		if config.IsSet("algorithm.key_bits") {
+			keyBits = config.GetInt("algorithm.key_bits")
+		}
+		intersectRuntime, err = intersect_runtime.NewIntersectSumRuntime(role, interval,
+			timeout, intersect, keyBits, &valueSource, config.GetInt("algorithm.value_decimals"),
+			producer, consumer, kv, nebula, graphDefinition)
+		if err != nil {
+			log.Fatalf("Initialize runtime failed, err: %s", err)
+		}
+	case "hash":
+		if !config.IsSet("algorithm.hash") {
+			config.Set("algorithm.hash", "sha256")
+		}
+		hash, _, err := getHashers(config, "algorithm.hash", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		intersectRuntime, err = intersect_runtime.NewHashRuntime(role, interval,
+			timeout, hash, producer, consumer, kv, nebula, graphDefinition)
+		if err != nil {
+			log.Fatalf("Initialize runtime failed, err: %s", err)
+		}
+	case "multiparty":
+		var parties []multiparty.Party
+		if err = config.UnmarshalKey("algorithm.parties", &parties); err != nil {
+			log.Fatalf("Read party list failed, err: %s", err)
+		}
+		ring, err := multiparty.NewRing(parties, config.GetString("algorithm.party_id"))
+		if err != nil {
+			log.Fatalf("Initialize party ring failed, err: %s", err)
+		}
+		// grpc and file are configured with a single peer, i.e. mq.peer_address
+		// and mq.peer_key, so only a ring of 2 parties works on them
+		if mqType := config.GetString("mq.type"); ring.Size() > 2 && (mqType == "grpc" || mqType == "file") {
+			log.Fatalf("mq type %s supports 2 parties only, use pulsar or redis_stream for %d parties", mqType, ring.Size())
+		}
+		producers := make(map[string]runtime.Producer)
+		for _, party := range ring.Others() {
+			if producers[party.ID], err = newProducer(config, kv, party.Topic); err != nil {
+				log.Fatalf("Initialize mq producer of party %s failed, err: %s", party.ID, err)
+			}
+		}
+		if consumer, err = newConsumer(config, kv, ring.Self().Topic); err != nil {
+			log.Fatalf("Initialize mq consumer failed, err: %s", err)
+		}
+		secondHash, err := getSecondHash(config)
+		if err != nil {
+			log.Fatalf("Initialize ECDH Intersection failed, err: %s", err)
+		}
+		intersect, err := ecdh.NewECDHIntersect(config.GetString("algorithm.curve"), secondHash)
+		if err != nil {
+			log.Fatalf("Initialize ECDH Intersection failed, err: %s", err)
+		}
+		intersectRuntime, err = intersect_runtime.NewMultiPartyRuntime(interval,
+			timeout, intersect, ring, producers, consumer, kv, nebula, graphDefinition)
+		if err != nil {
+			log.Fatalf("Initialize runtime failed, err: %s", err)
+		}
 	default:
 		log.Fatalf("Unsupported algorithm: %s", algorithmType)
 	}
 
-	intersectRuntime.Run()
+	if err = intersectRuntime.SetDispatchPolicy(config.GetString("dispatcher.unhandled"),
+		config.GetDuration("dispatcher.handler_timeout")); err != nil {
+		log.Fatalf("Set dispatch policy failed, err: %s", err)
+	}
+	// a list rather than a map, since viper lowercases the keys of maps
+	var stepTimeouts []struct {
+		Step 		string
+		Timeout 	time.Duration
+	}
+	if err = config.UnmarshalKey("dispatcher.step_timeouts", &stepTimeouts); err != nil {
+		log.Fatalf("Invalid step timeouts, err: %s", err)
+	}
+	for _, stepTimeout := range stepTimeouts {
+		intersectRuntime.SetStepTimeout(stepTimeout.Step, stepTimeout.Timeout)
+	}
+
+	checkErrOrFail(intersectRuntime.Run())
+}
+
+func newProducer(config *viper.Viper, kv runtime.KV, topic string) (runtime.Producer, error) {
+	mqType := config.GetString("mq.type")
+	switch mqType {
+	case "pulsar":
+		schema, err := runtime.ReadSchema(config.GetString("mq.schema"))
+		if err != nil {
+			return nil, err
+		}
+		producer, err := runtime.NewPulsarProducer(config.GetString("mq.url"), topic, &schema)
+		if err != nil {
+			return nil, err
+		}
+		return producer, nil
+	case "grpc":
+		producer, err := runtime.NewStreamProducer(config.GetString("mq.peer_address"), topic, getTLSConfig(config))
+		if err != nil {
+			return nil, err
+		}
+		return producer, nil
+	case "redis_stream":
+		redisKV, ok := kv.(*runtime.RedisKV)
+		if !ok {
+			return nil, errors.New("redis_stream requires a redis kv")
+		}
+		return runtime.NewRedisStreamProducer(redisKV.Client(), topic), nil
+	case "file":
+		key, err := runtime.LoadSignKey(config.GetString("mq.sign_key"))
+		if err != nil {
+			return nil, err
+		}
+		producer, err := runtime.NewFileProducer(config.GetString("mq.outbox"), topic, key)
+		if err != nil {
+			return nil, err
+		}
+		return producer, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported mq type: %s", mqType))
+	}
+}
+
+func newConsumer(config *viper.Viper, kv runtime.KV, topic string) (runtime.Consumer, error) {
+	mqType := config.GetString("mq.type")
+	switch mqType {
+	case "pulsar":
+		schema, err := runtime.ReadSchema(config.GetString("mq.schema"))
+		if err != nil {
+			return nil, err
+		}
+		consumer, err := runtime.NewPulsarConsumer(config.GetString("mq.url"), topic, &schema)
+		if err != nil {
+			return nil, err
+		}
+		return consumer, nil
+	case "grpc":
+		consumer, err := runtime.NewStreamConsumer(config.GetString("mq.listen"), topic,
+			config.GetString("mq.spool"), getTLSConfig(config))
+		if err != nil {
+			return nil, err
+		}
+		return consumer, nil
+	case "redis_stream":
+		redisKV, ok := kv.(*runtime.RedisKV)
+		if !ok {
+			return nil, errors.New("redis_stream requires a redis kv")
+		}
+		name := config.GetString("mq.consumer")
+		if len(name) == 0 {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			name = fmt.Sprintf("%s-%s", hostname, config.GetString("role"))
+		}
+		consumer, err := runtime.NewRedisStreamConsumer(redisKV.Client(), topic, runtime.RedisStreamConsumerOptions{
+			Group: config.GetString("mq.group"),
+			Consumer: name,
+			ClaimIdle: config.GetDuration("mq.claim_idle"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return consumer, nil
+	case "file":
+		key, err := runtime.LoadVerifyKey(config.GetString("mq.peer_key"))
+		if err != nil {
+			return nil, err
+		}
+		consumer, err := runtime.NewFileConsumer(config.GetString("mq.inbox"), topic, key,
+			config.GetDuration("mq.poll_interval"))
+		if err != nil {
+			return nil, err
+		}
+		return consumer, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported mq type: %s", mqType))
+	}
+}
+
+func getTLSConfig(config *viper.Viper) runtime.TLSConfig {
+	return runtime.TLSConfig{
+		CertFile: config.GetString("mq.cert_file"),
+		KeyFile: config.GetString("mq.key_file"),
+		CAFile: config.GetString("mq.ca_file"),
+		PeerName: config.GetString("mq.peer_name"),
+	}
+}
+
+// loadKeyRing loads the host keys from algorithm.keys, or the single key from
+// algorithm.key_file. Client starts with an empty ring which is filled by the
+// keys announced by host.
+func loadKeyRing(config *viper.Viper, role string) (*rsa_blind.KeyRing, error) {
+	firstHash := config.GetString("algorithm.first_hash")
+	secondHash := config.GetString("algorithm.second_hash")
+	if role != "host" {
+		return rsa_blind.NewKeyRing(firstHash, secondHash), nil
+	}
+
+	if config.IsSet("algorithm.keys") {
+		var keyConfigs []rsa_blind.KeyConfig
+		if err := config.UnmarshalKey("algorithm.keys", &keyConfigs); err != nil {
+			return nil, err
+		}
+		return rsa_blind.LoadHostKeyRing(keyConfigs, firstHash, secondHash)
+	}
+
+	var intersect *rsa_blind.RSABlindIntersect
+	var err error
+	keyFile := config.GetString("algorithm.key_file")
+	if len(keyFile) > 0 {
+		privKey, loadErr := rsa_blind.LoadPrivateKey(keyFile)
+		if loadErr != nil {
+			return nil, errors.New(fmt.Sprintf("Load host key from %s failed, run `keygen` to create one, err: %s", keyFile, loadErr))
+		}
+		intersect, err = rsa_blind.NewHostRSABlindIntersect(privKey, firstHash, secondHash)
+	} else {
+		log.Warn("No algorithm.key_file configured, a new key is generated and hashes stored under the old one won't match")
+		intersect, err = rsa_blind.NewRSABlindIntersect(config.GetInt("algorithm.key_bits"),
+			firstHash, secondHash, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := rsa_blind.NewKeyRing(firstHash, secondHash)
+	keys.Add(&rsa_blind.RingKey{
+		ID: intersect.GetKeyID(),
+		Intersect: intersect,
+	})
+	return keys, nil
+}
+
+// loadVOPRFKey loads the key of host from the file under fileKey, the client
+// has no key
+func loadVOPRFKey(config *viper.Viper, role, fileKey string) (*voprf.VOPRFIntersect, error) {
+	keyFile := config.GetString(fileKey)
+	if role != "host" || len(keyFile) == 0 {
+		if role == "host" {
+			log.Warn("No algorithm.key_file configured, a new key is generated and the client pinned to the old one will refuse it")
+		}
+		return voprf.NewVOPRFIntersect(role)
+	}
+	privKey, err := ecdh.LoadPrivateKey(keyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Load host key from %s failed, run `keygen` to create one, err: %s", keyFile, err))
+	}
+	return voprf.NewHostVOPRFIntersect(privKey)
+}
+
+// loadECDHKey loads the key of either side from algorithm.key_file, without
+// it a new key is generated and the state stored under the old one is dropped
+func loadECDHKey(config *viper.Viper, secondHash hasher.Hasher) (*ecdh.ECDHIntersect, error) {
+	keyFile := config.GetString("algorithm.key_file")
+	if len(keyFile) == 0 {
+		log.Warn("No algorithm.key_file configured, a new key is generated and the hashes stored under the old one are dropped")
+		return ecdh.NewECDHIntersect(config.GetString("algorithm.curve"), secondHash)
+	}
+	privKey, err := ecdh.LoadPrivateKey(keyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Load key from %s failed, run `keygen` to create one, err: %s", keyFile, err))
+	}
+	return ecdh.NewECDHIntersectWithKey(privKey, secondHash)
+}
+
+// getHashers resolves the hashers configured under the given keys, an empty
+// key is skipped. With algorithm.hash_secret_file set, they're keyed with the
+// secret in it.
+func getHashers(config *viper.Viper, firstKey, secondKey string) (hasher.Hasher, hasher.Hasher, error) {
+	var secret []byte
+	if secretFile := config.GetString("algorithm.hash_secret_file"); len(secretFile) > 0 {
+		var err error
+		if secret, err = ioutil.ReadFile(secretFile); err != nil {
+			return nil, nil, err
+		}
+		secret = bytes.TrimSpace(secret)
+	}
+
+	keys := []string{firstKey, secondKey}
+	hashers := make([]hasher.Hasher, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		name := config.GetString(key)
+		if hasher.IsWeak(name) {
+			log.WithField(key, name).Warn("The hash is weak and only kept for compatibility, use sha256 or sha3_256 instead")
+		}
+
+		var err error
+		if len(secret) > 0 {
+			hashers[i], err = hasher.GetKeyedHasher(name, secret)
+		} else {
+			hashers[i], err = hasher.GetHasher(name)
+		}
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Invalid %s, err: %s", key, err))
+		}
+	}
+	return hashers[0], hashers[1], nil
+}
+
+// getSecondHash resolves algorithm.second_hash, sha256 by default
+func getSecondHash(config *viper.Viper) (hasher.Hasher, error) {
+	if !config.IsSet("algorithm.second_hash") {
+		config.Set("algorithm.second_hash", "sha256")
+	}
+	_, secondHash, err := getHashers(config, "", "algorithm.second_hash")
+	return secondHash, err
+}
+
+func keygen(config *viper.Viper, args []string) {
+	algorithmType := config.GetString("algorithm.type")
+	if algorithmType != "rsa" && algorithmType != "voprf" && algorithmType != "ecdh" {
+		log.Fatalf("keygen is not supported by algorithm: %s", algorithmType)
+	}
+
+	keyFile := config.GetString("algorithm.key_file")
+	if len(args) > 0 {
+		keyFile = args[0]
+	}
+	if len(keyFile) == 0 {
+		log.Fatal("A key file or algorithm.key_file should be given to run keygen")
+	}
+
+	var keyID string
+	if algorithmType == "voprf" {
+		privKey, err := ecdh.GenerateAndSavePrivateKey(keyFile)
+		if err != nil {
+			log.Fatalf("Generate host key failed, err: %s", err)
+		}
+		intersect, err := voprf.NewHostVOPRFIntersect(privKey)
+		if err != nil {
+			log.Fatalf("Generate host key failed, err: %s", err)
+		}
+		keyID = intersect.GetKeyID()
+	} else if algorithmType == "ecdh" {
+		privKey, err := ecdh.GenerateAndSavePrivateKey(keyFile)
+		if err != nil {
+			log.Fatalf("Generate key failed, err: %s", err)
+		}
+		intersect, err := ecdh.NewECDHIntersectWithKey(privKey, &hasher.SHA256Hash{})
+		if err != nil {
+			log.Fatalf("Generate key failed, err: %s", err)
+		}
+		keyID = intersect.GetKeyID()
+	} else {
+		privKey, err := rsa_blind.GenerateAndSavePrivateKey(keyFile, config.GetInt("algorithm.key_bits"))
+		if err != nil {
+			log.Fatalf("Generate host key failed, err: %s", err)
+		}
+		keyID = rsa_blind.KeyFingerprint(&privKey.PublicKey)
+	}
+
+	log.WithFields(log.Fields{
+		"key_file": keyFile,
+		"key_id": keyID,
+	}).Info("Host key generated")
+}
+
+func resetTampered(kv runtime.KV) {
+	tampered, err := intersect_runtime.ResetTampered(kv)
+	if err != nil {
+		log.Fatalf("Reset tampered flag failed, err: %s", err)
+	}
+	for sessionKey, reason := range tampered {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"reason": reason,
+		}).Warning("Cleared tampered session")
+	}
+	log.WithField("num_sessions", len(tampered)).Warning("The tampered flag of peer is reset, data is sent to peer again")
 }
 
 func checkErrOrFail(err error) {
@@ -0,0 +1,260 @@
+package ecdh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+)
+
+// ECDH-based PSI relies on the commutativity of scalar multiplication:
+// a * (b * H(x)) == b * (a * H(x)), so both parties encrypt their own items
+// with their secret scalars, then re-encrypt the items of the peer.
+type ECDHStep = runtime.Step
+
+const (
+	StepClientEncrypt 	ECDHStep = "ClientEncrypt"
+	StepHostReEncrypt 	ECDHStep = "HostReEncrypt"
+	StepClientHash 		ECDHStep = "ClientHash"
+	StepHostEncrypt 	ECDHStep = "HostEncrypt"
+	StepClientReEncrypt ECDHStep = "ClientReEncrypt"
+	StepHostHash 		ECDHStep = "HostHash"
+	// steps of threshold mode, the items of peer are first sent back shuffled
+	// and the verdict of the session is sent before the unshuffled ones
+	StepClientShuffle 	ECDHStep = "ClientShuffle"
+	StepHostShuffle 	ECDHStep = "HostShuffle"
+	StepClientThreshold ECDHStep = "ClientThreshold"
+	StepHostThreshold 	ECDHStep = "HostThreshold"
+	// steps of the threshold check, see threshold.go. The owner of a session
+	// sends the filter of its items, the selected candidates and the opened
+	// comparisons, and the peer sends the candidates and the comparisons.
+	StepClientFilter 	ECDHStep = "ClientFilter"
+	StepHostFilter 		ECDHStep = "HostFilter"
+	StepClientRotate 	ECDHStep = "ClientRotate"
+	StepHostRotate 		ECDHStep = "HostRotate"
+	StepClientSelect 	ECDHStep = "ClientSelect"
+	StepHostSelect 		ECDHStep = "HostSelect"
+	StepClientCompare 	ECDHStep = "ClientCompare"
+	StepHostCompare 	ECDHStep = "HostCompare"
+	StepClientOpen 		ECDHStep = "ClientOpen"
+	StepHostOpen 		ECDHStep = "HostOpen"
+	// the sealed labels of the items of host in labeled mode
+	StepHostLabels 		ECDHStep = "HostLabels"
+	StepExchangeData	ECDHStep = runtime.StepExchangeData
+	StepShutdown		ECDHStep = runtime.StepShutdown
+)
+
+const hashToCurveDST = "PPGI-ECDH-PSI-V01-CS01-with-P256_XMD:SHA-256_SSWU_RO_"
+
+type ECDHIntersect struct {
+	curve 		elliptic.Curve
+	secondHash 	hasher.Hasher
+	privKey		*big.Int
+}
+
+func getCurve(name string) (elliptic.Curve, error) {
+	switch name {
+	case "p256", "P-256":
+		return elliptic.P256(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported curve: %s", name))
+	}
+}
+
+// NewECDHIntersect takes the hasher of the finalized items, it should be the
+// same on both sides
+func NewECDHIntersect(curveName string, secondHash hasher.Hasher) (*ECDHIntersect, error) {
+	curve, err := getCurve(curveName)
+	if err != nil {
+		return nil, err
+	}
+
+	if secondHash == nil {
+		return nil, errors.New("The second hash should be set")
+	}
+
+	privKey, err := generatePrivKey(curve)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECDHIntersect{
+		curve: curve,
+		secondHash: secondHash,
+		privKey: privKey,
+	}, nil
+}
+
+// NewECDHIntersectWithKey uses a key loaded from file, so the hashes stored
+// by the previous runs still match
+func NewECDHIntersectWithKey(privKey *ecdsa.PrivateKey, secondHash hasher.Hasher) (*ECDHIntersect, error) {
+	if privKey.Curve != elliptic.P256() {
+		return nil, errors.New("The key is not on P-256")
+	}
+
+	if secondHash == nil {
+		return nil, errors.New("The second hash should be set")
+	}
+
+	return &ECDHIntersect{
+		curve: privKey.Curve,
+		secondHash: secondHash,
+		privKey: privKey.D,
+	}, nil
+}
+
+func (s *ECDHIntersect) Curve() elliptic.Curve {
+	return s.curve
+}
+
+// GetKeyID identifies the private key by the fingerprint of its pubkey
+func (s *ECDHIntersect) GetKeyID() string {
+	x, y := s.curve.ScalarBaseMult(s.privKey.Bytes())
+	return KeyFingerprint(elliptic.MarshalCompressed(s.curve, x, y))
+}
+
+// Fork returns an intersect on the same curve and with the same second hash,
+// but with a fresh private key
+func (s *ECDHIntersect) Fork() (*ECDHIntersect, error) {
+	privKey, err := generatePrivKey(s.curve)
+	if err != nil {
+		return nil, err
+	}
+	return &ECDHIntersect{
+		curve: s.curve,
+		secondHash: s.secondHash,
+		privKey: privKey,
+	}, nil
+}
+
+// generatePrivKey returns a random scalar in [1, n-1]
+func generatePrivKey(curve elliptic.Curve) (*big.Int, error) {
+	nMinusOne := big.NewInt(0).Sub(curve.Params().N, big.NewInt(1))
+	k, err := rand.Int(rand.Reader, nMinusOne)
+	if err != nil {
+		return nil, err
+	}
+	return k.Add(k, big.NewInt(1)), nil
+}
+
+// Encrypt hashes every message to the curve and multiplies it with the private key
+func (s *ECDHIntersect) Encrypt(msgs []string) ([][]byte, error) {
+	ret := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		x, y, err := HashToCurve(s.curve, []byte(msg), []byte(hashToCurveDST))
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = s.mul(x, y)
+	}
+	return ret, nil
+}
+
+// ReEncrypt multiplies the points encrypted by the peer with the private key
+func (s *ECDHIntersect) ReEncrypt(points [][]byte) ([][]byte, error) {
+	ret := make([][]byte, len(points))
+	for i, point := range points {
+		x, y := elliptic.UnmarshalCompressed(s.curve, point)
+		if x == nil {
+			return nil, errors.New(fmt.Sprintf("Invalid point at index %d", i))
+		}
+		ret[i] = s.mul(x, y)
+	}
+	return ret, nil
+}
+
+// Decrypt removes the private key from the points, by multiplying them with
+// its inverse modulo the order of the curve
+func (s *ECDHIntersect) Decrypt(points [][]byte) ([][]byte, error) {
+	inv := big.NewInt(0).ModInverse(s.privKey, s.curve.Params().N)
+	ret := make([][]byte, len(points))
+	for i, point := range points {
+		x, y := elliptic.UnmarshalCompressed(s.curve, point)
+		if x == nil {
+			return nil, errors.New(fmt.Sprintf("Invalid point at index %d", i))
+		}
+		rx, ry := s.curve.ScalarMult(x, y, inv.Bytes())
+		ret[i] = elliptic.MarshalCompressed(s.curve, rx, ry)
+	}
+	return ret, nil
+}
+
+// Blind multiplies the points with a fresh random scalar, which is returned to
+// remove it by Unblind, so the peer can't finalize the items it re-encrypts
+func (s *ECDHIntersect) Blind(points [][]byte) ([][]byte, *big.Int, error) {
+	blind, err := generatePrivKey(s.curve)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret, err := s.mulPoints(points, blind)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ret, blind, nil
+}
+
+// Unblind removes the scalar of Blind from the points
+func (s *ECDHIntersect) Unblind(points [][]byte, blind *big.Int) ([][]byte, error) {
+	return s.mulPoints(points, big.NewInt(0).ModInverse(blind, s.curve.Params().N))
+}
+
+func (s *ECDHIntersect) mulPoints(points [][]byte, k *big.Int) ([][]byte, error) {
+	ret := make([][]byte, len(points))
+	for i, point := range points {
+		x, y := elliptic.UnmarshalCompressed(s.curve, point)
+		if x == nil {
+			return nil, errors.New(fmt.Sprintf("Invalid point at index %d", i))
+		}
+		rx, ry := s.curve.ScalarMult(x, y, k.Bytes())
+		ret[i] = elliptic.MarshalCompressed(s.curve, rx, ry)
+	}
+	return ret, nil
+}
+
+// HashToPoints maps the messages to the curve without encrypting them, they're
+// what Decrypt returns after all the keys are removed
+func (s *ECDHIntersect) HashToPoints(msgs []string) ([][]byte, error) {
+	ret := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		x, y, err := HashToCurve(s.curve, []byte(msg), []byte(hashToCurveDST))
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = elliptic.MarshalCompressed(s.curve, x, y)
+	}
+	return ret, nil
+}
+
+// Finalize hashes the points encrypted by both parties, and the results are
+// the values to compare
+func (s *ECDHIntersect) Finalize(points [][]byte) [][]byte {
+	ret := make([][]byte, len(points))
+	for i, point := range points {
+		ret[i] = s.secondHash.Sum(point)
+	}
+	return ret
+}
+
+// Shuffle permutes the items in place with a uniformly random permutation, so
+// that the peer can't link the re-encrypted items to the ones it sent
+func Shuffle(items [][]byte) error {
+	for i := len(items) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i + 1)))
+		if err != nil {
+			return err
+		}
+		k := int(j.Int64())
+		items[i], items[k] = items[k], items[i]
+	}
+	return nil
+}
+
+func (s *ECDHIntersect) mul(x, y *big.Int) []byte {
+	rx, ry := s.curve.ScalarMult(x, y, s.privKey.Bytes())
+	return elliptic.MarshalCompressed(s.curve, rx, ry)
+}
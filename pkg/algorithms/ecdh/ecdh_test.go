@@ -0,0 +1,329 @@
+package ecdh
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+)
+
+func TestHashToCurve(t *testing.T) {
+	// test vectors of P256_XMD:SHA-256_SSWU_RO_ in RFC 9380, appendix J.1.1
+	dst := []byte("QUUX-V01-CS02-with-P256_XMD:SHA-256_SSWU_RO_")
+	vectors := []struct {
+		msg string
+		x   string
+		y   string
+	}{
+		{
+			msg: "",
+			x:   "2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4",
+			y:   "8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415",
+		},
+		{
+			msg: "abc",
+			x:   "0bb8b87485551aa43ed54f009230450b492fead5f1cc91658775dac4a3388a0f",
+			y:   "5c41b3d0731a27a7b14bc0bf0ccded2d8751f83493404c84a88e71ffd424212e",
+		},
+	}
+
+	for _, v := range vectors {
+		x, y, err := HashToCurve(elliptic.P256(), []byte(v.msg), dst)
+		assert.NoError(t, err)
+		assert.Equal(t, v.x, hex.EncodeToString(x.FillBytes(make([]byte, 32))))
+		assert.Equal(t, v.y, hex.EncodeToString(y.FillBytes(make([]byte, 32))))
+	}
+}
+
+func TestECDHIntersection(t *testing.T) {
+	client, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	host, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+
+	hostA := []string{"21022219911301911", "640111191119381029", "1732819483", "184", "97561890571"}
+	hostB := []string{"640111191119381029", "1732819483", "3728172745", "97561890571"}
+
+	target := map[string]bool{"640111191119381029": true, "1732819483": true, "97561890571": true}
+
+	// host side
+	hostEnc, err := host.Encrypt(hostA)
+	assert.NoError(t, err)
+	hostDoubleEnc, err := client.ReEncrypt(hostEnc)
+	assert.NoError(t, err)
+	ta := host.Finalize(hostDoubleEnc)
+
+	// client side
+	clientEnc, err := client.Encrypt(hostB)
+	assert.NoError(t, err)
+	clientDoubleEnc, err := host.ReEncrypt(clientEnc)
+	assert.NoError(t, err)
+	tb := client.Finalize(clientDoubleEnc)
+
+	hashSet := make(map[string]bool)
+	for _, hash := range ta {
+		hashSet[string(hash)] = true
+	}
+
+	matched := make(map[string]bool)
+	for i, hash := range tb {
+		if hashSet[string(hash)] {
+			matched[hostB[i]] = true
+		}
+	}
+	assert.Equal(t, target, matched)
+
+	_, err = host.ReEncrypt([][]byte{[]byte("not a point")})
+	assert.Error(t, err)
+}
+
+func TestECDHKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "ecdh.pem")
+	privKey, err := GenerateAndSavePrivateKey(keyFile)
+	assert.NoError(t, err)
+	_, err = GenerateAndSavePrivateKey(keyFile)
+	assert.Error(t, err)
+
+	first, err := NewECDHIntersectWithKey(privKey, &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	loaded, err := LoadPrivateKey(keyFile)
+	assert.NoError(t, err)
+	second, err := NewECDHIntersectWithKey(loaded, &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	assert.Equal(t, first.GetKeyID(), second.GetKeyID())
+
+	// the restarted side encrypts the same items to the same points
+	items := []string{"640111191119381029", "1732819483"}
+	before, err := first.Encrypt(items)
+	assert.NoError(t, err)
+	after, err := second.Encrypt(items)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	fresh, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.GetKeyID(), fresh.GetKeyID())
+}
+
+func TestShuffle(t *testing.T) {
+	items := make([][]byte, 100)
+	for i := range items {
+		items[i] = []byte{byte(i)}
+	}
+	shuffled := make([][]byte, len(items))
+	copy(shuffled, items)
+	assert.NoError(t, Shuffle(shuffled))
+
+	assert.NotEqual(t, items, shuffled)
+	seen := make(map[byte]bool)
+	for _, item := range shuffled {
+		seen[item[0]] = true
+	}
+	assert.Equal(t, len(items), len(seen))
+	assert.NoError(t, Shuffle(nil))
+}
+
+func TestECDHCardinality(t *testing.T) {
+	client, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	host, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+
+	hostA := []string{"21022219911301911", "640111191119381029", "1732819483", "184", "97561890571"}
+	hostB := []string{"640111191119381029", "1732819483", "3728172745", "97561890571"}
+
+	// the host shuffles the client's items after re-encrypting them
+	clientEnc, err := client.Encrypt(hostB)
+	assert.NoError(t, err)
+	clientDoubleEnc, err := host.ReEncrypt(clientEnc)
+	assert.NoError(t, err)
+	assert.NoError(t, Shuffle(clientDoubleEnc))
+	tb := client.Finalize(clientDoubleEnc)
+
+	// the client finalizes the host's items by itself
+	hostEnc, err := host.Encrypt(hostA)
+	assert.NoError(t, err)
+	hostDoubleEnc, err := client.ReEncrypt(hostEnc)
+	assert.NoError(t, err)
+	ta := client.Finalize(hostDoubleEnc)
+
+	hashSet := make(map[string]bool)
+	for _, hash := range ta {
+		hashSet[string(hash)] = true
+	}
+	count := 0
+	for _, hash := range tb {
+		if hashSet[string(hash)] {
+			count++
+		}
+	}
+	assert.Equal(t, 3, count)
+}
+
+func TestECDHMultiParty(t *testing.T) {
+	sets := [][]string{
+		{"21022219911301911", "640111191119381029", "1732819483", "184", "97561890571"},
+		{"640111191119381029", "1732819483", "3728172745", "97561890571"},
+		{"1732819483", "97561890571", "184", "5550123"},
+	}
+	first, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	// every round uses fresh keys
+	parties := make([]*ECDHIntersect, len(sets))
+	for i := range parties {
+		parties[i], err = first.Fork()
+		assert.NoError(t, err)
+		assert.NotEqual(t, 0, parties[i].privKey.Cmp(first.privKey))
+	}
+
+	// every set goes round the ring, encrypted and shuffled by every party
+	counts := make(map[string]int)
+	for i, set := range sets {
+		items, err := parties[i].Encrypt(set)
+		assert.NoError(t, err)
+		for hop := 1; hop < len(parties); hop++ {
+			items, err = parties[(i + hop) % len(parties)].ReEncrypt(items)
+			assert.NoError(t, err)
+			assert.NoError(t, Shuffle(items))
+		}
+		for _, item := range items {
+			counts[string(item)]++
+		}
+	}
+
+	common := make([][]byte, 0)
+	for item, count := range counts {
+		if count == len(sets) {
+			common = append(common, []byte(item))
+		}
+	}
+	assert.Equal(t, 2, len(common))
+
+	// then the keys are removed one by one
+	for _, party := range parties {
+		common, err = party.Decrypt(common)
+		assert.NoError(t, err)
+	}
+
+	points, err := parties[1].HashToPoints(sets[1])
+	assert.NoError(t, err)
+	commonSet := make(map[string]bool)
+	for _, item := range common {
+		commonSet[string(item)] = true
+	}
+	matched := make([]string, 0)
+	for i, point := range points {
+		if commonSet[string(point)] {
+			matched = append(matched, sets[1][i])
+		}
+	}
+	assert.Equal(t, []string{"1732819483", "97561890571"}, matched)
+}
+
+func TestECDHLabeled(t *testing.T) {
+	client, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	host, err := NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+
+	hostItems := []string{"640111191119381029", "1732819483", "3728172745"}
+	hostLabels := []string{"0.12", "0.87", "0.45"}
+	clientItems := []string{"1732819483", "21022219911301911", "3728172745"}
+
+	// host seals the labels with the points encrypted by itself only
+	hostPoints, err := host.Encrypt(hostItems)
+	assert.NoError(t, err)
+	sealed := make(map[string][]byte)
+	for i, point := range hostPoints {
+		tag, key := LabelTagAndKey(point)
+		sealed[string(tag)], err = SealLabel(key, []byte(hostLabels[i]))
+		assert.NoError(t, err)
+	}
+
+	// client removes its own key from the items re-encrypted by host
+	encrypted, err := client.Encrypt(clientItems)
+	assert.NoError(t, err)
+	reEncrypted, err := host.ReEncrypt(encrypted)
+	assert.NoError(t, err)
+	points, err := client.Decrypt(reEncrypted)
+	assert.NoError(t, err)
+
+	opened := make(map[string]string)
+	for i, point := range points {
+		tag, key := LabelTagAndKey(point)
+		if label, ok := sealed[string(tag)]; ok {
+			plain, err := OpenLabel(key, label)
+			assert.NoError(t, err)
+			opened[clientItems[i]] = string(plain)
+		}
+	}
+	assert.Equal(t, map[string]string{"1732819483": "0.87", "3728172745": "0.45"}, opened)
+
+	// a label can't be opened with the key of another item
+	_, key := LabelTagAndKey(points[0])
+	tag, _ := LabelTagAndKey(points[2])
+	_, err = OpenLabel(key, sealed[string(tag)])
+	assert.Equal(t, ErrLabel, err)
+}
+
+func TestThresholdCheck(t *testing.T) {
+	curve := elliptic.P256()
+	finals := func(items ...string) [][]byte {
+		ret := make([][]byte, len(items))
+		for i, item := range items {
+			hash := sha256.Sum256([]byte(item))
+			ret[i] = hash[:]
+		}
+		return ret
+	}
+	session := finals("a", "b", "c", "d")
+	own := finals("b", "c", "d", "e", "f")
+
+	check := func(threshold int) bool {
+		owner, err := NewThresholdKey(curve)
+		assert.NoError(t, err)
+		peer, err := NewThresholdKey(curve)
+		assert.NoError(t, err)
+
+		hashes, bits, err := owner.EncryptFilter(session)
+		assert.NoError(t, err)
+		candidates, picks, err := peer.Rotate(hashes, bits, own)
+		assert.NoError(t, err)
+		assert.Len(t, candidates, len(own) * (int(hashes) + 1))
+
+		selected, err := owner.Select(peer.PubKey(), int(hashes) + 1, candidates)
+		assert.NoError(t, err)
+		count, err := peer.Count(selected, int(hashes) + 1, picks)
+		assert.NoError(t, err)
+		comparisons, err := peer.Compare(count, threshold, len(session))
+		assert.NoError(t, err)
+
+		// the peer can't open the comparisons by itself
+		met, err := peer.AnyZero(comparisons)
+		assert.NoError(t, err)
+		assert.False(t, met)
+
+		opened, err := owner.Open(comparisons)
+		assert.NoError(t, err)
+		met, err = peer.AnyZero(opened)
+		assert.NoError(t, err)
+		return met
+	}
+	assert.True(t, check(2))
+	assert.True(t, check(3))
+	assert.False(t, check(4))
+
+	// a group without zero is rejected
+	owner, err := NewThresholdKey(curve)
+	assert.NoError(t, err)
+	hashes, bits, err := owner.EncryptFilter(session)
+	assert.NoError(t, err)
+	groupSize := int(hashes) + 1
+	_, err = owner.Select(owner.PubKey(), groupSize, bits[:groupSize])
+	assert.Error(t, err)
+}
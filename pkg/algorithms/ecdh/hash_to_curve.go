@@ -0,0 +1,168 @@
+package ecdh
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Hash-to-curve for P-256 following RFC 9380, suite P256_XMD:SHA-256_SSWU_RO_.
+// The implementation is not constant time, which is acceptable here since the
+// hashed inputs are the ids we are going to blind anyway, not secret keys.
+
+const (
+	h2cSecurityBytes = 48 // L = ceil((ceil(log2(p)) + k) / 8), k = 128
+	sha256BlockSize  = 64
+)
+
+var (
+	bigOne   = big.NewInt(1)
+	bigTwo   = big.NewInt(2)
+	bigThree = big.NewInt(3)
+)
+
+// expandMessageXMD implements expand_message_xmd with sha256
+func expandMessageXMD(msg, dst []byte, lenInBytes int) ([]byte, error) {
+	ell := (lenInBytes + sha256.Size - 1) / sha256.Size
+	if ell > 255 || lenInBytes > 65535 || len(dst) > 255 {
+		return nil, errors.New(fmt.Sprintf("Invalid expand_message_xmd params, len: %d, dst len: %d", lenInBytes, len(dst)))
+	}
+
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+
+	h := sha256.New()
+	h.Write(make([]byte, sha256BlockSize))
+	h.Write(msg)
+	h.Write([]byte{byte(lenInBytes >> 8), byte(lenInBytes)})
+	h.Write([]byte{0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	h.Reset()
+	h.Write(b0)
+	h.Write([]byte{1})
+	h.Write(dstPrime)
+	bi := h.Sum(nil)
+
+	uniform := make([]byte, 0, ell*sha256.Size)
+	uniform = append(uniform, bi...)
+	for i := 2; i <= ell; i++ {
+		xored := make([]byte, sha256.Size)
+		for j := range xored {
+			xored[j] = b0[j] ^ bi[j]
+		}
+		h.Reset()
+		h.Write(xored)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		bi = h.Sum(nil)
+		uniform = append(uniform, bi...)
+	}
+
+	return uniform[:lenInBytes], nil
+}
+
+// hashToField maps msg to count elements of the base field of the curve
+func hashToField(curve elliptic.Curve, msg, dst []byte, count int) ([]*big.Int, error) {
+	uniform, err := expandMessageXMD(msg, dst, count*h2cSecurityBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	p := curve.Params().P
+	ret := make([]*big.Int, count)
+	for i := 0; i < count; i++ {
+		chunk := uniform[i*h2cSecurityBytes : (i+1)*h2cSecurityBytes]
+		ret[i] = big.NewInt(0).Mod(big.NewInt(0).SetBytes(chunk), p)
+	}
+	return ret, nil
+}
+
+// mapToCurveSSWU implements the simplified Shallue-van de Woestijne-Ulas
+// method for curves of form y^2 = x^3 + A * x + B with A = -3
+func mapToCurveSSWU(curve elliptic.Curve, u *big.Int) (*big.Int, *big.Int) {
+	params := curve.Params()
+	p := params.P
+	a := big.NewInt(0).Sub(p, bigThree)
+	b := params.B
+	z := big.NewInt(0).Sub(p, big.NewInt(10))
+
+	mul := func(x, y *big.Int) *big.Int {
+		return big.NewInt(0).Mod(big.NewInt(0).Mul(x, y), p)
+	}
+	add := func(x, y *big.Int) *big.Int {
+		return big.NewInt(0).Mod(big.NewInt(0).Add(x, y), p)
+	}
+	inv0 := func(x *big.Int) *big.Int {
+		if x.Sign() == 0 {
+			return big.NewInt(0)
+		}
+		return big.NewInt(0).ModInverse(x, p)
+	}
+	gx := func(x *big.Int) *big.Int {
+		return add(add(mul(mul(x, x), x), mul(a, x)), b)
+	}
+
+	u2 := mul(u, u)
+	zu2 := mul(z, u2)
+	tv1 := inv0(add(mul(zu2, zu2), zu2))
+
+	var x1 *big.Int
+	if tv1.Sign() == 0 {
+		x1 = mul(b, inv0(mul(z, a)))
+	} else {
+		negBOverA := mul(big.NewInt(0).Sub(p, b), inv0(a))
+		x1 = mul(negBOverA, add(bigOne, tv1))
+	}
+
+	x, y := x1, sqrtMod(gx(x1), p)
+	if y == nil {
+		x = mul(zu2, x1)
+		y = sqrtMod(gx(x), p)
+	}
+
+	if u.Bit(0) != y.Bit(0) {
+		y = big.NewInt(0).Mod(big.NewInt(0).Neg(y), p)
+	}
+	return x, y
+}
+
+// sqrtMod returns the square root of x modulo p with p = 3 (mod 4), or nil if
+// x is not a quadratic residue
+func sqrtMod(x, p *big.Int) *big.Int {
+	exp := big.NewInt(0).Rsh(big.NewInt(0).Add(p, bigOne), 2)
+	y := big.NewInt(0).Exp(x, exp, p)
+	if big.NewInt(0).Exp(y, bigTwo, p).Cmp(big.NewInt(0).Mod(x, p)) != 0 {
+		return nil
+	}
+	return y
+}
+
+// HashToCurve hashes msg to a point of curve under the domain separation tag dst
+func HashToCurve(curve elliptic.Curve, msg, dst []byte) (*big.Int, *big.Int, error) {
+	if curve != elliptic.P256() {
+		return nil, nil, errors.New(fmt.Sprintf("Hash-to-curve is not supported on curve %s", curve.Params().Name))
+	}
+
+	u, err := hashToField(curve, msg, dst, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x0, y0 := mapToCurveSSWU(curve, u[0])
+	x1, y1 := mapToCurveSSWU(curve, u[1])
+	// the cofactor of P-256 is 1, so no clearing is needed
+	x, y := curve.Add(x0, y0, x1, y1)
+	return x, y, nil
+}
+
+// HashToScalar hashes msg to a scalar of curve under the domain separation tag dst
+func HashToScalar(curve elliptic.Curve, msg, dst []byte) (*big.Int, error) {
+	uniform, err := expandMessageXMD(msg, dst, h2cSecurityBytes)
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(0).Mod(big.NewInt(0).SetBytes(uniform), curve.Params().N), nil
+}
@@ -0,0 +1,87 @@
+package ecdh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// LoadPrivateKey reads a PEM-encoded P-256 private key, both PKCS#8 ("PRIVATE
+// KEY") and SEC 1 ("EC PRIVATE KEY") blocks are accepted
+func LoadPrivateKey(filename string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("No PEM block found in %s", filename))
+	}
+
+	var privKey *ecdsa.PrivateKey
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if privKey, ok = key.(*ecdsa.PrivateKey); !ok {
+			return nil, errors.New(fmt.Sprintf("The key in %s is not an EC key", filename))
+		}
+	case "EC PRIVATE KEY":
+		if privKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported PEM block type: %s", block.Type))
+	}
+
+	if privKey.Curve != elliptic.P256() {
+		return nil, errors.New(fmt.Sprintf("The key in %s is not on P-256", filename))
+	}
+	return privKey, nil
+}
+
+// GenerateAndSavePrivateKey generates a new P-256 key and writes it to
+// filename as a PKCS#8 PEM block, it refuses to overwrite an existing file
+func GenerateAndSavePrivateKey(filename string) (*ecdsa.PrivateKey, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = pem.Encode(f, &pem.Block{
+		Type: "PRIVATE KEY",
+		Bytes: der,
+	}); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+// KeyFingerprint identifies a pubkey by the sha256 of its compressed encoding,
+// only the first 16 bytes are kept
+func KeyFingerprint(element []byte) string {
+	hash := sha256.Sum256(element)
+	return hex.EncodeToString(hash[:16])
+}
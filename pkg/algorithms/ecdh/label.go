@@ -0,0 +1,67 @@
+package ecdh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// In labeled PSI the host seals the label of an item x with a key derived
+// from k_host * H(x), and publishes it under a tag derived from the same
+// point. The client gets k_host * H(y) of its own items by removing its key
+// from the items re-encrypted by host, so it can only find and open the
+// labels of the items it holds.
+
+const (
+	labelTagDST 	= "PPGI-ECDH-LABEL-TAG-V01"
+	labelKeyDST 	= "PPGI-ECDH-LABEL-KEY-V01"
+)
+
+var ErrLabel = errors.New("Failed to open the sealed label")
+
+// LabelTagAndKey derives the tag and the AES-256 key of the label from the
+// point encrypted by host only
+func LabelTagAndKey(point []byte) ([]byte, []byte) {
+	tag := sha256.Sum256(append([]byte(labelTagDST), point...))
+	key := sha256.Sum256(append([]byte(labelKeyDST), point...))
+	return tag[:], key[:]
+}
+
+// SealLabel encrypts the label with AES-GCM, the random nonce is prepended
+func SealLabel(key, label []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, label, nil), nil
+}
+
+// OpenLabel reverts SealLabel, it fails if the key is not the one sealed with
+func OpenLabel(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrLabel
+	}
+	label, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrLabel
+	}
+	return label, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
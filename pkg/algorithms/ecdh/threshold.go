@@ -0,0 +1,377 @@
+package ecdh
+
+import (
+	"fmt"
+	"errors"
+	"math/big"
+	"crypto/rand"
+	"crypto/elliptic"
+
+	"github.com/knwng/ppgi/pkg/algorithms/filter"
+)
+
+// The threshold of the overlap of a session is checked without either side
+// learning the size of it. The owner of the session puts the final hashes of
+// its items to a Bloom filter, and encrypts every bit b as b * G with ElGamal,
+// i.e. (r * G, b * G + r * X), under a fresh key x of the session. The peer
+// adds up the bits of each of its own final hashes, which gives k, the number
+// of hash functions, only when the hash is in the filter. The sum is tested
+// against all the k + 1 values it may be, rotated by a random offset, so the
+// owner finds exactly one zero at a random place, and returns where it is as
+// encrypted bits under the joint key of both sides. The peer adds up the bits
+// which mean k to the encrypted overlap, and tests it against all the values
+// from threshold to the size of the session. Only the peer can open the tests
+// after the owner removes its part of the joint key, so the peer learns
+// whether the threshold is met and nothing else, and tells the owner.
+//
+// The overlap counts the own hashes falling into the filter by chance as
+// well, which happens with the rate ThresholdFPRate.
+
+const ThresholdFPRate = 1.0 / (1 << 20)
+
+var (
+	ErrNoZero = errors.New("None of the candidates is zero")
+	ErrManyZeros = errors.New("More than one of the candidates is zero")
+)
+
+// ThresholdKey is the ElGamal key of one side in the threshold check
+type ThresholdKey struct {
+	curve 		elliptic.Curve
+	privKey 	*big.Int
+}
+
+type curvePoint struct {
+	x, y 		*big.Int
+}
+
+type elGamal struct {
+	c1, c2 		curvePoint
+}
+
+func NewThresholdKey(curve elliptic.Curve) (*ThresholdKey, error) {
+	privKey, err := generatePrivKey(curve)
+	if err != nil {
+		return nil, err
+	}
+	return &ThresholdKey{
+		curve: curve,
+		privKey: privKey,
+	}, nil
+}
+
+func (k *ThresholdKey) PubKey() []byte {
+	return k.marshalPoint(k.pubPoint())
+}
+
+// EncryptFilter puts the hashes to a Bloom filter, and returns the number of
+// hash functions and the encrypted bits of it
+func (k *ThresholdKey) EncryptFilter(hashes [][]byte) (uint32, [][]byte, error) {
+	capacity := uint64(len(hashes))
+	if capacity == 0 {
+		capacity = 1
+	}
+	bloom, err := filter.NewBloomFilter(capacity, ThresholdFPRate)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, hash := range hashes {
+		bloom.Add(hash)
+	}
+
+	pub := k.pubPoint()
+	ret := make([][]byte, bloom.Size())
+	for i := range ret {
+		bit := int64(0)
+		if bloom.Bit(uint64(i)) {
+			bit = 1
+		}
+		ct, err := k.encrypt(bit, pub)
+		if err != nil {
+			return 0, nil, err
+		}
+		ret[i] = k.marshal(ct)
+	}
+	return bloom.Hashes(), ret, nil
+}
+
+// Rotate tests every own hash against the encrypted filter of the owner. It
+// returns hashes + 1 candidates for every own hash, and the index of the one
+// which is zero when the hash is in the filter.
+func (k *ThresholdKey) Rotate(hashes uint32, bits [][]byte, own [][]byte) ([][]byte, []int, error) {
+	if hashes == 0 || len(bits) == 0 {
+		return nil, nil, errors.New("The encrypted filter is empty")
+	}
+	filterBits := make([]elGamal, len(bits))
+	for i, bit := range bits {
+		ct, err := k.unmarshal(bit)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Invalid bit at index %d, err: %s", i, err))
+		}
+		filterBits[i] = ct
+	}
+
+	groupSize := int(hashes) + 1
+	ret := make([][]byte, 0, len(own) * groupSize)
+	picks := make([]int, len(own))
+	for i, hash := range own {
+		var sum elGamal
+		for j, index := range filter.Indexes(hash, uint64(len(bits)), hashes) {
+			if j == 0 {
+				sum = filterBits[index]
+			} else {
+				sum = k.add(sum, filterBits[index])
+			}
+		}
+
+		offset, err := rand.Int(rand.Reader, big.NewInt(int64(groupSize)))
+		if err != nil {
+			return nil, nil, err
+		}
+		// the j-th candidate tests whether the sum is (j + offset) mod groupSize
+		rotation := int(offset.Int64())
+		picks[i] = (int(hashes) - rotation + groupSize) % groupSize
+		for j := 0; j < groupSize; j++ {
+			value := big.NewInt(int64((j + rotation) % groupSize))
+			candidate, err := k.scale(k.subPlain(sum, value))
+			if err != nil {
+				return nil, nil, err
+			}
+			ret = append(ret, k.marshal(candidate))
+		}
+	}
+	return ret, picks, nil
+}
+
+// Select finds the zero of every group of candidates, and returns the
+// candidates as encrypted bits under the joint key of both sides, only the
+// zero one being 1
+func (k *ThresholdKey) Select(peerPubKey []byte, groupSize int, candidates [][]byte) ([][]byte, error) {
+	if groupSize < 2 || len(candidates) % groupSize != 0 {
+		return nil, errors.New(fmt.Sprintf("%d candidates can't be split into groups of %d", len(candidates), groupSize))
+	}
+	peerPub, err := k.unmarshalPoint(peerPubKey)
+	if err != nil {
+		return nil, err
+	}
+	pub := k.pubPoint()
+	jx, jy := k.curve.Add(pub.x, pub.y, peerPub.x, peerPub.y)
+	joint := curvePoint{jx, jy}
+
+	ret := make([][]byte, len(candidates))
+	for start := 0; start < len(candidates); start += groupSize {
+		zero := -1
+		for j := 0; j < groupSize; j++ {
+			ct, err := k.unmarshal(candidates[start + j])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid candidate at index %d, err: %s", start + j, err))
+			}
+			if !k.decryptsToZero(ct) {
+				continue
+			}
+			if zero >= 0 {
+				return nil, ErrManyZeros
+			}
+			zero = j
+		}
+		if zero < 0 {
+			return nil, ErrNoZero
+		}
+
+		for j := 0; j < groupSize; j++ {
+			bit := int64(0)
+			if j == zero {
+				bit = 1
+			}
+			ct, err := k.encrypt(bit, joint)
+			if err != nil {
+				return nil, err
+			}
+			ret[start + j] = k.marshal(ct)
+		}
+	}
+	return ret, nil
+}
+
+// Count adds up the picked ones of the selected candidates, which gives the
+// encrypted overlap
+func (k *ThresholdKey) Count(selected [][]byte, groupSize int, picks []int) ([]byte, error) {
+	if len(picks) == 0 || len(selected) != len(picks) * groupSize {
+		return nil, errors.New(fmt.Sprintf("The size of selected candidates doesn't match, %d vs %d", len(selected), len(picks) * groupSize))
+	}
+	var sum elGamal
+	for i, pick := range picks {
+		if pick < 0 || pick >= groupSize {
+			return nil, errors.New(fmt.Sprintf("Invalid pick at index %d", i))
+		}
+		ct, err := k.unmarshal(selected[i * groupSize + pick])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid selected candidate at index %d, err: %s", i, err))
+		}
+		if i == 0 {
+			sum = ct
+		} else {
+			sum = k.add(sum, ct)
+		}
+	}
+	return k.marshal(sum), nil
+}
+
+// Compare tests the encrypted overlap against every value in [min, max], the
+// comparisons are shuffled so the one which is zero tells nothing
+func (k *ThresholdKey) Compare(count []byte, min, max int) ([][]byte, error) {
+	ct, err := k.unmarshal(count)
+	if err != nil {
+		return nil, err
+	}
+	if min < 0 || max < min {
+		return nil, errors.New(fmt.Sprintf("Invalid range [%d, %d]", min, max))
+	}
+
+	ret := make([][]byte, 0, max - min + 1)
+	for value := min; value <= max; value++ {
+		comparison, err := k.scale(k.subPlain(ct, big.NewInt(int64(value))))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, k.marshal(comparison))
+	}
+	if err = Shuffle(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Open removes this key from the comparisons encrypted under the joint key,
+// so they're encrypted under the key of the peer only
+func (k *ThresholdKey) Open(comparisons [][]byte) ([][]byte, error) {
+	ret := make([][]byte, len(comparisons))
+	for i, comparison := range comparisons {
+		ct, err := k.unmarshal(comparison)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid comparison at index %d, err: %s", i, err))
+		}
+		ct.c2 = k.decrypt(ct)
+		ret[i] = k.marshal(ct)
+	}
+	return ret, nil
+}
+
+// AnyZero reports whether any of the comparisons opened by the owner is zero,
+// i.e. the overlap is in the range compared with
+func (k *ThresholdKey) AnyZero(opened [][]byte) (bool, error) {
+	met := false
+	for i, comparison := range opened {
+		ct, err := k.unmarshal(comparison)
+		if err != nil {
+			return false, errors.New(fmt.Sprintf("Invalid comparison at index %d, err: %s", i, err))
+		}
+		if k.decryptsToZero(ct) {
+			met = true
+		}
+	}
+	return met, nil
+}
+
+func (k *ThresholdKey) pubPoint() curvePoint {
+	x, y := k.curve.ScalarBaseMult(k.privKey.Bytes())
+	return curvePoint{x, y}
+}
+
+// encrypt encrypts m * G under the public key
+func (k *ThresholdKey) encrypt(m int64, pub curvePoint) (elGamal, error) {
+	r, err := generatePrivKey(k.curve)
+	if err != nil {
+		return elGamal{}, err
+	}
+	c1x, c1y := k.curve.ScalarBaseMult(r.Bytes())
+	sx, sy := k.curve.ScalarMult(pub.x, pub.y, r.Bytes())
+	if m != 0 {
+		mx, my := k.curve.ScalarBaseMult(big.NewInt(m).Bytes())
+		sx, sy = k.curve.Add(sx, sy, mx, my)
+	}
+	return elGamal{curvePoint{c1x, c1y}, curvePoint{sx, sy}}, nil
+}
+
+// decrypt returns c2 - x * c1
+func (k *ThresholdKey) decrypt(ct elGamal) curvePoint {
+	sx, sy := k.curve.ScalarMult(ct.c1.x, ct.c1.y, k.privKey.Bytes())
+	return k.sub(ct.c2, curvePoint{sx, sy})
+}
+
+func (k *ThresholdKey) decryptsToZero(ct elGamal) bool {
+	m := k.decrypt(ct)
+	return m.x.Sign() == 0 && m.y.Sign() == 0
+}
+
+func (k *ThresholdKey) add(a, b elGamal) elGamal {
+	c1x, c1y := k.curve.Add(a.c1.x, a.c1.y, b.c1.x, b.c1.y)
+	c2x, c2y := k.curve.Add(a.c2.x, a.c2.y, b.c2.x, b.c2.y)
+	return elGamal{curvePoint{c1x, c1y}, curvePoint{c2x, c2y}}
+}
+
+// subPlain subtracts value * G from the encrypted value
+func (k *ThresholdKey) subPlain(ct elGamal, value *big.Int) elGamal {
+	if value.Sign() == 0 {
+		return ct
+	}
+	vx, vy := k.curve.ScalarBaseMult(value.Bytes())
+	return elGamal{ct.c1, k.sub(ct.c2, curvePoint{vx, vy})}
+}
+
+// scale multiplies the encrypted value with a random scalar, so it's zero or
+// a random point
+func (k *ThresholdKey) scale(ct elGamal) (elGamal, error) {
+	rho, err := generatePrivKey(k.curve)
+	if err != nil {
+		return elGamal{}, err
+	}
+	c1x, c1y := k.curve.ScalarMult(ct.c1.x, ct.c1.y, rho.Bytes())
+	c2x, c2y := k.curve.ScalarMult(ct.c2.x, ct.c2.y, rho.Bytes())
+	return elGamal{curvePoint{c1x, c1y}, curvePoint{c2x, c2y}}, nil
+}
+
+// sub returns a - b, the infinity is (0, 0)
+func (k *ThresholdKey) sub(a, b curvePoint) curvePoint {
+	if b.x.Sign() == 0 && b.y.Sign() == 0 {
+		return a
+	}
+	negY := big.NewInt(0).Sub(k.curve.Params().P, b.y)
+	x, y := k.curve.Add(a.x, a.y, b.x, negY)
+	return curvePoint{x, y}
+}
+
+func (k *ThresholdKey) pointSize() int {
+	return 1 + (k.curve.Params().BitSize + 7) / 8
+}
+
+func (k *ThresholdKey) marshalPoint(p curvePoint) []byte {
+	return elliptic.MarshalCompressed(k.curve, p.x, p.y)
+}
+
+func (k *ThresholdKey) unmarshalPoint(data []byte) (curvePoint, error) {
+	x, y := elliptic.UnmarshalCompressed(k.curve, data)
+	if x == nil {
+		return curvePoint{}, errors.New("Invalid point")
+	}
+	return curvePoint{x, y}, nil
+}
+
+func (k *ThresholdKey) marshal(ct elGamal) []byte {
+	return append(k.marshalPoint(ct.c1), k.marshalPoint(ct.c2)...)
+}
+
+func (k *ThresholdKey) unmarshal(data []byte) (elGamal, error) {
+	size := k.pointSize()
+	if len(data) != 2 * size {
+		return elGamal{}, errors.New("Wrong size of ciphertext")
+	}
+	c1, err := k.unmarshalPoint(data[:size])
+	if err != nil {
+		return elGamal{}, err
+	}
+	c2, err := k.unmarshalPoint(data[size:])
+	if err != nil {
+		return elGamal{}, err
+	}
+	return elGamal{c1, c2}, nil
+}
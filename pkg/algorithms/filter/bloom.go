@@ -0,0 +1,329 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const bloomHeaderSize = 28
+
+// a shard has the header, the offset of its words and the words
+const bloomShardHeaderSize = bloomHeaderSize + 8
+
+// BloomFilter is a Bloom filter sized for a capacity and a false-positive rate.
+// The bit indexes of an item come from double hashing of its sha256, so the
+// filter can be rebuilt by the peer from the marshaled bits only.
+type BloomFilter struct {
+	m 			uint64
+	k 			uint32
+	capacity 	uint64
+	count 		uint64
+	bits 		[]uint64
+}
+
+// NewBloomFilter creates a filter holding capacity items with the false-positive
+// rate fpRate, the rate grows beyond it when more items are added
+func NewBloomFilter(capacity uint64, fpRate float64) (*BloomFilter, error) {
+	if capacity == 0 {
+		return nil, errors.New("The capacity of bloom filter should be positive")
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, errors.New(fmt.Sprintf("The false-positive rate should be in (0, 1), got %g", fpRate))
+	}
+
+	// m = -n ln(p) / ln(2)^2, k = m / n ln(2)
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	return &BloomFilter{
+		m: m,
+		k: k,
+		capacity: capacity,
+		bits: make([]uint64, (m + 63) / 64),
+	}, nil
+}
+
+func (s *BloomFilter) indexes(item []byte) []uint64 {
+	return Indexes(item, s.m, s.k)
+}
+
+// Indexes returns the indexes of the bits of the item in a filter of m bits and
+// k hash functions, so a filter can be probed without its bits, e.g. when they
+// are encrypted
+func Indexes(item []byte, m uint64, k uint32) []uint64 {
+	hash := sha256.Sum256(item)
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16]) | 1
+	ret := make([]uint64, k)
+	for i := range ret {
+		ret[i] = (h1 + uint64(i) * h2) % m
+	}
+	return ret
+}
+
+// Size is the number of bits of the filter
+func (s *BloomFilter) Size() uint64 {
+	return s.m
+}
+
+// Hashes is the number of hash functions of the filter
+func (s *BloomFilter) Hashes() uint32 {
+	return s.k
+}
+
+// Bit reports whether the i-th bit is set
+func (s *BloomFilter) Bit(i uint64) bool {
+	return i < s.m && s.getBit(i)
+}
+
+func (s *BloomFilter) getBit(i uint64) bool {
+	return s.bits[i / 64] & (1 << (i % 64)) != 0
+}
+
+func (s *BloomFilter) setBit(i uint64) bool {
+	if s.getBit(i) {
+		return false
+	}
+	s.bits[i / 64] |= 1 << (i % 64)
+	return true
+}
+
+// Add inserts the item and returns the indexes of the bits it newly set, which
+// can be sent to the peer as a delta
+func (s *BloomFilter) Add(item []byte) []uint64 {
+	newBits := make([]uint64, 0)
+	for _, i := range s.indexes(item) {
+		if s.setBit(i) {
+			newBits = append(newBits, i)
+		}
+	}
+	s.count++
+	return newBits
+}
+
+// Test reports whether the item may be in the set
+func (s *BloomFilter) Test(item []byte) bool {
+	for _, i := range s.indexes(item) {
+		if !s.getBit(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Count is the number of items added, including the duplicated ones
+func (s *BloomFilter) Count() uint64 {
+	return s.count
+}
+
+func (s *BloomFilter) Capacity() uint64 {
+	return s.capacity
+}
+
+// Full reports whether the false-positive rate is beyond the configured one
+func (s *BloomFilter) Full() bool {
+	return s.count > s.capacity
+}
+
+// MarshalBinary encodes the filter as m, k, capacity, count and the bits, all
+// in big endian
+func (s *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, bloomHeaderSize + 8 * len(s.bits))
+	s.putHeader(data)
+	for i, word := range s.bits {
+		binary.BigEndian.PutUint64(data[bloomHeaderSize + 8 * i:], word)
+	}
+	return data, nil
+}
+
+func (s *BloomFilter) putHeader(data []byte) {
+	binary.BigEndian.PutUint64(data[0:8], s.m)
+	binary.BigEndian.PutUint32(data[8:12], s.k)
+	binary.BigEndian.PutUint64(data[12:20], s.capacity)
+	binary.BigEndian.PutUint64(data[20:28], s.count)
+}
+
+// unmarshalHeader creates an empty filter from the header
+func unmarshalHeader(data []byte) (*BloomFilter, error) {
+	if len(data) < bloomHeaderSize {
+		return nil, errors.New("The encoded bloom filter is too short")
+	}
+	s := &BloomFilter{
+		m: binary.BigEndian.Uint64(data[0:8]),
+		k: binary.BigEndian.Uint32(data[8:12]),
+		capacity: binary.BigEndian.Uint64(data[12:20]),
+		count: binary.BigEndian.Uint64(data[20:28]),
+	}
+	if s.m == 0 || s.k == 0 || s.k > 64 {
+		return nil, errors.New(fmt.Sprintf("Invalid bloom filter, m: %d, k: %d", s.m, s.k))
+	}
+	return s, nil
+}
+
+func UnmarshalBloomFilter(data []byte) (*BloomFilter, error) {
+	s, err := unmarshalHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	words := (s.m + 63) / 64
+	if uint64(len(data) - bloomHeaderSize) != 8 * words {
+		return nil, errors.New("The size of encoded bloom filter doesn't match m")
+	}
+
+	s.bits = make([]uint64, words)
+	for i := range s.bits {
+		s.bits[i] = binary.BigEndian.Uint64(data[bloomHeaderSize + 8 * i:])
+	}
+	return s, nil
+}
+
+// Shards is the number of shards of at most shardWords words the filter is
+// split into
+func (s *BloomFilter) Shards(shardWords uint64) uint64 {
+	return (uint64(len(s.bits)) + shardWords - 1) / shardWords
+}
+
+// MarshalShard encodes the i-th shard of at most shardWords words, so a filter
+// bigger than the limit of a message is sent in pieces. Every shard carries the
+// header and the offset of its words, so the shards can be assembled in any
+// order.
+func (s *BloomFilter) MarshalShard(i, shardWords uint64) ([]byte, error) {
+	if shardWords == 0 || i >= s.Shards(shardWords) {
+		return nil, errors.New(fmt.Sprintf("Shard %d is out of the filter", i))
+	}
+	offset := i * shardWords
+	end := offset + shardWords
+	if end > uint64(len(s.bits)) {
+		end = uint64(len(s.bits))
+	}
+
+	data := make([]byte, bloomShardHeaderSize + 8 * (end - offset))
+	s.putHeader(data)
+	binary.BigEndian.PutUint64(data[bloomHeaderSize:], offset)
+	for j, word := range s.bits[offset:end] {
+		binary.BigEndian.PutUint64(data[bloomShardHeaderSize + 8 * j:], word)
+	}
+	return data, nil
+}
+
+// ShardAssembler rebuilds a filter from its shards
+type ShardAssembler struct {
+	filter 		*BloomFilter
+	// offset -> number of words of the shards received
+	received 	map[uint64]uint64
+	words 		uint64
+}
+
+func NewShardAssembler() *ShardAssembler {
+	return &ShardAssembler{received: make(map[uint64]uint64)}
+}
+
+// Add adds a shard, and returns the filter once all its words are received. A
+// shard received again is ignored.
+func (a *ShardAssembler) Add(shard []byte) (*BloomFilter, error) {
+	header, err := unmarshalHeader(shard)
+	if err != nil {
+		return nil, err
+	}
+	if len(shard) < bloomShardHeaderSize || (len(shard) - bloomShardHeaderSize) % 8 != 0 {
+		return nil, errors.New("Wrong size of bloom filter shard")
+	}
+	if a.filter == nil {
+		header.bits = make([]uint64, (header.m + 63) / 64)
+		a.filter = header
+	} else if header.m != a.filter.m || header.k != a.filter.k ||
+			header.capacity != a.filter.capacity || header.count != a.filter.count {
+		return nil, errors.New("The shard belongs to another bloom filter")
+	}
+
+	offset := binary.BigEndian.Uint64(shard[bloomHeaderSize:])
+	words := uint64(len(shard) - bloomShardHeaderSize) / 8
+	total := uint64(len(a.filter.bits))
+	if words == 0 || offset >= total || words > total - offset {
+		return nil, errors.New(fmt.Sprintf("Shard of %d words at %d is out of the filter", words, offset))
+	}
+	if received, ok := a.received[offset]; ok && received == words {
+		return nil, nil
+	}
+	for o, n := range a.received {
+		if offset < o + n && o < offset + words {
+			return nil, errors.New(fmt.Sprintf("Shard of %d words at %d overlaps the ones received", words, offset))
+		}
+	}
+
+	for j := uint64(0); j < words; j++ {
+		a.filter.bits[offset + j] = binary.BigEndian.Uint64(shard[bloomShardHeaderSize + 8 * j:])
+	}
+	a.received[offset] = words
+	a.words += words
+	if a.words < total {
+		return nil, nil
+	}
+	return a.filter, nil
+}
+
+// EncodeDelta encodes the indexes of newly set bits, and the number of items
+// added with them, as sorted uvarint gaps
+func EncodeDelta(indexes []uint64, added uint64) []byte {
+	sorted := make([]uint64, len(indexes))
+	copy(sorted, indexes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	data := make([]byte, 0, 2 * binary.MaxVarintLen64 + 3 * len(sorted))
+	data = appendUvarint(data, added)
+	data = appendUvarint(data, uint64(len(sorted)))
+	last := uint64(0)
+	for _, i := range sorted {
+		data = appendUvarint(data, i - last)
+		last = i
+	}
+	return data
+}
+
+func appendUvarint(data []byte, x uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, x)
+	return append(data, buf[:n]...)
+}
+
+// ApplyDelta sets the bits encoded by EncodeDelta
+func (s *BloomFilter) ApplyDelta(data []byte) error {
+	added, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("Invalid bloom filter delta")
+	}
+	data = data[n:]
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("Invalid bloom filter delta")
+	}
+	data = data[n:]
+
+	indexes := make([]uint64, 0)
+	last := uint64(0)
+	for j := uint64(0); j < size; j++ {
+		gap, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("Invalid bloom filter delta")
+		}
+		data = data[n:]
+		last += gap
+		if last >= s.m {
+			return errors.New(fmt.Sprintf("Bit index %d is out of the filter of %d bits", last, s.m))
+		}
+		indexes = append(indexes, last)
+	}
+
+	for _, i := range indexes {
+		s.setBit(i)
+	}
+	s.count += added
+	return nil
+}
@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func item(i int) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(i))
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter, err := NewBloomFilter(10000, 0.001)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10000; i++ {
+		filter.Add(item(i))
+	}
+	for i := 0; i < 10000; i++ {
+		assert.True(t, filter.Test(item(i)))
+	}
+	assert.False(t, filter.Full())
+
+	falsePositives := 0
+	for i := 10000; i < 110000; i++ {
+		if filter.Test(item(i)) {
+			falsePositives++
+		}
+	}
+	// 100 expected
+	assert.Less(t, falsePositives, 200)
+
+	_, err = NewBloomFilter(0, 0.001)
+	assert.Error(t, err)
+	_, err = NewBloomFilter(100, 1)
+	assert.Error(t, err)
+}
+
+func TestBloomFilterMarshalAndDelta(t *testing.T) {
+	host, err := NewBloomFilter(1000, 0.0001)
+	assert.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		host.Add(item(i))
+	}
+
+	data, err := host.MarshalBinary()
+	assert.NoError(t, err)
+	client, err := UnmarshalBloomFilter(data)
+	assert.NoError(t, err)
+	assert.Equal(t, host, client)
+
+	// the client catches up with deltas
+	newBits := make([]uint64, 0)
+	for i := 500; i < 600; i++ {
+		newBits = append(newBits, host.Add(item(i))...)
+	}
+	assert.False(t, client.Test(item(550)))
+	assert.NoError(t, client.ApplyDelta(EncodeDelta(newBits, 100)))
+	assert.Equal(t, host, client)
+
+	// applying a delta twice is harmless, except for the count
+	assert.NoError(t, client.ApplyDelta(EncodeDelta(newBits, 0)))
+	assert.Equal(t, host, client)
+
+	_, err = UnmarshalBloomFilter(data[:len(data) - 1])
+	assert.Error(t, err)
+	assert.Error(t, client.ApplyDelta(EncodeDelta([]uint64{host.m}, 1)))
+	assert.Error(t, client.ApplyDelta([]byte{0x80}))
+}
+
+func TestBloomFilterShards(t *testing.T) {
+	host, err := NewBloomFilter(10000, 0.0001)
+	assert.NoError(t, err)
+	for i := 0; i < 5000; i++ {
+		host.Add(item(i))
+	}
+
+	shardWords := uint64(500)
+	shards := host.Shards(shardWords)
+	assert.Equal(t, (uint64(len(host.bits)) + shardWords - 1) / shardWords, shards)
+	assert.True(t, shards > 1)
+
+	// the shards are received in reverse order, one of them twice
+	assembler := NewShardAssembler()
+	for i := int(shards) - 1; i >= 0; i-- {
+		shard, err := host.MarshalShard(uint64(i), shardWords)
+		assert.NoError(t, err)
+		client, err := assembler.Add(shard)
+		assert.NoError(t, err)
+		if i > 0 {
+			assert.Nil(t, client)
+			client, err = assembler.Add(shard)
+			assert.NoError(t, err)
+			assert.Nil(t, client)
+		} else {
+			assert.Equal(t, host, client)
+		}
+	}
+
+	_, err = host.MarshalShard(shards, shardWords)
+	assert.Error(t, err)
+
+	// a shard of another filter or overlapping the ones received is refused
+	other, err := NewBloomFilter(100, 0.0001)
+	assert.NoError(t, err)
+	assembler = NewShardAssembler()
+	shard, err := host.MarshalShard(0, shardWords)
+	assert.NoError(t, err)
+	_, err = assembler.Add(shard)
+	assert.NoError(t, err)
+	otherShard, err := other.MarshalShard(0, shardWords)
+	assert.NoError(t, err)
+	_, err = assembler.Add(otherShard)
+	assert.Error(t, err)
+	overlapping, err := host.MarshalShard(1, shardWords / 2)
+	assert.NoError(t, err)
+	_, err = assembler.Add(overlapping)
+	assert.Error(t, err)
+}
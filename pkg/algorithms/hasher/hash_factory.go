@@ -0,0 +1,195 @@
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+type Hasher interface {
+	Sum([]byte) []byte
+}
+
+type MD5Hash struct {}
+
+func (s *MD5Hash) Sum(msg []byte) []byte {
+	hash := md5.Sum(msg)
+	return hash[:]
+}
+
+type SHA256Hash struct {}
+
+func (s *SHA256Hash) Sum(msg []byte) []byte {
+	hash := sha256.Sum256(msg)
+	return hash[:]
+}
+
+type SHA224Hash struct {}
+
+func (s *SHA224Hash) Sum(msg []byte) []byte {
+	hash := sha256.Sum224(msg)
+	return hash[:]
+}
+
+type SHA512Hash struct {}
+
+func (s *SHA512Hash) Sum(msg []byte) []byte {
+	hash := sha512.Sum512(msg)
+	return hash[:]
+}
+
+type SHA3_256Hash struct {}
+
+func (s *SHA3_256Hash) Sum(msg []byte) []byte {
+	hash := sha3.Sum256(msg)
+	return hash[:]
+}
+
+type SHA3_512Hash struct {}
+
+func (s *SHA3_512Hash) Sum(msg []byte) []byte {
+	hash := sha3.Sum512(msg)
+	return hash[:]
+}
+
+// ShakeHash reads Size bytes from SHAKE128 or SHAKE256
+type ShakeHash struct {
+	Size 		int
+	Strong 		bool
+}
+
+func (s *ShakeHash) Sum(msg []byte) []byte {
+	hash := make([]byte, s.Size)
+	if s.Strong {
+		sha3.ShakeSum256(hash, msg)
+	} else {
+		sha3.ShakeSum128(hash, msg)
+	}
+	return hash
+}
+
+type BLAKE2b256Hash struct {}
+
+func (s *BLAKE2b256Hash) Sum(msg []byte) []byte {
+	hash := blake2b.Sum256(msg)
+	return hash[:]
+}
+
+type BLAKE2b512Hash struct {}
+
+func (s *BLAKE2b512Hash) Sum(msg []byte) []byte {
+	hash := blake2b.Sum512(msg)
+	return hash[:]
+}
+
+// HMACHash is the keyed version of a registered hash, with a secret shared by
+// both sides of a deployment
+type HMACHash struct {
+	newHash 	func() hash.Hash
+	key 		[]byte
+}
+
+func (s *HMACHash) Sum(msg []byte) []byte {
+	mac := hmac.New(s.newHash, s.key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+type registryEntry struct {
+	hasher 		Hasher
+	// newHash is nil for the hashes that can't be used with HMAC
+	newHash 	func() hash.Hash
+	weak 		bool
+}
+
+var registry = make(map[string]registryEntry)
+
+// Register adds a hasher under name, newHash is used by the keyed version and
+// can be nil. It panics on duplicated names, like the registries in stdlib.
+func Register(name string, hasher Hasher, newHash func() hash.Hash) {
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("Hasher %s is registered twice", name))
+	}
+	registry[name] = registryEntry{
+		hasher: hasher,
+		newHash: newHash,
+	}
+}
+
+func newBLAKE2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+func newBLAKE2b512() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+func init() {
+	Register("md5", &MD5Hash{}, md5.New)
+	Register("sha224", &SHA224Hash{}, sha256.New224)
+	Register("sha256", &SHA256Hash{}, sha256.New)
+	Register("sha512", &SHA512Hash{}, sha512.New)
+	Register("sha3_256", &SHA3_256Hash{}, sha3.New256)
+	Register("sha3_512", &SHA3_512Hash{}, sha3.New512)
+	Register("shake128", &ShakeHash{Size: 32}, nil)
+	Register("shake256", &ShakeHash{Size: 64, Strong: true}, nil)
+	Register("blake2b_256", &BLAKE2b256Hash{}, newBLAKE2b256)
+	Register("blake2b_512", &BLAKE2b512Hash{}, newBLAKE2b512)
+
+	// md5 is kept for the deployments that still store hashes with it
+	entry := registry["md5"]
+	entry.weak = true
+	registry["md5"] = entry
+}
+
+// GetHasher returns the hasher registered under name
+func GetHasher(name string) (Hasher, error) {
+	entry, ok := registry[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported hash: %s, supported: %v", name, Names()))
+	}
+	return entry.hasher, nil
+}
+
+// GetKeyedHasher returns HMAC with key over the hash registered under name
+func GetKeyedHasher(name string, key []byte) (Hasher, error) {
+	entry, ok := registry[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported hash: %s, supported: %v", name, Names()))
+	}
+	if entry.newHash == nil {
+		return nil, errors.New(fmt.Sprintf("Hash %s can't be keyed", name))
+	}
+	if len(key) == 0 {
+		return nil, errors.New("The key of keyed hash should not be empty")
+	}
+	return &HMACHash{
+		newHash: entry.newHash,
+		key: append([]byte{}, key...),
+	}, nil
+}
+
+// IsWeak reports the hashes that are only kept for compatibility
+func IsWeak(name string) bool {
+	return registry[name].weak
+}
+
+// Names returns the sorted names of all registered hashers
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,74 @@
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHasher(t *testing.T) {
+	sizes := map[string]int{
+		"md5": 16,
+		"sha224": 28,
+		"sha256": 32,
+		"sha512": 64,
+		"sha3_256": 32,
+		"sha3_512": 64,
+		"shake128": 32,
+		"shake256": 64,
+		"blake2b_256": 32,
+		"blake2b_512": 64,
+	}
+	assert.Equal(t, len(sizes), len(Names()))
+	for name, size := range sizes {
+		h, err := GetHasher(name)
+		assert.NoError(t, err)
+		assert.Equal(t, size, len(h.Sum([]byte("1732819483"))), name)
+	}
+
+	// known answers of the empty message
+	h, _ := GetHasher("sha3_256")
+	assert.Equal(t, "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a", hex.EncodeToString(h.Sum(nil)))
+	h, _ = GetHasher("blake2b_256")
+	assert.Equal(t, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8", hex.EncodeToString(h.Sum(nil)))
+	h, _ = GetHasher("shake128")
+	assert.Equal(t, "7f9c2ba4e88f827d616045507605853ed73b8093f6efbc88eb1a6eacfa66ef26", hex.EncodeToString(h.Sum(nil)))
+
+	_, err := GetHasher("sha1")
+	assert.Error(t, err)
+	_, err = GetHasher("")
+	assert.Error(t, err)
+
+	assert.True(t, IsWeak("md5"))
+	assert.False(t, IsWeak("sha256"))
+}
+
+func TestGetKeyedHasher(t *testing.T) {
+	secret := []byte("per-deployment secret")
+	h, err := GetKeyedHasher("sha256", secret)
+	assert.NoError(t, err)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("1732819483"))
+	assert.Equal(t, mac.Sum(nil), h.Sum([]byte("1732819483")))
+
+	other, err := GetKeyedHasher("sha256", []byte("another secret"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, h.Sum([]byte("1732819483")), other.Sum([]byte("1732819483")))
+
+	for _, name := range []string{"sha3_512", "blake2b_512"} {
+		h, err := GetKeyedHasher(name, secret)
+		assert.NoError(t, err)
+		assert.Equal(t, 64, len(h.Sum([]byte("1732819483"))))
+	}
+
+	_, err = GetKeyedHasher("shake256", secret)
+	assert.Error(t, err)
+	_, err = GetKeyedHasher("sha256", nil)
+	assert.Error(t, err)
+	_, err = GetKeyedHasher("unknown", secret)
+	assert.Error(t, err)
+}
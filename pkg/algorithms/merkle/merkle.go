@@ -0,0 +1,205 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// leaves and inner nodes are hashed with different prefixes, so an inner node
+// can't be passed off as a leaf
+const (
+	leafPrefix byte = 0x00
+	nodePrefix byte = 0x01
+)
+
+// SaltSize is the size of the salt of each committed element
+const SaltSize = 16
+
+var errEmptyTree = errors.New("A merkle tree needs at least one leaf")
+
+// LeafHash hides the element behind the salt, the leaf reveals nothing about
+// the element until the salt is opened
+func LeafHash(salt, element []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(salt)
+	h.Write(element)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Tree is a binary merkle tree, the last node of a level without sibling is
+// promoted to the next level as is
+type Tree struct {
+	// levels[0] is the leaves, and the last level is the root
+	levels 		[][][]byte
+}
+
+func NewTree(leaves [][]byte) (*Tree, error) {
+	if len(leaves) == 0 {
+		return nil, errEmptyTree
+	}
+
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level) + 1) / 2)
+		for i := 0; i < len(level); i += 2 {
+			if i + 1 < len(level) {
+				next = append(next, nodeHash(level[i], level[i + 1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &Tree{levels: levels}, nil
+}
+
+func (t *Tree) Root() []byte {
+	return t.levels[len(t.levels) - 1][0]
+}
+
+func (t *Tree) Size() int {
+	return len(t.levels[0])
+}
+
+// Proof returns the siblings on the path from the leaf to the root
+func (t *Tree) Proof(index int) ([][]byte, error) {
+	if index < 0 || index >= t.Size() {
+		return nil, errors.New(fmt.Sprintf("Leaf index %d out of range [0, %d)", index, t.Size()))
+	}
+
+	proof := make([][]byte, 0, len(t.levels) - 1)
+	for _, level := range t.levels[:len(t.levels) - 1] {
+		if index % 2 == 1 {
+			proof = append(proof, level[index - 1])
+		} else if index + 1 < len(level) {
+			proof = append(proof, level[index + 1])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// Verify checks that leaf is the index-th of the size leaves committed by root
+func Verify(root, leaf []byte, index, size int, proof [][]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+
+	hash, used := leaf, 0
+	for n := size; n > 1; n = (n + 1) / 2 {
+		if index % 2 == 1 || index + 1 < n {
+			if used >= len(proof) {
+				return false
+			}
+			if index % 2 == 1 {
+				hash = nodeHash(proof[used], hash)
+			} else {
+				hash = nodeHash(hash, proof[used])
+			}
+			used++
+		}
+		index /= 2
+	}
+	return used == len(proof) && bytes.Equal(hash, root)
+}
+
+// Opening is an element and its salt, which opens one leaf of a commitment
+type Opening struct {
+	ID 			string		`json:"id"`
+	Salt 		[]byte		`json:"salt"`
+}
+
+// Commitment binds a party to a batch of ids. The leaves are sorted, so the
+// index of a leaf reveals nothing about the position of the id in the batch.
+type Commitment struct {
+	Openings 	[]Opening
+	tree 		*Tree
+}
+
+// Commit commits to the ids and numDummies dummy leaves, the dummies hide the
+// size of the batch and can't be opened to any id
+func Commit(ids []string, numDummies int) (*Commitment, error) {
+	openings := make([]Opening, len(ids) + numDummies)
+	for i := range openings {
+		salt := make([]byte, SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if i < len(ids) {
+			openings[i] = Opening{ID: ids[i], Salt: salt}
+		} else {
+			// the salt of a dummy is never opened, so its leaf looks random
+			openings[i] = Opening{Salt: salt}
+		}
+	}
+
+	leaves := make([][]byte, len(openings))
+	for i, opening := range openings {
+		leaves[i] = LeafHash(opening.Salt, []byte(opening.ID))
+	}
+	order := make([]int, len(leaves))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(leaves[order[i]], leaves[order[j]]) < 0
+	})
+
+	sorted := make([]Opening, len(openings))
+	for i, j := range order {
+		sorted[i] = openings[j]
+	}
+	return NewCommitment(sorted)
+}
+
+// NewCommitment rebuilds the commitment from the openings in leaf order
+func NewCommitment(openings []Opening) (*Commitment, error) {
+	leaves := make([][]byte, len(openings))
+	for i, opening := range openings {
+		leaves[i] = LeafHash(opening.Salt, []byte(opening.ID))
+	}
+	tree, err := NewTree(leaves)
+	if err != nil {
+		return nil, err
+	}
+	return &Commitment{Openings: openings, tree: tree}, nil
+}
+
+func (c *Commitment) Root() []byte {
+	return c.tree.Root()
+}
+
+func (c *Commitment) Size() int {
+	return c.tree.Size()
+}
+
+// Prove returns the index, salt and path of the leaf of id
+func (c *Commitment) Prove(id string) (int, []byte, [][]byte, bool) {
+	if len(id) == 0 {
+		return 0, nil, nil, false
+	}
+	for i, opening := range c.Openings {
+		if opening.ID == id {
+			proof, err := c.tree.Proof(i)
+			if err != nil {
+				return 0, nil, nil, false
+			}
+			return i, opening.Salt, proof, true
+		}
+	}
+	return 0, nil, nil, false
+}
@@ -0,0 +1,60 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleProof(t *testing.T) {
+	for size := 1; size <= 9; size++ {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			leaves[i] = LeafHash(nil, []byte(fmt.Sprintf("leaf-%d", i)))
+		}
+		tree, err := NewTree(leaves)
+		assert.NoError(t, err)
+
+		for i, leaf := range leaves {
+			proof, err := tree.Proof(i)
+			assert.NoError(t, err)
+			assert.True(t, Verify(tree.Root(), leaf, i, size, proof), "size = %d, index = %d", size, i)
+			// a leaf doesn't verify at another index
+			assert.False(t, Verify(tree.Root(), leaf, (i + 1) % (size + 1), size, proof), "size = %d, index = %d", size, i)
+		}
+		assert.False(t, Verify(tree.Root(), LeafHash(nil, []byte("other")), 0, size, [][]byte{}))
+	}
+
+	_, err := NewTree(nil)
+	assert.Error(t, err)
+}
+
+func TestCommitment(t *testing.T) {
+	ids := []string{"alice", "bob", "carol"}
+	c, err := Commit(ids, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, c.Size())
+
+	for _, id := range ids {
+		index, salt, proof, ok := c.Prove(id)
+		assert.True(t, ok)
+		assert.True(t, Verify(c.Root(), LeafHash(salt, []byte(id)), index, c.Size(), proof))
+		// the salt only opens the leaf to the committed id
+		assert.False(t, Verify(c.Root(), LeafHash(salt, []byte("mallory")), index, c.Size(), proof))
+	}
+	_, _, _, ok := c.Prove("mallory")
+	assert.False(t, ok)
+	_, _, _, ok = c.Prove("")
+	assert.False(t, ok)
+
+	// the commitment is rebuilt from the stored openings
+	rebuilt, err := NewCommitment(c.Openings)
+	assert.NoError(t, err)
+	assert.Equal(t, c.Root(), rebuilt.Root())
+
+	// fresh salts give a different root for the same ids
+	other, err := Commit(ids, 5)
+	assert.NoError(t, err)
+	assert.NotEqual(t, c.Root(), other.Root())
+}
@@ -0,0 +1,304 @@
+package multiparty
+
+import (
+	"fmt"
+	"errors"
+	"math/big"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/elliptic"
+	"encoding/binary"
+)
+
+// The sets are compared as polynomials encrypted with ElGamal in the exponent
+// under the joint key of all the parties. Every party except the leader puts
+// its items in bins and sends the coefficients of the polynomial of each bin,
+// whose roots are the items in it, see EncryptSet. The leader evaluates the
+// polynomials of all the parties at each of its own items and adds them up
+// with random weights, see Evaluate. The sum is zero only if the item is a
+// root of all of them, and it's decrypted round the ring, so the leader only
+// learns which of its items are held by every party, and nobody learns how
+// many parties hold any other item.
+
+// binLoad is the average number of items in a bin, the bins are padded to
+// the fullest one with random roots so the loads don't leak
+const binLoad = 32
+
+// RoundKeys are the secrets of a party in a round
+type RoundKeys struct {
+	curve 		elliptic.Curve
+	// share is the share x of the joint key
+	share 		*big.Int
+}
+
+func NewRoundKeys(curve elliptic.Curve) (*RoundKeys, error) {
+	share, err := randomScalar(curve)
+	if err != nil {
+		return nil, err
+	}
+	return &RoundKeys{
+		curve: curve,
+		share: share,
+	}, nil
+}
+
+// randomScalar returns a random scalar in [1, n-1]
+func randomScalar(curve elliptic.Curve) (*big.Int, error) {
+	nMinusOne := big.NewInt(0).Sub(curve.Params().N, big.NewInt(1))
+	k, err := rand.Int(rand.Reader, nMinusOne)
+	if err != nil {
+		return nil, err
+	}
+	return k.Add(k, big.NewInt(1)), nil
+}
+
+// PubKey is the public share x * G of the joint key
+func (k *RoundKeys) PubKey() []byte {
+	x, y := k.curve.ScalarBaseMult(k.share.Bytes())
+	return elliptic.MarshalCompressed(k.curve, x, y)
+}
+
+// sumKeys adds up the public shares, nil is returned for no shares
+func sumKeys(curve elliptic.Curve, pubKeys [][]byte) (*big.Int, *big.Int, error) {
+	var sx, sy *big.Int
+	for i, pubKey := range pubKeys {
+		x, y := elliptic.UnmarshalCompressed(curve, pubKey)
+		if x == nil {
+			return nil, nil, errors.New(fmt.Sprintf("Invalid public key at index %d", i))
+		}
+		if sx == nil {
+			sx, sy = x, y
+		} else {
+			sx, sy = curve.Add(sx, sy, x, y)
+		}
+	}
+	return sx, sy, nil
+}
+
+// Scalars maps the hashed points of ids, see ECDHIntersect.Finalize, to the
+// roots of polynomials
+func Scalars(curve elliptic.Curve, hashes [][]byte) []*big.Int {
+	ret := make([]*big.Int, len(hashes))
+	for i, hash := range hashes {
+		digest := sha256.Sum256(hash)
+		ret[i] = big.NewInt(0).SetBytes(digest[:])
+		ret[i].Mod(ret[i], curve.Params().N)
+	}
+	return ret
+}
+
+func binOf(scalar *big.Int, numBins int) int {
+	return int(big.NewInt(0).Mod(scalar, big.NewInt(int64(numBins))).Int64())
+}
+
+// polynomial returns the coefficients of the polynomial with the roots, from
+// the constant one up
+func polynomial(roots []*big.Int, n *big.Int) []*big.Int {
+	coeffs := []*big.Int{big.NewInt(1)}
+	for _, root := range roots {
+		next := make([]*big.Int, len(coeffs) + 1)
+		for i := range next {
+			next[i] = big.NewInt(0)
+		}
+		for i, coeff := range coeffs {
+			next[i + 1].Add(next[i + 1], coeff)
+			next[i].Sub(next[i], big.NewInt(0).Mul(root, coeff))
+		}
+		for _, coeff := range next {
+			coeff.Mod(coeff, n)
+		}
+		coeffs = next
+	}
+	return coeffs
+}
+
+// EncryptSet encrypts the polynomials of the bins of the scalars under the
+// joint key of pubKeys. The first item is the number of coefficients of a bin,
+// the coefficients of every bin follow.
+func (k *RoundKeys) EncryptSet(scalars []*big.Int, pubKeys [][]byte) ([][]byte, error) {
+	jx, jy, err := sumKeys(k.curve, pubKeys)
+	if err != nil {
+		return nil, err
+	}
+	if jx == nil {
+		return nil, errors.New("No public key to encrypt with")
+	}
+
+	numBins := (len(scalars) + binLoad - 1) / binLoad
+	if numBins == 0 {
+		numBins = 1
+	}
+	bins := make([][]*big.Int, numBins)
+	maxLoad := 1
+	for _, scalar := range scalars {
+		bin := binOf(scalar, numBins)
+		bins[bin] = append(bins[bin], scalar)
+		if len(bins[bin]) > maxLoad {
+			maxLoad = len(bins[bin])
+		}
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(maxLoad + 1))
+	ret := make([][]byte, 0, 1 + numBins * (maxLoad + 1))
+	ret = append(ret, header)
+	for _, roots := range bins {
+		for len(roots) < maxLoad {
+			root, err := randomScalar(k.curve)
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, root)
+		}
+		for _, coeff := range polynomial(roots, k.curve.Params().N) {
+			ct, err := k.encrypt(coeff, jx, jy)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, ct.marshal(k.curve))
+		}
+	}
+	return ret, nil
+}
+
+// encrypt returns (r * G, m * G + r * J)
+func (k *RoundKeys) encrypt(m, jx, jy *big.Int) (*ciphertext, error) {
+	r, err := randomScalar(k.curve)
+	if err != nil {
+		return nil, err
+	}
+	c1x, c1y := k.curve.ScalarBaseMult(r.Bytes())
+	c2x, c2y := k.curve.ScalarMult(jx, jy, r.Bytes())
+	if m.Sign() != 0 {
+		mx, my := k.curve.ScalarBaseMult(m.Bytes())
+		c2x, c2y = k.curve.Add(c2x, c2y, mx, my)
+	}
+	return &ciphertext{c1x, c1y, c2x, c2y}, nil
+}
+
+// Evaluate evaluates the encrypted polynomials of every party in sets at each
+// of the scalars, and adds them up with random weights
+func (k *RoundKeys) Evaluate(scalars []*big.Int, sets [][][]byte) ([][]byte, error) {
+	sums := make([]*ciphertext, len(scalars))
+	for i, set := range sets {
+		if len(set) < 2 || len(set[0]) != 4 {
+			return nil, errors.New(fmt.Sprintf("Invalid set at index %d", i))
+		}
+		numCoeffs := int(binary.BigEndian.Uint32(set[0]))
+		if numCoeffs < 2 || (len(set) - 1) % numCoeffs != 0 {
+			return nil, errors.New(fmt.Sprintf("Wrong number of coefficients in set at index %d", i))
+		}
+		coeffs := make([]*ciphertext, len(set) - 1)
+		for j, item := range set[1:] {
+			ct, err := k.unmarshalCiphertext(item)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid ciphertext at index %d of set %d, err: %s", j, i, err))
+			}
+			coeffs[j] = ct
+		}
+		numBins := len(coeffs) / numCoeffs
+
+		for j, scalar := range scalars {
+			bin := coeffs[binOf(scalar, numBins) * numCoeffs:][:numCoeffs]
+			value := bin[numCoeffs - 1]
+			for c := numCoeffs - 2; c >= 0; c-- {
+				value = k.add(k.mul(value, scalar), bin[c])
+			}
+			weight, err := randomScalar(k.curve)
+			if err != nil {
+				return nil, err
+			}
+			value = k.mul(value, weight)
+			if sums[j] == nil {
+				sums[j] = value
+			} else {
+				sums[j] = k.add(sums[j], value)
+			}
+		}
+	}
+
+	ret := make([][]byte, len(scalars))
+	for i, sum := range sums {
+		if sum == nil {
+			return nil, errors.New("No set to evaluate")
+		}
+		ret[i] = sum.marshal(k.curve)
+	}
+	return ret, nil
+}
+
+// Decrypt removes the share of this party from the ciphertexts
+func (k *RoundKeys) Decrypt(items [][]byte) ([][]byte, error) {
+	ret := make([][]byte, len(items))
+	for i, item := range items {
+		ct, err := k.unmarshalCiphertext(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid ciphertext at index %d, err: %s", i, err))
+		}
+		ct.c2x, ct.c2y = k.removeShare(ct)
+		ret[i] = ct.marshal(k.curve)
+	}
+	return ret, nil
+}
+
+// Open removes the last share from the ciphertexts, and reports which of them
+// are zero
+func (k *RoundKeys) Open(items [][]byte) ([]bool, error) {
+	ret := make([]bool, len(items))
+	for i, item := range items {
+		ct, err := k.unmarshalCiphertext(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid ciphertext at index %d, err: %s", i, err))
+		}
+		mx, my := k.removeShare(ct)
+		// the point at infinity is (0, 0)
+		ret[i] = mx.Sign() == 0 && my.Sign() == 0
+	}
+	return ret, nil
+}
+
+// removeShare returns c2 - x * c1 == c2 + (n - x) * c1
+func (k *RoundKeys) removeShare(ct *ciphertext) (*big.Int, *big.Int) {
+	negShare := big.NewInt(0).Sub(k.curve.Params().N, k.share)
+	dx, dy := k.curve.ScalarMult(ct.c1x, ct.c1y, negShare.Bytes())
+	return k.curve.Add(ct.c2x, ct.c2y, dx, dy)
+}
+
+type ciphertext struct {
+	c1x, c1y 	*big.Int
+	c2x, c2y 	*big.Int
+}
+
+func (k *RoundKeys) add(a, b *ciphertext) *ciphertext {
+	c1x, c1y := k.curve.Add(a.c1x, a.c1y, b.c1x, b.c1y)
+	c2x, c2y := k.curve.Add(a.c2x, a.c2y, b.c2x, b.c2y)
+	return &ciphertext{c1x, c1y, c2x, c2y}
+}
+
+func (k *RoundKeys) mul(a *ciphertext, scalar *big.Int) *ciphertext {
+	c1x, c1y := k.curve.ScalarMult(a.c1x, a.c1y, scalar.Bytes())
+	c2x, c2y := k.curve.ScalarMult(a.c2x, a.c2y, scalar.Bytes())
+	return &ciphertext{c1x, c1y, c2x, c2y}
+}
+
+func (k *RoundKeys) pointSize() int {
+	return 1 + (k.curve.Params().BitSize + 7) / 8
+}
+
+func (ct *ciphertext) marshal(curve elliptic.Curve) []byte {
+	ret := elliptic.MarshalCompressed(curve, ct.c1x, ct.c1y)
+	return append(ret, elliptic.MarshalCompressed(curve, ct.c2x, ct.c2y)...)
+}
+
+func (k *RoundKeys) unmarshalCiphertext(data []byte) (*ciphertext, error) {
+	size := k.pointSize()
+	if len(data) != 2 * size {
+		return nil, errors.New("Wrong size of ciphertext")
+	}
+	c1x, c1y := elliptic.UnmarshalCompressed(k.curve, data[:size])
+	c2x, c2y := elliptic.UnmarshalCompressed(k.curve, data[size:])
+	if c1x == nil || c2x == nil {
+		return nil, errors.New("Invalid point in ciphertext")
+	}
+	return &ciphertext{c1x, c1y, c2x, c2y}, nil
+}
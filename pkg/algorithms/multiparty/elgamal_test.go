@@ -0,0 +1,115 @@
+package multiparty
+
+import (
+	"fmt"
+	"testing"
+	"math/big"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+)
+
+// intersectSets runs a round with sets[0] on leader, and returns the items of
+// leader held by every party
+func intersectSets(t *testing.T, sets [][]string) []string {
+	intersect, err := ecdh.NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	curve := intersect.Curve()
+
+	keys := make([]*RoundKeys, len(sets))
+	pubKeys := make([][]byte, len(sets))
+	for i := range sets {
+		keys[i], err = NewRoundKeys(curve)
+		assert.NoError(t, err)
+		pubKeys[i] = keys[i].PubKey()
+	}
+
+	scalarsOf := func(set []string) []*big.Int {
+		points, err := intersect.HashToPoints(set)
+		assert.NoError(t, err)
+		return Scalars(curve, intersect.Finalize(points))
+	}
+
+	// every party except leader encrypts the polynomials of its set
+	encrypted := make([][][]byte, 0)
+	for i, set := range sets[1:] {
+		items, err := keys[i + 1].EncryptSet(scalarsOf(set), pubKeys)
+		assert.NoError(t, err)
+		encrypted = append(encrypted, items)
+	}
+
+	items, err := keys[0].Evaluate(scalarsOf(sets[0]), encrypted)
+	assert.NoError(t, err)
+	for i := 1; i < len(keys); i++ {
+		items, err = keys[i].Decrypt(items)
+		assert.NoError(t, err)
+	}
+	zeros, err := keys[0].Open(items)
+	assert.NoError(t, err)
+
+	ret := make([]string, 0)
+	for i, zero := range zeros {
+		if zero {
+			ret = append(ret, sets[0][i])
+		}
+	}
+	return ret
+}
+
+func TestIntersectSets(t *testing.T) {
+	sets := [][]string{
+		{"a", "b", "c", "d"},
+		{"b", "c", "d", "e"},
+		{"c", "d", "f"},
+	}
+	assert.ElementsMatch(t, []string{"c", "d"}, intersectSets(t, sets))
+
+	// an empty set matches nothing
+	assert.Empty(t, intersectSets(t, [][]string{{"a", "b"}, {}}))
+
+	// many bins, the items held by two of three parties don't match
+	large := make([][]string, 3)
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("id-%d", i)
+		large[0] = append(large[0], id)
+		if i % 2 == 0 {
+			large[1] = append(large[1], id)
+		}
+		if i % 3 == 0 {
+			large[2] = append(large[2], id)
+		}
+	}
+	expected := make([]string, 0)
+	for i := 0; i < 200; i += 6 {
+		expected = append(expected, fmt.Sprintf("id-%d", i))
+	}
+	assert.ElementsMatch(t, expected, intersectSets(t, large))
+}
+
+func TestPolynomial(t *testing.T) {
+	n := big.NewInt(101)
+	// (X - 2)(X - 3) == X^2 - 5X + 6
+	coeffs := polynomial([]*big.Int{big.NewInt(2), big.NewInt(3)}, n)
+	assert.Equal(t, []*big.Int{big.NewInt(6), big.NewInt(96), big.NewInt(1)}, coeffs)
+}
+
+func TestInvalidSets(t *testing.T) {
+	intersect, err := ecdh.NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	keys, err := NewRoundKeys(intersect.Curve())
+	assert.NoError(t, err)
+	scalars := []*big.Int{big.NewInt(1)}
+
+	_, err = keys.EncryptSet(scalars, nil)
+	assert.Error(t, err)
+	_, err = keys.Evaluate(scalars, nil)
+	assert.Error(t, err)
+	_, err = keys.Evaluate(scalars, [][][]byte{{{0, 0, 0, 2}, {0x02}}})
+	assert.Error(t, err)
+	_, err = keys.Evaluate(scalars, [][][]byte{{{0, 0, 0, 3}, {0x02}, {0x02}}})
+	assert.Error(t, err)
+	_, err = keys.Decrypt([][]byte{{0x02}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+package multiparty
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+)
+
+type MultiPartyStep = runtime.Step
+
+// Every round, each party sends its public share of a fresh joint key to the
+// leader, and once the leader broadcasts all the shares, every other party
+// encrypts the polynomials of its set under the joint key and sends them to
+// the leader, see EncryptSet. The leader evaluates them at its own items, the
+// result is decrypted round the ring back to the leader, which finds the items
+// held by every party and broadcasts their hashes.
+const (
+	StepStart 		MultiPartyStep = "MultiPartyStart"
+	StepRoundKey 	MultiPartyStep = "MultiPartyRoundKey"
+	StepJointKey 	MultiPartyStep = "MultiPartyJointKey"
+	StepSubmit 		MultiPartyStep = "MultiPartySubmit"
+	StepDecrypt 	MultiPartyStep = "MultiPartyDecrypt"
+	StepResult 		MultiPartyStep = "MultiPartyResult"
+	StepShutdown	MultiPartyStep = runtime.StepShutdown
+)
+
+// Party is a member of the consortium and the mq topic it consumes
+type Party struct {
+	ID 		string	`mapstructure:"id"`
+	Topic 	string	`mapstructure:"topic"`
+}
+
+// Ring is the ordered list of parties seen from one of them, the first party
+// is the leader
+type Ring struct {
+	parties 	[]Party
+	self 		int
+}
+
+func NewRing(parties []Party, selfID string) (*Ring, error) {
+	if len(parties) < 2 {
+		return nil, errors.New(fmt.Sprintf("Multi-party PSI needs at least 2 parties, got %d", len(parties)))
+	}
+
+	self := -1
+	ids := make(map[string]bool)
+	for i, party := range parties {
+		if len(party.ID) == 0 || len(party.Topic) == 0 {
+			return nil, errors.New(fmt.Sprintf("The id and topic of party %d should be set", i))
+		}
+		if ids[party.ID] {
+			return nil, errors.New(fmt.Sprintf("Duplicated party: %s", party.ID))
+		}
+		ids[party.ID] = true
+		if party.ID == selfID {
+			self = i
+		}
+	}
+	if self < 0 {
+		return nil, errors.New(fmt.Sprintf("Party %s is not in the party list", selfID))
+	}
+
+	return &Ring{
+		parties: parties,
+		self: self,
+	}, nil
+}
+
+func (r *Ring) Size() int {
+	return len(r.parties)
+}
+
+func (r *Ring) Self() Party {
+	return r.parties[r.self]
+}
+
+func (r *Ring) Leader() Party {
+	return r.parties[0]
+}
+
+func (r *Ring) IsLeader() bool {
+	return r.self == 0
+}
+
+// Next is the party after self
+func (r *Ring) Next() Party {
+	return r.parties[(r.self + 1) % len(r.parties)]
+}
+
+// Parties returns all the parties in the order of the ring
+func (r *Ring) Parties() []Party {
+	ret := make([]Party, len(r.parties))
+	copy(ret, r.parties)
+	return ret
+}
+
+// Last is the last party of the ring
+func (r *Ring) Last() Party {
+	return r.parties[len(r.parties) - 1]
+}
+
+// Index is the position of self in the ring, the leader is 0
+func (r *Ring) Index() int {
+	return r.self
+}
+
+// IsLast reports whether self is the last party of the ring
+func (r *Ring) IsLast() bool {
+	return r.self == len(r.parties) - 1
+}
+
+// Others returns all the parties except self
+func (r *Ring) Others() []Party {
+	ret := make([]Party, 0, len(r.parties) - 1)
+	for i, party := range r.parties {
+		if i != r.self {
+			ret = append(ret, party)
+		}
+	}
+	return ret
+}
+
+func (r *Ring) Has(id string) bool {
+	for _, party := range r.parties {
+		if party.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package multiparty
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	parties := []Party{
+		{ID: "bank_a", Topic: "ppgi_bank_a"},
+		{ID: "bank_b", Topic: "ppgi_bank_b"},
+		{ID: "bank_c", Topic: "ppgi_bank_c"},
+	}
+
+	leader, err := NewRing(parties, "bank_a")
+	assert.NoError(t, err)
+	assert.True(t, leader.IsLeader())
+	assert.False(t, leader.IsLast())
+	assert.Equal(t, "bank_b", leader.Next().ID)
+	assert.Equal(t, []Party{parties[1], parties[2]}, leader.Others())
+
+	last, err := NewRing(parties, "bank_c")
+	assert.NoError(t, err)
+	assert.False(t, last.IsLeader())
+	assert.True(t, last.IsLast())
+	assert.Equal(t, "bank_c", leader.Last().ID)
+	assert.Equal(t, 2, last.Index())
+	assert.Equal(t, parties, last.Parties())
+	assert.Equal(t, "bank_a", last.Next().ID)
+	assert.Equal(t, "bank_a", last.Leader().ID)
+	assert.True(t, last.Has("bank_b"))
+	assert.False(t, last.Has("bank_d"))
+
+	_, err = NewRing(parties, "bank_d")
+	assert.Error(t, err)
+	_, err = NewRing(parties[:1], "bank_a")
+	assert.Error(t, err)
+	_, err = NewRing(append(parties, Party{ID: "bank_a", Topic: "another"}), "bank_a")
+	assert.Error(t, err)
+	_, err = NewRing(append(parties, Party{ID: "bank_d"}), "bank_a")
+	assert.Error(t, err)
+}
@@ -1,11 +1,13 @@
 package naive
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
 )
 
 const (
@@ -13,87 +15,159 @@ const (
 	CLIENT = "client"
 )
 
-func NaivePSI(conn runtime.Conn, role string, elements [][]byte) [][]byte {
-	if role != SERVER && role != CLIENT {
-		panic(fmt.Sprintf("role must be server or client, found %v\n", role))
-	}
-	numElement := len(elements)
-	// Hash the elements
-	hashes := make([][]byte, 0, numElement)
-	for _, element := range elements {
-		hash := sha256.Sum256(element)
-		hashes = append(hashes, hash[:])
+type NaiveStep = runtime.Step
+
+// The steps are the same for both roles. Each side sends the salted hashes of
+// its new ids with the salt, and the peer hashes all its ids with the salt and
+// sends back the matched hashes with the salt.
+const (
+	StepHash 			NaiveStep = "NaiveHash"
+	StepMatched 		NaiveStep = "NaiveMatched"
+	StepExchangeData	NaiveStep = runtime.StepExchangeData
+	StepShutdown		NaiveStep = runtime.StepShutdown
+)
+
+// SaltSize is the size of the salt generated for each session
+const SaltSize = 16
+
+// MaxHashes bounds the number of hashes the peer can announce, and the slice
+// only grows as the hashes arrive, so a wrong count can't exhaust the memory
+const MaxHashes = 1 << 26
+
+// the capacity the hashes of peer start with
+const initHashes = 1024
+
+// HashElements hashes each element with the salt prepended. The hashes are
+// only comparable with ones of the same hasher and salt
+func HashElements(hash hasher.Hasher, salt []byte, elements [][]byte) [][]byte {
+	hashes := make([][]byte, len(elements))
+	for i, element := range elements {
+		salted := make([]byte, 0, len(salt) + len(element))
+		salted = append(salted, salt...)
+		salted = append(salted, element...)
+		hashes[i] = hash.Sum(salted)
 	}
+	return hashes
+}
 
-	intersectionHashSet := make(map[string]bool)
+// Match returns the elements whose hashes are in peerHashes
+func Match(elements, hashes, peerHashes [][]byte) [][]byte {
+	peerSet := make(map[string]bool, len(peerHashes))
+	for _, hash := range peerHashes {
+		peerSet[string(hash)] = true
+	}
 	result := make([][]byte, 0)
+	for i, hash := range hashes {
+		if peerSet[string(hash)] {
+			result = append(result, elements[i])
+		}
+	}
+	return result
+}
+
+// NaivePSI intersects the elements with the peer by comparing the salted
+// hashes, both sides should use the same hasher and salt. It's only suitable
+// for non-sensitive elements, since the peer can recover any element of a
+// small domain by brute force
+func NaivePSI(conn runtime.Conn, role string, elements [][]byte, hash hasher.Hasher, salt []byte) ([][]byte, error) {
+	if role != SERVER && role != CLIENT {
+		return nil, errors.New(fmt.Sprintf("role must be server or client, found %v", role))
+	}
+	hashSize := len(hash.Sum(nil))
+	hashes := HashElements(hash, salt, elements)
+
+	var intersection [][]byte
 	if role == CLIENT {
-		// 1. client sends her hash values to server
-		for _, hash := range hashes {
-			n, err := conn.Write(hash)
-			if err != nil || n != len(hash) {
-				panic("")
-			}
+		// 1. client sends the number of her hashes and the hashes to server
+		if err := writeHashes(conn, hashes); err != nil {
+			return nil, err
 		}
 		// 2. read intersection hash
-		numBuf := make([]byte, 4)
-		n, err := conn.Read(numBuf)
-		if err != nil || n != 4 {
-			panic("")
-		}
-		numIntersection := int(binary.LittleEndian.Uint32(numBuf))
-
-		for i := 0; i < numIntersection; i++ {
-			hash := make([]byte, 32)
-			n, err := conn.Read(hash)
-			if err != nil || n != 32 {
-				panic("")
-			}
-			intersectionHashSet[string(hash)] = true
+		var err error
+		if intersection, err = readHashes(conn, hashSize); err != nil {
+			return nil, err
 		}
 	} else {
 		// 1. server receives the client hashes
-		peerHashes := make([][]byte, 0, numElement)
-		// TODO(zhuzilin) Here I hardcoded for sha256, may need the user
-		// to provide a bit size for the hash functions in the future.
-		for i := 0; i < numElement; i++ {
-			hash := make([]byte, 32)
-			n, err := conn.Read(hash)
-			if err != nil || n != 32 {
-				panic("")
-			}
-			peerHashes = append(peerHashes, hash)
+		peerHashes, err := readHashes(conn, hashSize)
+		if err != nil {
+			return nil, err
 		}
 
-		// 2. server compare the client hash with her own hashes.
-		hashSet := make(map[string]bool)
+		// 2. server compares the client hashes with her own hashes, duplicated
+		// hashes are sent once
+		ownSet := make(map[string]bool, len(hashes))
 		for _, hash := range hashes {
-			hashSet[string(hash)] = true
+			ownSet[string(hash)] = true
 		}
+		intersection = make([][]byte, 0)
 		for _, hash := range peerHashes {
-			if _, ok := hashSet[string(hash)]; ok {
-				intersectionHashSet[string(hash)] = true
+			if ownSet[string(hash)] {
+				intersection = append(intersection, hash)
+				delete(ownSet, string(hash))
 			}
 		}
 
-		// 3. send the intersection hash back to clent.
-		numIntersection := len(intersectionHashSet)
-		numBuf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(numBuf, uint32(numIntersection))
-		conn.Write(numBuf)
-		for hashStr, _ := range intersectionHashSet {
-			hash := []byte(hashStr)
-			n, err := conn.Write(hash)
-			if err != nil || n != len(hash) {
-				panic("")
-			}
+		// 3. send the intersection hash back to client
+		if err = writeHashes(conn, intersection); err != nil {
+			return nil, err
 		}
 	}
 	// Read the origin values from the intersection hashes.
-	for i := 0; i < numElement; i++ {
-		if _, ok := intersectionHashSet[string(hashes[i])]; ok {
-			result = append(result, elements[i])
+	return Match(elements, hashes, intersection), nil
+}
+
+func writeHashes(conn runtime.Conn, hashes [][]byte) error {
+	numBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(numBuf, uint32(len(hashes)))
+	if err := writeFull(conn, numBuf); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := writeFull(conn, hash); err != nil {
+			return err
 		}
 	}
-	return result
+	return nil
+}
+
+func readHashes(conn runtime.Conn, hashSize int) ([][]byte, error) {
+	numBuf := make([]byte, 4)
+	if err := readFull(conn, numBuf); err != nil {
+		return nil, err
+	}
+	num := int(binary.LittleEndian.Uint32(numBuf))
+	if num > MaxHashes {
+		return nil, errors.New(fmt.Sprintf("The peer sends %d hashes, more than %d", num, MaxHashes))
+	}
+
+	capacity := num
+	if capacity > initHashes {
+		capacity = initHashes
+	}
+	hashes := make([][]byte, 0, capacity)
+	for i := 0; i < num; i++ {
+		hash := make([]byte, hashSize)
+		if err := readFull(conn, hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func writeFull(conn runtime.Conn, buf []byte) error {
+	n, err := conn.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+func readFull(conn runtime.Conn, buf []byte) error {
+	_, err := io.ReadFull(conn, buf)
+	return err
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,30 +28,35 @@ func byteArray2IntArray(array [][]byte) []uint32 {
 	return result
 }
 
-func TestNaivePSI(t *testing.T) {
-
-	serverData := []uint32{1, 2, 3, 4}
-	clientData := []uint32{6, 5, 4, 3}
-
+func runNaivePSI(t *testing.T, serverData, clientData []uint32, hash hasher.Hasher, serverSalt, clientSalt []byte) ([][]byte, [][]byte) {
 	ch := make(chan []byte)
 	conn := runtime.NewChannelConn(ch)
 
 	serverCh := make(chan [][]byte)
 	go func() {
 		data := intArray2ByteArray(serverData)
-		result := NaivePSI(conn, SERVER, data)
+		result, err := NaivePSI(conn, SERVER, data, hash, serverSalt)
+		assert.Nil(t, err)
 		serverCh <- result
 	}()
 
 	clientCh := make(chan [][]byte)
 	go func() {
 		data := intArray2ByteArray(clientData)
-		result := NaivePSI(conn, CLIENT, data)
+		result, err := NaivePSI(conn, CLIENT, data, hash, clientSalt)
+		assert.Nil(t, err)
 		clientCh <- result
 	}()
 
-	serverResult := <-serverCh
-	clientResult := <-clientCh
+	return <-serverCh, <-clientCh
+}
+
+func TestNaivePSI(t *testing.T) {
+
+	serverData := []uint32{1, 2, 3, 4}
+	clientData := []uint32{6, 5, 4, 3}
+
+	serverResult, clientResult := runNaivePSI(t, serverData, clientData, &hasher.SHA256Hash{}, nil, nil)
 
 	serverIntersection := byteArray2IntArray(serverResult)
 	clientIntersection := byteArray2IntArray(clientResult)
@@ -58,3 +64,67 @@ func TestNaivePSI(t *testing.T) {
 	assert.Equal(t, true, reflect.DeepEqual(serverIntersection, []uint32{3, 4}))
 	assert.Equal(t, true, reflect.DeepEqual(clientIntersection, []uint32{4, 3}))
 }
+
+func TestNaivePSISalt(t *testing.T) {
+	serverData := []uint32{1, 2, 3, 4, 5}
+	clientData := []uint32{7, 5, 6, 1}
+
+	hash, err := hasher.GetHasher("sha512")
+	assert.Nil(t, err)
+
+	salt := []byte("session salt")
+	serverResult, clientResult := runNaivePSI(t, serverData, clientData, hash, salt, salt)
+	assert.Equal(t, []uint32{1, 5}, byteArray2IntArray(serverResult))
+	assert.Equal(t, []uint32{5, 1}, byteArray2IntArray(clientResult))
+
+	// hashes of different salts never match
+	serverResult, clientResult = runNaivePSI(t, serverData, clientData, hash, salt, []byte("another salt"))
+	assert.Equal(t, 0, len(serverResult))
+	assert.Equal(t, 0, len(clientResult))
+}
+
+func TestNaivePSIRole(t *testing.T) {
+	conn := runtime.NewChannelConn(make(chan []byte))
+	_, err := NaivePSI(conn, "peer", nil, &hasher.SHA256Hash{}, nil)
+	assert.NotNil(t, err)
+}
+
+// pieceConn hands out the written bytes a few at a time
+type pieceConn struct {
+	data 	[]byte
+}
+
+func (c *pieceConn) Write(val []byte) (int, error) {
+	c.data = append(c.data, val...)
+	return len(val), nil
+}
+
+func (c *pieceConn) Read(buf []byte) (int, error) {
+	piece := c.data
+	if len(piece) > 3 {
+		piece = piece[:3]
+	}
+	n := copy(buf, piece)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *pieceConn) Close() {
+}
+
+func TestReadHashes(t *testing.T) {
+	hashes := HashElements(&hasher.SHA256Hash{}, nil, intArray2ByteArray([]uint32{1, 2, 3}))
+	conn := &pieceConn{}
+	assert.Nil(t, writeHashes(conn, hashes))
+
+	// the hashes are read in full even if they arrive in pieces
+	ret, err := readHashes(conn, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, hashes, ret)
+
+	numBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(numBuf, MaxHashes + 1)
+	conn = &pieceConn{data: numBuf}
+	_, err = readHashes(conn, 32)
+	assert.NotNil(t, err)
+}
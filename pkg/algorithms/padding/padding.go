@@ -0,0 +1,139 @@
+package padding
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+)
+
+// Padding hides the number of items of a batch from the peer: every batch is
+// padded with dummies to the smallest bucket that holds it, or to a multiple of
+// the largest bucket. With a positive epsilon the number of items is first
+// increased by the noise of the shifted and truncated two-sided geometric
+// mechanism, so the padded size is (epsilon, delta)-differentially private
+// with respect to adding or removing one item.
+type Padding struct {
+	buckets 	[]int
+	epsilon 	float64
+	delta 		float64
+	// shift makes the noise negative with probability at most delta, the
+	// negative noise is truncated to 0
+	shift 		int
+}
+
+type Config struct {
+	Buckets 	[]int		`mapstructure:"buckets"`
+	Epsilon 	float64		`mapstructure:"dp_epsilon"`
+	Delta 		float64		`mapstructure:"dp_delta"`
+}
+
+const defaultDelta = 1e-6
+
+func NewPadding(config Config) (*Padding, error) {
+	if len(config.Buckets) == 0 {
+		return nil, errors.New("At least one bucket size should be set")
+	}
+	buckets := append([]int{}, config.Buckets...)
+	sort.Ints(buckets)
+	if buckets[0] <= 0 {
+		return nil, errors.New(fmt.Sprintf("The bucket sizes should be positive, got %v", config.Buckets))
+	}
+	if config.Epsilon < 0 {
+		return nil, errors.New(fmt.Sprintf("The epsilon should not be negative, got %g", config.Epsilon))
+	}
+
+	s := &Padding{
+		buckets: buckets,
+		epsilon: config.Epsilon,
+		delta: config.Delta,
+	}
+	if s.epsilon > 0 {
+		if s.delta == 0 {
+			s.delta = defaultDelta
+		}
+		if s.delta <= 0 || s.delta >= 1 {
+			return nil, errors.New(fmt.Sprintf("The delta should be in (0, 1), got %g", s.delta))
+		}
+		// P(X <= -k) = alpha^k / (1 + alpha) for the two-sided geometric X
+		alpha := math.Exp(-s.epsilon)
+		s.shift = int(math.Ceil(math.Log(s.delta * (1 + alpha)) / math.Log(alpha)))
+		if s.shift < 0 {
+			s.shift = 0
+		}
+	}
+	return s, nil
+}
+
+// Size returns the padded size of a batch of n items
+func (s *Padding) Size(n int) (int, error) {
+	if s.epsilon > 0 {
+		noise, err := twoSidedGeometric(math.Exp(-s.epsilon))
+		if err != nil {
+			return 0, err
+		}
+		if noise += s.shift; noise > 0 {
+			n += noise
+		}
+	}
+
+	for _, bucket := range s.buckets {
+		if n <= bucket {
+			return bucket, nil
+		}
+	}
+	largest := s.buckets[len(s.buckets) - 1]
+	return (n + largest - 1) / largest * largest, nil
+}
+
+// twoSidedGeometric samples X with P(X = k) proportional to alpha^|k|, as the
+// difference of two geometric variables
+func twoSidedGeometric(alpha float64) (int, error) {
+	a, err := geometric(alpha)
+	if err != nil {
+		return 0, err
+	}
+	b, err := geometric(alpha)
+	if err != nil {
+		return 0, err
+	}
+	return a - b, nil
+}
+
+// geometric samples the number of failures before the first success, with the
+// probability of failure alpha
+func geometric(alpha float64) (int, error) {
+	u, err := uniform()
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Floor(math.Log(u) / math.Log(alpha))), nil
+}
+
+// uniform returns a float in (0, 1) from crypto/rand
+func uniform() (float64, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	return (float64(binary.BigEndian.Uint64(buf) >> 11) + 0.5) / (1 << 53), nil
+}
+
+// AppendShuffled appends the dummies to the items and shuffles them, so that
+// the positions of the items are not revealed either
+func AppendShuffled(items, dummies [][]byte) ([][]byte, error) {
+	ret := make([][]byte, 0, len(items) + len(dummies))
+	ret = append(ret, items...)
+	ret = append(ret, dummies...)
+	for i := len(ret) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i + 1)))
+		if err != nil {
+			return nil, err
+		}
+		ret[i], ret[j.Int64()] = ret[j.Int64()], ret[i]
+	}
+	return ret, nil
+}
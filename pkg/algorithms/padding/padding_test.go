@@ -0,0 +1,54 @@
+package padding
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaddingSize(t *testing.T) {
+	s, err := NewPadding(Config{Buckets: []int{1000, 100, 10}})
+	assert.NoError(t, err)
+
+	for n, expected := range map[int]int{0: 10, 1: 10, 10: 10, 11: 100, 999: 1000, 1000: 1000, 1001: 2000, 4500: 5000} {
+		size, err := s.Size(n)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, size, "n = %d", n)
+	}
+
+	_, err = NewPadding(Config{})
+	assert.Error(t, err)
+	_, err = NewPadding(Config{Buckets: []int{0, 10}})
+	assert.Error(t, err)
+	_, err = NewPadding(Config{Buckets: []int{10}, Epsilon: 1, Delta: 2})
+	assert.Error(t, err)
+}
+
+func TestPaddingNoise(t *testing.T) {
+	s, err := NewPadding(Config{Buckets: []int{1}, Epsilon: 0.5})
+	assert.NoError(t, err)
+	// alpha = e^-0.5, alpha^k / (1 + alpha) <= 1e-6 needs k = 27
+	assert.Equal(t, 27, s.shift)
+
+	// with buckets of size 1 the padded size is n plus the noise
+	total := 0
+	rounds := 20000
+	for i := 0; i < rounds; i++ {
+		size, err := s.Size(100)
+		assert.NoError(t, err)
+		assert.True(t, size >= 100)
+		total += size - 100
+	}
+	mean := float64(total) / float64(rounds)
+	assert.InDelta(t, float64(s.shift), mean, 0.5)
+}
+
+func TestAppendShuffled(t *testing.T) {
+	items := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	dummies := [][]byte{[]byte("x"), []byte("y")}
+	padded, err := AppendShuffled(items, dummies)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, append(append([][]byte{}, items...), dummies...), padded)
+	// the input is not modified
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, items)
+}
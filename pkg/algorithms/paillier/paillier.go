@@ -0,0 +1,170 @@
+package paillier
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Paillier is additively homomorphic: Enc(a) * Enc(b) mod N^2 = Enc(a + b).
+// The generator is g = N + 1, so g^m = 1 + m * N mod N^2 and no
+// exponentiation is needed for it.
+
+var (
+	ErrMessageTooLarge 	= errors.New("The message should be in [0, N)")
+	ErrCiphertext 		= errors.New("The ciphertext should be in [1, N^2) and coprime to N")
+)
+
+type PublicKey struct {
+	N 			*big.Int
+	NSquare 	*big.Int
+}
+
+type PrivateKey struct {
+	PublicKey
+	// lambda = lcm(p - 1, q - 1), mu = lambda^-1 mod N
+	lambda 		*big.Int
+	mu 			*big.Int
+}
+
+// NewPublicKey creates the public key from N, e.g. the one sent by peer
+func NewPublicKey(n *big.Int) *PublicKey {
+	return &PublicKey{
+		N: n,
+		NSquare: big.NewInt(0).Mul(n, n),
+	}
+}
+
+// GenerateKey generates a key with a modulus of bits bits
+func GenerateKey(random io.Reader, bits int) (*PrivateKey, error) {
+	if bits < 1024 {
+		return nil, errors.New(fmt.Sprintf("The key should have at least 1024 bits, got %d", bits))
+	}
+
+	for {
+		p, err := rand.Prime(random, bits / 2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := rand.Prime(random, bits - bits / 2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		n := big.NewInt(0).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+
+		one := big.NewInt(1)
+		pMinusOne := big.NewInt(0).Sub(p, one)
+		qMinusOne := big.NewInt(0).Sub(q, one)
+		gcd := big.NewInt(0).GCD(nil, nil, pMinusOne, qMinusOne)
+		lambda := big.NewInt(0).Mul(pMinusOne, qMinusOne)
+		lambda.Div(lambda, gcd)
+
+		mu := big.NewInt(0).ModInverse(lambda, n)
+		if mu == nil {
+			continue
+		}
+
+		return &PrivateKey{
+			PublicKey: *NewPublicKey(n),
+			lambda: lambda,
+			mu: mu,
+		}, nil
+	}
+}
+
+// randomUnit returns a random r in [1, N) coprime to N
+func (s *PublicKey) randomUnit(random io.Reader) (*big.Int, error) {
+	one := big.NewInt(1)
+	for {
+		r, err := rand.Int(random, s.N)
+		if err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 && big.NewInt(0).GCD(nil, nil, r, s.N).Cmp(one) == 0 {
+			return r, nil
+		}
+	}
+}
+
+// Encrypt computes (1 + m * N) * r^N mod N^2
+func (s *PublicKey) Encrypt(m *big.Int) (*big.Int, error) {
+	if m.Sign() < 0 || m.Cmp(s.N) >= 0 {
+		return nil, ErrMessageTooLarge
+	}
+	r, err := s.randomUnit(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	c := big.NewInt(0).Mul(m, s.N)
+	c.Add(c, big.NewInt(1))
+	c.Mod(c, s.NSquare)
+	rn := big.NewInt(0).Exp(r, s.N, s.NSquare)
+	return c.Mul(c, rn).Mod(c, s.NSquare), nil
+}
+
+// Add returns the encryption of the sum of the messages of a and b
+func (s *PublicKey) Add(a, b *big.Int) *big.Int {
+	ret := big.NewInt(0).Mul(a, b)
+	return ret.Mod(ret, s.NSquare)
+}
+
+// Rerandomize multiplies c with a fresh encryption of 0, so the result can't
+// be linked to c
+func (s *PublicKey) Rerandomize(c *big.Int) (*big.Int, error) {
+	zero, err := s.Encrypt(big.NewInt(0))
+	if err != nil {
+		return nil, err
+	}
+	return s.Add(c, zero), nil
+}
+
+// Validate checks that c is a valid ciphertext
+func (s *PublicKey) Validate(c *big.Int) error {
+	if c.Sign() <= 0 || c.Cmp(s.NSquare) >= 0 {
+		return ErrCiphertext
+	}
+	if big.NewInt(0).GCD(nil, nil, c, s.N).Cmp(big.NewInt(1)) != 0 {
+		return ErrCiphertext
+	}
+	return nil
+}
+
+// Decrypt computes L(c^lambda mod N^2) * mu mod N, with L(x) = (x - 1) / N
+func (s *PrivateKey) Decrypt(c *big.Int) (*big.Int, error) {
+	if err := s.Validate(c); err != nil {
+		return nil, err
+	}
+	x := big.NewInt(0).Exp(c, s.lambda, s.NSquare)
+	x.Sub(x, big.NewInt(1))
+	x.Div(x, s.N)
+	x.Mul(x, s.mu)
+	return x.Mod(x, s.N), nil
+}
+
+// EncodeSigned maps m in (-N/2, N/2) to [0, N), negative ones to the upper half
+func (s *PublicKey) EncodeSigned(m *big.Int) (*big.Int, error) {
+	half := big.NewInt(0).Rsh(s.N, 1)
+	if big.NewInt(0).Abs(m).Cmp(half) >= 0 {
+		return nil, ErrMessageTooLarge
+	}
+	return big.NewInt(0).Mod(m, s.N), nil
+}
+
+// DecodeSigned reverts EncodeSigned
+func (s *PublicKey) DecodeSigned(m *big.Int) *big.Int {
+	half := big.NewInt(0).Rsh(s.N, 1)
+	if m.Cmp(half) > 0 {
+		return big.NewInt(0).Sub(m, s.N)
+	}
+	return big.NewInt(0).Set(m)
+}
@@ -0,0 +1,97 @@
+package paillier
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaillier(t *testing.T) {
+	key, err := GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, 1024, key.N.BitLen())
+
+	m := big.NewInt(2022)
+	c, err := key.Encrypt(m)
+	assert.NoError(t, err)
+	d, err := key.Decrypt(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, m.Cmp(d))
+
+	// the encryption is randomized
+	c2, err := key.Encrypt(m)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, c.Cmp(c2))
+
+	_, err = key.Encrypt(key.N)
+	assert.Equal(t, ErrMessageTooLarge, err)
+	_, err = key.Decrypt(key.NSquare)
+	assert.Equal(t, ErrCiphertext, err)
+}
+
+func TestPaillierHomomorphic(t *testing.T) {
+	key, err := GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	pub := NewPublicKey(key.N)
+
+	values := []int64{1500, -200, 37, 0, -1000}
+	sum, err := pub.Encrypt(big.NewInt(0))
+	assert.NoError(t, err)
+	for _, v := range values {
+		encoded, err := pub.EncodeSigned(big.NewInt(v))
+		assert.NoError(t, err)
+		c, err := pub.Encrypt(encoded)
+		assert.NoError(t, err)
+		sum = pub.Add(sum, c)
+	}
+
+	rerandomized, err := pub.Rerandomize(sum)
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, sum.Cmp(rerandomized))
+
+	d, err := key.Decrypt(rerandomized)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(337), pub.DecodeSigned(d).Int64())
+}
+
+func TestSumMatched(t *testing.T) {
+	key, err := GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	pub := NewPublicKey(key.N)
+
+	own := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	points := [][]byte{[]byte("b"), []byte("d"), []byte("c"), []byte("e")}
+	values := []int64{100, 2000, -30, 40000}
+	ciphertexts := make([]*big.Int, len(values))
+	for i, v := range values {
+		encoded, err := key.EncodeSigned(big.NewInt(v))
+		assert.NoError(t, err)
+		ciphertexts[i], err = key.Encrypt(encoded)
+		assert.NoError(t, err)
+	}
+
+	decodedPoints, decodedCiphertexts, err := pub.DecodePairs(EncodePairs(points, ciphertexts))
+	assert.NoError(t, err)
+	assert.Equal(t, points, decodedPoints)
+
+	sum, count, err := pub.SumMatched(own, decodedPoints, decodedCiphertexts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	d, err := key.Decrypt(sum)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(70), key.DecodeSigned(d).Int64())
+
+	sum, count, err = pub.SumMatched(own, points[1:2], ciphertexts[1:2])
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	d, err = key.Decrypt(sum)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), d.Int64())
+
+	_, _, err = pub.DecodePairs([][]byte{[]byte("a")})
+	assert.Error(t, err)
+	_, _, err = pub.DecodePairs([][]byte{[]byte("a"), key.NSquare.Bytes()})
+	assert.Error(t, err)
+}
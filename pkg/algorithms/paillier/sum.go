@@ -0,0 +1,77 @@
+package paillier
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+)
+
+// The intersection-sum protocol (Private Join and Compute) runs on ECDH and
+// Paillier: host holds a value for each id and the Paillier key. Client sends
+// its encrypted ids, host sends them back re-encrypted and shuffled, together
+// with its own encrypted ids paired with the encrypted values. Client
+// re-encrypts the ids of host, adds up the values of the ones in the
+// intersection homomorphically, and host decrypts the sum only. Client learns
+// the size of the intersection, and the sum is never sent back, since a client
+// could pick a single id and learn its value.
+type SumStep = runtime.Step
+
+const (
+	StepHostRequest 	SumStep = "SumHostRequest"
+	StepClientEncrypt 	SumStep = "SumClientEncrypt"
+	StepHostReEncrypt 	SumStep = "SumHostReEncrypt"
+	StepHostEncrypt 	SumStep = "SumHostEncrypt"
+	StepClientSum 		SumStep = "SumClientSum"
+	StepShutdown		SumStep = runtime.StepShutdown
+)
+
+// EncodePairs interleaves the points and the ciphertexts of their values
+func EncodePairs(points [][]byte, ciphertexts []*big.Int) [][]byte {
+	ret := make([][]byte, 0, 2 * len(points))
+	for i, point := range points {
+		ret = append(ret, point, ciphertexts[i].Bytes())
+	}
+	return ret
+}
+
+// DecodePairs reverts EncodePairs and validates the ciphertexts
+func (s *PublicKey) DecodePairs(data [][]byte) ([][]byte, []*big.Int, error) {
+	if len(data) % 2 != 0 {
+		return nil, nil, errors.New(fmt.Sprintf("The pairs should have even length, got %d", len(data)))
+	}
+	points := make([][]byte, len(data) / 2)
+	ciphertexts := make([]*big.Int, len(data) / 2)
+	for i := range points {
+		points[i] = data[2 * i]
+		ciphertexts[i] = big.NewInt(0).SetBytes(data[2 * i + 1])
+		if err := s.Validate(ciphertexts[i]); err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Invalid ciphertext at index %d", i))
+		}
+	}
+	return points, ciphertexts, nil
+}
+
+// SumMatched adds up the ciphertexts whose points are in own, and returns the
+// rerandomized sum and the number of matched points. An empty intersection
+// gives a fresh encryption of 0.
+func (s *PublicKey) SumMatched(own [][]byte, points [][]byte, ciphertexts []*big.Int) (*big.Int, int, error) {
+	ownSet := make(map[string]bool)
+	for _, point := range own {
+		ownSet[string(point)] = true
+	}
+
+	sum, err := s.Encrypt(big.NewInt(0))
+	if err != nil {
+		return nil, 0, err
+	}
+	count := 0
+	for i, point := range points {
+		if ownSet[string(point)] {
+			sum = s.Add(sum, ciphertexts[i])
+			count++
+		}
+	}
+	return sum, count, nil
+}
@@ -0,0 +1,112 @@
+package rsa_blind
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// DefaultFDHTag is the domain-separation tag used when none is configured
+const DefaultFDHTag = "PPGI-RSA-BLIND-PSI-FDH-V1"
+
+// FullDomainHash maps a message to a uniformly distributed integer in [1, N):
+// the message is expanded to the byte length of N, the bits above the size of
+// N are cleared, and the output is rejected and expanded again with the next
+// counter while it's not in range. Every input is prefixed by the tag so the
+// hashes can't be reused by other protocols.
+type FullDomainHash struct {
+	name 		string
+	expand 		func(seed []byte, length int) []byte
+	tag 		[]byte
+}
+
+// NewFullDomainHash supports mgf1_sha256, mgf1_sha512, shake128 and shake256
+func NewFullDomainHash(name, tag string) (*FullDomainHash, error) {
+	if len(tag) == 0 {
+		tag = DefaultFDHTag
+	}
+	if len(tag) > 255 {
+		return nil, errors.New("The tag of full domain hash should be at most 255 bytes")
+	}
+
+	var expand func(seed []byte, length int) []byte
+	switch name {
+	case "mgf1_sha256":
+		expand = func(seed []byte, length int) []byte {
+			return mgf1(sha256.New, seed, length)
+		}
+	case "mgf1_sha512":
+		expand = func(seed []byte, length int) []byte {
+			return mgf1(sha512.New, seed, length)
+		}
+	case "shake128":
+		expand = func(seed []byte, length int) []byte {
+			out := make([]byte, length)
+			sha3.ShakeSum128(out, seed)
+			return out
+		}
+	case "shake256":
+		expand = func(seed []byte, length int) []byte {
+			out := make([]byte, length)
+			sha3.ShakeSum256(out, seed)
+			return out
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported full domain hash: %s", name))
+	}
+
+	// the tag is length-prefixed so that no tag is a prefix of another one
+	prefix := append([]byte{byte(len(tag))}, tag...)
+	return &FullDomainHash{
+		name: name,
+		expand: expand,
+		tag: prefix,
+	}, nil
+}
+
+func (s *FullDomainHash) Name() string {
+	return s.name
+}
+
+// Hash returns H(tag || msg || counter) in [1, N)
+func (s *FullDomainHash) Hash(msg []byte, n *big.Int) *big.Int {
+	length := (n.BitLen() + 7) / 8
+	excessBits := uint(length * 8 - n.BitLen())
+
+	seed := make([]byte, len(s.tag) + len(msg) + 4)
+	copy(seed, s.tag)
+	copy(seed[len(s.tag):], msg)
+
+	// each round is rejected with probability below 1/2
+	for counter := uint32(0); ; counter++ {
+		binary.BigEndian.PutUint32(seed[len(seed) - 4:], counter)
+		out := s.expand(seed, length)
+		out[0] &= 0xff >> excessBits
+
+		x := bytesToBigInt(out)
+		if x.Sign() > 0 && x.Cmp(n) < 0 {
+			return x
+		}
+	}
+}
+
+// mgf1 is the mask generation function of PKCS#1 v2.2, B.2.1
+func mgf1(newHash func() hash.Hash, seed []byte, length int) []byte {
+	out := make([]byte, 0, length + 64)
+	counter := make([]byte, 4)
+	h := newHash()
+	for i := uint32(0); len(out) < length; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		h.Reset()
+		h.Write(seed)
+		h.Write(counter)
+		out = h.Sum(out)
+	}
+	return out[:length]
+}
@@ -0,0 +1,68 @@
+package rsa_blind
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMGF1(t *testing.T) {
+	// the first block is sha256(seed || 0x00000000)
+	seed := []byte("1732819483")
+	first := sha256.Sum256(append(append([]byte{}, seed...), 0, 0, 0, 0))
+	out := mgf1(sha256.New, seed, 100)
+	assert.Equal(t, 100, len(out))
+	assert.Equal(t, first[:], out[:32])
+	assert.Equal(t, out[:50], mgf1(sha256.New, seed, 50))
+}
+
+func TestFullDomainHash(t *testing.T) {
+	// N = 2^1000 + 1 rejects almost every output with the top bit set
+	n := big.NewInt(0).Add(big.NewInt(0).Lsh(big.NewInt(1), 1000), big.NewInt(1))
+	for _, name := range []string{"mgf1_sha256", "mgf1_sha512", "shake128", "shake256"} {
+		fdh, err := NewFullDomainHash(name, "")
+		assert.NoError(t, err)
+		other, err := NewFullDomainHash(name, "another tag")
+		assert.NoError(t, err)
+
+		x := fdh.Hash([]byte("1732819483"), n)
+		assert.True(t, x.Sign() > 0 && x.Cmp(n) < 0)
+		assert.Equal(t, x, fdh.Hash([]byte("1732819483"), n))
+		// spread over the whole domain instead of the low 256 bits
+		assert.True(t, x.BitLen() > 900)
+		assert.NotEqual(t, x, fdh.Hash([]byte("1732819484"), n))
+		assert.NotEqual(t, x, other.Hash([]byte("1732819483"), n))
+	}
+
+	_, err := NewFullDomainHash("md5", "")
+	assert.Error(t, err)
+}
+
+func TestRSAIntersectionWithFullDomainHash(t *testing.T) {
+	fdh, err := NewFullDomainHash("shake256", "")
+	assert.NoError(t, err)
+
+	client, err := NewRSABlindIntersect(1024, "sha256", "sha256", "client")
+	assert.NoError(t, err)
+	host, err := NewRSABlindIntersect(1024, "sha256", "sha256", "host")
+	assert.NoError(t, err)
+	client.SetFullDomainHash(fdh)
+	host.SetFullDomainHash(fdh)
+
+	n, e := host.GetPubKey()
+	client.SetPubKey(n, e)
+
+	hostA := []string{"21022219911301911", "640111191119381029", "1732819483", "184", "97561890571"}
+	hostB := []string{"640111191119381029", "1732819483", "3728172745", "97561890571"}
+
+	ta := host.HostOfflineHash(hostA)
+	yb, rands, err := client.ClientBlinding(hostB)
+	assert.NoError(t, err)
+	zb := host.HostBlindSigning(yb)
+	assert.NoError(t, client.VerifyBlindSigning(yb, zb))
+	tb := client.ClientUnblinding(zb, rands)
+
+	assert.Equal(t, [][2]int{{1, 0}, {2, 1}, {4, 3}}, host.CompareIds(ta, tb))
+}
@@ -0,0 +1,102 @@
+package rsa_blind
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+// LoadPrivateKey reads a PEM-encoded RSA private key, both PKCS#8 ("PRIVATE KEY")
+// and PKCS#1 ("RSA PRIVATE KEY") blocks are accepted
+func LoadPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("No PEM block found in %s", filename))
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("The key in %s is not an RSA key", filename))
+		}
+		return privKey, privKey.Validate()
+	case "RSA PRIVATE KEY":
+		privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return privKey, privKey.Validate()
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported PEM block type: %s", block.Type))
+	}
+}
+
+// SavePrivateKey writes the private key to filename as a PKCS#8 PEM block, it
+// refuses to overwrite an existing file
+func SavePrivateKey(filename string, privKey *rsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return pem.Encode(f, &pem.Block{
+		Type: "PRIVATE KEY",
+		Bytes: der,
+	})
+}
+
+// GenerateAndSavePrivateKey generates a new key of given size and saves it to filename
+func GenerateAndSavePrivateKey(filename string, bits int) (*rsa.PrivateKey, error) {
+	privKey, _, err := generateRSAKeyPair(bits)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = SavePrivateKey(filename, privKey); err != nil {
+		return nil, err
+	}
+
+	return privKey, nil
+}
+
+// PubKeyFingerprint is KeyFingerprint on the pubkey received from message
+func PubKeyFingerprint(n []byte, e int) string {
+	return KeyFingerprint(&rsa.PublicKey{
+		N: big.NewInt(0).SetBytes(n),
+		E: e,
+	})
+}
+
+// KeyFingerprint identifies a pubkey by the sha256 of its PKIX encoding, only
+// the first 16 bytes are kept
+func KeyFingerprint(pubKey *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,59 @@
+package rsa_blind
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoadPrivateKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "host.pem")
+
+	privKey, err := GenerateAndSavePrivateKey(keyFile, 2048)
+	assert.NoError(t, err)
+
+	loaded, err := LoadPrivateKey(keyFile)
+	assert.NoError(t, err)
+	assert.True(t, privKey.Equal(loaded))
+	assert.Equal(t, KeyFingerprint(&privKey.PublicKey), KeyFingerprint(&loaded.PublicKey))
+
+	// never overwrite an existing key
+	_, err = GenerateAndSavePrivateKey(keyFile, 2048)
+	assert.Error(t, err)
+
+	// hashes produced before and after reloading the key are the same
+	host, err := NewHostRSABlindIntersect(privKey, "sha256", "md5")
+	assert.NoError(t, err)
+	reloadedHost, err := NewHostRSABlindIntersect(loaded, "sha256", "md5")
+	assert.NoError(t, err)
+	assert.Equal(t, host.GetKeyID(), reloadedHost.GetKeyID())
+	assert.Equal(t, host.HostOfflineHash([]string{"1732819483"}), reloadedHost.HostOfflineHash([]string{"1732819483"}))
+
+	// the client derives the same key id from the pubkey
+	client, err := NewRSABlindIntersect(2048, "sha256", "md5", "client")
+	assert.NoError(t, err)
+	n, e := host.GetPubKey()
+	client.SetPubKey(n, e)
+	assert.Equal(t, host.GetKeyID(), client.GetKeyID())
+	assert.Equal(t, host.GetKeyID(), PubKeyFingerprint(n, e))
+}
+
+func TestLoadPKCS1PrivateKey(t *testing.T) {
+	privKey, _, err := generateRSAKeyPair(2048)
+	assert.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "host.pem")
+	data := pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privKey),
+	})
+	assert.NoError(t, ioutil.WriteFile(keyFile, data, 0600))
+
+	loaded, err := LoadPrivateKey(keyFile)
+	assert.NoError(t, err)
+	assert.True(t, privKey.Equal(loaded))
+}
@@ -0,0 +1,219 @@
+package rsa_blind
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+)
+
+// RingKey is a key with its validity window [NotBefore, NotAfter), a zero time
+// means the window is unbounded on that side
+type RingKey struct {
+	ID 			string
+	NotBefore	time.Time
+	NotAfter	time.Time
+	Intersect 	*RSABlindIntersect
+}
+
+func (k *RingKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+func (k *RingKey) ExpiredAt(t time.Time) bool {
+	return !k.NotAfter.IsZero() && !t.Before(k.NotAfter)
+}
+
+// KeyConfig describes a host key in config file, times are in RFC 3339
+type KeyConfig struct {
+	File 		string	`mapstructure:"file"`
+	NotBefore	string	`mapstructure:"not_before"`
+	NotAfter	string	`mapstructure:"not_after"`
+}
+
+// KeyRing holds all the keys known by one side. Several keys can be valid at
+// the same time so the key can be rotated without a gap: the current key is
+// the valid one that became valid last, and the older ones are still accepted
+// until they expire
+type KeyRing struct {
+	firstHash 	string
+	secondHash 	string
+	hashers		[]hasher.Hasher
+	keys		map[string]*RingKey
+	workers		int
+	fdh			*FullDomainHash
+}
+
+func NewKeyRing(firstHash, secondHash string) *KeyRing {
+	return &KeyRing{
+		firstHash: firstHash,
+		secondHash: secondHash,
+		keys: make(map[string]*RingKey),
+		workers: DefaultWorkers(),
+	}
+}
+
+// LoadHostKeyRing loads the host keys listed in config
+func LoadHostKeyRing(configs []KeyConfig, firstHash, secondHash string) (*KeyRing, error) {
+	ring := NewKeyRing(firstHash, secondHash)
+	for _, config := range configs {
+		privKey, err := LoadPrivateKey(config.File)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to load key %s, err: %s", config.File, err))
+		}
+		intersect, err := NewHostRSABlindIntersect(privKey, firstHash, secondHash)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &RingKey{
+			ID: intersect.GetKeyID(),
+			Intersect: intersect,
+		}
+		if key.NotBefore, err = parseKeyTime(config.NotBefore); err != nil {
+			return nil, err
+		}
+		if key.NotAfter, err = parseKeyTime(config.NotAfter); err != nil {
+			return nil, err
+		}
+		if !key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore) {
+			return nil, errors.New(fmt.Sprintf("Key %s expires before it becomes valid", config.File))
+		}
+		ring.Add(key)
+	}
+	return ring, nil
+}
+
+func parseKeyTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (r *KeyRing) Add(key *RingKey) {
+	key.Intersect.SetWorkers(r.workers)
+	key.Intersect.SetFullDomainHash(r.fdh)
+	if r.hashers != nil {
+		key.Intersect.SetHashers(r.hashers[0], r.hashers[1])
+	}
+	r.keys[key.ID] = key
+}
+
+// SetWorkers sets the number of workers of all the keys, including the ones
+// added later
+func (r *KeyRing) SetWorkers(workers int) {
+	r.workers = workers
+	for _, key := range r.keys {
+		key.Intersect.SetWorkers(workers)
+	}
+}
+
+// SetFullDomainHash sets the full domain hash of all the keys, including the
+// ones added later
+func (r *KeyRing) SetFullDomainHash(fdh *FullDomainHash) {
+	r.fdh = fdh
+	for _, key := range r.keys {
+		key.Intersect.SetFullDomainHash(fdh)
+	}
+}
+
+// SetHashers replaces the hashers of all the keys, including the ones added
+// later, e.g. with keyed ones
+func (r *KeyRing) SetHashers(firstHash, secondHash hasher.Hasher) {
+	r.hashers = []hasher.Hasher{firstHash, secondHash}
+	for _, key := range r.keys {
+		key.Intersect.SetHashers(firstHash, secondHash)
+	}
+}
+
+// AddPubKey is used by client to add a pubkey announced by host
+func (r *KeyRing) AddPubKey(n []byte, e int, notBefore, notAfter time.Time) (*RingKey, error) {
+	intersect, err := NewRSABlindIntersect(0, r.firstHash, r.secondHash, "client")
+	if err != nil {
+		return nil, err
+	}
+	intersect.SetPubKey(n, e)
+
+	key := &RingKey{
+		ID: intersect.GetKeyID(),
+		NotBefore: notBefore,
+		NotAfter: notAfter,
+		Intersect: intersect,
+	}
+	r.Add(key)
+	return key, nil
+}
+
+func (r *KeyRing) Get(id string) (*RingKey, bool) {
+	key, ok := r.keys[id]
+	return key, ok
+}
+
+// GetValid returns the key only if it's valid at t
+func (r *KeyRing) GetValid(id string, t time.Time) (*RingKey, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown key: %s", id))
+	}
+	if !key.ValidAt(t) {
+		return nil, errors.New(fmt.Sprintf("Key %s is not valid at %s", id, t))
+	}
+	return key, nil
+}
+
+func (r *KeyRing) Remove(id string) {
+	delete(r.keys, id)
+}
+
+// Keys returns all the keys that are not expired at t, ordered by NotBefore
+func (r *KeyRing) Keys(t time.Time) []*RingKey {
+	keys := make([]*RingKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		if !key.ExpiredAt(t) {
+			keys = append(keys, key)
+		}
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// Expired returns the keys expired at t
+func (r *KeyRing) Expired(t time.Time) []*RingKey {
+	keys := make([]*RingKey, 0)
+	for _, key := range r.keys {
+		if key.ExpiredAt(t) {
+			keys = append(keys, key)
+		}
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// Current returns the key to use for new data at t, or nil if no key is valid
+func (r *KeyRing) Current(t time.Time) *RingKey {
+	var current *RingKey
+	for _, key := range r.Keys(t) {
+		if key.ValidAt(t) {
+			current = key
+		}
+	}
+	return current
+}
+
+func sortKeys(keys []*RingKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].NotBefore.Equal(keys[j].NotBefore) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].NotBefore.Before(keys[j].NotBefore)
+	})
+}
@@ -0,0 +1,86 @@
+package rsa_blind
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldFile := filepath.Join(dir, "old.pem")
+	newFile := filepath.Join(dir, "new.pem")
+	_, err := GenerateAndSavePrivateKey(oldFile, 1024)
+	assert.NoError(t, err)
+	_, err = GenerateAndSavePrivateKey(newFile, 1024)
+	assert.NoError(t, err)
+
+	// the two keys overlap in [2022-02-01, 2022-03-01)
+	ring, err := LoadHostKeyRing([]KeyConfig{
+		{File: oldFile, NotAfter: "2022-03-01T00:00:00Z"},
+		{File: newFile, NotBefore: "2022-02-01T00:00:00Z"},
+	}, "sha256", "sha256")
+	assert.NoError(t, err)
+
+	keys := ring.Keys(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, 2, len(keys))
+	oldKey, newKey := keys[0], keys[1]
+
+	current := ring.Current(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, oldKey.ID, current.ID)
+
+	overlap := time.Date(2022, 2, 15, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, newKey.ID, ring.Current(overlap).ID)
+	_, err = ring.GetValid(oldKey.ID, overlap)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(ring.Expired(overlap)))
+
+	// not valid before NotBefore, and expires at NotAfter
+	_, err = ring.GetValid(newKey.ID, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Error(t, err)
+	after := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	_, err = ring.GetValid(oldKey.ID, after)
+	assert.Error(t, err)
+	expired := ring.Expired(after)
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, oldKey.ID, expired[0].ID)
+
+	ring.Remove(oldKey.ID)
+	_, ok := ring.Get(oldKey.ID)
+	assert.False(t, ok)
+	_, err = ring.GetValid("unknown", after)
+	assert.Error(t, err)
+
+	// the client builds the same key from the announcement
+	clientRing := NewKeyRing("sha256", "sha256")
+	n, e := newKey.Intersect.GetPubKey()
+	clientKey, err := clientRing.AddPubKey(n, e, newKey.NotBefore, newKey.NotAfter)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey.ID, clientKey.ID)
+	assert.Equal(t, newKey.ID, clientRing.Current(after).ID)
+
+	data := []string{"640111191119381029", "1732819483"}
+	yb, rands, err := clientKey.Intersect.ClientBlinding(data)
+	assert.NoError(t, err)
+	zb := newKey.Intersect.HostBlindSigning(yb)
+	assert.NoError(t, clientKey.Intersect.VerifyBlindSigning(yb, zb))
+	assert.Equal(t, newKey.Intersect.HostOfflineHash(data), clientKey.Intersect.ClientUnblinding(zb, rands))
+}
+
+func TestLoadHostKeyRingRejectsBadWindow(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "host.pem")
+	_, err := GenerateAndSavePrivateKey(keyFile, 1024)
+	assert.NoError(t, err)
+
+	_, err = LoadHostKeyRing([]KeyConfig{
+		{File: keyFile, NotBefore: "2022-03-01T00:00:00Z", NotAfter: "2022-02-01T00:00:00Z"},
+	}, "sha256", "sha256")
+	assert.Error(t, err)
+
+	_, err = LoadHostKeyRing([]KeyConfig{
+		{File: keyFile, NotBefore: "yesterday"},
+	}, "sha256", "sha256")
+	assert.Error(t, err)
+}
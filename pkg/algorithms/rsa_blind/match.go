@@ -0,0 +1,75 @@
+package rsa_blind
+
+import (
+	"sort"
+)
+
+// CompareHashes is a hash join of ta and tb: it returns all the pairs (i, j)
+// with ta[i] == tb[j], ordered by i then j, which is the order of comparing
+// them one by one. Duplicated hashes produce every combination of their indexes.
+func CompareHashes(ta, tb [][]byte) [][2]int {
+	matcher := NewStreamMatcher()
+	matcher.AddB(tb)
+	return matcher.AddA(ta)
+}
+
+// StreamMatcher matches two sets of hashes fed in chunks of any size and in any
+// interleaving, the indexes are counted from the first chunk of each side. Each
+// pair is returned exactly once, by the call that adds its later element:
+//   - AddA returns the new pairs ordered by i then j
+//   - AddB returns the new pairs ordered by j then i
+// SortPairs puts the pairs collected from all the calls in the order of
+// CompareHashes.
+type StreamMatcher struct {
+	indexA 		map[string][]int
+	indexB 		map[string][]int
+	sizeA 		int
+	sizeB 		int
+}
+
+func NewStreamMatcher() *StreamMatcher {
+	return &StreamMatcher{
+		indexA: make(map[string][]int),
+		indexB: make(map[string][]int),
+	}
+}
+
+// AddA adds the next chunk of ta, and returns its matches with tb seen so far
+func (s *StreamMatcher) AddA(chunk [][]byte) [][2]int {
+	pairs := make([][2]int, 0)
+	for k, hash := range chunk {
+		i := s.sizeA + k
+		key := string(hash)
+		for _, j := range s.indexB[key] {
+			pairs = append(pairs, [2]int{i, j})
+		}
+		s.indexA[key] = append(s.indexA[key], i)
+	}
+	s.sizeA += len(chunk)
+	return pairs
+}
+
+// AddB adds the next chunk of tb, and returns its matches with ta seen so far
+func (s *StreamMatcher) AddB(chunk [][]byte) [][2]int {
+	pairs := make([][2]int, 0)
+	for k, hash := range chunk {
+		j := s.sizeB + k
+		key := string(hash)
+		for _, i := range s.indexA[key] {
+			pairs = append(pairs, [2]int{i, j})
+		}
+		s.indexB[key] = append(s.indexB[key], j)
+	}
+	s.sizeB += len(chunk)
+	return pairs
+}
+
+// SortPairs sorts the pairs by i then j
+func SortPairs(pairs [][2]int) {
+	sort.Slice(pairs, func(x, y int) bool {
+		if pairs[x][0] == pairs[y][0] {
+			return pairs[x][1] < pairs[y][1]
+		}
+		return pairs[x][0] < pairs[y][0]
+	})
+}
@@ -0,0 +1,78 @@
+package rsa_blind
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nestedLoopCompare is the reference: compare every pair one by one
+func nestedLoopCompare(ta, tb [][]byte) [][2]int {
+	ret := make([][2]int, 0)
+	for i, m := range ta {
+		for j, n := range tb {
+			if bytes.Equal(m, n) {
+				ret = append(ret, [2]int{i, j})
+			}
+		}
+	}
+	return ret
+}
+
+func randomHashes(r *rand.Rand, size, domain int) [][]byte {
+	hashes := make([][]byte, size)
+	for i := range hashes {
+		// a small domain produces a lot of duplicates
+		hashes[i] = []byte{byte(r.Intn(domain)), byte(r.Intn(domain))}
+	}
+	return hashes
+}
+
+func TestCompareHashes(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, domain := range []int{4, 16, 256} {
+		ta := randomHashes(r, 300, domain)
+		tb := randomHashes(r, 200, domain)
+		assert.Equal(t, nestedLoopCompare(ta, tb), CompareHashes(ta, tb))
+	}
+
+	assert.Equal(t, [][2]int{}, CompareHashes(nil, [][]byte{[]byte("a")}))
+	assert.Equal(t, [][2]int{{0, 1}, {0, 2}, {2, 1}, {2, 2}},
+		CompareHashes([][]byte{[]byte("a"), []byte("b"), []byte("a")},
+			[][]byte{[]byte("c"), []byte("a"), []byte("a")}))
+}
+
+func TestStreamMatcher(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ta := randomHashes(r, 500, 16)
+	tb := randomHashes(r, 400, 16)
+	expected := nestedLoopCompare(ta, tb)
+
+	// interleave chunks of random sizes from both sides
+	matcher := NewStreamMatcher()
+	pairs := make([][2]int, 0)
+	a, b := 0, 0
+	for a < len(ta) || b < len(tb) {
+		size := r.Intn(50) + 1
+		if b >= len(tb) || (a < len(ta) && r.Intn(2) == 0) {
+			end := a + size
+			if end > len(ta) {
+				end = len(ta)
+			}
+			pairs = append(pairs, matcher.AddA(ta[a:end])...)
+			a = end
+		} else {
+			end := b + size
+			if end > len(tb) {
+				end = len(tb)
+			}
+			pairs = append(pairs, matcher.AddB(tb[b:end])...)
+			b = end
+		}
+	}
+
+	SortPairs(pairs)
+	assert.Equal(t, expected, pairs)
+}
@@ -0,0 +1,61 @@
+package rsa_blind
+
+import (
+	goruntime "runtime"
+	"sync"
+)
+
+// minItemsPerWorker keeps small batches on the calling goroutine, where the
+// cost of spawning workers outweighs the modular exponentiations
+const minItemsPerWorker = 16
+
+// DefaultWorkers is the number of workers used when it's not configured
+func DefaultWorkers() int {
+	return goruntime.NumCPU()
+}
+
+// parallelFor calls fn(i) for every i in [0, n) on at most workers goroutines,
+// each one takes a contiguous chunk. It returns the error of the smallest index
+// that failed, other chunks are still run to the end.
+func parallelFor(n, workers int, fn func(i int) error) error {
+	if workers > n / minItemsPerWorker {
+		workers = n / minItemsPerWorker
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, workers)
+	chunk := (n + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * chunk
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				if err := fn(i); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,20 +2,86 @@ package rsa_blind
 
 import (
 	"math/big"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/binary"
 	"bytes"
+	"fmt"
 )
 
+// batchVerifyBits is the size of random exponents used in batch verification
+const batchVerifyBits = 64
+
+// minBatchVerify is the smallest batch checked with batchVerify, smaller ones
+// are checked one sign at a time
+const minBatchVerify = 32
+
+// InvalidSignError reports the first sign that fails verification
+type InvalidSignError struct {
+	Index int
+}
+
+func (e *InvalidSignError) Error() string {
+	return fmt.Sprintf("Invalid blind sign at index %d", e.Index)
+}
+
 func encryptRSA(pub *rsa.PublicKey, data *big.Int) *big.Int {
 	e := big.NewInt(int64(pub.E))
 	encrypted := big.NewInt(0).Exp(data, e, pub.N)
 	return encrypted
 }
 
+// decryptRSA takes the CRT fast path when the key is precomputed, which is
+// about 3-4x faster than the plain exponentiation with D
 func decryptRSA(priv *rsa.PrivateKey, data *big.Int) *big.Int {
-	decrypted := big.NewInt(0).Exp(data, priv.D, priv.N)
-	return decrypted
+	if canUseCRT(priv) {
+		decrypted := decryptRSACRT(priv, data)
+		// a fault in the CRT computation leaks the factors of N through the
+		// returned sign, so it's checked against the cheap public operation
+		if encryptRSA(&priv.PublicKey, decrypted).Cmp(getMod(data, priv.N)) == 0 {
+			return decrypted
+		}
+	}
+	return big.NewInt(0).Exp(data, priv.D, priv.N)
+}
+
+func canUseCRT(priv *rsa.PrivateKey) bool {
+	return len(priv.Primes) == 2 && priv.Precomputed.Dp != nil &&
+		priv.Precomputed.Dq != nil && priv.Precomputed.Qinv != nil
+}
+
+// decryptRSACRT computes m = m2 + q * (qInv * (m1 - m2) mod p), with
+// m1 = c^dp mod p and m2 = c^dq mod q
+func decryptRSACRT(priv *rsa.PrivateKey, data *big.Int) *big.Int {
+	p, q := priv.Primes[0], priv.Primes[1]
+	m1 := big.NewInt(0).Exp(data, priv.Precomputed.Dp, p)
+	m2 := big.NewInt(0).Exp(data, priv.Precomputed.Dq, q)
+	h := getMod(getMul(priv.Precomputed.Qinv, getMinus(m1, m2)), p)
+	return getAdd(m2, getMul(h, q))
+}
+
+// batchVerify runs the small exponent test of Bellare, Garay and Rabin: with
+// random r_i, it checks (prod z_i^r_i)^e = prod y_i^r_i (mod N).
+//
+// It's only a screening test. Host knows the factors of N, so it can multiply
+// a sign by an element of small order w, e.g. -1, and the batch still passes
+// when w^r_i = 1, i.e. with probability 1/2 for -1. It's only used when e has
+// more than 2 * batchVerifyBits bits and the batch has at least minBatchVerify
+// signs, an int e never has that many bits, so VerifyBlindSigning checks every
+// sign one by one with the keys of today.
+func batchVerify(pub *rsa.PublicKey, yb, zb []*big.Int) (bool, error) {
+	bound := big.NewInt(0).Lsh(big.NewInt(1), batchVerifyBits)
+	zProd := big.NewInt(1)
+	yProd := big.NewInt(1)
+	for i := range zb {
+		r, err := rand.Int(rand.Reader, bound)
+		if err != nil {
+			return false, err
+		}
+		zProd = getMod(getMul(zProd, big.NewInt(0).Exp(zb[i], r, pub.N)), pub.N)
+		yProd = getMod(getMul(yProd, big.NewInt(0).Exp(yb[i], r, pub.N)), pub.N)
+	}
+	return encryptRSA(pub, zProd).Cmp(yProd) == 0, nil
 }
 
 func crtCoefficient(p, q *big.Int) (*big.Int, *big.Int) {
@@ -1,15 +1,17 @@
 package rsa_blind
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"math/big"
 	"errors"
 	"fmt"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
 )
 
-type RSAStep string
+type RSAStep = runtime.Step
 
 const (
 	StepHostSendPubKey 	RSAStep = "HostSendPubkey"
@@ -18,18 +20,37 @@ const (
 	StepClientRcvPubKey RSAStep = "ClientReceivedPubkey"
 	StepClientBlind 	RSAStep = "ClientBlind"
 	StepClientUnblind 	RSAStep = "ClientUnblind"
-	StepExchangeData	RSAStep = "ExchangeData"
-	StepShutdown		RSAStep = "Shutdown"
+	StepHostFilter		RSAStep = "HostFilter"
+	StepHostFilterDelta	RSAStep = "HostFilterDelta"
+	StepClientRequestFilter	RSAStep = "ClientRequestFilter"
+	StepClientConfirm	RSAStep = "ClientConfirm"
+	StepHostConfirm		RSAStep = "HostConfirm"
+	StepClientCommit	RSAStep = "ClientCommit"
+	StepHostCommit		RSAStep = "HostCommit"
+	StepClientRequestProof	RSAStep = "ClientRequestProof"
+	StepHostRequestProof	RSAStep = "HostRequestProof"
+	StepClientProof		RSAStep = "ClientProof"
+	StepHostProof		RSAStep = "HostProof"
+	StepExchangeData	RSAStep = runtime.StepExchangeData
+	StepShutdown		RSAStep = runtime.StepShutdown
 )
 
 type RSABlindIntersect struct {
-	firstHash 	Hasher
-	secondHash 	Hasher
+	firstHash 	hasher.Hasher
+	secondHash 	hasher.Hasher
 	privKey		*rsa.PrivateKey
 	pubKey		*rsa.PublicKey
+	keyID		string
+	workers		int
+	fdh			*FullDomainHash
 }
 
 func NewRSABlindIntersect(bits int, firstHash, secondHash, role string) (*RSABlindIntersect, error) {
+	first, second, err := getHashers(firstHash, secondHash)
+	if err != nil {
+		return nil, err
+	}
+
 	if role == "host" {
 		privKey, pubKey, err := generateRSAKeyPair(bits)
 		if err != nil {
@@ -37,21 +58,60 @@ func NewRSABlindIntersect(bits int, firstHash, secondHash, role string) (*RSABli
 		}
 
 		return &RSABlindIntersect{
-			firstHash: getHasher(firstHash),
-			secondHash: getHasher(secondHash),
+			firstHash: first,
+			secondHash: second,
 			privKey: privKey,
 			pubKey: pubKey,
+			keyID: KeyFingerprint(pubKey),
+			workers: DefaultWorkers(),
 		}, nil
 	} else if role == "client" {
 		return &RSABlindIntersect{
-			firstHash: getHasher(firstHash),
-			secondHash: getHasher(secondHash),
+			firstHash: first,
+			secondHash: second,
+			workers: DefaultWorkers(),
 		}, nil
 	} else {
 		return nil, errors.New(fmt.Sprintf("Unsupported role: %s", role))
 	}
 }
 
+// NewHostRSABlindIntersect creates the host side with an existing private key,
+// e.g. the one loaded by LoadPrivateKey, so stored hashes stay valid across restarts
+func NewHostRSABlindIntersect(privKey *rsa.PrivateKey, firstHash, secondHash string) (*RSABlindIntersect, error) {
+	if privKey == nil {
+		return nil, errors.New("Private key of host should not be nil")
+	}
+
+	first, second, err := getHashers(firstHash, secondHash)
+	if err != nil {
+		return nil, err
+	}
+
+	privKey.Precompute()
+
+	return &RSABlindIntersect{
+		firstHash: first,
+		secondHash: second,
+		privKey: privKey,
+		pubKey: &privKey.PublicKey,
+		keyID: KeyFingerprint(&privKey.PublicKey),
+		workers: DefaultWorkers(),
+	}, nil
+}
+
+func getHashers(firstHash, secondHash string) (hasher.Hasher, hasher.Hasher, error) {
+	first, err := hasher.GetHasher(firstHash)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Invalid first hash, err: %s", err))
+	}
+	second, err := hasher.GetHasher(secondHash)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Invalid second hash, err: %s", err))
+	}
+	return first, second, nil
+}
+
 func generateRSAKeyPair(bits int) (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	privKey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
@@ -61,6 +121,33 @@ func generateRSAKeyPair(bits int) (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	return privKey, &privKey.PublicKey, nil
 }
 
+// SetWorkers sets the number of goroutines used by signing, blinding and
+// unblinding, values below 1 run them on the calling goroutine
+func (s *RSABlindIntersect) SetWorkers(workers int) {
+	s.workers = workers
+}
+
+// SetHashers replaces the hashers given by name, e.g. with keyed ones
+func (s *RSABlindIntersect) SetHashers(firstHash, secondHash hasher.Hasher) {
+	s.firstHash = firstHash
+	s.secondHash = secondHash
+}
+
+// SetFullDomainHash maps the ids into Z_N with fdh instead of taking the output
+// of firstHash as the integer to sign, both sides must use the same one. nil
+// switches back to firstHash.
+func (s *RSABlindIntersect) SetFullDomainHash(fdh *FullDomainHash) {
+	s.fdh = fdh
+}
+
+func (s *RSABlindIntersect) hashToInt(msg string) *big.Int {
+	if s.fdh != nil {
+		return s.fdh.Hash([]byte(msg), s.pubKey.N)
+	}
+	hi := s.firstHash.Sum([]byte(msg))
+	return bytesToBigInt(hi[:])
+}
+
 func (s RSABlindIntersect) HasPubKey() bool {
 	return s.pubKey != nil
 }
@@ -69,21 +156,27 @@ func (s RSABlindIntersect) GetPubKey() ([]byte, int) {
 	return s.pubKey.N.Bytes(), s.pubKey.E
 }
 
+// GetKeyID returns the fingerprint of the pubkey
+func (s RSABlindIntersect) GetKeyID() string {
+	return s.keyID
+}
+
 func (s *RSABlindIntersect) SetPubKey(n []byte, e int) {
 	s.pubKey = &rsa.PublicKey{
 		N: big.NewInt(0).SetBytes(n),
 		E: e,
 	}
+	s.keyID = KeyFingerprint(s.pubKey)
 }
 
 func (s *RSABlindIntersect) HostOfflineHash(msgs []string) [][]byte {
 	ta := make([][]byte, len(msgs))
-	for i, msg := range msgs {
-		hi := s.firstHash.Sum([]byte(msg))
-		hiEnc := decryptRSA(s.privKey, bytesToBigInt(hi[:]))
+	parallelFor(len(msgs), s.workers, func(i int) error {
+		hiEnc := decryptRSA(s.privKey, s.hashToInt(msgs[i]))
 		hiHashed := s.secondHash.Sum(hiEnc.Bytes())
 		ta[i] = hiHashed[:]
-	}
+		return nil
+	})
 	return ta
 }
 
@@ -91,45 +184,111 @@ func (s *RSABlindIntersect) ClientBlinding(msgs []string) ([]*big.Int, []*big.In
 	yb := make([]*big.Int, len(msgs))
 	rands := make([]*big.Int, len(msgs))
 
-	for i, msg := range msgs {
-		hi := s.firstHash.Sum([]byte(msg))
+	err := parallelFor(len(msgs), s.workers, func(i int) error {
+		hi := s.hashToInt(msgs[i])
 		r, err := rand.Int(rand.Reader, s.pubKey.N)
 		if err != nil {
-			return nil, nil, errors.New(fmt.Sprintf("Getting Random num failed, err: %s", err))
+			return errors.New(fmt.Sprintf("Getting Random num failed, err: %s", err))
 		}
 		rands[i] = r
 
 		rEnc := encryptRSA(s.pubKey, r)
-		yb[i] = getMod(big.NewInt(0).Mul(bytesToBigInt(hi[:]), rEnc), s.pubKey.N)
+		yb[i] = getMod(big.NewInt(0).Mul(hi, rEnc), s.pubKey.N)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 	return yb, rands, nil
 }
 
 func (s *RSABlindIntersect) HostBlindSigning(yb []*big.Int) []*big.Int {
 	zb := make([]*big.Int, len(yb))
-	for i, e := range yb {
-		zb[i] = decryptRSA(s.privKey, e)
-	}
+	parallelFor(len(yb), s.workers, func(i int) error {
+		zb[i] = decryptRSA(s.privKey, yb[i])
+		return nil
+	})
 	return zb
 }
 
+// VerifyBlindSigning checks that every signature returned by host satisfies
+// zb[i]^e = yb[i] (mod N) under the pubkey the client received, so a faulty or
+// malicious host can't corrupt the intersection silently
+func (s *RSABlindIntersect) VerifyBlindSigning(yb, zb []*big.Int) error {
+	if len(yb) != len(zb) {
+		return errors.New(fmt.Sprintf("The sizes of blinded data and signs don't match, %d vs %d", len(yb), len(zb)))
+	}
+
+	for i := range zb {
+		if zb[i] == nil || zb[i].Sign() <= 0 || zb[i].Cmp(s.pubKey.N) >= 0 {
+			return &InvalidSignError{Index: i}
+		}
+	}
+
+	// the batch test costs two exponentiations with batchVerifyBits-bit exponents
+	// per sign, it only pays off for a large e and a large batch, and it accepts
+	// some forged signs, see batchVerify, otherwise check them one by one
+	if len(zb) >= minBatchVerify && big.NewInt(int64(s.pubKey.E)).BitLen() > 2 * batchVerifyBits {
+		ok, err := batchVerify(s.pubKey, yb, zb)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		// find the bad one
+	}
+
+	for i := range zb {
+		if encryptRSA(s.pubKey, zb[i]).Cmp(getMod(yb[i], s.pubKey.N)) != 0 {
+			return &InvalidSignError{Index: i}
+		}
+	}
+
+	return nil
+}
+
 func (s *RSABlindIntersect) ClientUnblinding(zb []*big.Int, rands []*big.Int) [][]byte {
 	tb := make([][]byte, len(zb))
-	for i, e := range zb {
-		tb_array := s.secondHash.Sum(getDivMod(e, rands[i], s.pubKey.N).Bytes())
+	parallelFor(len(zb), s.workers, func(i int) error {
+		tb_array := s.secondHash.Sum(getDivMod(zb[i], rands[i], s.pubKey.N).Bytes())
 		tb[i] = tb_array[:]
-	}
+		return nil
+	})
 	return tb
 }
 
-func (s *RSABlindIntersect) CompareIds(ta, tb [][]byte) [][2]int {
-	cmp_ret := make([][2]int, 0)
-	for i, m := range ta {
-		for j, n := range tb {
-			if bytes.Compare(m[:], n[:]) == 0 {
-				cmp_ret = append(cmp_ret, [2]int{i, j})
-			}
+// DummyBlinded returns random values in [1, N), which host can't tell from
+// the blinded items, to pad a batch of client
+func (s *RSABlindIntersect) DummyBlinded(count int) ([]*big.Int, error) {
+	nMinusOne := big.NewInt(0).Sub(s.pubKey.N, big.NewInt(1))
+	ret := make([]*big.Int, count)
+	for i := range ret {
+		r, err := rand.Int(rand.Reader, nMinusOne)
+		if err != nil {
+			return nil, err
 		}
+		ret[i] = r.Add(r, big.NewInt(1))
 	}
-	return cmp_ret
+	return ret, nil
+}
+
+// DummyHashes returns random bytes of the size of the second hash, which
+// match no hash of any item, to pad the hashes sent to peer
+func (s *RSABlindIntersect) DummyHashes(count int) ([][]byte, error) {
+	size := len(s.secondHash.Sum(nil))
+	ret := make([][]byte, count)
+	for i := range ret {
+		ret[i] = make([]byte, size)
+		if _, err := rand.Read(ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// CompareIds returns all the pairs (i, j) with ta[i] == tb[j], ordered by i
+// then j, see CompareHashes
+func (s *RSABlindIntersect) CompareIds(ta, tb [][]byte) [][2]int {
+	return CompareHashes(ta, tb)
 }
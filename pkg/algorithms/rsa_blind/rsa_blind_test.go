@@ -1,7 +1,9 @@
 package rsa_blind
 
 import (
+	"fmt"
 	"testing"
+	"math/big"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,7 +13,7 @@ func TestRSAIntersection(t *testing.T) {
 	secondHash := "md5"
 	client, err := NewRSABlindIntersect(bits, firstHash, secondHash, "client")
 	assert.NoError(t, err)
-	server, err := NewRSABlindIntersect(bits, firstHash, secondHash, "server")
+	server, err := NewRSABlindIntersect(bits, firstHash, secondHash, "host")
 	assert.NoError(t, err)
 
 	n, e := server.GetPubKey()
@@ -32,6 +34,9 @@ func TestRSAIntersection(t *testing.T) {
 	// server sign
 	zb := server.HostBlindSigning(yb)
 
+	// client verifies signs
+	assert.NoError(t, client.VerifyBlindSigning(yb, zb))
+
 	// client unblinding
 	tb := client.ClientUnblinding(zb, rands)
 
@@ -41,3 +46,106 @@ func TestRSAIntersection(t *testing.T) {
 	}
 	assert.Equal(t, target, cmp_ret)
 }
+
+func TestRSAVerifyBlindSigning(t *testing.T) {
+	client, err := NewRSABlindIntersect(2048, "sha256", "md5", "client")
+	assert.NoError(t, err)
+	host, err := NewRSABlindIntersect(2048, "sha256", "md5", "host")
+	assert.NoError(t, err)
+	otherHost, err := NewRSABlindIntersect(2048, "sha256", "md5", "host")
+	assert.NoError(t, err)
+
+	n, e := host.GetPubKey()
+	client.SetPubKey(n, e)
+
+	yb, _, err := client.ClientBlinding([]string{"640111191119381029", "1732819483", "3728172745"})
+	assert.NoError(t, err)
+
+	zb := host.HostBlindSigning(yb)
+	assert.NoError(t, client.VerifyBlindSigning(yb, zb))
+
+	// one of the elements is signed with another key
+	zb[1] = otherHost.HostBlindSigning(yb[1:2])[0]
+	err = client.VerifyBlindSigning(yb, zb)
+	assert.Equal(t, &InvalidSignError{Index: 1}, err)
+
+	// a sign multiplied by -1, which the batch test accepts half of the time
+	zb = host.HostBlindSigning(yb)
+	nInt := big.NewInt(0).SetBytes(n)
+	zb[2] = big.NewInt(0).Sub(nInt, zb[2])
+	err = client.VerifyBlindSigning(yb, zb)
+	assert.Equal(t, &InvalidSignError{Index: 2}, err)
+
+	// signs are dropped
+	assert.Error(t, client.VerifyBlindSigning(yb, zb[:2]))
+}
+
+func TestRSAParallelMatchesSerial(t *testing.T) {
+	client, err := NewRSABlindIntersect(1024, "sha256", "sha256", "client")
+	assert.NoError(t, err)
+	host, err := NewRSABlindIntersect(1024, "sha256", "sha256", "host")
+	assert.NoError(t, err)
+
+	n, e := host.GetPubKey()
+	client.SetPubKey(n, e)
+
+	data := make([]string, 200)
+	for i := range data {
+		data[i] = fmt.Sprintf("%d", 1732819483 + i)
+	}
+
+	host.SetWorkers(1)
+	serial := host.HostOfflineHash(data)
+	host.SetWorkers(8)
+	client.SetWorkers(8)
+	assert.Equal(t, serial, host.HostOfflineHash(data))
+
+	yb, rands, err := client.ClientBlinding(data)
+	assert.NoError(t, err)
+	zb := host.HostBlindSigning(yb)
+	assert.NoError(t, client.VerifyBlindSigning(yb, zb))
+	assert.Equal(t, serial, client.ClientUnblinding(zb, rands))
+}
+
+func TestRSAUnknownHash(t *testing.T) {
+	_, err := NewRSABlindIntersect(1024, "sha256", "unknown", "client")
+	assert.Error(t, err)
+	_, err = NewRSABlindIntersect(1024, "unknown", "sha256", "host")
+	assert.Error(t, err)
+}
+
+func TestRSAPaddingDummies(t *testing.T) {
+	client, err := NewRSABlindIntersect(2048, "sha256", "sha256", "client")
+	assert.NoError(t, err)
+	server, err := NewRSABlindIntersect(2048, "sha256", "sha256", "host")
+	assert.NoError(t, err)
+	n, e := server.GetPubKey()
+	client.SetPubKey(n, e)
+
+	hostA := []string{"21022219911301911", "640111191119381029", "1732819483"}
+	hostB := []string{"640111191119381029", "1732819483", "3728172745"}
+
+	// the dummies of host are random hashes
+	ta := server.HostOfflineHash(hostA)
+	dummyHashes, err := server.DummyHashes(5)
+	assert.NoError(t, err)
+	for _, dummy := range dummyHashes {
+		assert.Equal(t, len(ta[0]), len(dummy))
+	}
+	ta = append(ta, dummyHashes...)
+
+	// the dummies of client are signed with the items, and dropped afterwards
+	yb, rands, err := client.ClientBlinding(hostB)
+	assert.NoError(t, err)
+	dummyBlinded, err := client.DummyBlinded(5)
+	assert.NoError(t, err)
+	for _, dummy := range dummyBlinded {
+		assert.True(t, dummy.Sign() > 0 && dummy.Cmp(client.pubKey.N) < 0)
+	}
+	zb := server.HostBlindSigning(append(yb, dummyBlinded...))
+	assert.Equal(t, len(hostB) + 5, len(zb))
+	assert.NoError(t, client.VerifyBlindSigning(yb, zb[:len(yb)]))
+	tb := client.ClientUnblinding(zb[:len(yb)], rands)
+
+	assert.Equal(t, [][2]int{{1, 0}, {2, 1}}, server.CompareIds(ta, tb))
+}
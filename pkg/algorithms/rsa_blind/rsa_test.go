@@ -29,3 +29,73 @@ func TestRSAUnofficial(t *testing.T) {
 	t.Logf("c: {%d}, decC: {%d}", c, decC.Int64())
 	assert.Equal(t, int64(c), decC.Int64())
 }
+
+func TestRSABatchVerify(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yb := make([]*big.Int, 5)
+	zb := make([]*big.Int, 5)
+	for i := range yb {
+		yb[i], err = rand.Int(rand.Reader, privkey.N)
+		assert.NoError(t, err)
+		zb[i] = decryptRSA(privkey, yb[i])
+	}
+
+	ok, err := batchVerify(&privkey.PublicKey, yb, zb)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// errors cancel out in the plain product, but not with random exponents
+	c := big.NewInt(12345)
+	zb[0] = getMod(getMul(zb[0], c), privkey.N)
+	zb[1] = getDivMod(zb[1], c, privkey.N)
+
+	ok, err = batchVerify(&privkey.PublicKey, yb, zb)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRSADecryptCRT(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, canUseCRT(privkey))
+
+	for i := 0; i < 10; i++ {
+		c, err := rand.Int(rand.Reader, privkey.N)
+		assert.NoError(t, err)
+		assert.Equal(t, big.NewInt(0).Exp(c, privkey.D, privkey.N), decryptRSACRT(privkey, c))
+		assert.Equal(t, big.NewInt(0).Exp(c, privkey.D, privkey.N), decryptRSA(privkey, c))
+	}
+
+	// a faulty precomputed value is caught and the plain path is taken
+	privkey.Precomputed.Dp = getAdd(privkey.Precomputed.Dp, big.NewInt(1))
+	c := big.NewInt(123456789)
+	assert.Equal(t, big.NewInt(0).Exp(c, privkey.D, privkey.N), decryptRSA(privkey, c))
+}
+
+func TestParallelFor(t *testing.T) {
+	for _, workers := range []int{0, 1, 4, 64} {
+		out := make([]int, 1000)
+		err := parallelFor(len(out), workers, func(i int) error {
+			out[i] = i * i
+			return nil
+		})
+		assert.NoError(t, err)
+		for i := range out {
+			assert.Equal(t, i * i, out[i])
+		}
+	}
+
+	err := parallelFor(1000, 4, func(i int) error {
+		if i == 700 || i == 300 {
+			return &InvalidSignError{Index: i}
+		}
+		return nil
+	})
+	assert.Equal(t, &InvalidSignError{Index: 300}, err)
+}
@@ -0,0 +1,435 @@
+package voprf
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+)
+
+// Verifiable OPRF in the style of RFC 9497, ciphersuite P256-SHA256. The host
+// evaluates the blinded items of the client with its secret key, and returns a
+// batched DLEQ proof showing that every item was evaluated with the key
+// behind the public key it announced, so it can't use a different key per item.
+type VOPRFStep = runtime.Step
+
+const (
+	StepHostSendPubKey 	VOPRFStep = "HostSendPubkey"
+	StepClientRcvPubKey VOPRFStep = "ClientReceivedPubkey"
+	StepClientBlind 	VOPRFStep = "ClientBlind"
+	StepHostEvaluate 	VOPRFStep = "HostEvaluate"
+	StepClientFinalize 	VOPRFStep = "ClientFinalize"
+	StepHostHash 		VOPRFStep = "HostHash"
+	StepExchangeData	VOPRFStep = runtime.StepExchangeData
+	StepShutdown		VOPRFStep = runtime.StepShutdown
+)
+
+const (
+	modeVOPRF 		= 0x01
+	suiteID 		= "P256-SHA256"
+	scalarSize		= 32
+)
+
+var ErrInvalidProof = errors.New("DLEQ proof verification failed")
+
+// ErrEmptyBatch is returned for a batch without elements, which has no proof
+var ErrEmptyBatch = errors.New("The batch is empty")
+
+// ErrBatchSize is returned when the host evaluates more or less elements than
+// it's given
+var ErrBatchSize = errors.New("Batch sizes don't match")
+
+var contextString = append([]byte("OPRFV1-"), append([]byte{modeVOPRF}, []byte("-"+suiteID)...)...)
+
+type point struct {
+	x, y *big.Int
+}
+
+type VOPRFIntersect struct {
+	curve 		elliptic.Curve
+	privKey		*big.Int
+	pubKey		*point
+}
+
+func NewVOPRFIntersect(role string) (*VOPRFIntersect, error) {
+	curve := elliptic.P256()
+	if role == "host" {
+		privKey, err := randomScalar(curve)
+		if err != nil {
+			return nil, err
+		}
+		x, y := curve.ScalarBaseMult(privKey.Bytes())
+
+		return &VOPRFIntersect{
+			curve: curve,
+			privKey: privKey,
+			pubKey: &point{x, y},
+		}, nil
+	} else if role == "client" {
+		return &VOPRFIntersect{
+			curve: curve,
+		}, nil
+	} else {
+		return nil, errors.New(fmt.Sprintf("Unsupported role: %s", role))
+	}
+}
+
+// NewHostVOPRFIntersect uses a key loaded from file, see ecdh.LoadPrivateKey,
+// so the key is kept across restarts
+func NewHostVOPRFIntersect(privKey *ecdsa.PrivateKey) (*VOPRFIntersect, error) {
+	curve := elliptic.P256()
+	if privKey.Curve != curve {
+		return nil, errors.New("The key is not on P-256")
+	}
+	return &VOPRFIntersect{
+		curve: curve,
+		privKey: privKey.D,
+		pubKey: &point{privKey.X, privKey.Y},
+	}, nil
+}
+
+func randomScalar(curve elliptic.Curve) (*big.Int, error) {
+	nMinusOne := big.NewInt(0).Sub(curve.Params().N, big.NewInt(1))
+	k, err := rand.Int(rand.Reader, nMinusOne)
+	if err != nil {
+		return nil, err
+	}
+	return k.Add(k, big.NewInt(1)), nil
+}
+
+func (s *VOPRFIntersect) HasPubKey() bool {
+	return s.pubKey != nil
+}
+
+func (s *VOPRFIntersect) GetPubKey() []byte {
+	return s.serialize(s.pubKey)
+}
+
+func (s *VOPRFIntersect) SetPubKey(pubKey []byte) error {
+	p, err := s.deserialize(pubKey)
+	if err != nil {
+		return err
+	}
+	s.pubKey = p
+	return nil
+}
+
+// GetKeyID is the fingerprint of the pubkey, see ecdh.KeyFingerprint
+func (s *VOPRFIntersect) GetKeyID() string {
+	return ecdh.KeyFingerprint(s.GetPubKey())
+}
+
+// rotationDigest binds the signature to the new pubkey
+func rotationDigest(newPubKey []byte) []byte {
+	hash := sha256.Sum256(append([]byte("ppgi-voprf-rotation-v1"), newPubKey...))
+	return hash[:]
+}
+
+// SignRotation signs the new pubkey of host with the key it replaces, so the
+// client pinned to this key can tell the rotation is made by its owner
+func (s *VOPRFIntersect) SignRotation(newPubKey []byte) ([]byte, error) {
+	privKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: s.curve,
+			X: s.pubKey.x,
+			Y: s.pubKey.y,
+		},
+		D: s.privKey,
+	}
+	return ecdsa.SignASN1(rand.Reader, privKey, rotationDigest(newPubKey))
+}
+
+// VerifyRotation checks the new pubkey is signed by the old one
+func VerifyRotation(oldPubKey, newPubKey, signature []byte) bool {
+	curve := elliptic.P256()
+	x, y := elliptic.UnmarshalCompressed(curve, oldPubKey)
+	if x == nil {
+		return false
+	}
+	return ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, rotationDigest(newPubKey), signature)
+}
+
+// Blind hashes every message to the group and multiplies it with a random blind
+func (s *VOPRFIntersect) Blind(msgs []string) ([][]byte, []*big.Int, error) {
+	blinded := make([][]byte, len(msgs))
+	blinds := make([]*big.Int, len(msgs))
+	for i, msg := range msgs {
+		blind, err := randomScalar(s.curve)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Getting Random num failed, err: %s", err))
+		}
+		inputElement, err := s.hashToGroup([]byte(msg))
+		if err != nil {
+			return nil, nil, err
+		}
+		blinds[i] = blind
+		blinded[i] = s.serialize(s.mul(inputElement, blind))
+	}
+	return blinded, blinds, nil
+}
+
+// BlindEvaluate evaluates the blinded elements with the private key, and
+// generates one proof for the whole batch
+func (s *VOPRFIntersect) BlindEvaluate(blinded [][]byte) ([][]byte, []byte, error) {
+	if len(blinded) == 0 {
+		return nil, nil, ErrEmptyBatch
+	}
+	c := make([]*point, len(blinded))
+	d := make([]*point, len(blinded))
+	evaluated := make([][]byte, len(blinded))
+	for i, ele := range blinded {
+		p, err := s.deserialize(ele)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("Invalid blinded element at index %d, err: %s", i, err))
+		}
+		c[i] = p
+		d[i] = s.mul(p, s.privKey)
+		evaluated[i] = s.serialize(d[i])
+	}
+
+	proof, err := s.generateProof(c, d)
+	if err != nil {
+		return nil, nil, err
+	}
+	return evaluated, proof, nil
+}
+
+// Finalize verifies the proof from host, then unblinds the evaluated elements
+// and hashes them with the inputs. If the proof is invalid, ErrInvalidProof is
+// returned and none of the outputs should be used, and so is ErrBatchSize if
+// the host evaluated more or less elements than it's given
+func (s *VOPRFIntersect) Finalize(msgs []string, blinds []*big.Int, blinded, evaluated [][]byte,
+		proof []byte) ([][]byte, error) {
+	if len(msgs) != len(blinds) || len(msgs) != len(blinded) || len(msgs) != len(evaluated) {
+		return nil, ErrBatchSize
+	}
+	if len(msgs) == 0 {
+		return nil, ErrEmptyBatch
+	}
+
+	c := make([]*point, len(blinded))
+	d := make([]*point, len(evaluated))
+	for i := range blinded {
+		var err error
+		if c[i], err = s.deserialize(blinded[i]); err != nil {
+			return nil, err
+		}
+		if d[i], err = s.deserialize(evaluated[i]); err != nil {
+			return nil, ErrInvalidProof
+		}
+	}
+
+	if !s.verifyProof(c, d, proof) {
+		return nil, ErrInvalidProof
+	}
+
+	n := s.curve.Params().N
+	outputs := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		blindInv := big.NewInt(0).ModInverse(blinds[i], n)
+		unblinded := s.mul(d[i], blindInv)
+		outputs[i] = s.finalizeHash([]byte(msg), s.serialize(unblinded))
+	}
+	return outputs, nil
+}
+
+// Evaluate computes the outputs of the host's own messages with its private key
+func (s *VOPRFIntersect) Evaluate(msgs []string) ([][]byte, error) {
+	outputs := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		inputElement, err := s.hashToGroup([]byte(msg))
+		if err != nil {
+			return nil, err
+		}
+		outputs[i] = s.finalizeHash([]byte(msg), s.serialize(s.mul(inputElement, s.privKey)))
+	}
+	return outputs, nil
+}
+
+func (s *VOPRFIntersect) finalizeHash(input, element []byte) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	writeWithLength(buf, input)
+	writeWithLength(buf, element)
+	buf.WriteString("Finalize")
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// generateProof generates the DLEQ proof that log_G(pubKey) == log_M(Z), where
+// M and Z are the composites of c and d
+func (s *VOPRFIntersect) generateProof(c, d []*point) ([]byte, error) {
+	m, err := s.computeComposite(c, d)
+	if err != nil {
+		return nil, err
+	}
+	z := s.mul(m, s.privKey)
+
+	r, err := randomScalar(s.curve)
+	if err != nil {
+		return nil, err
+	}
+	gx, gy := s.curve.ScalarBaseMult(r.Bytes())
+	t2 := &point{gx, gy}
+	t3 := s.mul(m, r)
+
+	challenge, err := s.challenge(m, z, t2, t3)
+	if err != nil {
+		return nil, err
+	}
+
+	n := s.curve.Params().N
+	resp := big.NewInt(0).Mod(big.NewInt(0).Sub(r, big.NewInt(0).Mul(challenge, s.privKey)), n)
+
+	proof := make([]byte, 2*scalarSize)
+	challenge.FillBytes(proof[:scalarSize])
+	resp.FillBytes(proof[scalarSize:])
+	return proof, nil
+}
+
+func (s *VOPRFIntersect) verifyProof(c, d []*point, proof []byte) bool {
+	if len(proof) != 2*scalarSize || len(c) == 0 || s.pubKey == nil {
+		return false
+	}
+	n := s.curve.Params().N
+	challenge := big.NewInt(0).SetBytes(proof[:scalarSize])
+	resp := big.NewInt(0).SetBytes(proof[scalarSize:])
+	if challenge.Cmp(n) >= 0 || resp.Cmp(n) >= 0 {
+		return false
+	}
+
+	m, z, err := s.computeComposites(c, d)
+	if err != nil {
+		return false
+	}
+
+	sgx, sgy := s.curve.ScalarBaseMult(resp.Bytes())
+	t2 := s.add(&point{sgx, sgy}, s.mul(s.pubKey, challenge))
+	t3 := s.add(s.mul(m, resp), s.mul(z, challenge))
+
+	expected, err := s.challenge(m, z, t2, t3)
+	if err != nil {
+		return false
+	}
+	return expected.Cmp(challenge) == 0
+}
+
+func (s *VOPRFIntersect) challenge(m, z, t2, t3 *point) (*big.Int, error) {
+	buf := bytes.NewBuffer([]byte{})
+	for _, p := range []*point{s.pubKey, m, z, t2, t3} {
+		writeWithLength(buf, s.serialize(p))
+	}
+	buf.WriteString("Challenge")
+	return ecdh.HashToScalar(s.curve, buf.Bytes(), s.dst("HashToScalar-"))
+}
+
+// computeComposites returns the random linear combinations M = sum(di * Ci)
+// and Z = sum(di * Di), the weights di are derived from the whole batch
+func (s *VOPRFIntersect) computeComposites(c, d []*point) (*point, *point, error) {
+	weights, err := s.compositeWeights(c, d)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var m, z *point
+	for i, w := range weights {
+		m = s.add(m, s.mul(c[i], w))
+		z = s.add(z, s.mul(d[i], w))
+	}
+	return m, z, nil
+}
+
+// computeComposite is the fast version used by the holder of the private key,
+// who derives Z from M directly
+func (s *VOPRFIntersect) computeComposite(c, d []*point) (*point, error) {
+	weights, err := s.compositeWeights(c, d)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *point
+	for i, w := range weights {
+		m = s.add(m, s.mul(c[i], w))
+	}
+	return m, nil
+}
+
+func (s *VOPRFIntersect) compositeWeights(c, d []*point) ([]*big.Int, error) {
+	if len(c) != len(d) {
+		return nil, errors.New("The sizes of blinded and evaluated elements don't match")
+	}
+
+	seedBuf := bytes.NewBuffer([]byte{})
+	writeWithLength(seedBuf, s.serialize(s.pubKey))
+	writeWithLength(seedBuf, s.dst("Seed-"))
+	seed := sha256.Sum256(seedBuf.Bytes())
+
+	weights := make([]*big.Int, len(c))
+	for i := range c {
+		buf := bytes.NewBuffer([]byte{})
+		writeWithLength(buf, seed[:])
+		binary.Write(buf, binary.BigEndian, uint16(i))
+		writeWithLength(buf, s.serialize(c[i]))
+		writeWithLength(buf, s.serialize(d[i]))
+		buf.WriteString("Composite")
+		w, err := ecdh.HashToScalar(s.curve, buf.Bytes(), s.dst("HashToScalar-"))
+		if err != nil {
+			return nil, err
+		}
+		weights[i] = w
+	}
+	return weights, nil
+}
+
+func (s *VOPRFIntersect) hashToGroup(msg []byte) (*point, error) {
+	x, y, err := ecdh.HashToCurve(s.curve, msg, s.dst("HashToGroup-"))
+	if err != nil {
+		return nil, err
+	}
+	return &point{x, y}, nil
+}
+
+func (s *VOPRFIntersect) dst(prefix string) []byte {
+	return append([]byte(prefix), contextString...)
+}
+
+func (s *VOPRFIntersect) mul(p *point, k *big.Int) *point {
+	x, y := s.curve.ScalarMult(p.x, p.y, k.Bytes())
+	return &point{x, y}
+}
+
+// add treats nil as the identity element
+func (s *VOPRFIntersect) add(p, q *point) *point {
+	if p == nil {
+		return q
+	}
+	if q == nil {
+		return p
+	}
+	x, y := s.curve.Add(p.x, p.y, q.x, q.y)
+	return &point{x, y}
+}
+
+func (s *VOPRFIntersect) serialize(p *point) []byte {
+	return elliptic.MarshalCompressed(s.curve, p.x, p.y)
+}
+
+func (s *VOPRFIntersect) deserialize(data []byte) (*point, error) {
+	x, y := elliptic.UnmarshalCompressed(s.curve, data)
+	if x == nil {
+		return nil, errors.New("Invalid group element")
+	}
+	return &point{x, y}, nil
+}
+
+func writeWithLength(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
@@ -0,0 +1,125 @@
+package voprf
+
+import (
+	"testing"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+)
+
+func TestVOPRFIntersection(t *testing.T) {
+	client, err := NewVOPRFIntersect("client")
+	assert.NoError(t, err)
+	host, err := NewVOPRFIntersect("host")
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.SetPubKey(host.GetPubKey()))
+
+	hostA := []string{"21022219911301911", "640111191119381029", "1732819483", "184", "97561890571"}
+	hostB := []string{"640111191119381029", "1732819483", "3728172745", "97561890571"}
+
+	target := [][2]int{{1, 0}, {2, 1}, {4, 3}}
+
+	ta, err := host.Evaluate(hostA)
+	assert.NoError(t, err)
+
+	blinded, blinds, err := client.Blind(hostB)
+	assert.NoError(t, err)
+
+	evaluated, proof, err := host.BlindEvaluate(blinded)
+	assert.NoError(t, err)
+
+	tb, err := client.Finalize(hostB, blinds, blinded, evaluated, proof)
+	assert.NoError(t, err)
+
+	cmpRet := make([][2]int, 0)
+	for i, a := range ta {
+		for j, b := range tb {
+			if string(a) == string(b) {
+				cmpRet = append(cmpRet, [2]int{i, j})
+			}
+		}
+	}
+	assert.Equal(t, target, cmpRet)
+}
+
+func TestVOPRFDetectsCheatingHost(t *testing.T) {
+	client, err := NewVOPRFIntersect("client")
+	assert.NoError(t, err)
+	host, err := NewVOPRFIntersect("host")
+	assert.NoError(t, err)
+	otherHost, err := NewVOPRFIntersect("host")
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.SetPubKey(host.GetPubKey()))
+
+	msgs := []string{"640111191119381029", "1732819483", "3728172745"}
+	blinded, blinds, err := client.Blind(msgs)
+	assert.NoError(t, err)
+
+	// one of the elements is evaluated with another key
+	evaluated, proof, err := host.BlindEvaluate(blinded)
+	assert.NoError(t, err)
+	otherEvaluated, _, err := otherHost.BlindEvaluate(blinded[1:2])
+	assert.NoError(t, err)
+	evaluated[1] = otherEvaluated[0]
+
+	_, err = client.Finalize(msgs, blinds, blinded, evaluated, proof)
+	assert.Equal(t, ErrInvalidProof, err)
+
+	// the whole batch is evaluated with another key, with a valid proof for that key
+	evaluated, proof, err = otherHost.BlindEvaluate(blinded)
+	assert.NoError(t, err)
+
+	_, err = client.Finalize(msgs, blinds, blinded, evaluated, proof)
+	assert.Equal(t, ErrInvalidProof, err)
+}
+
+func TestVOPRFRejectsEmptyBatch(t *testing.T) {
+	client, err := NewVOPRFIntersect("client")
+	assert.NoError(t, err)
+	host, err := NewVOPRFIntersect("host")
+	assert.NoError(t, err)
+	assert.NoError(t, client.SetPubKey(host.GetPubKey()))
+
+	_, _, err = host.BlindEvaluate(nil)
+	assert.Equal(t, ErrEmptyBatch, err)
+
+	_, err = client.Finalize(nil, nil, nil, nil, nil)
+	assert.Equal(t, ErrEmptyBatch, err)
+
+	// the host drops one of the elements
+	msgs := []string{"640111191119381029", "1732819483"}
+	blinded, blinds, err := client.Blind(msgs)
+	assert.NoError(t, err)
+	evaluated, proof, err := host.BlindEvaluate(blinded)
+	assert.NoError(t, err)
+	_, err = client.Finalize(msgs, blinds, blinded, evaluated[:1], proof)
+	assert.Equal(t, ErrBatchSize, err)
+}
+
+func TestVOPRFRotation(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "host.pem")
+	privKey, err := ecdh.GenerateAndSavePrivateKey(keyFile)
+	assert.NoError(t, err)
+	loaded, err := ecdh.LoadPrivateKey(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, privKey.D, loaded.D)
+
+	old, err := NewHostVOPRFIntersect(loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, ecdh.KeyFingerprint(old.GetPubKey()), old.GetKeyID())
+	rotated, err := NewVOPRFIntersect("host")
+	assert.NoError(t, err)
+	other, err := NewVOPRFIntersect("host")
+	assert.NoError(t, err)
+
+	signature, err := old.SignRotation(rotated.GetPubKey())
+	assert.NoError(t, err)
+	assert.True(t, VerifyRotation(old.GetPubKey(), rotated.GetPubKey(), signature))
+	// only the owner of the pinned key can rotate it, and only to the key signed
+	assert.False(t, VerifyRotation(other.GetPubKey(), rotated.GetPubKey(), signature))
+	assert.False(t, VerifyRotation(old.GetPubKey(), other.GetPubKey(), signature))
+}
@@ -25,6 +25,14 @@ type Graph struct {
 	ReverseNodeMap 	map[string]*Node
 }
 
+// ValueSource is where the value of an id is read from, either a prop of the
+// vertex with tag Name, or a prop of the edges of type Name out of the vertex
+type ValueSource struct {
+	Type 	string	`mapstructure:"type"`
+	Name 	string	`mapstructure:"name"`
+	Prop 	string	`mapstructure:"prop"`
+}
+
 // Graph data storage
 type VertexData struct{
     VID     string      `json:"vid"`
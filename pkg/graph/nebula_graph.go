@@ -451,6 +451,68 @@ func (s *NebulaReadWriter) GetSingleNeighbor(name, edge, prop string) ([]string,
     return unwrappedData, nil
 }
 
+/*
+GetValues reads the values of the given vertex ids from source, an id has
+one value for a vertex prop, and one value per edge for an edge prop. The
+values are returned as the strings of nebula values.
+*/
+func (s *NebulaReadWriter) GetValues(ids []string, source *ValueSource) (map[string][]string, error) {
+    var query string
+    switch source.Type {
+    case "vertex":
+        query = fmt.Sprintf("USE %s; FETCH PROP ON %s %s YIELD id(vertex) AS vid, properties(vertex).%s AS value;",
+                            s.graphName, source.Name, strings.Join(ids, ","), source.Prop)
+    case "edge":
+        query = fmt.Sprintf("USE %s; GO FROM %s OVER %s YIELD id($^) AS vid, properties(edge).%s AS value;",
+                            s.graphName, strings.Join(ids, ","), source.Name, source.Prop)
+    default:
+        return nil, errors.New(fmt.Sprintf("Unsupported value source type: %s", source.Type))
+    }
+
+    result, err := s.Query(query)
+    if err != nil {
+        log.WithFields(log.Fields{
+            "query": query,
+            "error": err,
+        }).Error("Failed to execute query")
+        return nil, err
+    }
+
+    ret := make(map[string][]string)
+    for i := 0; i < result.GetRowSize(); i++ {
+        row, err := result.GetRowValuesByIndex(i)
+        if err != nil {
+            log.WithFields(log.Fields{
+                "row": i,
+                "error": err,
+            }).Warn("Failed to get row from result data, skip")
+            continue
+        }
+
+        vidInt, err := getIntFromCol(row, "vid")
+        if err != nil {
+            log.WithFields(log.Fields{
+                "row_data": row,
+                "error": err,
+            }).Warn("Failed to get vid col from row, skip")
+            continue
+        }
+        vid := strconv.FormatInt(vidInt, 10)
+
+        value, err := row.GetValueByColName("value")
+        if err != nil || value.IsNull() {
+            log.WithFields(log.Fields{
+                "row_data": row,
+                "error": err,
+            }).Warn("Failed to get value col from row, skip")
+            continue
+        }
+        ret[vid] = append(ret[vid], value.String())
+    }
+
+    return ret, nil
+}
+
 // MultiQuery executes a list of queries sequentially and return a list of ResultSets
 func (s *NebulaReadWriter) MultiQuery(queryList []string) ([]*nebula.ResultSet, error) {
     session, err := s.pool.GetSession(s.username, s.password)
@@ -0,0 +1,913 @@
+package intersect
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"math/big"
+	"io/ioutil"
+	"encoding/json"
+	"gopkg.in/yaml.v2"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+)
+
+var errTampered = errors.New("The peer is flagged as tampered")
+
+// kvName stamps the key id on the names of kv entries, since the values stored
+// under different keys can't be mixed
+func kvName(name, keyID string) string {
+	if len(keyID) == 0 {
+		return name
+	}
+	return name + ":" + keyID
+}
+
+// baseRuntime holds the plumbing shared by all the intersection runtimes:
+// graph fetching, kv bookkeeping, message sending and exchanging matched data
+type baseRuntime struct {
+	role 				string
+	fetchInterval 		int
+	connTimeout			int
+	algorithm			string
+	producer 			runtime.Producer
+	consumer 			runtime.Consumer
+	kv 					runtime.KV
+	graphClient			*graph.NebulaReadWriter
+	graphDefinition		*graph.Graph
+	lastGraphFetchTime 	*time.Time
+	// canaries are synthetic ids that are never exported to the graph
+	canaries 			map[string]bool
+	// tampered is set once the peer is caught lying, no data is sent afterwards
+	tampered 			bool
+	// dispatcher routes the messages from consumer to the handlers of steps
+	dispatcher 			*runtime.Dispatcher
+	// the sessions of pubkeys announced but not acked yet
+	pendingAcks 		map[string]bool
+}
+
+func newBaseRuntime(role, algorithm string, fetchInterval int, connTimeout int,
+		producer runtime.Producer, consumer runtime.Consumer, kv runtime.KV,
+		graphClient *graph.NebulaReadWriter, graphDefinitionFn string) (baseRuntime, error) {
+
+	graphDefinition, err := readGraphDefinition(graphDefinitionFn)
+	if err != nil {
+		return baseRuntime{}, err
+	}
+
+	// the peer caught lying before a restart isn't trusted either, until the
+	// flag is cleared with ResetTampered
+	tampered, err := kv.HashGetAll("tampered")
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get tampered sessions from kv")
+		return baseRuntime{}, err
+	}
+	for sessionKey, reason := range tampered {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"reason": reason,
+		}).Error("Session was tampered by peer before")
+	}
+	if len(tampered) > 0 {
+		log.WithField("num_sessions", len(tampered)).Error("The peer is flagged as tampered, NO DATA IS SENT TO PEER " +
+			"until the flag is cleared with `ppgi -c <config> reset-tampered`")
+	}
+
+	return baseRuntime{
+		role: role,
+		fetchInterval: fetchInterval,
+		connTimeout: connTimeout,
+		algorithm: algorithm,
+		producer: producer,
+		consumer: consumer,
+		kv: kv,
+		graphClient: graphClient,
+		graphDefinition: graphDefinition,
+		tampered: len(tampered) > 0,
+		dispatcher: runtime.NewDispatcher(consumer, &kvProcessedStore{kv: kv}),
+	}, nil
+}
+
+// ResetTampered clears the tampered flag of peer, the sessions cleared are
+// returned with the reasons
+func ResetTampered(kv runtime.KV) (map[string]string, error) {
+	tampered, err := kv.HashGetAll("tampered")
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get tampered sessions from kv")
+		return nil, err
+	}
+	if err = kv.Del("tampered"); err != nil {
+		log.WithField("error", err).Error("Failed to clear tampered sessions in kv")
+		return nil, err
+	}
+	return tampered, nil
+}
+
+func readGraphDefinition(graphDefinitionFn string) (*graph.Graph, error) {
+	data, err := ioutil.ReadFile(graphDefinitionFn)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"graph_definition_fn": graphDefinitionFn,
+			"error": err,
+		}).Error("Failed to read graph definition data")
+		return nil, err
+	}
+
+	graphDefinition := graph.Graph{}
+
+	if err = yaml.Unmarshal(data, &graphDefinition); err != nil {
+		log.WithField("error", err).Error("Failed to unmarshal graph definition")
+		return nil, err
+	}
+
+	reverseMap := make(map[string]*graph.Node)
+	for i := range graphDefinition.Nodes {
+		reverseMap[graphDefinition.Nodes[i].Type] = &graphDefinition.Nodes[i]
+	}
+
+	graphDefinition.ReverseNodeMap = reverseMap
+
+	return &graphDefinition, nil
+}
+
+// fetchNewData looks up the data added to graph db since last fetch, it returns
+// false if there's nothing to process
+func (s *baseRuntime) fetchNewData() ([]string, time.Time, bool) {
+	data, newTime, err := s.lookupNewData()
+	if err != nil {
+		log.Errorf("Failed to fetch data from graph database, err: %s", err)
+		return nil, newTime, false
+	}
+
+	if len(data) == 0 {
+		var lastTime string
+		if s.lastGraphFetchTime == nil {
+			lastTime = "no start time"
+		} else {
+			lastTime = s.lastGraphFetchTime.String()
+		}
+		log.WithFields(log.Fields{
+			"start_time": lastTime,
+			"end_time": newTime,
+		}).Info("No new data found in graph database")
+		s.lastGraphFetchTime = &newTime
+		return nil, newTime, false
+	}
+
+	return data, newTime, true
+}
+
+func (s *baseRuntime) lookupNewData() ([]string, time.Time, error) {
+	totalData := make([]string, 0)
+
+	current := time.Now()
+
+	for _, node := range s.graphDefinition.Nodes {
+		data, err := s.graphClient.LookupWithTimeLimit(&node, s.lastGraphFetchTime, &current)
+		if err != nil {
+			return []string{}, time.Time{}, errors.New(fmt.Sprintf("Faield to look up node %+v in nebula graph, err: %s", node, err))
+		}
+		totalData = append(totalData, data...)
+	}
+
+	return totalData, current, nil
+}
+
+// processedTTL is how long the handled messages are remembered at least, well
+// after any redelivery of them
+const processedTTL = 24 * time.Hour
+
+// kvProcessedStore records the handled messages in kv sets. The ones of a
+// session without key are kept per session. The ones stamped with a key id are
+// kept per key and per processedTTL, so no set grows for longer than
+// processedTTL, and both the current and the previous set of the key are
+// checked. Every set expires processedTTL after it stops growing.
+type kvProcessedStore struct {
+	kv 		runtime.KV
+}
+
+// setNames returns the set to record the message in, followed by the older
+// sets to check
+func (p *kvProcessedStore) setNames(msg *runtime.Message) []string {
+	if len(msg.KeyID) == 0 {
+		return []string{kvName("processed_session", msg.SessionKey)}
+	}
+	period := time.Now().Unix() / int64(processedTTL / time.Second)
+	return []string{
+		processedSetName(msg.KeyID, period),
+		processedSetName(msg.KeyID, period - 1),
+	}
+}
+
+func processedSetName(keyID string, period int64) string {
+	return fmt.Sprintf("%s:%d", kvName("processed", keyID), period)
+}
+
+func (p *kvProcessedStore) IsProcessed(msg *runtime.Message, digest string) (bool, error) {
+	for _, name := range p.setNames(msg) {
+		ret, err := p.kv.SetCheck(name, []string{digest})
+		if err != nil {
+			return false, err
+		}
+		if ret[0] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *kvProcessedStore) MarkProcessed(msg *runtime.Message, digest string) error {
+	name := p.setNames(msg)[0]
+	if err := p.kv.SetAdd(name, []string{digest}); err != nil {
+		return err
+	}
+	ttl := processedTTL
+	if len(msg.KeyID) > 0 {
+		// the set of a key grows for up to processedTTL
+		ttl *= 2
+	}
+	return p.kv.Expire(name, ttl)
+}
+
+// SetDispatchPolicy sets what is done with the messages of steps without a
+// handler, and the timeout of handlers, 0 means no timeout
+func (s *baseRuntime) SetDispatchPolicy(unhandled string, timeout time.Duration) error {
+	if len(unhandled) > 0 {
+		if err := s.dispatcher.SetUnhandledPolicy(runtime.UnhandledPolicy(unhandled)); err != nil {
+			return err
+		}
+	}
+	s.dispatcher.SetTimeout(timeout)
+	return nil
+}
+
+// SetStepTimeout overrides the timeout of the handlers of step
+func (s *baseRuntime) SetStepTimeout(step string, timeout time.Duration) {
+	s.dispatcher.SetTimeout(timeout, runtime.Step(step))
+}
+
+// handle registers the handler of step of this algorithm
+func (s *baseRuntime) handle(step runtime.Step, handler runtime.Handler) {
+	s.dispatcher.Handle(s.algorithm, step, handler)
+}
+
+// onFetch runs task every fetch interval, once all the pubkeys announced are
+// acked
+func (s *baseRuntime) onFetch(task runtime.Task) {
+	s.dispatcher.Every(time.Duration(s.fetchInterval) * time.Second, func() error {
+		if len(s.pendingAcks) > 0 {
+			log.Info("Host's waiting for ack of pubkey from client, skip")
+			return nil
+		}
+		log.Info("Fetch data from graph database periodically")
+		return task()
+	})
+}
+
+// sendShutdown tells the peer to abort, the reason is carried in the data field
+func (s *baseRuntime) sendShutdown(sessionKey string, reason string) {
+	if err := s.producer.SendStruct(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: runtime.StepShutdown,
+		SessionKey: sessionKey,
+		Data: [][]byte{[]byte(reason)},
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"connection_info": s.producer.GetConnectionInfo(),
+			"session_key": sessionKey,
+			"error": err,
+		}).Fatal("Failed to send shutdown message")
+	}
+}
+
+// handleShutdown is called when the peer aborts, the returned error should
+// stop the runtime
+func (s *baseRuntime) handleShutdown(msg *runtime.Message) error {
+	reason := "unknown"
+	if len(msg.Data) > 0 {
+		reason = string(msg.Data[0])
+	}
+	err := errors.New(fmt.Sprintf("Peer aborted the session, reason: %s", reason))
+	log.WithFields(log.Fields{
+		"session_key": msg.SessionKey,
+		"error": err,
+	}).Error("Received shutdown message")
+	return err
+}
+
+// stopOnShutdown is the handler of StepShutdown, which stops the runtime
+func (s *baseRuntime) stopOnShutdown(msg *runtime.Message) error {
+	return runtime.Stop(s.handleShutdown(msg))
+}
+
+func (s *baseRuntime) sendMessageOrError(msg *runtime.Message) error {
+	if err := s.producer.SendStruct(msg); err != nil {
+		log.WithFields(log.Fields{
+			"connection_info": s.producer.GetConnectionInfo(),
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to send message to mq")
+		return err
+	}
+	return nil
+}
+
+func (s *baseRuntime) sendOriginData(keyID, sessionKey string, data []string) error {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to marshal data to json")
+		return err
+	}
+
+	if err = s.kv.HashPut(kvName("origin_data", keyID), map[string]string{sessionKey: string(encodedData)}); err != nil {
+		log.WithFields(log.Fields{
+			"data": data,
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to send rands to kv")
+		return err
+	}
+
+	return nil
+}
+
+func (s *baseRuntime) getOriginData(keyID, sessionKey string) ([]string, error) {
+	dataStr, err := s.kv.HashGet(kvName("origin_data", keyID), sessionKey);
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to get origin data from kv")
+		return []string{}, err
+	}
+
+	data := make([]string, 0)
+	if err = json.Unmarshal([]byte(dataStr), &data); err != nil {
+		log.WithFields(log.Fields{
+			"data_str": dataStr,
+			"error": err,
+		}).Error("Failed to unmarshal original data")
+		return []string{}, err
+	}
+
+	return data, nil
+}
+
+func (s *baseRuntime) delOriginData(keyID, sessionKey string) error {
+	if err := s.kv.HashDel(kvName("origin_data", keyID), []string{sessionKey}); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to delete used origin data from kv")
+		return err
+	}
+	return nil
+}
+
+func (s *baseRuntime) getRands(keyID, sessionKey string) ([]*big.Int, error) {
+	randsStr, err := s.kv.HashGet(kvName("rand", keyID), sessionKey)
+	if err != nil {
+		log.WithField("error", err).Warning("Failed to get rands from kv")
+		return []*big.Int{}, err
+	}
+
+	rands := make([]*big.Int, 0)
+
+	if err := json.Unmarshal([]byte(randsStr), &rands); err != nil {
+		log.WithFields(log.Fields{
+			"rands_str": randsStr,
+			"error": err,
+		}).Warning("Failed to unmarshal rand message")
+		return []*big.Int{}, err
+	}
+
+	return rands, nil
+}
+
+func (s *baseRuntime) sendRands(keyID, sessionKey string, rands []*big.Int) error {
+	encodedRands, err := json.Marshal(rands)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to marshal rands to json")
+		return err
+	}
+
+	if err = s.kv.HashPut(kvName("rand", keyID), map[string]string{sessionKey: string(encodedRands)}); err != nil {
+		log.WithField("error", err).Error("Failed to send rands to kv")
+		return err
+	}
+
+	return nil
+}
+
+func (s *baseRuntime) delRands(keyID, sessionKey string) error {
+	if err := s.kv.HashDel(kvName("rand", keyID), []string{sessionKey}); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to delete used rands from kv")
+		return err
+	}
+	return nil
+}
+
+func (s *baseRuntime) sendBlindedData(keyID, sessionKey string, blinded [][]byte) error {
+	encoded, err := json.Marshal(blinded)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to marshal blinded data to json")
+		return err
+	}
+
+	if err = s.kv.HashPut(kvName("blinded_data", keyID), map[string]string{sessionKey: string(encoded)}); err != nil {
+		log.WithField("error", err).Error("Failed to send blinded data to kv")
+		return err
+	}
+
+	return nil
+}
+
+func (s *baseRuntime) getBlindedData(keyID, sessionKey string) ([][]byte, error) {
+	dataStr, err := s.kv.HashGet(kvName("blinded_data", keyID), sessionKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to get blinded data from kv")
+		return [][]byte{}, err
+	}
+
+	blinded := make([][]byte, 0)
+	if err = json.Unmarshal([]byte(dataStr), &blinded); err != nil {
+		log.WithFields(log.Fields{
+			"data_str": dataStr,
+			"error": err,
+		}).Error("Failed to unmarshal blinded data")
+		return [][]byte{}, err
+	}
+
+	return blinded, nil
+}
+
+func (s *baseRuntime) delBlindedData(keyID, sessionKey string) error {
+	if err := s.kv.HashDel(kvName("blinded_data", keyID), []string{sessionKey}); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to delete used blinded data from kv")
+		return err
+	}
+	return nil
+}
+
+func (s *baseRuntime) createAndSendHashIDMap(keyID string, data []string, hash [][]byte) error {
+	hashIDMap := make(map[string]string)
+
+	if len(data) != len(hash) {
+		err := errors.New("The sizes of original data and hash don't match")
+		log.WithFields(log.Fields{
+			"original_data": data,
+			"hash": hash,
+			"error": err,
+		}).Error()
+		return err
+	}
+
+	for i, ele := range data {
+		hashIDMap[string(hash[i])] = ele
+	}
+
+	// send to kv
+	if err := s.kv.HashPut(kvName("hash_id_map", keyID), hashIDMap); err != nil {
+		log.WithField("error", err).Error("Failed to put HashIDMap to kv")
+		return err
+	}
+
+	return nil
+}
+
+// getHashIDMap returns all the hashes stored under the key, with their ids
+func (s *baseRuntime) getHashIDMap(keyID string) (map[string]string, error) {
+	hashIDMap, err := s.kv.HashGetAll(kvName("hash_id_map", keyID))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key_id": keyID,
+			"error": err,
+		}).Error("Failed to get stored hashes from kv")
+		return nil, err
+	}
+	return hashIDMap, nil
+}
+
+// scanStoredIDs pages through the hashes stored under the key with HSCAN and
+// calls fn with the ids of every page. An id may show up in more than one page.
+func (s *baseRuntime) scanStoredIDs(keyID string, count int64, fn func(ids []string) error) error {
+	cursor := uint64(0)
+	for {
+		page, next, err := s.kv.HashScan(kvName("hash_id_map", keyID), cursor, count)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"key_id": keyID,
+				"error": err,
+			}).Error("Failed to scan stored hashes in kv")
+			return err
+		}
+
+		idSet := make(map[string]bool)
+		ids := make([]string, 0, len(page))
+		for _, id := range page {
+			if !idSet[id] {
+				idSet[id] = true
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			if err = fn(ids); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// dropKeyData deletes everything stored under the key
+func (s *baseRuntime) dropKeyData(keyID string) error {
+	// the processed records under the key expire by themselves
+	for _, name := range []string{"hash_id_map", "rand", "origin_data", "blinded_data", "commitment", "peer_commitment"} {
+		if err := s.kv.Del(kvName(name, keyID)); err != nil {
+			log.WithFields(log.Fields{
+				"key_id": keyID,
+				"name": name,
+				"error": err,
+			}).Error("Failed to drop data stored under key")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *baseRuntime) getMatchedId(keyID string, hash []string) ([]string, error) {
+	ret, err := s.kv.HashMultiGet(kvName("hash_id_map", keyID), hash)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hash": hash,
+			"error": err,
+		}).Error("Failed to get matched id")
+		return []string{}, err
+	}
+
+	data, _ := runtime.GetExistingStringAndIndex(ret)
+
+	if len(data) == 0 {
+		msg := "No hash matched"
+		log.WithField("hash", hash).Warn(msg)
+		return []string{}, errors.New(msg)
+	}
+
+	return data, nil
+}
+
+func (s *baseRuntime) sendMatchedId(data []string) error {
+	if err := s.kv.SetAdd("matched_data", data); err != nil {
+		log.WithFields(log.Fields{
+			"data": data,
+			"error": err,
+		}).Error("Send matched id to kv set failed")
+		return err
+	}
+	return nil
+}
+
+func getMapKeys(m map[string][]int) []string {
+	j := 0
+	rets := make([]string, len(m))
+	for k := range m {
+		rets[j] = k
+		j++
+	}
+	return rets
+}
+
+func (s *baseRuntime) matchIDAndSendData(msg *runtime.Message) error {
+	hash := make([]string, len(msg.Data))
+	for i, ele := range msg.Data {
+		hash[i] = string(ele)
+	}
+
+	// get matched ids
+	matchedID, err := s.getMatchedId(msg.KeyID, hash)
+	if err != nil {
+		return err
+	}
+
+	return s.sendDataOfIDs(msg.SessionKey, msg.KeyID, matchedID)
+}
+
+// sendDataOfIDs records the matched ids, and sends their neighboring vertices
+// and edges to peer
+func (s *baseRuntime) sendDataOfIDs(sessionKey, keyID string, matchedID []string) error {
+	if s.tampered {
+		log.WithField("session_key", sessionKey).Warning("The peer is flagged as tampered, no data is sent")
+		return errTampered
+	}
+	matchedID = s.dropCanaries(matchedID)
+
+	// add matched ids to kv set
+	if err := s.sendMatchedId(matchedID); err != nil {
+		return err
+	}
+
+	// get neighboring vertices and edges
+	vertices, err := s.graphClient.GetAllNeighborVertices(matchedID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"ids": matchedID,
+			"error": err,
+		}).Error("Failed to get neighboring vertices")
+		return err
+	}
+
+	edges, err := s.graphClient.GetAllNeighborEdges(matchedID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"ids": matchedID,
+			"error": err,
+		}).Error("Failed to get neighboring edges")
+		return err
+	}
+
+	// filter non-matched vertices
+	vertexVIDs := make([]string, len(vertices))
+	j := 0
+	for k := range vertices {
+		vertexVIDs[j] = k
+		j++
+	}
+
+	checkResult, err := s.kv.SetCheck("matched_data", vertexVIDs)
+	if err != nil {
+		return err
+	}
+
+	matchedVIDs := make(map[string]interface{})
+	for i, flag := range checkResult {
+		if flag {
+			matchedVIDs[vertexVIDs[i]] = nil
+		}
+	}
+
+	matchedVertices := make([]*graph.VertexData, 0)
+	for k, v := range vertices {
+		if _, ok := matchedVIDs[k]; ok {
+			vertex := v
+			matchedVertices = append(matchedVertices, &vertex)
+		}
+	}
+
+	matchedEdges := make([]*graph.EdgeData, 0)
+	for i := range edges {
+		_, srcOk := matchedVIDs[edges[i].Source]
+		_, dstOk := matchedVIDs[edges[i].Destination]
+		if srcOk && dstOk {
+			matchedEdges = append(matchedEdges, &edges[i])
+		}
+	}
+
+	// send to host
+	verticesEncoded, err := json.Marshal(matchedVertices)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"vertices": matchedVertices,
+			"error": err,
+		}).Error("Failed to marshal matched vertices to json")
+		return err
+	}
+
+	edgesEncoded, err := json.Marshal(matchedEdges)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"edges": matchedEdges,
+			"error": err,
+		}).Error("Failed to marshal matched edges to json")
+		return err
+	}
+
+	graphEncoded, err := json.Marshal(s.graphDefinition)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"graph_definition": s.graphDefinition,
+			"error": err,
+		}).Error("Failed to marshal matched graph definition to json")
+		return err
+	}
+
+	if err := s.producer.SendStruct(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: runtime.StepExchangeData,
+		SessionKey: sessionKey,
+		KeyID: keyID,
+		Data: [][]byte{graphEncoded, verticesEncoded, edgesEncoded},
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"connection_info": s.producer.GetConnectionInfo(),
+			"error": err,
+		}).Error("Failed to send matched data through mq")
+		return err
+	}
+
+	log.Info("Finished matching ids and sent matched data")
+	return nil
+}
+
+func (s *baseRuntime) loadDataToGraphDB(msg *runtime.Message) error {
+	data := msg.Data
+	if len(data) != 3 {
+		log.WithField("message", msg).Error("The data field of StepExchangeData message has wrong format")
+		return errors.New("Wrong data field")
+	}
+
+	_, verticesEncoded, edgesEncoded := data[0], data[1], data[2]
+	vertices := make([]graph.VertexData, 0)
+	edges := make([]graph.EdgeData, 0)
+
+	if err := json.Unmarshal(verticesEncoded, &vertices); err != nil {
+		log.WithFields(log.Fields{
+			"encoded_vertices": verticesEncoded,
+			"error": err,
+		}).Error("Failed to unmarshal json-encoded vertices")
+		return err
+	}
+
+	if err := json.Unmarshal(edgesEncoded, &edges); err != nil {
+		log.WithFields(log.Fields{
+			"encoded_edges": edgesEncoded,
+			"error": err,
+		}).Error("Failed to unmarshal json-encoded edges")
+		return err
+	}
+
+	// canaries never go to the graph, even if the peer sends them
+	if len(s.canaries) > 0 {
+		kept := vertices[:0]
+		for _, vertex := range vertices {
+			if !s.canaries[vertex.VID] {
+				kept = append(kept, vertex)
+			}
+		}
+		vertices = kept
+
+		keptEdges := edges[:0]
+		for _, edge := range edges {
+			if !s.canaries[edge.Source] && !s.canaries[edge.Destination] {
+				keptEdges = append(keptEdges, edge)
+			}
+		}
+		edges = keptEdges
+	}
+
+	// add vertices and edges
+	// TODO(knwng): consider the situation when the definitions of two graphs are different
+	if err := s.graphClient.AddVertexData(vertices); err != nil {
+		return err
+	}
+
+	if err := s.graphClient.AddEdgeData(edges); err != nil {
+		return err
+	}
+
+	log.Info("Data loaded to graph db")
+
+	return nil
+}
+
+// getLastKeyID returns the id of the key the stored hashes were last computed
+// with, or "" if there's none
+func (s *baseRuntime) getLastKeyID() (string, error) {
+	lastKeyID, err := s.kv.Get("key_id")
+	if err != nil {
+		if runtime.IsNotFound(err) {
+			return "", nil
+		}
+		log.WithField("error", err).Error("Failed to get key id from kv")
+		return "", err
+	}
+	return lastKeyID, nil
+}
+
+func (s *baseRuntime) putKeyID(keyID string) error {
+	if err := s.kv.Put("key_id", keyID); err != nil {
+		log.WithFields(log.Fields{
+			"key_id": keyID,
+			"error": err,
+		}).Error("Failed to put key id to kv")
+		return err
+	}
+	log.WithField("key_id", keyID).Info("Key id recorded")
+	return nil
+}
+
+// sendPubKeyAndWaitAck announces every key in its own message. The messages
+// are dispatched as usual while the acks are awaited, but no data is fetched
+// until all of them are acked, then onAcked is called. The runtime fails if
+// they're not acked in time. The proof, if any, is attached to every message.
+func (s *baseRuntime) sendPubKeyAndWaitAck(step, ackStep runtime.Step, onAcked func(), proof []byte, keys ...runtime.Key) {
+	log.WithField("num_keys", len(keys)).Info("Host send pubkey to client")
+	s.pendingAcks = make(map[string]bool)
+	for _, key := range keys {
+		sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+
+		// TODO(knwng): need to retry here
+		if err := s.producer.SendStruct(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: step,
+			SessionKey: sessionKey,
+			Key: key,
+			KeyID: key.ID,
+			Proof: proof,
+		}); err != nil {
+			log.WithField("error", err).Fatal("Host failed to send pubkey")
+		}
+		s.pendingAcks[sessionKey] = true
+	}
+
+	s.handle(ackStep, func(msg *runtime.Message) error {
+		if !s.pendingAcks[msg.SessionKey] {
+			// consume reluctant pubkey ack message
+			log.Info("Host received pubkey ack from client after key exchange, skip")
+			return nil
+		}
+		delete(s.pendingAcks, msg.SessionKey)
+		if len(s.pendingAcks) == 0 {
+			log.Info("Host received all the acks of pubkey")
+			if onAcked != nil {
+				onAcked()
+			}
+		}
+		return nil
+	})
+
+	log.Info("Host's waiting for ack of pubkey from client")
+	s.dispatcher.After(time.Duration(s.connTimeout) * time.Second, func() error {
+		if len(s.pendingAcks) == 0 {
+			return nil
+		}
+		log.WithField("session_keys", getBoolMapKeys(s.pendingAcks)).
+			Error("Host didn't receive client's ack after sending pubkey")
+		return runtime.Stop(errors.New("The pubkey is not acked in time"))
+	})
+}
+
+func getBoolMapKeys(m map[string]bool) []string {
+	rets := make([]string, 0, len(m))
+	for k := range m {
+		rets = append(rets, k)
+	}
+	return rets
+}
+
+func bytesSliceToStringSlice(data [][]byte) []string {
+	ret := make([]string, len(data))
+	for i, ele := range data {
+		ret[i] = string(ele)
+	}
+	return ret
+}
+
+func stringSliceToBytesSlice(data []string) [][]byte {
+	ret := make([][]byte, len(data))
+	for i, ele := range data {
+		ret[i] = []byte(ele)
+	}
+	return ret
+}
+
+func (s *baseRuntime) dropCanaries(ids []string) []string {
+	if len(s.canaries) == 0 {
+		return ids
+	}
+	kept := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !s.canaries[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// flagTampered records the session the peer is caught lying in, and stops
+// sending data to the peer
+func (s *baseRuntime) flagTampered(sessionKey, reason string) {
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"reason": reason,
+	}).Error("The session is tampered by peer, stop sending data")
+	s.tampered = true
+	if err := s.kv.HashPut("tampered", map[string]string{sessionKey: reason}); err != nil {
+		log.WithField("error", err).Error("Failed to put tampered session to kv")
+	}
+}
@@ -0,0 +1,95 @@
+package intersect
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+)
+
+// recordCardinality counts the new matches between the final hashes of one
+// side and the ones of the other side seen so far. The hashes are kept in kv
+// sets without any id, the count of the session is exported to the kv hash
+// "cardinality" and the running total to "cardinality_total".
+func (s *baseRuntime) recordCardinality(sessionKey string, hashes [][]byte, own bool) (int, error) {
+	selfSet, peerSet := "cardinality_own", "cardinality_peer"
+	if !own {
+		selfSet, peerSet = peerSet, selfSet
+	}
+
+	// duplicated items are counted once
+	members := make([]string, 0, len(hashes))
+	memberSet := make(map[string]bool)
+	for _, hash := range hashes {
+		if !memberSet[string(hash)] {
+			memberSet[string(hash)] = true
+			members = append(members, string(hash))
+		}
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	seen, err := s.kv.SetCheck(selfSet, members)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to check hashes in kv")
+		return 0, err
+	}
+	newMembers := make([]string, 0, len(members))
+	for i, member := range members {
+		if !seen[i] {
+			newMembers = append(newMembers, member)
+		}
+	}
+	if len(newMembers) == 0 {
+		return 0, nil
+	}
+
+	matched, err := s.kv.SetCheck(peerSet, newMembers)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to check hashes in kv")
+		return 0, err
+	}
+	count := 0
+	for _, flag := range matched {
+		if flag {
+			count++
+		}
+	}
+
+	if err = s.kv.SetAdd(selfSet, newMembers); err != nil {
+		log.WithField("error", err).Error("Failed to add hashes to kv")
+		return 0, err
+	}
+
+	total := 0
+	totalStr, err := s.kv.Get("cardinality_total")
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get cardinality from kv")
+		return 0, err
+	}
+	if err == nil {
+		if total, err = strconv.Atoi(totalStr); err != nil {
+			log.WithField("cardinality_total", totalStr).Error("Cardinality stored in kv is not a number")
+			return 0, err
+		}
+	}
+	total += count
+
+	if err = s.kv.HashPut("cardinality", map[string]string{sessionKey: strconv.Itoa(count)}); err != nil {
+		log.WithField("error", err).Error("Failed to put cardinality to kv")
+		return 0, err
+	}
+	if err = s.kv.Put("cardinality_total", strconv.Itoa(total)); err != nil {
+		log.WithField("error", err).Error("Failed to put cardinality to kv")
+		return 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"cardinality": count,
+		"cardinality_total": total,
+	}).Info("Intersection cardinality updated")
+	return count, nil
+}
@@ -0,0 +1,331 @@
+package intersect
+
+import (
+	"fmt"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+)
+
+// ECDHRuntime runs the ECDH-based PSI, each side encrypts its own items and
+// the peer re-encrypts them, so no key exchange is needed before the rounds.
+//
+// In cardinality mode only the client learns the size of the intersection:
+// the host shuffles the client's items after re-encrypting them, and the
+// client finalizes the host's items by itself, so no hash can be linked to an
+// id and no data is exchanged.
+//
+// In threshold mode the matched ids of a session are only revealed when there
+// are at least threshold of them, see ecdh_threshold.go. In labeled mode client
+// gets the labels of the matched ids instead, see ecdh_labeled.go.
+type ECDHRuntime struct {
+	baseRuntime
+	intersect 			*ecdh.ECDHIntersect
+	mode 				string
+	threshold 			int
+	// the peer sessions waiting for the verdict, and the own sessions being
+	// judged by peer in threshold mode
+	pending 			map[string]*thresholdSession
+	owned 				map[string]*ownThresholdSession
+	// where host reads the labels from in labeled mode
+	labelSource 		*graph.ValueSource
+}
+
+func NewECDHRuntime(role string, fetchInterval int, connTimeout int,
+		intersect *ecdh.ECDHIntersect, mode string, producer runtime.Producer,
+		consumer runtime.Consumer, kv runtime.KV, graphClient *graph.NebulaReadWriter,
+		graphDefinitionFn string) (*ECDHRuntime, error) {
+
+	mode, ok := checkMode(mode, ModeCardinality, ModeThreshold, ModeLabeled)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported mode of ecdh: %s", mode))
+	}
+
+	base, err := newBaseRuntime(role, "ecdh", fetchInterval, connTimeout,
+		producer, consumer, kv, graphClient, graphDefinitionFn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECDHRuntime{
+		baseRuntime: base,
+		intersect: intersect,
+		mode: mode,
+		pending: make(map[string]*thresholdSession),
+		owned: make(map[string]*ownThresholdSession),
+	}, nil
+}
+
+// ecdhKeyedState lists what's computed with the private key, none of it
+// matches anymore once the key changes
+var ecdhKeyedState = []string{"hash_id_map", "cardinality_own", "cardinality_peer",
+	"cardinality_total", "cardinality", thresholdOwnKey, "host_labels", "label_keys"}
+
+// dropStaleState clears the state stored under another key, it happens when
+// no algorithm.key_file is configured or the key file is replaced
+func (s *ECDHRuntime) dropStaleState() error {
+	keyID := s.intersect.GetKeyID()
+	lastKeyID, err := s.getLastKeyID()
+	if err != nil {
+		return err
+	}
+	if lastKeyID == keyID {
+		return nil
+	}
+
+	if len(lastKeyID) > 0 {
+		log.WithFields(log.Fields{
+			"last_key_id": lastKeyID,
+			"key_id": keyID,
+		}).Warn("Key changed, drop the state stored under the old key")
+		for _, name := range ecdhKeyedState {
+			if err = s.kv.Del(name); err != nil {
+				log.WithFields(log.Fields{
+					"name": name,
+					"error": err,
+				}).Error("Failed to drop state stored under the old key")
+				return err
+			}
+		}
+	}
+	return s.putKeyID(keyID)
+}
+
+func (s *ECDHRuntime) Run() error {
+	if err := s.dropStaleState(); err != nil {
+		return err
+	}
+
+	if s.mode == ModeCardinality {
+		if s.role == "client" {
+			return s.runCardinalityClient()
+		} else if s.role == "host" {
+			return s.runCardinalityHost()
+		}
+	}
+
+	if s.mode == ModeThreshold {
+		if s.threshold <= 0 {
+			return errNoThreshold
+		}
+		if s.role == "client" {
+			return s.runThresholdClient()
+		} else if s.role == "host" {
+			return s.runThresholdHost()
+		}
+	}
+
+	if s.mode == ModeLabeled {
+		if s.role == "client" {
+			return s.runLabeledClient()
+		} else if s.role == "host" {
+			return s.runLabeledHost()
+		}
+	}
+
+	if s.role == "client" {
+		return s.runClient()
+	} else if s.role == "host" {
+		return s.runHost()
+	} else {
+		return errors.New(fmt.Sprintf("Unsupported role: %s", s.role))
+	}
+}
+
+func (s *ECDHRuntime) runClient() error {
+	return s.run(ecdh.StepClientEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepHostReEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to hash the items re-encrypted by host")
+			return s.finalizeOwnItems(msg, ecdh.StepClientHash)
+		},
+		ecdh.StepHostEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to re-encrypt the items from host")
+			return s.reEncryptPeerItems(msg, ecdh.StepClientReEncrypt)
+		},
+		ecdh.StepHostHash: func(msg *runtime.Message) error {
+			log.Info("Client starts to compare hash from host")
+			return s.matchIDAndSendData(msg)
+		},
+	})
+}
+
+func (s *ECDHRuntime) runHost() error {
+	return s.run(ecdh.StepHostEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepClientReEncrypt: func(msg *runtime.Message) error {
+			log.Info("Host starts to hash the items re-encrypted by client")
+			return s.finalizeOwnItems(msg, ecdh.StepHostHash)
+		},
+		ecdh.StepClientEncrypt: func(msg *runtime.Message) error {
+			log.Info("Host starts to re-encrypt the items from client")
+			return s.reEncryptPeerItems(msg, ecdh.StepHostReEncrypt)
+		},
+		ecdh.StepClientHash: func(msg *runtime.Message) error {
+			log.Info("Host starts to compare hash from client")
+			return s.matchIDAndSendData(msg)
+		},
+	})
+}
+
+func (s *ECDHRuntime) runCardinalityClient() error {
+	return s.run(ecdh.StepClientEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepHostReEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to count its items shuffled by host")
+			_, err := s.recordCardinality(msg.SessionKey, s.intersect.Finalize(msg.Data), true)
+			return err
+		},
+		ecdh.StepHostEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to count the items from host")
+			reEncrypted, err := s.intersect.ReEncrypt(msg.Data)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"session_key": msg.SessionKey,
+					"error": err,
+				}).Error("Failed to re-encrypt the items from host")
+				return err
+			}
+			_, err = s.recordCardinality(msg.SessionKey, s.intersect.Finalize(reEncrypted), false)
+			return err
+		},
+	})
+}
+
+func (s *ECDHRuntime) runCardinalityHost() error {
+	return s.run(ecdh.StepHostEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepClientEncrypt: func(msg *runtime.Message) error {
+			log.Info("Host starts to re-encrypt and shuffle the items from client")
+			return s.reEncryptPeerItems(msg, ecdh.StepHostReEncrypt)
+		},
+	})
+}
+
+// run registers the handlers shared by both roles, since the protocol is
+// symmetric, and dispatches the messages. New data is encrypted with
+// encryptStep, or sealed as labels by host in labeled mode.
+func (s *ECDHRuntime) run(encryptStep runtime.Step, handlers map[runtime.Step]func(*runtime.Message) error) error {
+	s.onFetch(func() error {
+		if s.mode == ModeThreshold {
+			// close the sessions not met in time
+			s.judgePendingSessions()
+		}
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
+
+		var err error
+		if encryptStep == ecdh.StepHostLabels {
+			err = s.sealAndSendLabels(data)
+		} else {
+			err = s.encryptOwnItems(data, encryptStep)
+		}
+		if err != nil {
+			return err
+		}
+
+		s.lastGraphFetchTime = &newTime
+		log.WithField("role", s.role).Info("Got new data from db, encrypted it and sent it to peer")
+		return nil
+	})
+
+	s.handle(ecdh.StepExchangeData, func(msg *runtime.Message) error {
+		if s.mode == ModeCardinality || s.mode == ModeLabeled {
+			log.WithField("session_key", msg.SessionKey).Warning("No data is exchanged in this mode, drop it")
+			return nil
+		}
+		// load data to nebula graph
+		return s.loadDataToGraphDB(msg)
+	})
+	s.handle(ecdh.StepShutdown, s.stopOnShutdown)
+	for step, handler := range handlers {
+		s.handle(step, handler)
+	}
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+func (s *ECDHRuntime) encryptOwnItems(data []string, step runtime.Step) error {
+	encrypted, err := s.intersect.Encrypt(data)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to encrypt data")
+		return err
+	}
+
+	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+
+	// in threshold mode the peer could finalize the items it re-encrypts, so
+	// they're blinded until the session is met
+	if s.mode == ModeThreshold {
+		if encrypted, err = s.blindSession(sessionKey, encrypted); err != nil {
+			return err
+		}
+	}
+
+	// the original data is needed when the peer sends back the re-encrypted
+	// items, except in cardinality mode where no id is linked to any hash
+	if s.mode != ModeCardinality {
+		if err = s.sendOriginData("", sessionKey, data); err != nil {
+			return err
+		}
+	}
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: sessionKey,
+		Data: encrypted,
+	})
+}
+
+func (s *ECDHRuntime) reEncryptPeerItems(msg *runtime.Message, step runtime.Step) error {
+	reEncrypted, err := s.intersect.ReEncrypt(msg.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to re-encrypt the items from peer")
+		return err
+	}
+
+	if s.mode == ModeCardinality {
+		if err = ecdh.Shuffle(reEncrypted); err != nil {
+			log.WithField("error", err).Error("Failed to shuffle the items from peer")
+			return err
+		}
+	}
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: msg.SessionKey,
+		Data: reEncrypted,
+	})
+}
+
+func (s *ECDHRuntime) finalizeOwnItems(msg *runtime.Message, step runtime.Step) error {
+	data, err := s.getOriginData("", msg.SessionKey)
+	if err != nil {
+		return err
+	}
+
+	hash := s.intersect.Finalize(msg.Data)
+
+	if err = s.createAndSendHashIDMap("", data, hash); err != nil {
+		return err
+	}
+
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: msg.SessionKey,
+		Data: hash,
+	}); err != nil {
+		return err
+	}
+
+	return s.delOriginData("", msg.SessionKey)
+}
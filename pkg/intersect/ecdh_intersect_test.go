@@ -0,0 +1,52 @@
+package intersect
+
+import (
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+)
+
+func TestECDHDropStaleState(t *testing.T) {
+	dir := t.TempDir()
+	graphFn := filepath.Join(dir, "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(graphFn, []byte("nodes: []\n"), 0600))
+	keyFile := filepath.Join(dir, "ecdh.pem")
+	privKey, err := ecdh.GenerateAndSavePrivateKey(keyFile)
+	assert.NoError(t, err)
+
+	kv := newMemKV()
+	start := func(intersect *ecdh.ECDHIntersect) {
+		s, err := NewECDHRuntime("client", 1, 10, intersect, "", nil, nil, kv, nil, graphFn)
+		assert.NoError(t, err)
+		assert.NoError(t, s.dropStaleState())
+	}
+
+	loaded, err := ecdh.NewECDHIntersectWithKey(privKey, &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	start(loaded)
+	assert.NoError(t, kv.HashPut("hash_id_map", map[string]string{"hash": "id"}))
+	assert.NoError(t, kv.Put("cardinality_total", "1"))
+
+	// the same key keeps the state
+	start(loaded)
+	num, err := kv.HashLen("hash_id_map")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), num)
+
+	fresh, err := ecdh.NewECDHIntersect("p256", &hasher.SHA256Hash{})
+	assert.NoError(t, err)
+	start(fresh)
+	num, err = kv.HashLen("hash_id_map")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), num)
+	_, err = kv.Get("cardinality_total")
+	assert.Error(t, err)
+	keyID, err := kv.Get("key_id")
+	assert.NoError(t, err)
+	assert.Equal(t, fresh.GetKeyID(), keyID)
+}
@@ -0,0 +1,239 @@
+package intersect
+
+import (
+	"errors"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+)
+
+// In labeled mode host reads a label of each of its ids from graph, seals it
+// with a key derived from its own encryption of the id, and sends the sealed
+// labels under tags derived from the same point. Client gets the points of its
+// own ids by removing its key from the items re-encrypted by host, and opens
+// the labels of the ids in the intersection. Host learns nothing, and no
+// neighbor data is exchanged.
+//
+// Client keeps the sealed labels in the kv hash "host_labels" (tag -> sealed
+// label) and the keys of its own ids in "label_keys" (tag -> key), and exports
+// the opened labels to "labels" (id -> label).
+
+var errNoLabelSource = errors.New("The label source should be set on host in labeled mode")
+
+// SetLabelSource sets where host reads the labels from in labeled mode
+func (s *ECDHRuntime) SetLabelSource(source *graph.ValueSource) {
+	s.labelSource = source
+}
+
+func (s *ECDHRuntime) runLabeledClient() error {
+	return s.run(ecdh.StepClientEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepHostReEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to open the labels of its items")
+			return s.openOwnLabels(msg)
+		},
+		ecdh.StepHostLabels: func(msg *runtime.Message) error {
+			log.Info("Client starts to open the labels from host")
+			return s.receiveHostLabels(msg)
+		},
+	})
+}
+
+func (s *ECDHRuntime) runLabeledHost() error {
+	if s.labelSource == nil || len(s.labelSource.Name) == 0 || len(s.labelSource.Prop) == 0 {
+		return errNoLabelSource
+	}
+	return s.run(ecdh.StepHostLabels, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepClientEncrypt: func(msg *runtime.Message) error {
+			log.Info("Host starts to re-encrypt the items from client")
+			return s.reEncryptPeerItems(msg, ecdh.StepHostReEncrypt)
+		},
+	})
+}
+
+// sealAndSendLabels sends the sealed labels of the new ids of host, an id
+// without label gets an empty one, so that client still finds it
+func (s *ECDHRuntime) sealAndSendLabels(data []string) error {
+	ids := make([][]byte, len(data))
+	for i, id := range data {
+		ids[i] = []byte(id)
+	}
+	if err := ecdh.Shuffle(ids); err != nil {
+		log.WithField("error", err).Error("Failed to shuffle ids")
+		return err
+	}
+	data = bytesSliceToStringSlice(ids)
+
+	values, err := s.graphClient.GetValues(data, s.labelSource)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to read labels from graph database")
+		return err
+	}
+	points, err := s.intersect.Encrypt(data)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to encrypt data")
+		return err
+	}
+
+	pairs := make([][]byte, 0, 2 * len(data))
+	for i, id := range data {
+		value, ok := values[id]
+		if !ok {
+			value = []string{}
+		}
+		label, err := json.Marshal(value)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to marshal label to json")
+			return err
+		}
+		tag, key := ecdh.LabelTagAndKey(points[i])
+		sealed, err := ecdh.SealLabel(key, label)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to seal label")
+			return err
+		}
+		pairs = append(pairs, tag, sealed)
+	}
+
+	step := ecdh.StepHostLabels
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: runtime.GenerateSessionKey(s.algorithm, step),
+		Data: pairs,
+	})
+}
+
+// openOwnLabels removes the key of client from its items re-encrypted by host,
+// stores their tags and keys, and opens the labels already received
+func (s *ECDHRuntime) openOwnLabels(msg *runtime.Message) error {
+	data, err := s.getOriginData("", msg.SessionKey)
+	if err != nil {
+		return err
+	}
+	points, err := s.intersect.Decrypt(msg.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to decrypt the items re-encrypted by host")
+		return err
+	}
+
+	tags := make([][]byte, len(points))
+	keys := make(map[string]string)
+	for i, point := range points {
+		var key []byte
+		tags[i], key = ecdh.LabelTagAndKey(point)
+		keys[string(tags[i])] = string(key)
+	}
+	if err = s.createAndSendHashIDMap("", data, tags); err != nil {
+		return err
+	}
+	if err = s.kv.HashPut("label_keys", keys); err != nil {
+		log.WithField("error", err).Error("Failed to put label keys to kv")
+		return err
+	}
+	if err = s.delOriginData("", msg.SessionKey); err != nil {
+		return err
+	}
+
+	return s.openLabels(bytesSliceToStringSlice(tags))
+}
+
+// receiveHostLabels stores the sealed labels of host, and opens the ones of
+// the ids client holds
+func (s *ECDHRuntime) receiveHostLabels(msg *runtime.Message) error {
+	if len(msg.Data) % 2 != 0 {
+		log.WithField("session_key", msg.SessionKey).Error("The label message has wrong format")
+		return errors.New("Wrong format of label message")
+	}
+	sealed := make(map[string]string)
+	tags := make([]string, 0, len(msg.Data) / 2)
+	for i := 0; i < len(msg.Data); i += 2 {
+		sealed[string(msg.Data[i])] = string(msg.Data[i + 1])
+		tags = append(tags, string(msg.Data[i]))
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	if err := s.kv.HashPut("host_labels", sealed); err != nil {
+		log.WithField("error", err).Error("Failed to put labels to kv")
+		return err
+	}
+
+	return s.openLabels(tags)
+}
+
+// openLabels opens the labels of the tags that both sides hold
+func (s *ECDHRuntime) openLabels(tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	sealedLabels, err := s.kv.HashMultiGet("host_labels", tags)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get labels from kv")
+		return err
+	}
+	sealed, index := runtime.GetExistingStringAndIndex(sealedLabels)
+	if len(sealed) == 0 {
+		return nil
+	}
+	matchedTags := make([]string, len(index))
+	for i, j := range index {
+		matchedTags[i] = tags[j]
+	}
+
+	ids, err := s.kv.HashMultiGet(kvName("hash_id_map", ""), matchedTags)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get matched id")
+		return err
+	}
+	keys, err := s.kv.HashMultiGet("label_keys", matchedTags)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get label keys from kv")
+		return err
+	}
+
+	labels := make(map[string]string)
+	for i := range matchedTags {
+		id, ok := ids[i].(string)
+		if !ok {
+			continue
+		}
+		key, ok := keys[i].(string)
+		if !ok {
+			continue
+		}
+		label, err := ecdh.OpenLabel([]byte(key), []byte(sealed[i]))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": id,
+				"error": err,
+			}).Warning("Failed to open the label of id, skip")
+			continue
+		}
+		labels[id] = string(label)
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	matchedID := make([]string, 0, len(labels))
+	for id := range labels {
+		matchedID = append(matchedID, id)
+	}
+	if err = s.sendMatchedId(matchedID); err != nil {
+		return err
+	}
+	if err = s.kv.HashPut("labels", labels); err != nil {
+		log.WithField("error", err).Error("Failed to put labels to kv")
+		return err
+	}
+
+	log.WithField("num_labels", len(labels)).Info("Client opened the labels of matched ids")
+	return nil
+}
@@ -0,0 +1,551 @@
+package intersect
+
+import (
+	"time"
+	"errors"
+	"strconv"
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+)
+
+// In threshold mode the matched ids of a session are only revealed when the
+// session shares at least threshold items with the peer. The items of the
+// session are blinded by the owner, so the peer re-encrypts them without being
+// able to finalize them, and sends them back shuffled first. The owner
+// collects its own final hashes without linking them to any id, and the sides
+// run the threshold check of ecdh/threshold.go on the final hashes of the
+// session and the own ones of the peer, so the peer only learns whether the
+// threshold is met and sends the verdict. Only when it's met the unshuffled
+// items are sent back, and the session goes on as in intersection mode. A
+// session not met within conn_timeout is closed, and its ids are never
+// revealed.
+
+var errNoThreshold = errors.New("The threshold should be positive in threshold mode")
+
+// the kv hash of the own final hashes, which the sessions of peer are checked
+// against
+const thresholdOwnKey = "threshold_own"
+
+const thresholdScanCount = 10000
+
+// thresholdSession is a session of peer waiting for the verdict
+type thresholdSession struct {
+	reEncrypted 		[][]byte
+	// the encrypted filter of the session, nil until the owner sends it
+	hashes 				uint32
+	filter 				[][]byte
+	// the key and the picks of the running check, nil when there is none
+	key 				*ecdh.ThresholdKey
+	picks 				[]int
+	// the number of own hashes the last check ran with
+	checked 			int
+	createdAt 			time.Time
+}
+
+// ownThresholdSession is an own session being checked by peer
+type ownThresholdSession struct {
+	key 				*ecdh.ThresholdKey
+	hashes 				uint32
+	createdAt 			time.Time
+}
+
+// SetThreshold sets the minimum number of matched ids of a session in
+// threshold mode
+func (s *ECDHRuntime) SetThreshold(threshold int) {
+	s.threshold = threshold
+}
+
+func (s *ECDHRuntime) runThresholdClient() error {
+	return s.run(ecdh.StepClientEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepHostShuffle: func(msg *runtime.Message) error {
+			log.Info("Client starts to collect its items shuffled by host")
+			return s.collectOwnHashes(msg, ecdh.StepClientFilter)
+		},
+		ecdh.StepHostEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to re-encrypt the items from host")
+			return s.holdPeerItems(msg, ecdh.StepClientShuffle)
+		},
+		ecdh.StepHostFilter: func(msg *runtime.Message) error {
+			log.Info("Client starts to check the items of host against the threshold")
+			return s.receiveFilter(msg)
+		},
+		ecdh.StepHostRotate: func(msg *runtime.Message) error {
+			return s.selectCandidates(msg, ecdh.StepClientSelect)
+		},
+		ecdh.StepHostSelect: func(msg *runtime.Message) error {
+			return s.compareOverlap(msg, ecdh.StepClientCompare)
+		},
+		ecdh.StepHostCompare: func(msg *runtime.Message) error {
+			return s.openComparisons(msg, ecdh.StepClientOpen)
+		},
+		ecdh.StepHostOpen: func(msg *runtime.Message) error {
+			return s.judgeSession(msg)
+		},
+		ecdh.StepHostThreshold: func(msg *runtime.Message) error {
+			return s.receiveVerdict(msg)
+		},
+		ecdh.StepHostReEncrypt: func(msg *runtime.Message) error {
+			log.Info("Client starts to hash the items re-encrypted by host")
+			return s.finalizeBlindedItems(msg, ecdh.StepClientHash)
+		},
+		ecdh.StepHostHash: func(msg *runtime.Message) error {
+			log.Info("Client starts to compare hash from host")
+			return s.matchIDAndSendData(msg)
+		},
+	})
+}
+
+func (s *ECDHRuntime) runThresholdHost() error {
+	return s.run(ecdh.StepHostEncrypt, map[runtime.Step]func(*runtime.Message) error{
+		ecdh.StepClientShuffle: func(msg *runtime.Message) error {
+			log.Info("Host starts to collect its items shuffled by client")
+			return s.collectOwnHashes(msg, ecdh.StepHostFilter)
+		},
+		ecdh.StepClientEncrypt: func(msg *runtime.Message) error {
+			log.Info("Host starts to re-encrypt the items from client")
+			return s.holdPeerItems(msg, ecdh.StepHostShuffle)
+		},
+		ecdh.StepClientFilter: func(msg *runtime.Message) error {
+			log.Info("Host starts to check the items of client against the threshold")
+			return s.receiveFilter(msg)
+		},
+		ecdh.StepClientRotate: func(msg *runtime.Message) error {
+			return s.selectCandidates(msg, ecdh.StepHostSelect)
+		},
+		ecdh.StepClientSelect: func(msg *runtime.Message) error {
+			return s.compareOverlap(msg, ecdh.StepHostCompare)
+		},
+		ecdh.StepClientCompare: func(msg *runtime.Message) error {
+			return s.openComparisons(msg, ecdh.StepHostOpen)
+		},
+		ecdh.StepClientOpen: func(msg *runtime.Message) error {
+			return s.judgeSession(msg)
+		},
+		ecdh.StepClientThreshold: func(msg *runtime.Message) error {
+			return s.receiveVerdict(msg)
+		},
+		ecdh.StepClientReEncrypt: func(msg *runtime.Message) error {
+			log.Info("Host starts to hash the items re-encrypted by client")
+			return s.finalizeBlindedItems(msg, ecdh.StepHostHash)
+		},
+		ecdh.StepClientHash: func(msg *runtime.Message) error {
+			log.Info("Host starts to compare hash from client")
+			return s.matchIDAndSendData(msg)
+		},
+	})
+}
+
+// thresholdStep returns the step of the check sent by this side, the first
+// one by client and the second one by host
+func (s *ECDHRuntime) thresholdStep(clientStep, hostStep runtime.Step) runtime.Step {
+	if s.role == "client" {
+		return clientStep
+	}
+	return hostStep
+}
+
+// blindSession blinds the own items of a session, and keeps the blind until
+// the items come back
+func (s *ECDHRuntime) blindSession(sessionKey string, encrypted [][]byte) ([][]byte, error) {
+	blinded, blind, err := s.intersect.Blind(encrypted)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to blind the own items")
+		return nil, err
+	}
+	if err = s.sendRands("", sessionKey, []*big.Int{blind}); err != nil {
+		return nil, err
+	}
+	return blinded, nil
+}
+
+// unblindSession removes the blind from the own items re-encrypted by peer
+func (s *ECDHRuntime) unblindSession(sessionKey string, points [][]byte) ([][]byte, error) {
+	rands, err := s.getRands("", sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rands) != 1 {
+		return nil, errors.New("The blind of the session is missing")
+	}
+	unblinded, err := s.intersect.Unblind(points, rands[0])
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to unblind the items from peer")
+		return nil, err
+	}
+	return unblinded, nil
+}
+
+// collectOwnHashes adds the final hashes of own items, which are shuffled by
+// peer, and sends the encrypted filter of them for the peer to check
+func (s *ECDHRuntime) collectOwnHashes(msg *runtime.Message, filterStep runtime.Step) error {
+	points, err := s.unblindSession(msg.SessionKey, msg.Data)
+	if err != nil {
+		return err
+	}
+	hashes := s.intersect.Finalize(points)
+	if len(hashes) > 0 {
+		own := make(map[string]string, len(hashes))
+		for _, hash := range hashes {
+			own[string(hash)] = ""
+		}
+		if err = s.kv.HashPut(thresholdOwnKey, own); err != nil {
+			log.WithField("error", err).Error("Failed to add hashes to kv")
+			return err
+		}
+	}
+
+	key, err := ecdh.NewThresholdKey(s.intersect.Curve())
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate the key of threshold check")
+		return err
+	}
+	numHashes, filter, err := key.EncryptFilter(hashes)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to encrypt the filter of own items")
+		return err
+	}
+	s.owned[msg.SessionKey] = &ownThresholdSession{
+		key: key,
+		hashes: numHashes,
+		createdAt: time.Now(),
+	}
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: filterStep,
+		SessionKey: msg.SessionKey,
+		Data: append([][]byte{[]byte(strconv.FormatUint(uint64(numHashes), 10))}, filter...),
+	}); err != nil {
+		return err
+	}
+
+	// the sessions of peer may be met with the new hashes
+	s.judgePendingSessions()
+	return nil
+}
+
+// holdPeerItems re-encrypts the items of a peer session, sends them back
+// shuffled, and keeps the unshuffled ones until the session is judged
+func (s *ECDHRuntime) holdPeerItems(msg *runtime.Message, shuffleStep runtime.Step) error {
+	reEncrypted, err := s.intersect.ReEncrypt(msg.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to re-encrypt the items from peer")
+		return err
+	}
+
+	shuffled := make([][]byte, len(reEncrypted))
+	copy(shuffled, reEncrypted)
+	if err = ecdh.Shuffle(shuffled); err != nil {
+		log.WithField("error", err).Error("Failed to shuffle the items from peer")
+		return err
+	}
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: shuffleStep,
+		SessionKey: msg.SessionKey,
+		Data: shuffled,
+	}); err != nil {
+		return err
+	}
+
+	s.pending[msg.SessionKey] = &thresholdSession{
+		reEncrypted: reEncrypted,
+		createdAt: time.Now(),
+	}
+	return nil
+}
+
+// receiveFilter keeps the encrypted filter of a peer session and starts to
+// check it
+func (s *ECDHRuntime) receiveFilter(msg *runtime.Message) error {
+	session, ok := s.pending[msg.SessionKey]
+	if !ok {
+		log.WithField("session_key", msg.SessionKey).Warning("The session of the filter is closed, skip")
+		return nil
+	}
+	if len(msg.Data) < 2 {
+		return errors.New("The filter of the session is empty")
+	}
+	numHashes, err := strconv.ParseUint(string(msg.Data[0]), 10, 32)
+	if err != nil || numHashes == 0 {
+		return errors.New("Invalid number of hash functions of the filter")
+	}
+	session.hashes = uint32(numHashes)
+	session.filter = msg.Data[1:]
+
+	if len(session.reEncrypted) < s.threshold {
+		// it can never be met
+		return s.closeSession(msg.SessionKey)
+	}
+	return s.checkSession(msg.SessionKey)
+}
+
+// judgePendingSessions closes the sessions not met in time, and checks the
+// others again when there are new own hashes
+func (s *ECDHRuntime) judgePendingSessions() {
+	timeout := time.Duration(s.connTimeout) * time.Second
+	for sessionKey, session := range s.pending {
+		if time.Since(session.createdAt) > timeout {
+			s.closeSession(sessionKey)
+		} else if session.filter != nil && session.key == nil {
+			s.checkSession(sessionKey)
+		}
+	}
+
+	// the verdict of an own session may be lost, the peer closes it in time
+	for sessionKey, own := range s.owned {
+		if time.Since(own.createdAt) > 2 * timeout {
+			log.WithField("session_key", sessionKey).Warning("No verdict of the own session in time, drop it")
+			s.dropOwnSession(sessionKey)
+		}
+	}
+}
+
+// checkSession starts a threshold check of a peer session, unless no own hash
+// is added since the last one
+func (s *ECDHRuntime) checkSession(sessionKey string) error {
+	session := s.pending[sessionKey]
+
+	numOwn, err := s.kv.HashLen(thresholdOwnKey)
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get the number of own hashes from kv")
+		return err
+	}
+	if int(numOwn) == session.checked {
+		return nil
+	}
+	own, err := s.getOwnHashes()
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdh.NewThresholdKey(s.intersect.Curve())
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate the key of threshold check")
+		return err
+	}
+	candidates, picks, err := key.Rotate(session.hashes, session.filter, own)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to check the filter of peer")
+		return err
+	}
+	session.key = key
+	session.picks = picks
+	session.checked = len(own)
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: s.thresholdStep(ecdh.StepClientRotate, ecdh.StepHostRotate),
+		SessionKey: sessionKey,
+		Data: append([][]byte{key.PubKey()}, candidates...),
+	})
+}
+
+// getOwnHashes reads all the own final hashes in pages
+func (s *ECDHRuntime) getOwnHashes() ([][]byte, error) {
+	ret := make([][]byte, 0)
+	cursor := uint64(0)
+	for {
+		page, next, err := s.kv.HashScan(thresholdOwnKey, cursor, thresholdScanCount)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to scan own hashes in kv")
+			return nil, err
+		}
+		for hash := range page {
+			ret = append(ret, []byte(hash))
+		}
+		if next == 0 {
+			return ret, nil
+		}
+		cursor = next
+	}
+}
+
+// selectCandidates finds which candidate of every own hash of peer is zero,
+// for an own session
+func (s *ECDHRuntime) selectCandidates(msg *runtime.Message, selectStep runtime.Step) error {
+	own, ok := s.owned[msg.SessionKey]
+	if !ok {
+		log.WithField("session_key", msg.SessionKey).Warning("The own session is closed, skip the candidates")
+		return nil
+	}
+	if len(msg.Data) < 1 {
+		return errors.New("The candidates carry no pubkey")
+	}
+	selected, err := own.key.Select(msg.Data[0], int(own.hashes) + 1, msg.Data[1:])
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to select the candidates of peer")
+		return err
+	}
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: selectStep,
+		SessionKey: msg.SessionKey,
+		Data: selected,
+	})
+}
+
+// compareOverlap adds up the selected candidates of a peer session, and
+// compares the overlap with every value from threshold to the size of session
+func (s *ECDHRuntime) compareOverlap(msg *runtime.Message, compareStep runtime.Step) error {
+	session, ok := s.pending[msg.SessionKey]
+	if !ok || session.key == nil {
+		log.WithField("session_key", msg.SessionKey).Warning("No check of the session is running, skip")
+		return nil
+	}
+	count, err := session.key.Count(msg.Data, int(session.hashes) + 1, session.picks)
+	if err != nil {
+		return s.failCheck(msg.SessionKey, err)
+	}
+	comparisons, err := session.key.Compare(count, s.threshold, len(session.reEncrypted))
+	if err != nil {
+		return s.failCheck(msg.SessionKey, err)
+	}
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: compareStep,
+		SessionKey: msg.SessionKey,
+		Data: comparisons,
+	})
+}
+
+// failCheck stops the running check of a peer session, it's checked again on
+// the next fetch
+func (s *ECDHRuntime) failCheck(sessionKey string, err error) error {
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"error": err,
+	}).Error("Failed to check the session of peer")
+	if session, ok := s.pending[sessionKey]; ok {
+		session.key = nil
+		session.picks = nil
+		session.checked = 0
+	}
+	return err
+}
+
+// openComparisons removes the own key from the comparisons of an own session
+func (s *ECDHRuntime) openComparisons(msg *runtime.Message, openStep runtime.Step) error {
+	own, ok := s.owned[msg.SessionKey]
+	if !ok {
+		log.WithField("session_key", msg.SessionKey).Warning("The own session is closed, skip the comparisons")
+		return nil
+	}
+	opened, err := own.key.Open(msg.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to open the comparisons of peer")
+		return err
+	}
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: openStep,
+		SessionKey: msg.SessionKey,
+		Data: opened,
+	})
+}
+
+// judgeSession releases a peer session when the opened comparisons tell it's
+// met, and keeps it otherwise since own hashes may still come
+func (s *ECDHRuntime) judgeSession(msg *runtime.Message) error {
+	session, ok := s.pending[msg.SessionKey]
+	if !ok || session.key == nil {
+		log.WithField("session_key", msg.SessionKey).Warning("No check of the session is running, skip")
+		return nil
+	}
+	met, err := session.key.AnyZero(msg.Data)
+	if err != nil {
+		return s.failCheck(msg.SessionKey, err)
+	}
+	session.key = nil
+	session.picks = nil
+	if !met {
+		log.WithField("session_key", msg.SessionKey).Info("The session of peer is not met yet")
+		return nil
+	}
+
+	delete(s.pending, msg.SessionKey)
+	if err = s.sendVerdict(msg.SessionKey, true); err != nil {
+		return err
+	}
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: s.thresholdStep(ecdh.StepClientReEncrypt, ecdh.StepHostReEncrypt),
+		SessionKey: msg.SessionKey,
+		Data: session.reEncrypted,
+	})
+}
+
+// closeSession drops a peer session which is not met
+func (s *ECDHRuntime) closeSession(sessionKey string) error {
+	delete(s.pending, sessionKey)
+	return s.sendVerdict(sessionKey, false)
+}
+
+func (s *ECDHRuntime) sendVerdict(sessionKey string, met bool) error {
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"threshold": s.threshold,
+		"met": met,
+	}).Info("Judged the session of peer")
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: s.thresholdStep(ecdh.StepClientThreshold, ecdh.StepHostThreshold),
+		SessionKey: sessionKey,
+		Data: [][]byte{[]byte(strconv.FormatBool(met))},
+	})
+}
+
+// receiveVerdict closes the own session when the threshold is not met, or
+// waits for the unshuffled items otherwise
+func (s *ECDHRuntime) receiveVerdict(msg *runtime.Message) error {
+	met := len(msg.Data) == 1 && string(msg.Data[0]) == strconv.FormatBool(true)
+	log.WithFields(log.Fields{
+		"session_key": msg.SessionKey,
+		"met": met,
+	}).Info("Received the verdict of own session")
+	if met {
+		delete(s.owned, msg.SessionKey)
+		return nil
+	}
+	return s.dropOwnSession(msg.SessionKey)
+}
+
+func (s *ECDHRuntime) dropOwnSession(sessionKey string) error {
+	delete(s.owned, sessionKey)
+	if err := s.delRands("", sessionKey); err != nil {
+		return err
+	}
+	return s.delOriginData("", sessionKey)
+}
+
+// finalizeBlindedItems unblinds the own items of a met session, and goes on as
+// in intersection mode
+func (s *ECDHRuntime) finalizeBlindedItems(msg *runtime.Message, hashStep runtime.Step) error {
+	points, err := s.unblindSession(msg.SessionKey, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Data = points
+	if err = s.finalizeOwnItems(msg, hashStep); err != nil {
+		return err
+	}
+	return s.delRands("", msg.SessionKey)
+}
@@ -0,0 +1,176 @@
+package intersect
+
+import (
+	"fmt"
+	"errors"
+	"crypto/rand"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/naive"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+)
+
+// HashRuntime intersects the ids by comparing their hashes, which is much
+// cheaper than the other algorithms but only fit for non-sensitive tags, since
+// the peer can recover any id of a small domain by brute force, unless the
+// hasher is keyed with a secret shared by both sides. Each session is hashed
+// with a fresh salt, so the hashes of different sessions can't be linked.
+// Both roles run the same steps.
+type HashRuntime struct {
+	baseRuntime
+	hash 				hasher.Hasher
+}
+
+func NewHashRuntime(role string, fetchInterval int, connTimeout int,
+		hash hasher.Hasher, producer runtime.Producer, consumer runtime.Consumer,
+		kv runtime.KV, graphClient *graph.NebulaReadWriter,
+		graphDefinitionFn string) (*HashRuntime, error) {
+
+	if hash == nil {
+		return nil, errors.New("The hasher should be set")
+	}
+
+	base, err := newBaseRuntime(role, "hash", fetchInterval, connTimeout,
+		producer, consumer, kv, graphClient, graphDefinitionFn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashRuntime{
+		baseRuntime: base,
+		hash: hash,
+	}, nil
+}
+
+// Run runs the same steps on both roles
+func (s *HashRuntime) Run() error {
+	if s.role != "client" && s.role != "host" {
+		return errors.New(fmt.Sprintf("Unsupported role: %s", s.role))
+	}
+	return s.run()
+}
+
+func (s *HashRuntime) run() error {
+	s.onFetch(func() error {
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
+		if err := s.sendHashes(data); err != nil {
+			return err
+		}
+		s.lastGraphFetchTime = &newTime
+		log.WithField("role", s.role).Info("Got new data from db, hashed it and sent it to peer")
+		return nil
+	})
+
+	s.handle(naive.StepHash, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Start to compare the hashes from peer")
+		return s.matchPeerHashes(msg)
+	})
+	s.handle(naive.StepMatched, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Start to match the hashes sent back by peer")
+		return s.matchOwnHashes(msg)
+	})
+	// load data to nebula graph
+	s.handle(naive.StepExchangeData, s.loadDataToGraphDB)
+	s.handle(naive.StepShutdown, s.stopOnShutdown)
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+// sendHashes adds the new ids to the stored ones, and sends their hashes
+// with a fresh salt, which goes first in the data
+func (s *HashRuntime) sendHashes(data []string) error {
+	ids := make(map[string]string)
+	for _, id := range data {
+		ids[id] = ""
+	}
+	if err := s.kv.HashPut("hash_ids", ids); err != nil {
+		log.WithField("error", err).Error("Failed to put ids to kv")
+		return err
+	}
+
+	salt := make([]byte, naive.SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		log.WithField("error", err).Error("Failed to generate salt")
+		return err
+	}
+
+	step := naive.StepHash
+	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+	if err := s.sendOriginData("", sessionKey, data); err != nil {
+		return err
+	}
+
+	hashes := naive.HashElements(s.hash, salt, stringSliceToBytesSlice(data))
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: sessionKey,
+		Data: append([][]byte{salt}, hashes...),
+	})
+}
+
+// matchPeerHashes hashes all the stored ids with the salt of the peer
+// session, sends back the matched hashes, and sends the data of the matched ids
+func (s *HashRuntime) matchPeerHashes(msg *runtime.Message) error {
+	if len(msg.Data) == 0 {
+		log.WithField("session_key", msg.SessionKey).Error("No salt is given in the message")
+		return errors.New("No salt is given")
+	}
+	salt, peerHashes := msg.Data[0], msg.Data[1:]
+
+	ids, err := s.kv.HashGetAll("hash_ids")
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get ids from kv")
+		return err
+	}
+	elements := make([][]byte, 0, len(ids))
+	for id := range ids {
+		elements = append(elements, []byte(id))
+	}
+
+	hashes := naive.HashElements(s.hash, salt, elements)
+	matched := naive.Match(elements, hashes, peerHashes)
+	matchedHashes := naive.HashElements(s.hash, salt, matched)
+
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: naive.StepMatched,
+		SessionKey: msg.SessionKey,
+		Data: append([][]byte{salt}, matchedHashes...),
+	}); err != nil {
+		return err
+	}
+
+	return s.sendDataOfIDs(msg.SessionKey, "", bytesSliceToStringSlice(matched))
+}
+
+// matchOwnHashes finds the ids of own session in the hashes sent back by
+// peer, and sends the data of them
+func (s *HashRuntime) matchOwnHashes(msg *runtime.Message) error {
+	if len(msg.Data) == 0 {
+		log.WithField("session_key", msg.SessionKey).Error("No salt is given in the message")
+		return errors.New("No salt is given")
+	}
+	salt, peerHashes := msg.Data[0], msg.Data[1:]
+
+	data, err := s.getOriginData("", msg.SessionKey)
+	if err != nil {
+		return err
+	}
+
+	elements := stringSliceToBytesSlice(data)
+	hashes := naive.HashElements(s.hash, salt, elements)
+	matched := naive.Match(elements, hashes, peerHashes)
+
+	if err = s.sendDataOfIDs(msg.SessionKey, "", bytesSliceToStringSlice(matched)); err != nil {
+		return err
+	}
+	return s.delOriginData("", msg.SessionKey)
+}
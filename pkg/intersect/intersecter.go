@@ -1,7 +1,11 @@
 package intersect
 
+import (
+	"time"
+)
+
 type Intersecter interface {
 	Run() error
-	runClient() error
-	runHost() error
+	SetDispatchPolicy(unhandled string, timeout time.Duration) error
+	SetStepTimeout(step string, timeout time.Duration)
 }
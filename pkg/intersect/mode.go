@@ -0,0 +1,36 @@
+package intersect
+
+const (
+	// ModeIntersection reveals the matched ids and exchanges their data
+	ModeIntersection 	= "intersection"
+	// ModeCardinality only reveals the size of the intersection
+	ModeCardinality 	= "cardinality"
+	// ModeUnbalanced is ModeIntersection for a small client set against a
+	// huge host set, the host publishes a filter of its set instead of hashes
+	ModeUnbalanced 		= "unbalanced"
+	// ModeThreshold is ModeIntersection, but the matched ids of a session are
+	// only revealed when there're at least threshold of them
+	ModeThreshold 		= "threshold"
+	// ModeLabeled only lets the client learn the matched ids, along with the
+	// labels host attaches to them
+	ModeLabeled 		= "labeled"
+	// ModeClientOnly only lets the client learn the matched ids, the host
+	// never gets the unblinded hashes of client
+	ModeClientOnly 		= "client_only"
+)
+
+// checkMode returns the mode to use, "" means ModeIntersection
+func checkMode(mode string, supported ...string) (string, bool) {
+	if len(mode) == 0 {
+		return ModeIntersection, true
+	}
+	if mode == ModeIntersection {
+		return mode, true
+	}
+	for _, m := range supported {
+		if mode == m {
+			return mode, true
+		}
+	}
+	return mode, false
+}
@@ -0,0 +1,594 @@
+package intersect
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"math/big"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/multiparty"
+)
+
+// MultiPartyRuntime runs the multi-party PSI among a ring of parties. Every
+// round each party except the leader encrypts the polynomials whose roots are
+// its items under a fresh joint ElGamal key of all the parties, and sends them
+// to the leader. The leader evaluates them at each of its own items and adds
+// them up with random weights, which is zero only for the items held by every
+// party. The sums are decrypted round the ring back to the leader, which
+// broadcasts the hashes of the intersection, and every party matches them
+// with its own ids.
+//
+// The leader only learns which of its items are held by every party, and the
+// other parties only see ciphertexts and the intersection, so nobody learns
+// what any pair or subset of parties has in common, nor how many parties hold
+// an item. The leader learns the number of bins and the fullest bin of every
+// party, which tells roughly the size of its set. No graph data is exchanged,
+// the matched ids are only put to the kv set "matched_data".
+type MultiPartyRuntime struct {
+	baseRuntime
+	intersect 			*ecdh.ECDHIntersect
+	ring 				*multiparty.Ring
+	producers 			map[string]runtime.Producer
+	rounds 				map[string]*multiPartyRound
+	// pending is set on leader when a party asks for a new round
+	pending 			bool
+}
+
+type multiPartyRound struct {
+	keys 				*multiparty.RoundKeys
+	// submitted is set once the own set is sent
+	submitted 			bool
+	createdAt 			time.Time
+	// the public shares of joint key in the order of ring
+	jointKeys 			[][]byte
+	// the public shares and the encrypted sets by party, and the own ids the
+	// sets are evaluated at, only used on leader
+	pubKeys 			map[string][]byte
+	sets 				map[string][][]byte
+	candidates 			[]string
+}
+
+// NewMultiPartyRuntime takes a producer for every other party, the one of
+// the next party in the ring is used as the default producer
+func NewMultiPartyRuntime(fetchInterval int, connTimeout int,
+		intersect *ecdh.ECDHIntersect, ring *multiparty.Ring,
+		producers map[string]runtime.Producer, consumer runtime.Consumer,
+		kv runtime.KV, graphClient *graph.NebulaReadWriter,
+		graphDefinitionFn string) (*MultiPartyRuntime, error) {
+
+	for _, party := range ring.Others() {
+		if _, ok := producers[party.ID]; !ok {
+			return nil, errors.New(fmt.Sprintf("No producer for party %s", party.ID))
+		}
+	}
+
+	// leader plays host, and the other parties play client
+	role := "client"
+	if ring.IsLeader() {
+		role = "host"
+	}
+
+	base, err := newBaseRuntime(role, "multiparty", fetchInterval, connTimeout,
+		producers[ring.Next().ID], consumer, kv, graphClient, graphDefinitionFn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultiPartyRuntime{
+		baseRuntime: base,
+		intersect: intersect,
+		ring: ring,
+		producers: producers,
+		rounds: make(map[string]*multiPartyRound),
+	}, nil
+}
+
+// Run registers the handlers shared by all the parties, the steps only leader
+// handles are checked in them
+func (s *MultiPartyRuntime) Run() error {
+	s.onFetch(func() error {
+		s.pruneRounds()
+
+		if data, newTime, ok := s.fetchNewData(); ok {
+			if err := s.addIDs(data); err != nil {
+				return err
+			}
+			s.lastGraphFetchTime = &newTime
+			log.WithField("num_ids", len(data)).Info("Got new data from db")
+
+			if s.ring.IsLeader() {
+				s.pending = true
+			} else {
+				s.requestRound()
+			}
+		}
+
+		if s.ring.IsLeader() && s.pending {
+			if err := s.startRound(); err != nil {
+				return err
+			}
+			s.pending = false
+		}
+		return nil
+	})
+
+	s.handleFromParty(multiparty.StepStart, func(msg *runtime.Message) error {
+		if s.ring.IsLeader() {
+			log.WithField("party", msg.Party).Info("Leader received a round request")
+			s.pending = true
+			return nil
+		}
+		log.WithField("session_key", msg.SessionKey).Info("Party joins a new round")
+		return s.sendRoundKey(msg.SessionKey)
+	})
+	s.handleFromParty(multiparty.StepRoundKey, func(msg *runtime.Message) error {
+		if !s.ring.IsLeader() || len(msg.Data) != 1 {
+			log.WithField("party", msg.Party).Warning("Received an unexpected round key, drop it")
+			return nil
+		}
+		return s.collectRoundKey(msg.SessionKey, msg.Party, msg.Data[0])
+	})
+	s.handleFromParty(multiparty.StepJointKey, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Party starts to encrypt its set")
+		return s.submitSet(msg.SessionKey, msg.Data)
+	})
+	s.handleFromParty(multiparty.StepSubmit, func(msg *runtime.Message) error {
+		if !s.ring.IsLeader() {
+			log.WithField("party", msg.Party).Warning("Received an encrypted set, but it's not leader")
+			return nil
+		}
+		return s.collectSet(msg.SessionKey, msg.Party, msg.Data)
+	})
+	s.handleFromParty(multiparty.StepDecrypt, func(msg *runtime.Message) error {
+		if s.ring.IsLeader() {
+			if msg.Party != s.ring.Last().ID {
+				log.WithField("party", msg.Party).Warning("Received the sums from a party other than the last one, drop them")
+				return nil
+			}
+			log.WithField("session_key", msg.SessionKey).Info("Leader starts to open the sums")
+			return s.openSums(msg.SessionKey, msg.Data)
+		}
+		log.WithField("session_key", msg.SessionKey).Info("Party starts to decrypt the sums")
+		return s.decryptSums(msg.SessionKey, msg.Data)
+	})
+	s.handleFromParty(multiparty.StepResult, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Party starts to match the intersection")
+		return s.matchIntersection(msg.SessionKey, msg.Data)
+	})
+	s.handleFromParty(multiparty.StepShutdown, s.stopOnShutdown)
+
+	log.WithFields(log.Fields{
+		"party": s.ring.Self().ID,
+		"leader": s.ring.Leader().ID,
+		"num_parties": s.ring.Size(),
+	}).Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+// handleFromParty registers a handler of the messages from the parties in
+// the ring only
+func (s *MultiPartyRuntime) handleFromParty(step runtime.Step, handler runtime.Handler) {
+	s.handle(step, func(msg *runtime.Message) error {
+		if !s.ring.Has(msg.Party) {
+			log.WithFields(log.Fields{
+				"session_key": msg.SessionKey,
+				"party": msg.Party,
+			}).Warning("Received a message from unknown party")
+			return nil
+		}
+		return handler(msg)
+	})
+}
+
+func (s *MultiPartyRuntime) sendTo(party string, msg *runtime.Message) error {
+	msg.Algorithm = s.algorithm
+	if len(msg.Party) == 0 {
+		msg.Party = s.ring.Self().ID
+	}
+
+	producer := s.producers[party]
+	if err := producer.SendStruct(msg); err != nil {
+		log.WithFields(log.Fields{
+			"connection_info": producer.GetConnectionInfo(),
+			"party": party,
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to send message to mq")
+		return err
+	}
+	return nil
+}
+
+// addIDs accumulates the ids, since the whole set is intersected every round
+func (s *MultiPartyRuntime) addIDs(data []string) error {
+	ids := make(map[string]string)
+	for _, id := range data {
+		ids[id] = ""
+	}
+	if err := s.kv.HashPut("multiparty_ids", ids); err != nil {
+		log.WithField("error", err).Error("Failed to put ids to kv")
+		return err
+	}
+	return nil
+}
+
+func (s *MultiPartyRuntime) getIDs() ([]string, error) {
+	ids, err := s.kv.HashGetAll("multiparty_ids")
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get ids from kv")
+		return nil, err
+	}
+	ret := make([]string, 0, len(ids))
+	for id := range ids {
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
+
+// ensureRound returns the state of the round, which is created by whichever
+// message of the round arrives first, since the messages come from different
+// parties
+func (s *MultiPartyRuntime) ensureRound(sessionKey string) (*multiPartyRound, error) {
+	if round, ok := s.rounds[sessionKey]; ok {
+		return round, nil
+	}
+
+	keys, err := multiparty.NewRoundKeys(s.intersect.Curve())
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate the keys of round")
+		return nil, err
+	}
+	round := &multiPartyRound{
+		keys: keys,
+		createdAt: time.Now(),
+	}
+	s.rounds[sessionKey] = round
+	return round, nil
+}
+
+// getRound returns the state of a round started before
+func (s *MultiPartyRuntime) getRound(sessionKey string) (*multiPartyRound, error) {
+	round, ok := s.rounds[sessionKey]
+	if !ok {
+		err := errors.New(fmt.Sprintf("Round %s doesn't exist or is dropped", sessionKey))
+		log.WithField("error", err).Error("Failed to get the round")
+		return nil, err
+	}
+	return round, nil
+}
+
+// pruneRounds drops the rounds not finished in time, e.g. when a party is down
+func (s *MultiPartyRuntime) pruneRounds() {
+	timeout := time.Duration(s.connTimeout * s.ring.Size()) * time.Second
+	for sessionKey, round := range s.rounds {
+		if time.Since(round.createdAt) > timeout {
+			log.WithField("session_key", sessionKey).Warning("Round is not finished in time, drop it")
+			delete(s.rounds, sessionKey)
+		}
+	}
+}
+
+func (s *MultiPartyRuntime) requestRound() {
+	step := multiparty.StepStart
+	s.sendTo(s.ring.Leader().ID, &runtime.Message{
+		Step: step,
+		SessionKey: runtime.GenerateSessionKey(s.algorithm, step),
+	})
+}
+
+// startRound tells all the parties to join a new round on leader
+func (s *MultiPartyRuntime) startRound() error {
+	step := multiparty.StepStart
+	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+	for _, party := range s.ring.Others() {
+		if err := s.sendTo(party.ID, &runtime.Message{
+			Step: step,
+			SessionKey: sessionKey,
+		}); err != nil {
+			return err
+		}
+	}
+
+	log.WithField("session_key", sessionKey).Info("Leader started a new round")
+	return s.sendRoundKey(sessionKey)
+}
+
+// sendRoundKey sends the public share of joint key of this party to leader
+func (s *MultiPartyRuntime) sendRoundKey(sessionKey string) error {
+	round, err := s.ensureRound(sessionKey)
+	if err != nil {
+		return err
+	}
+	if s.ring.IsLeader() {
+		return s.collectRoundKey(sessionKey, s.ring.Self().ID, round.keys.PubKey())
+	}
+	return s.sendTo(s.ring.Leader().ID, &runtime.Message{
+		Step: multiparty.StepRoundKey,
+		SessionKey: sessionKey,
+		Data: [][]byte{round.keys.PubKey()},
+	})
+}
+
+// collectRoundKey keeps the public shares on leader, and broadcasts all of them
+// once every party has sent its one
+func (s *MultiPartyRuntime) collectRoundKey(sessionKey, party string, pubKey []byte) error {
+	round, err := s.ensureRound(sessionKey)
+	if err != nil {
+		return err
+	}
+	if round.pubKeys == nil {
+		round.pubKeys = make(map[string][]byte)
+	}
+	if _, ok := round.pubKeys[party]; ok {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"party": party,
+		}).Warning("Received the round key of a party twice, skip")
+		return nil
+	}
+	round.pubKeys[party] = pubKey
+	if len(round.pubKeys) < s.ring.Size() {
+		return nil
+	}
+
+	jointKeys := make([][]byte, 0, s.ring.Size())
+	for _, party := range s.ring.Parties() {
+		jointKeys = append(jointKeys, round.pubKeys[party.ID])
+	}
+	round.pubKeys = nil
+	for _, party := range s.ring.Others() {
+		if err = s.sendTo(party.ID, &runtime.Message{
+			Step: multiparty.StepJointKey,
+			SessionKey: sessionKey,
+			Data: jointKeys,
+		}); err != nil {
+			return err
+		}
+	}
+	return s.submitSet(sessionKey, jointKeys)
+}
+
+// submitSet encrypts the polynomials of the whole set under the joint key, and
+// sends them to leader. Leader keeps its own ids to evaluate them at.
+func (s *MultiPartyRuntime) submitSet(sessionKey string, jointKeys [][]byte) error {
+	round, err := s.getRound(sessionKey)
+	if err != nil {
+		return err
+	}
+	if round.submitted {
+		log.WithField("session_key", sessionKey).Warning("The set is submitted twice, skip")
+		return nil
+	}
+	if len(jointKeys) != s.ring.Size() ||
+			string(jointKeys[s.ring.Index()]) != string(round.keys.PubKey()) {
+		err = errors.New("The joint key doesn't hold the round key of this party")
+		log.WithField("session_key", sessionKey).Error(err)
+		return err
+	}
+	round.jointKeys = jointKeys
+	round.submitted = true
+
+	ids, err := s.getIDs()
+	if err != nil {
+		return err
+	}
+	if s.ring.IsLeader() {
+		round.candidates = ids
+		return s.evaluateSets(sessionKey)
+	}
+
+	// an empty set is sent as well, or leader would wait for it
+	scalars, err := s.hashToScalars(ids)
+	if err != nil {
+		return err
+	}
+	encrypted, err := round.keys.EncryptSet(scalars, jointKeys)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to encrypt data")
+		return err
+	}
+	return s.sendTo(s.ring.Leader().ID, &runtime.Message{
+		Step: multiparty.StepSubmit,
+		SessionKey: sessionKey,
+		Data: encrypted,
+	})
+}
+
+// hashIDs maps the ids to the curve and hashes the points with the second hash
+func (s *MultiPartyRuntime) hashIDs(ids []string) ([][]byte, error) {
+	points, err := s.intersect.HashToPoints(ids)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to hash ids to curve")
+		return nil, err
+	}
+	return s.intersect.Finalize(points), nil
+}
+
+func (s *MultiPartyRuntime) hashToScalars(ids []string) ([]*big.Int, error) {
+	hashes, err := s.hashIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	return multiparty.Scalars(s.intersect.Curve(), hashes), nil
+}
+
+// collectSet keeps the encrypted sets on leader until the sets of all the
+// other parties arrive
+func (s *MultiPartyRuntime) collectSet(sessionKey, party string, items [][]byte) error {
+	round, err := s.getRound(sessionKey)
+	if err != nil {
+		return err
+	}
+	if round.sets == nil {
+		round.sets = make(map[string][][]byte)
+	}
+	if _, ok := round.sets[party]; ok {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"party": party,
+		}).Warning("Received the set of a party twice, skip")
+		return nil
+	}
+	round.sets[party] = items
+	return s.evaluateSets(sessionKey)
+}
+
+// evaluateSets evaluates the sets of the other parties at the own ids once all
+// of them arrive, and sends the sums round the ring to be decrypted
+func (s *MultiPartyRuntime) evaluateSets(sessionKey string) error {
+	round, err := s.getRound(sessionKey)
+	if err != nil {
+		return err
+	}
+	if !round.submitted || len(round.sets) < s.ring.Size() - 1 {
+		return nil
+	}
+
+	sets := make([][][]byte, 0, len(round.sets))
+	for _, party := range s.ring.Others() {
+		sets = append(sets, round.sets[party.ID])
+	}
+	round.sets = nil
+	scalars, err := s.hashToScalars(round.candidates)
+	if err != nil {
+		return err
+	}
+	sums, err := round.keys.Evaluate(scalars, sets)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to evaluate the sets")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"num_items": len(sums),
+	}).Info("Leader evaluated the sets of all the parties")
+	return s.sendTo(s.ring.Next().ID, &runtime.Message{
+		Step: multiparty.StepDecrypt,
+		SessionKey: sessionKey,
+		Data: sums,
+	})
+}
+
+// decryptSums removes the share of this party from the sums, and passes them
+// on, the last party sends them back to leader
+func (s *MultiPartyRuntime) decryptSums(sessionKey string, sums [][]byte) error {
+	round, err := s.getRound(sessionKey)
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := round.keys.Decrypt(sums)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to decrypt the sums")
+		return err
+	}
+	// the keys of round are no longer needed
+	delete(s.rounds, sessionKey)
+
+	return s.sendTo(s.ring.Next().ID, &runtime.Message{
+		Step: multiparty.StepDecrypt,
+		SessionKey: sessionKey,
+		Data: decrypted,
+	})
+}
+
+// openSums finds the own ids whose sums are zero on leader, and broadcasts
+// their hashes
+func (s *MultiPartyRuntime) openSums(sessionKey string, sums [][]byte) error {
+	round, err := s.getRound(sessionKey)
+	if err != nil {
+		return err
+	}
+	if len(sums) != len(round.candidates) {
+		err = errors.New(fmt.Sprintf("Got %d sums for %d ids", len(sums), len(round.candidates)))
+		log.WithField("session_key", sessionKey).Error(err)
+		return err
+	}
+
+	zeros, err := round.keys.Open(sums)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to open the sums")
+		return err
+	}
+	delete(s.rounds, sessionKey)
+
+	matchedID := make([]string, 0)
+	for i, zero := range zeros {
+		if zero {
+			matchedID = append(matchedID, round.candidates[i])
+		}
+	}
+	hashes, err := s.hashIDs(matchedID)
+	if err != nil {
+		return err
+	}
+	if err = ecdh.Shuffle(hashes); err != nil {
+		log.WithField("error", err).Error("Failed to shuffle the intersection")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"cardinality": len(hashes),
+	}).Info("Leader got the intersection of all the parties")
+	for _, party := range s.ring.Others() {
+		if err = s.sendTo(party.ID, &runtime.Message{
+			Step: multiparty.StepResult,
+			SessionKey: sessionKey,
+			Data: hashes,
+		}); err != nil {
+			return err
+		}
+	}
+	if len(matchedID) == 0 {
+		return nil
+	}
+	return s.sendMatchedId(matchedID)
+}
+
+func (s *MultiPartyRuntime) matchIntersection(sessionKey string, hashes [][]byte) error {
+	ids, err := s.getIDs()
+	if err != nil {
+		return err
+	}
+	ownHashes, err := s.hashIDs(ids)
+	if err != nil {
+		return err
+	}
+
+	hashIDMap := make(map[string]string)
+	for i, hash := range ownHashes {
+		hashIDMap[string(hash)] = ids[i]
+	}
+	matchedID := make([]string, 0)
+	for _, hash := range hashes {
+		if id, ok := hashIDMap[string(hash)]; ok {
+			matchedID = append(matchedID, id)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"num_matched": len(matchedID),
+		"num_hashes": len(hashes),
+	}).Info("Party matched the intersection of all the parties")
+	if len(matchedID) == 0 {
+		return nil
+	}
+	return s.sendMatchedId(matchedID)
+}
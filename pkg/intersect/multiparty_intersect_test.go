@@ -0,0 +1,144 @@
+package intersect
+
+import (
+	"time"
+	"testing"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/hasher"
+	"github.com/knwng/ppgi/pkg/algorithms/multiparty"
+)
+
+// chanConsumer delivers the messages put to its mailbox, nacked ones are put
+// back
+type chanConsumer struct {
+	mailbox 	chan runtime.Message
+}
+
+func (c *chanConsumer) Receive() ([]byte, error) {
+	msg := <-c.mailbox
+	return json.Marshal(&msg)
+}
+
+func (c *chanConsumer) ReceiveStruct() (runtime.Message, error) {
+	return <-c.mailbox, nil
+}
+
+func (c *chanConsumer) Ack(msg *runtime.Message) error {
+	return nil
+}
+
+func (c *chanConsumer) Nack(msg *runtime.Message) error {
+	c.mailbox <- *msg
+	return nil
+}
+
+func (c *chanConsumer) Close() {}
+
+// chanProducer sends to the mailbox of a chanConsumer
+type chanProducer struct {
+	mailbox 	chan runtime.Message
+}
+
+func (p *chanProducer) Send(payload []byte) error {
+	var msg runtime.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	p.mailbox <- msg
+	return nil
+}
+
+func (p *chanProducer) SendStruct(msg *runtime.Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.Send(payload)
+}
+
+func (p *chanProducer) GetConnectionInfo() string {
+	return "channel"
+}
+
+func (p *chanProducer) Close() {}
+
+// TestMultiParty runs a round among three parties, every party only puts the
+// ids held by all of them to matched_data
+func TestMultiParty(t *testing.T) {
+	graphFn := filepath.Join(t.TempDir(), "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(graphFn, []byte("nodes: []\n"), 0600))
+
+	parties := []multiparty.Party{
+		{ID: "bank_a", Topic: "ppgi_bank_a"},
+		{ID: "bank_b", Topic: "ppgi_bank_b"},
+		{ID: "bank_c", Topic: "ppgi_bank_c"},
+	}
+	sets := [][]string{
+		{"a", "b", "c", "d"},
+		{"b", "c", "d", "e"},
+		{"c", "d", "f"},
+	}
+	mailboxes := make(map[string]chan runtime.Message)
+	for _, party := range parties {
+		mailboxes[party.ID] = make(chan runtime.Message, 64)
+	}
+
+	runtimes := make([]*MultiPartyRuntime, len(parties))
+	kvs := make([]*memKV, len(parties))
+	for i, party := range parties {
+		ring, err := multiparty.NewRing(parties, party.ID)
+		assert.NoError(t, err)
+		producers := make(map[string]runtime.Producer)
+		for _, other := range ring.Others() {
+			producers[other.ID] = &chanProducer{mailbox: mailboxes[other.ID]}
+		}
+		intersect, err := ecdh.NewECDHIntersect("p256", &hasher.SHA256Hash{})
+		assert.NoError(t, err)
+		kvs[i] = newMemKV()
+		runtimes[i], err = NewMultiPartyRuntime(1, 10, intersect, ring, producers,
+			&chanConsumer{mailbox: mailboxes[party.ID]}, kvs[i], nil, graphFn)
+		assert.NoError(t, err)
+		assert.NoError(t, runtimes[i].addIDs(sets[i]))
+	}
+	runtimes[0].pending = true
+
+	done := make(chan error, len(runtimes))
+	for _, s := range runtimes {
+		go func(s *MultiPartyRuntime) { done <- s.Run() }(s)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, kv := range kvs {
+		for {
+			matched, err := kv.SetCheck("matched_data", []string{"c", "d"})
+			assert.NoError(t, err)
+			if matched[0] && matched[1] {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("The round didn't finish in time")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, s := range runtimes {
+		s.dispatcher.After(0, func() error { return runtime.Stop(nil) })
+	}
+	for range runtimes {
+		assert.NoError(t, <-done)
+	}
+
+	for _, kv := range kvs {
+		kv.mu.Lock()
+		assert.Equal(t, map[string]bool{"c": true, "d": true}, kv.sets["matched_data"])
+		kv.mu.Unlock()
+	}
+}
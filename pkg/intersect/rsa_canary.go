@@ -0,0 +1,162 @@
+package intersect
+
+import (
+	"time"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/padding"
+	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+)
+
+// Canaries are synthetic ids both sides agreed on out of band. They're mixed
+// into every batch of blinded ids of client and every batch of hashes of host,
+// so the hashes of the canaries must show up in every ClientUnblind and
+// HostHash message. Host computes the hashes of the canaries with its own key,
+// and client learns them by unblinding its own canaries. A batch missing any
+// of them flags the session as tampered, and no data is sent to the peer
+// afterwards. The canaries are never stored as ids, never matched, and never
+// exported to the graph.
+//
+// It's only a safety net: a peer that tells the canaries apart from the other
+// items can still lie about the rest.
+
+var errCanaryPending = errors.New("The hashes of canaries are not known yet")
+
+// SetCanaries mixes the canaries into every batch and checks them in every
+// batch of peer
+func (s *RSABlindRuntime) SetCanaries(canaries []string) error {
+	if s.mode == ModeUnbalanced {
+		return errors.New("Canaries are not supported in unbalanced mode")
+	}
+	if len(canaries) == 0 {
+		return errors.New("At least one canary should be set")
+	}
+
+	s.canaries = make(map[string]bool)
+	for _, canary := range canaries {
+		s.canaries[canary] = true
+	}
+	s.canaryList = getBoolMapKeys(s.canaries)
+	s.canaryHashes = make(map[string]map[string]bool)
+	s.canaryRequested = make(map[string]time.Time)
+	return nil
+}
+
+// withCanaries shuffles the canaries into the data, so the peer can't tell
+// them by position
+func (s *RSABlindRuntime) withCanaries(data []string) ([]string, error) {
+	if len(s.canaryList) == 0 {
+		return data, nil
+	}
+	mixed, err := padding.AppendShuffled(stringSliceToBytesSlice(data), stringSliceToBytesSlice(s.canaryList))
+	if err != nil {
+		log.WithField("error", err).Error("Failed to shuffle canaries into data")
+		return nil, err
+	}
+	return bytesSliceToStringSlice(mixed), nil
+}
+
+// splitCanaries separates the hashes of canaries from the ones of real ids
+func (s *RSABlindRuntime) splitCanaries(data []string, hashes [][]byte) ([]string, [][]byte, map[string]bool) {
+	if len(s.canaries) == 0 {
+		return data, hashes, nil
+	}
+	realData := make([]string, 0, len(data))
+	realHashes := make([][]byte, 0, len(hashes))
+	canaryHashes := make(map[string]bool)
+	for i, id := range data {
+		if s.canaries[id] {
+			canaryHashes[string(hashes[i])] = true
+		} else {
+			realData = append(realData, id)
+			realHashes = append(realHashes, hashes[i])
+		}
+	}
+	return realData, realHashes, canaryHashes
+}
+
+// hostCanaryHashes computes the hashes of the canaries under the key, which
+// host can do by itself
+func (s *RSABlindRuntime) hostCanaryHashes(key *rsa_blind.RingKey) map[string]bool {
+	if hashes, ok := s.canaryHashes[key.ID]; ok {
+		return hashes
+	}
+	hashes := make(map[string]bool)
+	for _, hash := range key.Intersect.HostOfflineHash(s.canaryList) {
+		hashes[string(hash)] = true
+	}
+	s.canaryHashes[key.ID] = hashes
+	return hashes
+}
+
+// checkCanaries flags the session as tampered if any hash of the canaries is
+// missing in the batch of peer
+func (s *RSABlindRuntime) checkCanaries(msg *runtime.Message, expected map[string]bool) bool {
+	found := make(map[string]bool)
+	for _, hash := range msg.Data {
+		if expected[string(hash)] {
+			found[string(hash)] = true
+		}
+	}
+	if len(found) != len(expected) {
+		s.flagTampered(msg.SessionKey, "canaries missing in the hashes of peer")
+		return false
+	}
+	return true
+}
+
+// requestCanaryHashes sends a batch of only the canaries when client doesn't
+// know their hashes under the key yet, the host hashes are retried until then
+func (s *RSABlindRuntime) requestCanaryHashes(key *rsa_blind.RingKey) error {
+	if _, ok := s.canaryHashes[key.ID]; ok {
+		return nil
+	}
+	if requestedAt, ok := s.canaryRequested[key.ID]; ok && time.Since(requestedAt) < time.Duration(s.connTimeout) * time.Second {
+		return nil
+	}
+	log.WithField("key_id", key.ID).Info("Client blinds the canaries to learn their hashes")
+	s.canaryRequested[key.ID] = time.Now()
+	return s.blindAndSend(key, []string{})
+}
+
+// learnCanaryHashes records the hashes of the canaries unblinded by client
+func (s *RSABlindRuntime) learnCanaryHashes(keyID string, hashes map[string]bool) {
+	if _, ok := s.canaryHashes[keyID]; ok || len(hashes) == 0 {
+		return
+	}
+	s.canaryHashes[keyID] = hashes
+	delete(s.canaryRequested, keyID)
+}
+
+// receiveHostHash matches the hashes of host after checking its canaries. The
+// batch is retried while the hashes of canaries are unknown, and client stops
+// when the batch doesn't match the commitment of host.
+func (s *RSABlindRuntime) receiveHostHash(msg *runtime.Message) error {
+	if s.canaries != nil {
+		expected, ok := s.canaryHashes[msg.KeyID]
+		if !ok {
+			log.WithField("session_key", msg.SessionKey).Info("Retry the hashes of host until the hashes of canaries are known")
+			return runtime.Retry(errCanaryPending)
+		}
+		if !s.checkCanaries(msg, expected) {
+			return nil
+		}
+	}
+
+	if s.mode == ModeClientOnly {
+		return s.matchClientOnly(msg)
+	}
+
+	if s.commitment {
+		err := s.matchCommitted(msg, rsa_blind.StepClientRequestProof)
+		if err == errNoCommitment || err == errCommitmentSize {
+			s.sendShutdown(msg.SessionKey, err.Error())
+			return runtime.Stop(err)
+		}
+		return err
+	}
+	return s.matchIDAndSendData(msg)
+}
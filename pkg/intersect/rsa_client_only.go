@@ -0,0 +1,68 @@
+package intersect
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+)
+
+// In client-only mode the client never sends its unblinded hashes back
+// (ClientUnblind is skipped), so only the client matches and learns the
+// intersection. The host can't tell which of its ids are matched, so it has
+// no data to send, and the client only sends the data of the matched ids to
+// host when the exchange policy allows it, which reveals them to host.
+
+const (
+	// ExchangeNone keeps the matched ids on client, no data is exchanged
+	ExchangeNone 			= "none"
+	// ExchangeClientToHost lets client send the data of the matched ids to host
+	ExchangeClientToHost 	= "client_to_host"
+)
+
+// SetExchange sets the direction data is exchanged in client-only mode
+func (s *RSABlindRuntime) SetExchange(exchange string) error {
+	if len(exchange) == 0 {
+		exchange = ExchangeNone
+	}
+	if exchange != ExchangeNone && exchange != ExchangeClientToHost {
+		return errors.New(fmt.Sprintf("Unsupported exchange policy: %s", exchange))
+	}
+	if s.mode != ModeClientOnly && exchange != ExchangeNone {
+		return errors.New("The exchange policy only applies to client_only mode")
+	}
+	s.exchange = exchange
+	return nil
+}
+
+// acceptsData tells whether the data sent by peer may be loaded
+func (s *RSABlindRuntime) acceptsData() bool {
+	if s.mode != ModeClientOnly {
+		return true
+	}
+	return s.role == "host" && s.exchange == ExchangeClientToHost
+}
+
+// matchClientOnly records the ids matched with the hashes of host, and only
+// sends their data when the policy allows
+func (s *RSABlindRuntime) matchClientOnly(msg *runtime.Message) error {
+	matchedID, err := s.getMatchedId(msg.KeyID, bytesSliceToStringSlice(msg.Data))
+	if err != nil {
+		return err
+	}
+
+	if s.exchange == ExchangeClientToHost {
+		return s.sendDataOfIDs(msg.SessionKey, msg.KeyID, matchedID)
+	}
+
+	if err = s.sendMatchedId(s.dropCanaries(matchedID)); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"session_key": msg.SessionKey,
+		"num_matched": len(matchedID),
+	}).Info("Client matched the hashes of host, no data is exchanged")
+	return nil
+}
@@ -0,0 +1,338 @@
+package intersect
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"math/big"
+	"crypto/rand"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/merkle"
+	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+)
+
+// With commitments each side commits to every batch with the merkle root of
+// its salted ids, padded with dummy leaves to the size of the batch, before
+// the peer processes it: the client before its blinded items are signed
+// (ClientCommit), and the host before its hashes are sent (HostCommit). The
+// peer refuses a batch whose size doesn't match the commitment, and when the
+// revealed hashes of a batch match its own ids it can demand a proof of
+// inclusion of each matched id (ClientRequestProof / HostRequestProof). The
+// data of the matched ids is only sent after every proof is verified, so a
+// party can't claim an id it didn't commit to before seeing any sign or hash
+// of the peer. A wrong proof aborts both sides.
+
+var (
+	errNoCommitment 		= errors.New("The batch is not committed")
+	errCommitmentSize 		= errors.New("The size of the batch doesn't match the commitment")
+	errCommitmentFormat 	= errors.New("Wrong format of commitment message")
+	errInclusionProof 		= errors.New("Failed to verify the proofs of inclusion")
+)
+
+type peerCommitment struct {
+	Root 		[]byte		`json:"root"`
+	Size 		int			`json:"size"`
+}
+
+type inclusionProof struct {
+	Hash 		[]byte		`json:"hash"`
+	Index 		int			`json:"index"`
+	Salt 		[]byte		`json:"salt"`
+	Path 		[][]byte	`json:"path"`
+}
+
+// pendingProof holds the ids matched in a peer batch until they're proven
+type pendingProof struct {
+	keyID 		string
+	// hash -> id
+	ids 		map[string]string
+	createdAt 	time.Time
+}
+
+// SetCommitment makes both sides commit to every batch, and demands proofs of
+// inclusion for the given fraction of the matched batches of peer
+func (s *RSABlindRuntime) SetCommitment(proofRate float64) error {
+	if s.mode == ModeUnbalanced || s.mode == ModeClientOnly {
+		return errors.New(fmt.Sprintf("Commitments are not supported in %s mode", s.mode))
+	}
+	if proofRate < 0 || proofRate > 1 {
+		return errors.New("The proof rate should be in [0, 1]")
+	}
+	s.commitment = true
+	s.proofRate = proofRate
+	s.pendingProofs = make(map[string]*pendingProof)
+	return nil
+}
+
+// commitAndSend keeps the openings of the batch and sends its root, it must
+// be sent before the batch itself
+func (s *RSABlindRuntime) commitAndSend(keyID, sessionKey string, data []string, numDummies int, step runtime.Step) error {
+	commitment, err := merkle.Commit(data, numDummies)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to commit to the batch")
+		return err
+	}
+
+	encoded, err := json.Marshal(commitment.Openings)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to marshal openings to json")
+		return err
+	}
+	if err = s.kv.HashPut(kvName("commitment", keyID), map[string]string{sessionKey: string(encoded)}); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to put openings to kv")
+		return err
+	}
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: sessionKey,
+		KeyID: keyID,
+		Data: [][]byte{commitment.Root(), rsa_blind.IntToBytes(commitment.Size())},
+	})
+}
+
+func (s *RSABlindRuntime) receiveCommitment(msg *runtime.Message) error {
+	if len(msg.Data) != 2 {
+		log.WithField("session_key", msg.SessionKey).Error(errCommitmentFormat)
+		return errCommitmentFormat
+	}
+
+	encoded, err := json.Marshal(&peerCommitment{
+		Root: msg.Data[0],
+		Size: rsa_blind.BytesToInt(msg.Data[1]),
+	})
+	if err != nil {
+		log.WithField("error", err).Error("Failed to marshal commitment to json")
+		return err
+	}
+	if err = s.kv.HashPut(kvName("peer_commitment", msg.KeyID), map[string]string{msg.SessionKey: string(encoded)}); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to put commitment of peer to kv")
+		return err
+	}
+	return nil
+}
+
+func (s *RSABlindRuntime) getPeerCommitment(keyID, sessionKey string) (*peerCommitment, error) {
+	encoded, err := s.kv.HashGet(kvName("peer_commitment", keyID), sessionKey)
+	if err != nil {
+		if runtime.IsNotFound(err) {
+			return nil, errNoCommitment
+		}
+		log.WithFields(log.Fields{
+			"session_key": sessionKey,
+			"error": err,
+		}).Error("Failed to get commitment of peer from kv")
+		return nil, err
+	}
+
+	commitment := &peerCommitment{}
+	if err = json.Unmarshal([]byte(encoded), commitment); err != nil {
+		log.WithField("error", err).Error("Failed to unmarshal commitment of peer")
+		return nil, err
+	}
+	return commitment, nil
+}
+
+// checkCommittedSize refuses a peer batch that is not committed, or whose size
+// differs from the commitment
+func (s *RSABlindRuntime) checkCommittedSize(msg *runtime.Message) error {
+	commitment, err := s.getPeerCommitment(msg.KeyID, msg.SessionKey)
+	if err != nil {
+		return err
+	}
+	if commitment.Size != len(msg.Data) {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"committed": commitment.Size,
+			"size": len(msg.Data),
+		}).Error(errCommitmentSize)
+		return errCommitmentSize
+	}
+	return nil
+}
+
+// matchCommitted matches the revealed hashes of a peer batch, and demands the
+// proofs of the matched ids before sending their data
+func (s *RSABlindRuntime) matchCommitted(msg *runtime.Message, requestStep runtime.Step) error {
+	if err := s.checkCommittedSize(msg); err != nil {
+		return err
+	}
+
+	hashes := bytesSliceToStringSlice(msg.Data)
+	ret, err := s.kv.HashMultiGet(kvName("hash_id_map", msg.KeyID), hashes)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get matched id")
+		return err
+	}
+	ids, index := runtime.GetExistingStringAndIndex(ret)
+	if len(ids) == 0 {
+		log.WithField("session_key", msg.SessionKey).Warn("No hash matched")
+		return nil
+	}
+
+	if demand, err := s.demandProof(); err != nil || !demand {
+		return s.sendDataOfIDs(msg.SessionKey, msg.KeyID, ids)
+	}
+
+	pending := &pendingProof{
+		keyID: msg.KeyID,
+		ids: make(map[string]string),
+		createdAt: time.Now(),
+	}
+	matched := make([][]byte, len(ids))
+	for i, id := range ids {
+		matched[i] = msg.Data[index[i]]
+		pending.ids[hashes[index[i]]] = id
+	}
+	s.pendingProofs[msg.SessionKey] = pending
+
+	log.WithFields(log.Fields{
+		"session_key": msg.SessionKey,
+		"num_matched": len(ids),
+	}).Info("Demand the proofs of inclusion of the matched ids")
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: requestStep,
+		SessionKey: msg.SessionKey,
+		KeyID: msg.KeyID,
+		Data: matched,
+	})
+}
+
+func (s *RSABlindRuntime) demandProof() (bool, error) {
+	if s.proofRate >= 1 {
+		return true, nil
+	}
+	const scale = 1000000
+	r, err := rand.Int(rand.Reader, big.NewInt(scale))
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate random number")
+		return false, err
+	}
+	return float64(r.Int64()) < s.proofRate * scale, nil
+}
+
+// sendProofs opens the leaves of the requested hashes in own batch, the ones
+// not in the batch are left out
+func (s *RSABlindRuntime) sendProofs(msg *runtime.Message, proofStep runtime.Step) error {
+	encoded, err := s.kv.HashGet(kvName("commitment", msg.KeyID), msg.SessionKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to get openings from kv")
+		return err
+	}
+	openings := make([]merkle.Opening, 0)
+	if err = json.Unmarshal([]byte(encoded), &openings); err != nil {
+		log.WithField("error", err).Error("Failed to unmarshal openings")
+		return err
+	}
+	commitment, err := merkle.NewCommitment(openings)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to rebuild the commitment")
+		return err
+	}
+
+	ret, err := s.kv.HashMultiGet(kvName("hash_id_map", msg.KeyID), bytesSliceToStringSlice(msg.Data))
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get ids of requested hashes")
+		return err
+	}
+	ids, index := runtime.GetExistingStringAndIndex(ret)
+
+	proofs := make([][]byte, 0, len(ids))
+	for i, id := range ids {
+		leafIndex, salt, path, ok := commitment.Prove(id)
+		if !ok {
+			log.WithField("session_key", msg.SessionKey).Warning("The requested id is not in the batch")
+			continue
+		}
+		proof, err := json.Marshal(&inclusionProof{
+			Hash: msg.Data[index[i]],
+			Index: leafIndex,
+			Salt: salt,
+			Path: path,
+		})
+		if err != nil {
+			log.WithField("error", err).Error("Failed to marshal proof to json")
+			return err
+		}
+		proofs = append(proofs, proof)
+	}
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: proofStep,
+		SessionKey: msg.SessionKey,
+		KeyID: msg.KeyID,
+		Data: proofs,
+	})
+}
+
+// verifyProofs sends the data of the matched ids once every one of them is
+// proven to be in the committed batch, and fails otherwise
+func (s *RSABlindRuntime) verifyProofs(msg *runtime.Message) error {
+	pending, ok := s.pendingProofs[msg.SessionKey]
+	if !ok {
+		log.WithField("session_key", msg.SessionKey).Warning("No proof is pending for the session, drop it")
+		return nil
+	}
+	delete(s.pendingProofs, msg.SessionKey)
+
+	commitment, err := s.getPeerCommitment(pending.keyID, msg.SessionKey)
+	if err != nil {
+		return err
+	}
+
+	proven := make(map[string]bool)
+	for _, encoded := range msg.Data {
+		proof := &inclusionProof{}
+		if err = json.Unmarshal(encoded, proof); err != nil {
+			log.WithField("error", err).Error("Failed to unmarshal proof")
+			return errInclusionProof
+		}
+		id, ok := pending.ids[string(proof.Hash)]
+		if !ok {
+			continue
+		}
+		leaf := merkle.LeafHash(proof.Salt, []byte(id))
+		if !merkle.Verify(commitment.Root, leaf, proof.Index, commitment.Size, proof.Path) {
+			log.WithField("session_key", msg.SessionKey).Error("Invalid proof of inclusion")
+			return errInclusionProof
+		}
+		proven[id] = true
+	}
+
+	for _, id := range pending.ids {
+		if !proven[id] {
+			log.WithField("session_key", msg.SessionKey).Error("A matched id is not proven")
+			return errInclusionProof
+		}
+	}
+
+	log.WithField("session_key", msg.SessionKey).Info("Verified the proofs of inclusion")
+	return s.sendDataOfIDs(msg.SessionKey, pending.keyID, getBoolMapKeys(proven))
+}
+
+// prunePendingProofs drops the matched ids whose proofs are not received in
+// time, their data is never sent
+func (s *RSABlindRuntime) prunePendingProofs() {
+	for sessionKey, pending := range s.pendingProofs {
+		if time.Since(pending.createdAt) > time.Duration(s.connTimeout) * time.Second {
+			log.WithField("session_key", sessionKey).Warning("No proof is received in time, drop the matched ids")
+			delete(s.pendingProofs, sessionKey)
+		}
+	}
+}
@@ -5,72 +5,82 @@ import (
 	"time"
 	"errors"
 	"math/big"
-	"io/ioutil"
-	"encoding/json"
-	"gopkg.in/yaml.v2"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/knwng/ppgi/pkg/graph"
 	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/filter"
+	"github.com/knwng/ppgi/pkg/algorithms/padding"
 	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
 )
 
+// the ids stored under the last key are scanned and re-hashed in pages of
+// about this size when the key rotates
+const rehashBatchSize = 1000
+
+// RSABlindRuntime can hold several keys at the same time. Every message and kv
+// entry is stamped with the id of the key it's computed with, new data always
+// goes with the current key, and the data of older keys is still served until
+// the keys expire
 type RSABlindRuntime struct {
-	role 				string
-	fetchInterval 		int
-	connTimeout			int
-	algorithm			string
-	intersect 			*rsa_blind.RSABlindIntersect
-	producer 			runtime.Producer
-	consumer 			runtime.Consumer
-	kv 					runtime.KV
-	graphClient			*graph.NebulaReadWriter
-	graphDefinition		*graph.Graph
-	// nodes			[]graph.PrincipleNode
-	lastGraphFetchTime 	*time.Time
+	baseRuntime
+	keys 				*rsa_blind.KeyRing
+	mode 				string
+	// exchange is the direction data is exchanged in client-only mode
+	exchange 			string
+	filterCapacity 		uint64
+	filterFPRate 		float64
+	filters 			map[string]*filter.BloomFilter
+	// client only, the filters being received in shards, by session key
+	filterShards 		map[string]*filterAssembly
+	// padding hides the sizes of the batches, nil means no padding
+	padding 			*padding.Padding
+	// commitment binds both sides to every batch before the peer processes it
+	commitment 			bool
+	proofRate 			float64
+	pendingProofs 		map[string]*pendingProof
+	// the canaries in random order, and their hashes by key id
+	canaryList 			[]string
+	canaryHashes 		map[string]map[string]bool
+	// client only, when the canaries were last blinded by key id
+	canaryRequested 	map[string]time.Time
 }
 
 func NewRSABlindRuntime(role string, fetchInterval int, connTimeout int,
-		intersect *rsa_blind.RSABlindIntersect, producer runtime.Producer,
+		keys *rsa_blind.KeyRing, mode string, producer runtime.Producer,
 		consumer runtime.Consumer, kv runtime.KV, graphClient *graph.NebulaReadWriter,
 		graphDefinitionFn string) (*RSABlindRuntime, error) {
 
-	data, err := ioutil.ReadFile(graphDefinitionFn)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"graph_definition_fn": graphDefinitionFn,
-			"error": err,
-		}).Fatal("Failed to read graph definition data")
-	}
-
-	graphDefinition := graph.Graph{}
-
-	if err = yaml.Unmarshal(data, &graphDefinition); err != nil {
-		log.Fatal("Failed to unmarshal graph definition")
+	mode, ok := checkMode(mode, ModeUnbalanced, ModeClientOnly)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported mode of rsa: %s", mode))
 	}
 
-	reverseMap := make(map[string]*graph.Node)
-	for _, node := range graphDefinition.Nodes {
-		reverseMap[node.Type] = &node
+	base, err := newBaseRuntime(role, "rsa", fetchInterval, connTimeout,
+		producer, consumer, kv, graphClient, graphDefinitionFn)
+	if err != nil {
+		return nil, err
 	}
 
-	graphDefinition.ReverseNodeMap = reverseMap
-
 	return &RSABlindRuntime{
-		role: role,
-		fetchInterval: fetchInterval,
-		connTimeout: connTimeout,
-		algorithm: "rsa",
-		intersect: intersect,
-		producer: producer,
-		consumer: consumer,
-		kv: kv,
-		graphClient: graphClient,
-		graphDefinition: &graphDefinition,
+		baseRuntime: base,
+		keys: keys,
+		mode: mode,
+		filterCapacity: defaultFilterCapacity,
+		filterFPRate: defaultFilterFPRate,
+		filters: make(map[string]*filter.BloomFilter),
+		filterShards: make(map[string]*filterAssembly),
+		exchange: ExchangeNone,
 	}, nil
 }
 
+// SetPadding pads every batch of blinded items, hashes and unblinded hashes
+// with dummies, which are dropped before anything is stored to kv
+func (s *RSABlindRuntime) SetPadding(p *padding.Padding) {
+	s.padding = p
+}
+
 func (s *RSABlindRuntime) Run() error {
 	if s.role == "client" {
 		return s.runClient()
@@ -82,669 +92,640 @@ func (s *RSABlindRuntime) Run() error {
 }
 
 func (s *RSABlindRuntime) runClient() error {
-	// get data from consumer
-	msgChan := make(chan runtime.Message)
-	go s.receiveMessage(msgChan)
-
-	fetchGraphTicker := time.NewTicker(time.Duration(s.fetchInterval) * time.Second)
-	defer fetchGraphTicker.Stop()
-
-	log.Info("Waiting for incoming message")
-	// client loop
-	for {
-		select {
-		case <-fetchGraphTicker.C:
-			log.Info("Fetch data from graph database periodically")
-			// check whether key exchanging finished
-			if !s.intersect.HasPubKey() {
-				log.Warn("The client hasn't got pubkey yet, skip")
-				continue
-			}
-
-			// fetch data
-			data, newTime, err := s.lookupNewData()
-			if err != nil {
-				log.Errorf("Failed to fetch data from graph database, err: %s", err)
-				continue
-			}
-
-			if len(data) == 0 {
-				var lastTime string
-				if s.lastGraphFetchTime == nil {
-					lastTime = "no start time"
-				} else {
-					lastTime = s.lastGraphFetchTime.String()
-				}
-				log.WithFields(log.Fields{
-					"start_time": lastTime,
-					"end_time": newTime,
-				}).Info("No new data found in graph database")
-				s.lastGraphFetchTime = &newTime
-				continue
-			}
-
-			yb, rands, err := s.intersect.ClientBlinding(data)
-			if err != nil {
-				log.WithField("data", data).Errorf("ClientBlinding failed, err: %s", err)
-				continue
-			}
+	s.onFetch(func() error {
+		// check whether key exchanging finished
+		key := s.keys.Current(time.Now())
+		if key == nil {
+			log.Warn("The client hasn't got a valid pubkey yet, skip")
+			return nil
+		}
 
-			// send message to mq
-			step := rsa_blind.StepClientBlind
-			sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
-
-			if err = s.sendMessageOrError(&runtime.Message{
-				Algorithm: s.algorithm,
-				Step: step,
-				SessionKey: sessionKey,
-				Data: rsa_blind.BigIntsToBytesSlice(yb),
-			}); err != nil {
-				continue
-			}
+		if err := s.rotateKey(key); err != nil {
+			return err
+		}
 
-			// Send original data to kv
-			if err = s.sendOriginData(sessionKey, data); err != nil {
-				continue
-			}
+		if s.commitment {
+			s.prunePendingProofs()
+		}
 
-			// Send rands to kv
-			if err = s.sendRands(sessionKey, rands); err != nil {
-				continue
-			}
+		if s.canaries != nil {
+			s.requestCanaryHashes(key)
+		}
 
-			s.lastGraphFetchTime = &newTime
-			log.Info("Client got new data from db, blind it, and send to host")
-		case msg := <-msgChan:
-			// process received message
-			switch msg.Step {
-			case rsa_blind.StepHostSendPubKey:
-				log.Info("Client received pubkey from host")
-				if s.intersect.HasPubKey() {
-					log.Warning("Client has already had pubkey, skip")
-				}
-
-				if len(msg.Key.N) == 0 || msg.Key.E <= 0 {
-					log.WithField("msg", msg).Warning("Client received invalid pubkey")
-					s.sendShutdown(msg.SessionKey)
-					continue
-				}
-
-				s.intersect.SetPubKey(msg.Key.N, msg.Key.E)
-
-				// send ack message
-				s.sendMessageOrError(&runtime.Message{
-					Algorithm: s.algorithm,
-					Step: rsa_blind.StepClientRcvPubKey,
-					SessionKey: msg.SessionKey,
-				})
-			case rsa_blind.StepHostBlindSign:
-				log.Info("Client starts to unblind signs from host")
-
-				// get rands from kv
-				rands, err := s.getRands(msg.SessionKey)
-				if err != nil {
-					continue
-				}
-
-				tb := s.intersect.ClientUnblinding(rsa_blind.BytesSliceToBigInts(msg.Data), rands)
-
-				s.sendMessageOrError(&runtime.Message{
-					Algorithm: s.algorithm,
-					Step: rsa_blind.StepClientUnblind,
-					SessionKey: msg.SessionKey,
-					Data: tb,
-				})
-
-				// get origin data
-				data, err := s.getOriginData(msg.SessionKey)
-				if err != nil {
-					continue
-				}
-
-				// combine hash and data, and send to kv
-				if err = s.createAndSendHashIDMap(data, tb); err != nil {
-					continue
-				}
-
-				// delete rands
-				s.delRands(msg.SessionKey)
-				log.Info("Client unblind the sign from host and send the hash to host")
-			case rsa_blind.StepHostHash:
-				// compare hash with current ID
-				log.Info("Client starts to compare hash from host")
-				if err := s.matchIDAndSendData(&msg); err != nil {
-					continue
-				}
-			case rsa_blind.StepExchangeData:
-				// load data to nebula graph
-				if err := s.loadDataToGraphDB(&msg); err != nil {
-					continue
-				}
-			default:
-				log.WithField("msg", msg).Warning("Client received a message with wrong step")
-				continue
-			}
+		if _, ok := s.filters[key.ID]; s.mode == ModeUnbalanced && !ok && !s.assemblingFilter(key.ID) {
+			log.WithField("key_id", key.ID).Info("Client hasn't got the filter of host yet, request it")
+			s.requestFilter(key.ID)
 		}
-		
-	}
-}
 
-func (s *RSABlindRuntime) runHost() error {
-	// pubkey exchange
-	s.pubKeyExchange()
+		// fetch data
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
 
-	// receive message from consumer
-	msgChan := make(chan runtime.Message)
-	go s.receiveMessage(msgChan)
+		if err := s.blindAndSend(key, data); err != nil {
+			return err
+		}
 
-	fetchGraphTicker := time.NewTicker(time.Duration(s.fetchInterval) * time.Second)
-	defer fetchGraphTicker.Stop()
+		s.lastGraphFetchTime = &newTime
+		log.Info("Client got new data from db, blind it, and send to host")
+		return nil
+	})
+
+	s.handle(rsa_blind.StepHostSendPubKey, s.receivePubKey)
+	s.handle(rsa_blind.StepHostBlindSign, s.unblindSigns)
+	s.handle(rsa_blind.StepHostCommit, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Client received the commitment of host")
+		return s.receiveCommitment(msg)
+	})
+	s.handle(rsa_blind.StepHostHash, func(msg *runtime.Message) error {
+		// compare hash with current ID
+		log.Info("Client starts to compare hash from host")
+		return s.receiveHostHash(msg)
+	})
+	s.handle(rsa_blind.StepHostRequestProof, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Client starts to prove the ids requested by host")
+		return s.sendProofs(msg, rsa_blind.StepClientProof)
+	})
+	s.handle(rsa_blind.StepHostProof, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Client starts to verify the proofs from host")
+		err := s.verifyProofs(msg)
+		if err == errInclusionProof {
+			s.sendShutdown(msg.SessionKey, err.Error())
+			return runtime.Stop(err)
+		}
+		return err
+	})
+	s.handle(rsa_blind.StepHostFilter, s.receiveFilterOf)
+	s.handle(rsa_blind.StepHostFilterDelta, s.receiveFilterOf)
+	s.handle(rsa_blind.StepHostConfirm, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Client received the hashes confirmed by host")
+		return s.receiveConfirmed(msg)
+	})
+	s.handle(rsa_blind.StepExchangeData, func(msg *runtime.Message) error {
+		if !s.acceptsData() {
+			log.WithField("session_key", msg.SessionKey).Warning("No data is accepted from host in this mode, drop it")
+			return nil
+		}
+		// load data to nebula graph
+		return s.loadDataToGraphDB(msg)
+	})
+	s.handle(rsa_blind.StepShutdown, s.stopOnShutdown)
 
 	log.Info("Waiting for incoming message")
-	// host loop
-	for {
-		select {
-		case <-fetchGraphTicker.C:
-			log.Info("Fetch data from graph database periodically")
-			data, newTime, err := s.lookupNewData()
-			if err != nil {
-				log.Errorf("Failed to fetch data from graph database, err: %s", err)
-				continue
-			}
-
-			if len(data) == 0 {
-				var lastTime string
-				if s.lastGraphFetchTime == nil {
-					lastTime = "no start time"
-				} else {
-					lastTime = s.lastGraphFetchTime.String()
-				}
-				log.WithFields(log.Fields{
-					"start_time": lastTime,
-					"end_time": newTime,
-				}).Info("No new data found in graph database")
-				s.lastGraphFetchTime = &newTime
-				continue
-			}
-
-			ta := s.intersect.HostOfflineHash(data)
-
-			// send hash-data map to kv
-			hashDataMap := make(map[string]string)
-			for i, hash := range ta {
-				hashDataMap[string(hash)] = data[i]
-			}
-			if err = s.kv.HashPut("hash_id_map", hashDataMap); err != nil {
-				log.WithFields(log.Fields{
-					"hash_data_map": hashDataMap,
-					"error": err,
-				}).Error("Failed to send hash-data map to kv")
-				continue
-			}
-
-			step := rsa_blind.StepHostHash
+	return s.dispatcher.Run()
+}
 
-			sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+func (s *RSABlindRuntime) receivePubKey(msg *runtime.Message) error {
+	log.Info("Client received pubkey from host")
+	if len(msg.Key.N) == 0 || msg.Key.E <= 0 {
+		log.WithField("msg", msg).Warning("Client received invalid pubkey")
+		s.sendShutdown(msg.SessionKey, "invalid pubkey")
+		return runtime.Stop(errors.New("Client received invalid pubkey"))
+	}
 
-			if err = s.sendMessageOrError(&runtime.Message{
-				Algorithm: s.algorithm,
-				Step: step,
-				SessionKey: sessionKey,
-				Data: ta,
-			}); err != nil {
-				continue
-			}
+	fingerprint := rsa_blind.PubKeyFingerprint(msg.Key.N, msg.Key.E)
+	if len(msg.Key.ID) > 0 && msg.Key.ID != fingerprint {
+		log.WithFields(log.Fields{
+			"key_id": msg.Key.ID,
+			"fingerprint": fingerprint,
+		}).Warning("The key id doesn't match the fingerprint of pubkey")
+		s.sendShutdown(msg.SessionKey, "key id mismatch")
+		return runtime.Stop(errors.New(fmt.Sprintf("The key id %s doesn't match the fingerprint of pubkey %s",
+			msg.Key.ID, fingerprint)))
+	}
 
-			s.lastGraphFetchTime = &newTime
-			log.Info("Host got data from graph db, calculated hash and sent it to client")
-		case msg := <-msgChan:
-			// process message received from mq
-			switch msg.Step {
-			case rsa_blind.StepClientBlind:
-				log.Info("Host starts to blind sign hash from client")
-				zb := s.intersect.HostBlindSigning(rsa_blind.BytesSliceToBigInts(msg.Data))
-				s.sendMessageOrError(&runtime.Message{
-					Algorithm: s.algorithm,
-					Step: rsa_blind.StepHostBlindSign,
-					SessionKey: msg.SessionKey,
-					Data: rsa_blind.BigIntsToBytesSlice(zb),
-				})
-			case rsa_blind.StepClientUnblind:
-				// compare hash with current ID
-				log.Info("Host starts to compare hash from client")
-				if err := s.matchIDAndSendData(&msg); err != nil {
-					continue
-				}
-			case rsa_blind.StepClientRcvPubKey:
-				// consume reluctant pubkey ack message
-				log.Info("Host received pubkey ack from client after key exchange, skip")
-			case rsa_blind.StepExchangeData:
-				// load data to nebula graph
-				if err := s.loadDataToGraphDB(&msg); err != nil {
-					continue
-				}
-			default:
-				log.WithField("msg", msg).Warning("Host received a message with wrong step")
-				continue
-			}
-		}
+	if _, ok := s.keys.Get(fingerprint); ok {
+		log.WithField("key_id", fingerprint).Warning("Client has already had the pubkey, update it")
+	}
+	key, err := s.keys.AddPubKey(msg.Key.N, msg.Key.E,
+		unixToTime(msg.Key.NotBefore), unixToTime(msg.Key.NotAfter))
+	if err != nil {
+		log.WithField("error", err).Error("Failed to add pubkey to key ring")
+		return runtime.Stop(err)
 	}
+	log.WithFields(log.Fields{
+		"key_id": key.ID,
+		"not_before": key.NotBefore,
+		"not_after": key.NotAfter,
+	}).Info("Client added pubkey to key ring")
 
+	// send ack message
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: rsa_blind.StepClientRcvPubKey,
+		SessionKey: msg.SessionKey,
+		KeyID: key.ID,
+	})
 }
 
+func (s *RSABlindRuntime) unblindSigns(msg *runtime.Message) error {
+	log.Info("Client starts to unblind signs from host")
+	key, err := s.getUnexpiredKey(msg.KeyID)
+	if err != nil {
+		s.cleanSession(msg.KeyID, msg.SessionKey)
+		return err
+	}
 
-func (s *RSABlindRuntime) lookupNewData() ([]string, time.Time, error) {
-	totalData := make([]string, 0)
-
-	current := time.Now()
+	// get rands from kv
+	rands, err := s.getRands(key.ID, msg.SessionKey)
+	if err != nil {
+		return err
+	}
 
-	for _, node := range s.graphDefinition.Nodes {
-		data, err := s.graphClient.LookupWithTimeLimit(&node, s.lastGraphFetchTime, &current)
-		if err != nil {
-			return []string{}, time.Time{}, errors.New(fmt.Sprintf("Faield to look up node %+v in nebula graph, err: %s", node, err))
+	// verify the signs before using them, the ones of the dummies
+	// padded after the items are dropped
+	zb := rsa_blind.BytesSliceToBigInts(msg.Data)
+	if len(zb) < len(rands) {
+		err = errors.New(fmt.Sprintf("Host returned %d signs for %d items", len(zb), len(rands)))
+		s.abortSession(key.ID, msg.SessionKey, err)
+		return runtime.Stop(err)
+	}
+	numDummies := len(zb) - len(rands)
+	zb = zb[:len(rands)]
+	if err = s.verifyBlindSigning(key, msg.SessionKey, zb); err != nil {
+		if _, ok := err.(*rsa_blind.InvalidSignError); ok {
+			s.abortSession(key.ID, msg.SessionKey, err)
+			return runtime.Stop(err)
 		}
-		totalData = append(totalData, data...)
+		return err
 	}
 
-	return totalData, current, nil
-}
+	tb := key.Intersect.ClientUnblinding(zb, rands)
 
-func (s *RSABlindRuntime) receiveMessage(c chan runtime.Message) {
-	for {
-		msg, err := s.consumer.ReceiveStruct()
+	// the hashes are kept from host in client-only mode
+	if s.mode != ModeClientOnly {
+		paddedTb, err := s.padHashes(key, tb, numDummies)
 		if err != nil {
-			log.WithField("error", err).Warning("Client failed to receive message")
-			continue
+			return err
 		}
-		c <- msg
+		s.sendMessageOrError(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: rsa_blind.StepClientUnblind,
+			SessionKey: msg.SessionKey,
+			KeyID: key.ID,
+			Data: paddedTb,
+		})
 	}
-}
 
-func (s *RSABlindRuntime) sendShutdown(sessionKey string) {
-	if err := s.producer.SendStruct(&runtime.Message{
-		Algorithm: s.algorithm,
-		Step: rsa_blind.StepShutdown,
-	}); err != nil {
-		log.WithFields(log.Fields{
-			"connection_info": s.producer.GetConnectionInfo(),
-			"session_key": sessionKey,
-			"error": err,
-		}).Fatal("Failed to send shutdown message")
+	// get origin data
+	data, err := s.getOriginData(key.ID, msg.SessionKey)
+	if err != nil {
+		return err
 	}
-}
 
-func (s *RSABlindRuntime) sendMessageOrError(msg *runtime.Message) error {
-	if err := s.producer.SendStruct(msg); err != nil {
-		log.WithFields(log.Fields{
-			"connection_info": s.producer.GetConnectionInfo(),
-			"session_key": msg.SessionKey,
-			"error": err,
-		}).Error("Failed to send message to mq")
+	// the canaries are never stored as ids
+	data, tb, canaryHashes := s.splitCanaries(data, tb)
+
+	// combine hash and data, and send to kv
+	if err = s.createAndSendHashIDMap(key.ID, data, tb); err != nil {
 		return err
 	}
+
+	if s.mode == ModeUnbalanced {
+		hashIDMap := make(map[string]string)
+		for i, hash := range tb {
+			hashIDMap[string(hash)] = data[i]
+		}
+		s.matchWithFilter(key.ID, msg.SessionKey, hashIDMap)
+	}
+
+	// delete rands
+	s.delRands(key.ID, msg.SessionKey)
+	s.delBlindedData(key.ID, msg.SessionKey)
+	log.Info("Client unblind the sign from host and send the hash to host")
+
+	s.learnCanaryHashes(key.ID, canaryHashes)
 	return nil
 }
 
+func (s *RSABlindRuntime) receiveFilterOf(msg *runtime.Message) error {
+	log.Info("Client starts to match with the filter from host")
+	return s.receiveFilter(msg)
+}
 
-func (s *RSABlindRuntime) getRands(sessionKey string) ([]*big.Int, error) {
-	randsStr, err := s.kv.HashGet("rand", sessionKey)
-	if err != nil {
-		log.WithField("error", err).Warning("Failed to get rands from kv")
-		return []*big.Int{}, err
-	}
+func (s *RSABlindRuntime) runHost() error {
+	s.onFetch(func() error {
+		key := s.keys.Current(time.Now())
+		if key == nil {
+			log.Error("The host has no valid key, skip")
+			return nil
+		}
 
-	rands := make([]*big.Int, 0)
+		if err := s.rotateKey(key); err != nil {
+			return err
+		}
 
-	if err := json.Unmarshal([]byte(randsStr), &rands); err != nil {
-		log.WithFields(log.Fields{
-			"rands_str": randsStr,
-			"error": err,
-		}).Warning("Failed to unmarshal rand message")
-		return []*big.Int{}, err
-	}
+		if s.commitment {
+			s.prunePendingProofs()
+		}
 
-	return rands, nil
-}
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
 
-func (s *RSABlindRuntime) sendRands(sessionKey string, rands []*big.Int) error {
-	encodedRands, err := json.Marshal(rands)
-	if err != nil {
-		log.WithField("error", err).Error("Failed to marshal rands to json")
-		return err
-	}
+		if err := s.hashAndSend(key, data); err != nil {
+			return err
+		}
 
-	if err = s.kv.HashPut("rand", map[string]string{sessionKey: string(encodedRands)}); err != nil {
-		log.WithField("error", err).Error("Failed to send rands to kv")
+		s.lastGraphFetchTime = &newTime
+		log.Info("Host got data from graph db, calculated hash and sent it to client")
+		return nil
+	})
+
+	s.handle(rsa_blind.StepClientCommit, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Host received the commitment of client")
+		return s.receiveCommitment(msg)
+	})
+	s.handle(rsa_blind.StepClientBlind, s.blindSign)
+	s.handle(rsa_blind.StepClientUnblind, s.matchClientHashes)
+	s.handle(rsa_blind.StepClientRequestProof, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Host starts to prove the ids requested by client")
+		if _, err := s.getUnexpiredKey(msg.KeyID); err != nil {
+			return err
+		}
+		return s.sendProofs(msg, rsa_blind.StepHostProof)
+	})
+	s.handle(rsa_blind.StepClientProof, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Host starts to verify the proofs from client")
+		err := s.verifyProofs(msg)
+		if err == errInclusionProof {
+			s.sendShutdown(msg.SessionKey, err.Error())
+			return runtime.Stop(err)
+		}
 		return err
-	}
+	})
+	s.handle(rsa_blind.StepClientRequestFilter, func(msg *runtime.Message) error {
+		log.Info("Host received filter request from client")
+		key, err := s.getUnexpiredKey(msg.KeyID)
+		if err != nil {
+			return err
+		}
+		return s.publishFilter(key, msg.SessionKey)
+	})
+	s.handle(rsa_blind.StepClientConfirm, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Host starts to confirm the filter hits of client")
+		return s.confirmHashes(msg)
+	})
+	s.handle(rsa_blind.StepExchangeData, func(msg *runtime.Message) error {
+		if !s.acceptsData() {
+			log.WithField("session_key", msg.SessionKey).Warning("No data is accepted from client by the exchange policy, drop it")
+			return nil
+		}
+		// load data to nebula graph
+		return s.loadDataToGraphDB(msg)
+	})
+	s.handle(rsa_blind.StepShutdown, s.stopOnShutdown)
 
-	return nil
+	// pubkey exchange, StepClientRcvPubKey is handled by it
+	s.pubKeyExchange()
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
 }
 
-func (s *RSABlindRuntime) delRands(sessionKey string) error {
-	if err := s.kv.HashDel("rand", []string{sessionKey}); err != nil {
+func (s *RSABlindRuntime) blindSign(msg *runtime.Message) error {
+	log.Info("Host starts to blind sign hash from client")
+	key, err := s.keys.GetValid(msg.KeyID, time.Now())
+	if err != nil {
 		log.WithFields(log.Fields{
-			"session_key": sessionKey,
+			"session_key": msg.SessionKey,
 			"error": err,
-		}).Error("Failed to delete used rands from kv")
+		}).Error("Refuse to sign with the key")
 		return err
 	}
-	return nil
+
+	// nothing is signed before the batch is committed
+	if s.commitment {
+		if err = s.checkCommittedSize(msg); err == errNoCommitment || err == errCommitmentSize {
+			s.sendShutdown(msg.SessionKey, err.Error())
+			return runtime.Stop(err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	zb := key.Intersect.HostBlindSigning(rsa_blind.BytesSliceToBigInts(msg.Data))
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: rsa_blind.StepHostBlindSign,
+		SessionKey: msg.SessionKey,
+		KeyID: key.ID,
+		Data: rsa_blind.BigIntsToBytesSlice(zb),
+	})
 }
 
-func (s *RSABlindRuntime) sendOriginData(sessionKey string, data []string) error {
-	encodedData, err := json.Marshal(data)
+func (s *RSABlindRuntime) matchClientHashes(msg *runtime.Message) error {
+	// compare hash with current ID
+	log.Info("Host starts to compare hash from client")
+	if s.mode == ModeClientOnly {
+		log.WithField("session_key", msg.SessionKey).Warning("Client shouldn't send its hashes in client-only mode, drop them")
+		return nil
+	}
+	key, err := s.getUnexpiredKey(msg.KeyID)
 	if err != nil {
-		log.WithField("error", err).Error("Failed to marshal data to json")
 		return err
 	}
-
-	if err = s.kv.HashPut("origin_data", map[string]string{sessionKey: string(encodedData)}); err != nil {
-		log.WithFields(log.Fields{
-			"data": data,
-			"session_key": sessionKey,
-			"error": err,
-		}).Error("Failed to send rands to kv")
+	if s.canaries != nil && !s.checkCanaries(msg, s.hostCanaryHashes(key)) {
+		return nil
+	}
+	if s.commitment {
+		err := s.matchCommitted(msg, rsa_blind.StepHostRequestProof)
+		if err == errNoCommitment || err == errCommitmentSize {
+			s.sendShutdown(msg.SessionKey, err.Error())
+			return runtime.Stop(err)
+		}
 		return err
 	}
+	return s.matchIDAndSendData(msg)
+}
 
-	return nil
+// pubKeyExchange announces all the keys that are not expired, including the
+// ones that become valid later, so that client is ready when the key rotates
+func (s *RSABlindRuntime) pubKeyExchange() {
+	keys := make([]runtime.Key, 0)
+	for _, key := range s.keys.Keys(time.Now()) {
+		n, e := key.Intersect.GetPubKey()
+		keys = append(keys, runtime.Key{
+			N: n,
+			E: e,
+			ID: key.ID,
+			NotBefore: timeToUnix(key.NotBefore),
+			NotAfter: timeToUnix(key.NotAfter),
+		})
+	}
+	if len(keys) == 0 {
+		log.Fatal("The host has no key to announce")
+	}
+
+	// the filters are published once the keys are acked
+	s.sendPubKeyAndWaitAck(rsa_blind.StepHostSendPubKey, rsa_blind.StepClientRcvPubKey, func() {
+		if s.mode == ModeUnbalanced {
+			for _, key := range s.keys.Keys(time.Now()) {
+				s.publishFilter(key, "")
+			}
+		}
+	}, nil, keys...)
 }
 
-func (s *RSABlindRuntime) getOriginData(sessionKey string) ([]string, error) {
-	dataStr, err := s.kv.HashGet("origin_data", sessionKey);
+// hashAndSend is the host side of a round: hash the data, keep the hash-id map
+// and send the hash to client, or the filter delta in unbalanced mode
+func (s *RSABlindRuntime) hashAndSend(key *rsa_blind.RingKey, data []string) error {
+	items, err := s.withCanaries(data)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"session_key": sessionKey,
-			"error": err,
-		}).Error("Failed to get origin data from kv")
-		return []string{}, err
-	}
-
-	data := make([]string, 0)
-	if err = json.Unmarshal([]byte(dataStr), &data); err != nil {
-		log.WithFields(log.Fields{
-			"data_str": dataStr,
-			"error": err,
-		}).Error("Failed to unmarshal original data")
-		return []string{}, err
+		return err
 	}
+	ta := key.Intersect.HostOfflineHash(items)
 
-	return data, nil
-}
-
-func (s *RSABlindRuntime) createAndSendHashIDMap(data []string, hash [][]byte) error {
-	hashIDMap := make(map[string]string)
-
-	if len(data) != len(hash) {
-		err := errors.New("The sizes of original data and hash don't match")
-		log.WithFields(log.Fields{
-			"original_data": data,
-			"hash": hash,
-			"error": err,
-		}).Error()
+	// send hash-data map to kv, without the canaries
+	realData, realTa, _ := s.splitCanaries(items, ta)
+	if err := s.createAndSendHashIDMap(key.ID, realData, realTa); err != nil {
 		return err
 	}
 
-	for i, ele := range data {
-		hashIDMap[string(hash[i])] = ele
+	if s.mode == ModeUnbalanced {
+		return s.publishFilterDelta(key, ta)
 	}
 
-	// send to kv
-	if err := s.kv.HashPut("hash_id_map", hashIDMap); err != nil {
-		log.WithField("error", err).Error("Failed to put HashIDMap to kv")
+	numDummies, err := s.numDummies(len(ta))
+	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func (s *RSABlindRuntime) getMatchedId(hash []string) ([]string, error) {
-	ret, err := s.kv.HashMultiGet("hash_id_map", hash)
+	paddedTa, err := s.padHashes(key, ta, numDummies)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"hash": hash,
-			"error": err,
-		}).Error("Failed to get matched id")
-		return []string{}, err
+		return err
 	}
 
-	data, _ := runtime.GetExistingStringAndIndex(ret)
-
-	if len(data) == 0 {
-		msg := "No hash matched"
-		log.WithField("hash", hash).Warn(msg)
-		return []string{}, errors.New(msg)
+	step := rsa_blind.StepHostHash
+	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+	if s.commitment {
+		if err = s.commitAndSend(key.ID, sessionKey, items, numDummies, rsa_blind.StepHostCommit); err != nil {
+			return err
+		}
 	}
 
-	return data, nil	
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: sessionKey,
+		KeyID: key.ID,
+		Data: paddedTa,
+	})
 }
 
-func (s *RSABlindRuntime) sendMatchedId(data []string) error {
-	if err := s.kv.SetAdd("matched_data", data); err != nil {
-		log.WithFields(log.Fields{
-			"data": data,
-			"error": err,
-		}).Error("Send matched id to kv set failed")
-		return err
+// numDummies returns how many dummies a batch of n items is padded with
+func (s *RSABlindRuntime) numDummies(n int) (int, error) {
+	if s.padding == nil {
+		return 0, nil
 	}
-	return nil
+	size, err := s.padding.Size(n)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get the padded size")
+		return 0, err
+	}
+	return size - n, nil
 }
 
-func getMapKeys(m map[string][]int) []string {
-	j := 0
-	rets := make([]string, len(m))
-	for k := range m {
-		rets[j] = k
-		j++
+// padHashes appends random hashes to the hashes and shuffles them, so the peer
+// can't tell the position of a matched hash either
+func (s *RSABlindRuntime) padHashes(key *rsa_blind.RingKey, hashes [][]byte, numDummies int) ([][]byte, error) {
+	if numDummies == 0 {
+		return hashes, nil
+	}
+	dummies, err := key.Intersect.DummyHashes(numDummies)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate dummy hashes")
+		return nil, err
+	}
+	padded, err := padding.AppendShuffled(hashes, dummies)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to shuffle hashes")
+		return nil, err
 	}
-	return rets
+	return padded, nil
 }
 
-func (s *RSABlindRuntime) matchIDAndSendData(msg *runtime.Message) error {
-	hash := make([]string, len(msg.Data))
-	for i, ele := range msg.Data {
-		hash[i] = string(ele)
-	}
-	
-	// get matched ids
-	matchedID, err := s.getMatchedId(hash)
+// blindAndSend is the client side of a round: blind the data, keep everything
+// needed to unblind and verify the signs, and send the blinded data to host
+func (s *RSABlindRuntime) blindAndSend(key *rsa_blind.RingKey, data []string) error {
+	// the canaries are unblinded with the data, and dropped before the ids
+	// are stored
+	data, err := s.withCanaries(data)
 	if err != nil {
 		return err
 	}
 
-	// add matched ids to kv set
-	if err = s.sendMatchedId(matchedID); err != nil {
+	yb, rands, err := key.Intersect.ClientBlinding(data)
+	if err != nil {
+		log.WithField("data", data).Errorf("ClientBlinding failed, err: %s", err)
 		return err
 	}
 
-	// get neighboring vertices and edges
-	vertices, err := s.graphClient.GetAllNeighborVertices(matchedID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"ids": matchedID,
-			"error": err,
-		}).Error("Failed to get neighboring vertices")
+	step := rsa_blind.StepClientBlind
+	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+	ybBytes := rsa_blind.BigIntsToBytesSlice(yb)
+
+	// Send original data to kv
+	if err = s.sendOriginData(key.ID, sessionKey, data); err != nil {
 		return err
 	}
 
-	edges, err := s.graphClient.GetAllNeighborEdges(matchedID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"ids": matchedID,
-			"error": err,
-		}).Error("Failed to get neighboring edges")
+	// Send rands to kv
+	if err = s.sendRands(key.ID, sessionKey, rands); err != nil {
 		return err
 	}
 
-	// filter non-matched vertices
-	vertexVIDs := make([]string, len(vertices))
-	j := 0
-	for k := range vertices {
-		vertexVIDs[j] = k
-		j++
+	// Send blinded data to kv, it's used to verify the signs from host
+	if err = s.sendBlindedData(key.ID, sessionKey, ybBytes); err != nil {
+		return err
 	}
 
-	checkResult, err := s.kv.SetCheck("matched_data", vertexVIDs)
+	// the dummies are appended after the items, host can't tell them from
+	// the blinded items, and they're never stored
+	numDummies, err := s.numDummies(len(yb))
 	if err != nil {
 		return err
 	}
-
-	matchedVIDs := make(map[string]interface{})
-	for i, flag := range checkResult {
-		if flag {
-			matchedVIDs[vertexVIDs[i]] = nil
+	if numDummies > 0 {
+		dummies, err := key.Intersect.DummyBlinded(numDummies)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to generate dummy items")
+			return err
 		}
+		ybBytes = append(ybBytes, rsa_blind.BigIntsToBytesSlice(dummies)...)
 	}
 
-	matchedVertices := make([]*graph.VertexData, 0)
-	for k, v := range vertices {
-		if _, ok := matchedVIDs[k]; ok {
-			matchedVertices = append(matchedVertices, &v)
+	if s.commitment {
+		if err = s.commitAndSend(key.ID, sessionKey, data, numDummies, rsa_blind.StepClientCommit); err != nil {
+			return err
 		}
 	}
 
-	matchedEdges := make([]*graph.EdgeData, 0)
-	for _, e := range edges {
-		_, srcOk := matchedVIDs[e.Source]
-		_, dstOk := matchedVIDs[e.Destination]
-		if srcOk && dstOk {
-			matchedEdges = append(matchedEdges, &e)
-		}
-	}
+	// send message to mq
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: sessionKey,
+		KeyID: key.ID,
+		Data: ybBytes,
+	})
+}
 
-	// send to host
-	verticesEncoded, err := json.Marshal(matchedVertices)
+// rotateKey re-hashes the ids stored under the last key with the current one,
+// the old entries are kept so the peer can still match them until the old key
+// expires. The data of expired keys are dropped afterwards.
+func (s *RSABlindRuntime) rotateKey(key *rsa_blind.RingKey) error {
+	lastKeyID, err := s.getLastKeyID()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"vertices": matchedVertices,
-			"error": err,
-		}).Error("Failed to marshal matched vertices to json")
 		return err
 	}
 
-	edgesEncoded, err := json.Marshal(matchedEdges)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"edges": matchedEdges,
-			"error": err,
-		}).Error("Failed to marshal matched edges to json")
-		return err
+	if lastKeyID != key.ID {
+		if len(lastKeyID) > 0 {
+			log.WithFields(log.Fields{
+				"last_key_id": lastKeyID,
+				"key_id": key.ID,
+			}).Info("Key rotated, re-hash the stored ids with the new key")
+			if err = s.rehash(lastKeyID, key); err != nil {
+				return err
+			}
+		}
+		if err = s.putKeyID(key.ID); err != nil {
+			return err
+		}
 	}
 
-	graphEncoded, err := json.Marshal(s.graphDefinition)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"graph_definition": s.graphDefinition,
-			"error": err,
-		}).Error("Failed to marshal matched graph definition to json")
-		return err
+	for _, expired := range s.keys.Expired(time.Now()) {
+		log.WithField("key_id", expired.ID).Info("Key expired, drop the data stored under it")
+		if err = s.dropKeyData(expired.ID); err != nil {
+			return err
+		}
+		s.keys.Remove(expired.ID)
+		delete(s.filters, expired.ID)
 	}
 
-	if err := s.producer.SendStruct(&runtime.Message{
-		Algorithm: s.algorithm,
-		Step: rsa_blind.StepExchangeData,
-		SessionKey: msg.SessionKey,
-		Data: [][]byte{graphEncoded, verticesEncoded, edgesEncoded},
-	}); err != nil {
-		log.WithFields(log.Fields{
-			"connection_info": s.producer.GetConnectionInfo(),
-			"error": err,
-		}).Error("Failed to send matched data through mq")
+	return nil
+}
+
+func (s *RSABlindRuntime) rehash(lastKeyID string, key *rsa_blind.RingKey) error {
+	numIDs := 0
+	err := s.scanStoredIDs(lastKeyID, rehashBatchSize, func(ids []string) error {
+		numIDs += len(ids)
+		if s.role == "host" {
+			return s.hashAndSend(key, ids)
+		}
+		return s.blindAndSend(key, ids)
+	})
+	if err != nil {
 		return err
 	}
 
-	log.Info("Finished matching ids and sent matched data")
+	log.WithFields(log.Fields{
+		"last_key_id": lastKeyID,
+		"key_id": key.ID,
+		"num_ids": numIDs,
+	}).Info("Re-hashed the stored ids with the new key")
 	return nil
 }
 
-func (s *RSABlindRuntime) loadDataToGraphDB(msg *runtime.Message) error {
-	data := msg.Data
-	if len(data) != 3 {
-		log.WithField("message", msg).Error("The data field of StepExchangeData message has wrong format")
-		return errors.New("Wrong data field")
+// getUnexpiredKey accepts a key that is not valid yet, since the peer may
+// switch a bit earlier because of clock skew
+func (s *RSABlindRuntime) getUnexpiredKey(keyID string) (*rsa_blind.RingKey, error) {
+	key, ok := s.keys.Get(keyID)
+	if !ok || key.ExpiredAt(time.Now()) {
+		err := errors.New(fmt.Sprintf("Unknown or expired key: %s", keyID))
+		log.WithField("key_id", keyID).Error(err)
+		return nil, err
 	}
+	return key, nil
+}
 
-	_, verticesEncoded, edgesEncoded := data[0], data[1], data[2]
-	vertices := make([]graph.VertexData, 0)
-	edges := make([]graph.EdgeData, 0)
-
-	if err := json.Unmarshal(verticesEncoded, &vertices); err != nil {
-		log.WithFields(log.Fields{
-			"encoded_vertices": verticesEncoded,
-			"error": err,
-		}).Error("Failed to unmarshal json-encoded vertices")
+func (s *RSABlindRuntime) verifyBlindSigning(key *rsa_blind.RingKey, sessionKey string, zb []*big.Int) error {
+	ybBytes, err := s.getBlindedData(key.ID, sessionKey)
+	if err != nil {
 		return err
 	}
 
-	if err := json.Unmarshal(edgesEncoded, &edges); err != nil {
+	if err = key.Intersect.VerifyBlindSigning(rsa_blind.BytesSliceToBigInts(ybBytes), zb); err != nil {
 		log.WithFields(log.Fields{
-			"encoded_edges": edgesEncoded,
+			"session_key": sessionKey,
+			"key_id": key.ID,
 			"error": err,
-		}).Error("Failed to unmarshal json-encoded edges")
-		return err
-	}
-
-	// add vertices and edges 
-	// TODO(knwng): consider the situation when the definitions of two graphs are different
-	if err := s.graphClient.AddVertexData(vertices); err != nil {
+		}).Error("Failed to verify the signs from host")
 		return err
 	}
 
-	if err := s.graphClient.AddEdgeData(edges); err != nil {
-		return err
-	}
-
-	log.Info("Data loaded to graph db")
-
 	return nil
 }
 
+// abortSession drops everything kept for the session and tells the host why
+func (s *RSABlindRuntime) abortSession(keyID, sessionKey string, reason error) {
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"error": reason,
+	}).Error("Abort the session")
+	s.cleanSession(keyID, sessionKey)
+	s.sendShutdown(sessionKey, reason.Error())
+}
 
-func (s *RSABlindRuntime) pubKeyExchange() {
-	log.Info("Host send pubkey to client")
-	step := rsa_blind.StepHostSendPubKey
-	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
-	n, e := s.intersect.GetPubKey()
-	key := runtime.Key{
-		N: n,
-		E: e,
-	}
+func (s *RSABlindRuntime) cleanSession(keyID, sessionKey string) {
+	s.delRands(keyID, sessionKey)
+	s.delOriginData(keyID, sessionKey)
+	s.delBlindedData(keyID, sessionKey)
+}
 
-	// TODO(knwng): need to retry here
-	if err := s.producer.SendStruct(&runtime.Message{
-		Algorithm: s.algorithm,
-		Step: step,
-		SessionKey: sessionKey,
-		Key: key,
-	}); err != nil {
-		log.WithField("error", err).Fatal("Host failed to send pubkey")
-	}
-
-	// receive message from consumer
-	msgChan := make(chan runtime.Message)
-	go s.receiveMessage(msgChan)
-
-	log.Info("Host's waiting for ack of pubkey from client")
-	for {
-		select {
-		case msg := <-msgChan:
-			if msg.Step != rsa_blind.StepClientRcvPubKey {
-				continue
-			} else {
-				return
-			}
-		case <-time.After(time.Duration(s.connTimeout) * time.Second):
-			log.WithField("session_key", sessionKey).
-				Fatal("Host didn't receive client's ack after sending pubkey")
-		}
+// the validity of keys are sent as unix seconds, 0 for unbounded
+func timeToUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
+	return t.Unix()
 }
 
-func bytesSliceToStringSlice(data [][]byte) []string {
-	ret := make([]string, len(data))
-	for i, ele := range data {
-		ret[i] = string(ele)
+func unixToTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
 	}
-	return ret
+	return time.Unix(sec, 0)
 }
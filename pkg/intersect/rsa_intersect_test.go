@@ -0,0 +1,134 @@
+package intersect
+
+import (
+	"strings"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+)
+
+// memProducer keeps the messages sent
+type memProducer struct {
+	sent 		[]*runtime.Message
+}
+
+func (p *memProducer) Send(payload []byte) error {
+	return nil
+}
+
+func (p *memProducer) SendStruct(msg *runtime.Message) error {
+	p.sent = append(p.sent, msg)
+	return nil
+}
+
+func (p *memProducer) GetConnectionInfo() string {
+	return "memory"
+}
+
+func (p *memProducer) Close() {}
+
+func TestRSAReceiveInvalidPubKey(t *testing.T) {
+	graphFn := filepath.Join(t.TempDir(), "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(graphFn, []byte("nodes: []\n"), 0600))
+	producer := &memProducer{}
+	client, err := NewRSABlindRuntime("client", 1, 10, rsa_blind.NewKeyRing("sha256", "sha256"), "",
+		producer, nil, newMemKV(), nil, graphFn)
+	assert.NoError(t, err)
+
+	intersect, err := rsa_blind.NewRSABlindIntersect(1024, "sha256", "sha256", "host")
+	assert.NoError(t, err)
+	n, e := intersect.GetPubKey()
+
+	for _, msgKey := range []runtime.Key{
+		{},
+		{ID: "another", N: n, E: e},
+	} {
+		err = client.receivePubKey(&runtime.Message{
+			Algorithm: "rsa",
+			Step: rsa_blind.StepHostSendPubKey,
+			Key: msgKey,
+		})
+		assert.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "stop:"))
+	}
+	assert.Len(t, producer.sent, 2)
+	for _, msg := range producer.sent {
+		assert.Equal(t, rsa_blind.StepShutdown, msg.Step)
+	}
+}
+
+func TestScanStoredIDs(t *testing.T) {
+	graphFn := filepath.Join(t.TempDir(), "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(graphFn, []byte("nodes: []\n"), 0600))
+	kv := newMemKV()
+	s, err := NewRSABlindRuntime("host", 1, 10, rsa_blind.NewKeyRing("sha256", "sha256"), "",
+		&memProducer{}, nil, kv, nil, graphFn)
+	assert.NoError(t, err)
+
+	assert.NoError(t, kv.HashPut(kvName("hash_id_map", "old"), map[string]string{
+		"h1": "a", "h2": "b", "h3": "c", "h4": "d", "h5": "e",
+	}))
+	pages := 0
+	ids := make([]string, 0)
+	assert.NoError(t, s.scanStoredIDs("old", 2, func(page []string) error {
+		assert.LessOrEqual(t, len(page), 2)
+		pages++
+		ids = append(ids, page...)
+		return nil
+	}))
+	assert.Equal(t, 3, pages)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e"}, ids)
+}
+
+func TestKVProcessedStore(t *testing.T) {
+	kv := newMemKV()
+	store := &kvProcessedStore{kv: kv}
+	msg := &runtime.Message{Step: rsa_blind.StepClientBlind, SessionKey: "session", KeyID: "key"}
+
+	processed, err := store.IsProcessed(msg, "digest")
+	assert.NoError(t, err)
+	assert.False(t, processed)
+	assert.NoError(t, store.MarkProcessed(msg, "digest"))
+	processed, err = store.IsProcessed(msg, "digest")
+	assert.NoError(t, err)
+	assert.True(t, processed)
+
+	// the set of a key expires, and the one of the last period is still checked
+	names := store.setNames(msg)
+	assert.Equal(t, 2 * processedTTL, kv.ttls[names[0]])
+	kv.sets[names[1]] = kv.sets[names[0]]
+	delete(kv.sets, names[0])
+	processed, err = store.IsProcessed(msg, "digest")
+	assert.NoError(t, err)
+	assert.True(t, processed)
+
+	sessionMsg := &runtime.Message{Step: rsa_blind.StepClientBlind, SessionKey: "session"}
+	assert.NoError(t, store.MarkProcessed(sessionMsg, "digest"))
+	assert.Equal(t, processedTTL, kv.ttls[kvName("processed_session", "session")])
+}
+
+func TestResetTampered(t *testing.T) {
+	graphFn := filepath.Join(t.TempDir(), "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(graphFn, []byte("nodes: []\n"), 0600))
+	kv := newMemKV()
+	assert.NoError(t, kv.HashPut("tampered", map[string]string{"session": "canaries missing"}))
+
+	s, err := NewRSABlindRuntime("host", 1, 10, rsa_blind.NewKeyRing("sha256", "sha256"), "",
+		&memProducer{}, nil, kv, nil, graphFn)
+	assert.NoError(t, err)
+	assert.True(t, s.tampered)
+
+	cleared, err := ResetTampered(kv)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"session": "canaries missing"}, cleared)
+
+	s, err = NewRSABlindRuntime("host", 1, 10, rsa_blind.NewKeyRing("sha256", "sha256"), "",
+		&memProducer{}, nil, kv, nil, graphFn)
+	assert.NoError(t, err)
+	assert.False(t, s.tampered)
+}
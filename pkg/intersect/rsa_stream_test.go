@@ -0,0 +1,335 @@
+package intersect
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"testing"
+	"math/big"
+	"io/ioutil"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"path/filepath"
+	"crypto/x509/pkix"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+)
+
+// memKV keeps everything in maps, expiry is only recorded
+type memKV struct {
+	mu 			sync.Mutex
+	values 		map[string]string
+	hashes 		map[string]map[string]string
+	sets 		map[string]map[string]bool
+	ttls 		map[string]time.Duration
+}
+
+func newMemKV() *memKV {
+	return &memKV{
+		values: make(map[string]string),
+		hashes: make(map[string]map[string]string),
+		sets: make(map[string]map[string]bool),
+		ttls: make(map[string]time.Duration),
+	}
+}
+
+func (kv *memKV) Put(key string, val string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.values[key] = val
+	return nil
+}
+
+func (kv *memKV) Get(key string) (string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	val, ok := kv.values[key]
+	if !ok {
+		return "", redis.Nil
+	}
+	return val, nil
+}
+
+func (kv *memKV) Del(key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.values, key)
+	delete(kv.hashes, key)
+	delete(kv.sets, key)
+	return nil
+}
+
+func (kv *memKV) Expire(key string, ttl time.Duration) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.ttls[key] = ttl
+	return nil
+}
+
+func (kv *memKV) HashPut(key string, data map[string]string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.hashes[key] == nil {
+		kv.hashes[key] = make(map[string]string)
+	}
+	for field, val := range data {
+		kv.hashes[key][field] = val
+	}
+	return nil
+}
+
+func (kv *memKV) HashGet(key, field string) (string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	val, ok := kv.hashes[key][field]
+	if !ok {
+		return "", redis.Nil
+	}
+	return val, nil
+}
+
+func (kv *memKV) HashMultiGet(key string, fields []string) ([]interface{}, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	ret := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if val, ok := kv.hashes[key][field]; ok {
+			ret[i] = val
+		}
+	}
+	return ret, nil
+}
+
+func (kv *memKV) HashGetAll(key string) (map[string]string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	ret := make(map[string]string)
+	for field, val := range kv.hashes[key] {
+		ret[field] = val
+	}
+	return ret, nil
+}
+
+// HashScan pages through the fields in order, the cursor is the offset of
+// the next page
+func (kv *memKV) HashScan(key string, cursor uint64, count int64) (map[string]string, uint64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	fields := make([]string, 0, len(kv.hashes[key]))
+	for field := range kv.hashes[key] {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	ret := make(map[string]string)
+	next := cursor
+	for ; next < uint64(len(fields)) && int64(len(ret)) < count; next++ {
+		ret[fields[next]] = kv.hashes[key][fields[next]]
+	}
+	if next >= uint64(len(fields)) {
+		next = 0
+	}
+	return ret, next, nil
+}
+
+func (kv *memKV) HashLen(key string) (int64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return int64(len(kv.hashes[key])), nil
+}
+
+func (kv *memKV) HashDel(key string, fields []string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for _, field := range fields {
+		delete(kv.hashes[key], field)
+	}
+	return nil
+}
+
+func (kv *memKV) SetAdd(key string, members []string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.sets[key] == nil {
+		kv.sets[key] = make(map[string]bool)
+	}
+	for _, member := range members {
+		kv.sets[key][member] = true
+	}
+	return nil
+}
+
+func (kv *memKV) SetCheck(key string, members []string) ([]bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	ret := make([]bool, len(members))
+	for i, member := range members {
+		ret[i] = kv.sets[key][member]
+	}
+	return ret, nil
+}
+
+func (kv *memKV) SetDel(key string, members []string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for _, member := range members {
+		delete(kv.sets[key], member)
+	}
+	return nil
+}
+
+// ackedConsumer reports the steps of the messages acked
+type ackedConsumer struct {
+	runtime.Consumer
+	acked 		chan runtime.Step
+}
+
+func (c *ackedConsumer) Ack(msg *runtime.Message) error {
+	err := c.Consumer.Ack(msg)
+	select {
+	case c.acked <- msg.Step:
+	default:
+	}
+	return err
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(file, data, 0600))
+}
+
+// issueCerts writes a CA and the certificates of names signed by it, it
+// returns the file of CA
+func issueCerts(t *testing.T, dir string, names ...string) string {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "ppgi test ca"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", caDER)
+
+	for i, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject: pkix.Name{CommonName: name},
+			DNSNames: []string{name},
+			NotBefore: time.Now().Add(-time.Hour),
+			NotAfter: time.Now().Add(time.Hour),
+			KeyUsage: x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		assert.NoError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		writePEM(t, filepath.Join(dir, name + ".pem"), "CERTIFICATE", der)
+		writePEM(t, filepath.Join(dir, name + ".key"), "EC PRIVATE KEY", keyDER)
+	}
+	return caFile
+}
+
+func tlsConfigOf(dir, caFile, name, peerName string) runtime.TLSConfig {
+	return runtime.TLSConfig{
+		CertFile: filepath.Join(dir, name + ".pem"),
+		KeyFile: filepath.Join(dir, name + ".key"),
+		CAFile: caFile,
+		PeerName: peerName,
+	}
+}
+
+// TestRSAOverStream runs host and client over the stream transport, the
+// handlers of both sides send while the peer is busy sending too. The client
+// learns the hashes of its canaries from a full blind signing round, and host
+// checks them.
+func TestRSAOverStream(t *testing.T) {
+	dir := t.TempDir()
+	caFile := issueCerts(t, dir, "host.ppgi", "client.ppgi")
+	graphFn := filepath.Join(dir, "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(graphFn, []byte("nodes: []\n"), 0600))
+
+	hostConsumer, err := runtime.NewStreamConsumer("127.0.0.1:0", "client_to_host",
+		filepath.Join(dir, "host_spool"), tlsConfigOf(dir, caFile, "host.ppgi", "client.ppgi"))
+	assert.NoError(t, err)
+	defer hostConsumer.Close()
+	clientConsumer, err := runtime.NewStreamConsumer("127.0.0.1:0", "host_to_client",
+		filepath.Join(dir, "client_spool"), tlsConfigOf(dir, caFile, "client.ppgi", "host.ppgi"))
+	assert.NoError(t, err)
+	defer clientConsumer.Close()
+
+	hostProducer, err := runtime.NewStreamProducer(fmt.Sprintf("https://%s", clientConsumer.Addr()),
+		"host_to_client", tlsConfigOf(dir, caFile, "host.ppgi", "client.ppgi"))
+	assert.NoError(t, err)
+	defer hostProducer.Close()
+	clientProducer, err := runtime.NewStreamProducer(fmt.Sprintf("https://%s", hostConsumer.Addr()),
+		"client_to_host", tlsConfigOf(dir, caFile, "client.ppgi", "host.ppgi"))
+	assert.NoError(t, err)
+	defer clientProducer.Close()
+
+	intersect, err := rsa_blind.NewRSABlindIntersect(2048, "sha256", "sha256", "host")
+	assert.NoError(t, err)
+	hostKeys := rsa_blind.NewKeyRing("sha256", "sha256")
+	hostKeys.Add(&rsa_blind.RingKey{ID: intersect.GetKeyID(), Intersect: intersect})
+
+	acked := &ackedConsumer{Consumer: hostConsumer, acked: make(chan runtime.Step, 64)}
+	hostKV := newMemKV()
+	host, err := NewRSABlindRuntime("host", 1, 10, hostKeys, "", hostProducer,
+		acked, hostKV, nil, graphFn)
+	assert.NoError(t, err)
+	client, err := NewRSABlindRuntime("client", 1, 10, rsa_blind.NewKeyRing("sha256", "sha256"), "",
+		clientProducer, clientConsumer, newMemKV(), nil, graphFn)
+	assert.NoError(t, err)
+	canaries := []string{"canary-1", "canary-2"}
+	assert.NoError(t, host.SetCanaries(canaries))
+	assert.NoError(t, client.SetCanaries(canaries))
+
+	hostDone := make(chan error, 1)
+	clientDone := make(chan error, 1)
+	go func() { hostDone <- host.Run() }()
+	go func() { clientDone <- client.Run() }()
+
+	timeout := time.After(30 * time.Second)
+	for unblinded := false; !unblinded; {
+		select {
+		case step := <-acked.acked:
+			unblinded = step == rsa_blind.StepClientUnblind
+		case err := <-hostDone:
+			t.Fatalf("Host stopped, err: %v", err)
+		case err := <-clientDone:
+			t.Fatalf("Client stopped, err: %v", err)
+		case <-timeout:
+			t.Fatal("The round didn't finish in time")
+		}
+	}
+
+	host.dispatcher.After(0, func() error { return runtime.Stop(nil) })
+	client.dispatcher.After(0, func() error { return runtime.Stop(nil) })
+	assert.NoError(t, <-hostDone)
+	assert.NoError(t, <-clientDone)
+
+	// the canaries host hashed by itself show up in the hashes of client
+	assert.Len(t, client.canaryHashes[intersect.GetKeyID()], len(canaries))
+	tampered, err := hostKV.HashLen("tampered")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), tampered)
+}
@@ -0,0 +1,405 @@
+package intersect
+
+import (
+	"time"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/filter"
+	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+)
+
+// In unbalanced mode the host never sends its hashes. It keeps a Bloom filter
+// of them per key, publishes the whole filter once and the newly set bits
+// afterwards, and the client tests its own hashes against the filter locally.
+// The filter of a huge set is far bigger than a message, so it's built from kv
+// page by page and published in shards. A hit may be a false positive, so the
+// client asks the host to confirm the hashes hit before it sends their data.
+// The host still matches exactly on the hashes unblinded by client.
+
+const (
+	defaultFilterCapacity 	= 1000000
+	defaultFilterFPRate 	= 1e-6
+	// the hashes are read from kv in pages of about this size
+	filterScanCount 		= 10000
+	// 1MB of bits per shard, well below the default limit of 5MB of pulsar
+	filterShardWords 		= 1 << 17
+)
+
+var (
+	errFilterFormat 	= errors.New("Wrong format of filter message")
+	errFilterPending 	= errors.New("The filter is still being received")
+)
+
+// filterAssembly is a filter being received in shards
+type filterAssembly struct {
+	keyID 		string
+	assembler 	*filter.ShardAssembler
+	started 	time.Time
+}
+
+// SetFilterParams sets the size of the filters in unbalanced mode. The filter is
+// rebuilt with doubled capacity when it holds more items than the capacity.
+func (s *RSABlindRuntime) SetFilterParams(capacity uint64, fpRate float64) {
+	if capacity > 0 {
+		s.filterCapacity = capacity
+	}
+	if fpRate > 0 {
+		s.filterFPRate = fpRate
+	}
+}
+
+// buildFilter creates the filter of key from the hashes stored in kv, which are
+// scanned page by page instead of loaded at once
+func (s *RSABlindRuntime) buildFilter(key *rsa_blind.RingKey, capacity uint64) (*filter.BloomFilter, error) {
+	name := kvName("hash_id_map", key.ID)
+	size, err := s.kv.HashLen(name)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get the number of stored hashes from kv")
+		return nil, err
+	}
+	for capacity < uint64(size) {
+		capacity *= 2
+	}
+
+	bloom, err := filter.NewBloomFilter(capacity, s.filterFPRate)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to create bloom filter")
+		return nil, err
+	}
+	cursor := uint64(0)
+	for {
+		page, next, err := s.kv.HashScan(name, cursor, filterScanCount)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to scan stored hashes from kv")
+			return nil, err
+		}
+		for hash := range page {
+			bloom.Add([]byte(hash))
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	s.filters[key.ID] = bloom
+	log.WithFields(log.Fields{
+		"key_id": key.ID,
+		"capacity": capacity,
+		"count": bloom.Count(),
+	}).Info("Host built the filter of its set")
+	return bloom, nil
+}
+
+// publishFilter sends the whole filter of key in shards under one session key
+func (s *RSABlindRuntime) publishFilter(key *rsa_blind.RingKey, sessionKey string) error {
+	bloom, ok := s.filters[key.ID]
+	if !ok {
+		var err error
+		if bloom, err = s.buildFilter(key, s.filterCapacity); err != nil {
+			return err
+		}
+	}
+
+	if len(sessionKey) == 0 {
+		sessionKey = runtime.GenerateSessionKey(s.algorithm, rsa_blind.StepHostFilter)
+	}
+	shards := bloom.Shards(filterShardWords)
+	for i := uint64(0); i < shards; i++ {
+		shard, err := bloom.MarshalShard(i, filterShardWords)
+		if err != nil {
+			return err
+		}
+		if err = s.sendMessageOrError(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: rsa_blind.StepHostFilter,
+			SessionKey: sessionKey,
+			KeyID: key.ID,
+			Data: [][]byte{shard},
+		}); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"key_id": key.ID,
+		"num_shards": shards,
+	}).Info("Host published the filter of its set")
+	return nil
+}
+
+// publishFilterDelta adds the new hashes to the filter and sends the newly set
+// bits, or the whole rebuilt filter if it's full
+func (s *RSABlindRuntime) publishFilterDelta(key *rsa_blind.RingKey, ta [][]byte) error {
+	bloom, ok := s.filters[key.ID]
+	if !ok {
+		// the new hashes are in kv already
+		return s.publishFilter(key, "")
+	}
+
+	newBits := make([]uint64, 0)
+	for _, hash := range ta {
+		newBits = append(newBits, bloom.Add(hash)...)
+	}
+
+	if bloom.Full() {
+		log.WithFields(log.Fields{
+			"key_id": key.ID,
+			"capacity": bloom.Capacity(),
+		}).Warning("The filter is full, rebuild it with doubled capacity")
+		if _, err := s.buildFilter(key, 2 * bloom.Capacity()); err != nil {
+			return err
+		}
+		return s.publishFilter(key, "")
+	}
+
+	step := rsa_blind.StepHostFilterDelta
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: runtime.GenerateSessionKey(s.algorithm, step),
+		KeyID: key.ID,
+		Data: [][]byte{filter.EncodeDelta(newBits, uint64(len(ta)))},
+	})
+}
+
+func (s *RSABlindRuntime) requestFilter(keyID string) {
+	step := rsa_blind.StepClientRequestFilter
+	s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: runtime.GenerateSessionKey(s.algorithm, step),
+		KeyID: keyID,
+	})
+}
+
+// receiveFilter handles both the shards of the whole filter and the deltas on
+// client, and then tests the hashes stored under the key again
+func (s *RSABlindRuntime) receiveFilter(msg *runtime.Message) error {
+	key, err := s.getUnexpiredKey(msg.KeyID)
+	if err != nil {
+		return err
+	}
+	if len(msg.Data) != 1 {
+		log.WithField("session_key", msg.SessionKey).Error("The filter message has wrong format")
+		return errFilterFormat
+	}
+
+	if msg.Step == rsa_blind.StepHostFilter {
+		bloom, err := s.assembleFilter(key.ID, msg)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to decode the filter shard from host")
+			return err
+		}
+		if bloom == nil {
+			return nil
+		}
+		s.filters[key.ID] = bloom
+		log.WithFields(log.Fields{
+			"key_id": key.ID,
+			"count": bloom.Count(),
+		}).Info("Client received the filter of host")
+	} else {
+		bloom, ok := s.filters[key.ID]
+		if !ok {
+			if s.assemblingFilter(key.ID) {
+				// the delta is applied once the filter is complete
+				return runtime.Retry(errFilterPending)
+			}
+			log.WithField("key_id", key.ID).Warning("Client received a delta before the filter, request the filter")
+			s.requestFilter(key.ID)
+			return nil
+		}
+		if err = bloom.ApplyDelta(msg.Data[0]); err != nil {
+			log.WithField("error", err).Error("Failed to apply the filter delta from host, request the filter")
+			delete(s.filters, key.ID)
+			s.requestFilter(key.ID)
+			return err
+		}
+	}
+
+	hashIDMap, err := s.getHashIDMap(key.ID)
+	if err != nil {
+		return err
+	}
+	return s.matchWithFilter(key.ID, msg.SessionKey, hashIDMap)
+}
+
+// assembleFilter adds a shard to the filter of its session, and returns the
+// filter once it's complete. The first filter of the key completed wins, and
+// the other ones being received are dropped.
+func (s *RSABlindRuntime) assembleFilter(keyID string, msg *runtime.Message) (*filter.BloomFilter, error) {
+	assembly, ok := s.filterShards[msg.SessionKey]
+	if !ok {
+		assembly = &filterAssembly{
+			keyID: keyID,
+			assembler: filter.NewShardAssembler(),
+			started: time.Now(),
+		}
+		s.filterShards[msg.SessionKey] = assembly
+	}
+
+	bloom, err := assembly.assembler.Add(msg.Data[0])
+	if err != nil {
+		delete(s.filterShards, msg.SessionKey)
+		return nil, err
+	}
+	if bloom != nil {
+		for sessionKey, other := range s.filterShards {
+			if other.keyID == keyID {
+				delete(s.filterShards, sessionKey)
+			}
+		}
+	}
+	return bloom, nil
+}
+
+// assemblingFilter reports whether a filter of key is being received, the ones
+// not completed within the connection timeout are dropped
+func (s *RSABlindRuntime) assemblingFilter(keyID string) bool {
+	assembling := false
+	for sessionKey, assembly := range s.filterShards {
+		if time.Since(assembly.started) > time.Duration(s.connTimeout) * time.Second {
+			log.WithField("key_id", assembly.keyID).Warning("The filter is not received in time, drop it")
+			delete(s.filterShards, sessionKey)
+		} else if assembly.keyID == keyID {
+			assembling = true
+		}
+	}
+	return assembling
+}
+
+// matchWithFilter asks host to confirm the hashes in its filter, the ids
+// matched before are skipped. Nothing is sent for a hit before it's confirmed,
+// since it may be a false positive.
+func (s *RSABlindRuntime) matchWithFilter(keyID, sessionKey string, hashIDMap map[string]string) error {
+	bloom, ok := s.filters[keyID]
+	if !ok {
+		if !s.assemblingFilter(keyID) {
+			s.requestFilter(keyID)
+		}
+		return nil
+	}
+
+	candidates := make([]string, 0)
+	candidateHashes := make(map[string]string)
+	for hash, id := range hashIDMap {
+		if _, ok := candidateHashes[id]; !ok && bloom.Test([]byte(hash)) {
+			candidateHashes[id] = hash
+			candidates = append(candidates, id)
+		}
+	}
+
+	newIDs, err := s.unmatchedIDs(candidates)
+	if err != nil || len(newIDs) == 0 {
+		return err
+	}
+	hashes := make([][]byte, len(newIDs))
+	for i, id := range newIDs {
+		hashes[i] = []byte(candidateHashes[id])
+	}
+
+	log.WithFields(log.Fields{
+		"key_id": keyID,
+		"num_ids": len(newIDs),
+	}).Info("Client matched ids with the filter of host, ask host to confirm them")
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: rsa_blind.StepClientConfirm,
+		SessionKey: sessionKey,
+		KeyID: keyID,
+		Data: hashes,
+	})
+}
+
+// unmatchedIDs drops the ids matched before
+func (s *RSABlindRuntime) unmatchedIDs(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	matched, err := s.kv.SetCheck("matched_data", ids)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to check matched ids in kv")
+		return nil, err
+	}
+	newIDs := make([]string, 0)
+	for i, id := range ids {
+		if !matched[i] {
+			newIDs = append(newIDs, id)
+		}
+	}
+	return newIDs, nil
+}
+
+// confirmHashes sends back the hashes of client that are really in the set of
+// host, the false positives of the filter are left out
+func (s *RSABlindRuntime) confirmHashes(msg *runtime.Message) error {
+	if s.mode != ModeUnbalanced {
+		log.WithField("session_key", msg.SessionKey).Warning("Client shouldn't ask for confirmation in this mode, drop it")
+		return nil
+	}
+	key, err := s.getUnexpiredKey(msg.KeyID)
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]string, len(msg.Data))
+	for i, hash := range msg.Data {
+		hashes[i] = string(hash)
+	}
+	ret, err := s.kv.HashMultiGet(kvName("hash_id_map", key.ID), hashes)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to look up the hashes of client in kv")
+		return err
+	}
+	_, indexes := runtime.GetExistingStringAndIndex(ret)
+	confirmed := make([][]byte, len(indexes))
+	for i, j := range indexes {
+		confirmed[i] = msg.Data[j]
+	}
+
+	log.WithFields(log.Fields{
+		"session_key": msg.SessionKey,
+		"num_hits": len(hashes),
+		"num_confirmed": len(confirmed),
+	}).Info("Host confirmed the filter hits of client")
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: rsa_blind.StepHostConfirm,
+		SessionKey: msg.SessionKey,
+		KeyID: key.ID,
+		Data: confirmed,
+	})
+}
+
+// receiveConfirmed sends the data of the ids whose hashes are confirmed by host
+func (s *RSABlindRuntime) receiveConfirmed(msg *runtime.Message) error {
+	key, err := s.getUnexpiredKey(msg.KeyID)
+	if err != nil {
+		return err
+	}
+	if len(msg.Data) == 0 {
+		return nil
+	}
+
+	hashes := make([]string, len(msg.Data))
+	for i, hash := range msg.Data {
+		hashes[i] = string(hash)
+	}
+	ids, err := s.getMatchedId(key.ID, hashes)
+	if err != nil {
+		return err
+	}
+	// the same ids may be confirmed again after the filter is updated
+	newIDs, err := s.unmatchedIDs(ids)
+	if err != nil || len(newIDs) == 0 {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"key_id": key.ID,
+		"num_ids": len(newIDs),
+	}).Info("Client sends the data of ids confirmed by host")
+	return s.sendDataOfIDs(msg.SessionKey, key.ID, newIDs)
+}
@@ -0,0 +1,454 @@
+package intersect
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"math/big"
+	"crypto/rand"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/paillier"
+)
+
+// IntersectSumRuntime computes the sum of the values of the ids in the
+// intersection, the values are read from the graph of host. Every round runs
+// on the whole sets of both sides, with fresh ECDH keys, and only host learns
+// the sum. Client learns the size of the intersection, and no id or graph data
+// is revealed to either side.
+type IntersectSumRuntime struct {
+	baseRuntime
+	intersect 			*ecdh.ECDHIntersect
+	// host only
+	key 				*paillier.PrivateKey
+	valueSource 		*graph.ValueSource
+	valueDecimals 		int
+	// the sessions host sent its values in, each one accepts a single sum
+	sessions 			map[string]time.Time
+	// client only
+	rounds 				map[string]*sumRound
+	// pending is set on client when host asks for a new round
+	pending 			bool
+}
+
+type sumRound struct {
+	intersect 			*ecdh.ECDHIntersect
+	createdAt 			time.Time
+	// own ids re-encrypted by host
+	own 				[][]byte
+	// the ids of host re-encrypted by client, and their encrypted values
+	pub 				*paillier.PublicKey
+	points 				[][]byte
+	ciphertexts 		[]*big.Int
+}
+
+// NewIntersectSumRuntime takes the Paillier key bits and the value source on
+// host, both are ignored on client
+func NewIntersectSumRuntime(role string, fetchInterval int, connTimeout int,
+		intersect *ecdh.ECDHIntersect, keyBits int, valueSource *graph.ValueSource,
+		valueDecimals int, producer runtime.Producer, consumer runtime.Consumer,
+		kv runtime.KV, graphClient *graph.NebulaReadWriter,
+		graphDefinitionFn string) (*IntersectSumRuntime, error) {
+
+	base, err := newBaseRuntime(role, "sum", fetchInterval, connTimeout,
+		producer, consumer, kv, graphClient, graphDefinitionFn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &IntersectSumRuntime{
+		baseRuntime: base,
+		intersect: intersect,
+		valueSource: valueSource,
+		valueDecimals: valueDecimals,
+		sessions: make(map[string]time.Time),
+		rounds: make(map[string]*sumRound),
+	}
+
+	if role == "host" {
+		if valueSource == nil || len(valueSource.Name) == 0 || len(valueSource.Prop) == 0 {
+			return nil, errors.New("The value source should be set on host")
+		}
+		if valueDecimals < 0 {
+			return nil, errors.New(fmt.Sprintf("The decimals of value should not be negative, got %d", valueDecimals))
+		}
+		if s.key, err = paillier.GenerateKey(rand.Reader, keyBits); err != nil {
+			log.WithField("error", err).Error("Failed to generate paillier key")
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *IntersectSumRuntime) Run() error {
+	if s.role == "client" {
+		return s.runClient()
+	} else if s.role == "host" {
+		return s.runHost()
+	} else {
+		return errors.New(fmt.Sprintf("Unsupported role: %s", s.role))
+	}
+}
+
+func (s *IntersectSumRuntime) runClient() error {
+	s.onFetch(func() error {
+		s.pruneRounds()
+
+		if data, newTime, ok := s.fetchNewData(); ok {
+			if err := s.addIDs(data); err != nil {
+				return err
+			}
+			s.lastGraphFetchTime = &newTime
+			log.WithField("num_ids", len(data)).Info("Got new data from db")
+			s.pending = true
+		}
+
+		if s.pending {
+			if err := s.startRound(); err != nil {
+				return err
+			}
+			s.pending = false
+		}
+		return nil
+	})
+
+	s.handle(paillier.StepHostRequest, func(msg *runtime.Message) error {
+		log.Info("Client received a round request from host")
+		s.pending = true
+		return nil
+	})
+	s.handle(paillier.StepHostReEncrypt, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Client received its ids re-encrypted by host")
+		round, ok := s.rounds[msg.SessionKey]
+		if !ok {
+			log.WithField("session_key", msg.SessionKey).Warning("Round doesn't exist or is dropped")
+			return nil
+		}
+		round.own = msg.Data
+		return s.sumMatched(msg.SessionKey)
+	})
+	s.handle(paillier.StepHostEncrypt, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Client starts to re-encrypt the ids of host")
+		if err := s.receiveHostValues(msg); err != nil {
+			return err
+		}
+		return s.sumMatched(msg.SessionKey)
+	})
+	s.handle(paillier.StepShutdown, s.stopOnShutdown)
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+func (s *IntersectSumRuntime) runHost() error {
+	s.onFetch(func() error {
+		for sessionKey, createdAt := range s.sessions {
+			if time.Since(createdAt) > time.Duration(s.connTimeout) * time.Second {
+				log.WithField("session_key", sessionKey).Warning("No sum is received in time, drop the session")
+				delete(s.sessions, sessionKey)
+			}
+		}
+
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
+		if err := s.addIDs(data); err != nil {
+			return err
+		}
+		s.lastGraphFetchTime = &newTime
+		log.WithField("num_ids", len(data)).Info("Got new data from db, ask client for a new round")
+
+		step := paillier.StepHostRequest
+		return s.sendMessageOrError(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: step,
+			SessionKey: runtime.GenerateSessionKey(s.algorithm, step),
+		})
+	})
+
+	s.handle(paillier.StepClientEncrypt, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Host starts to re-encrypt the ids of client")
+		return s.sendHostValues(msg)
+	})
+	s.handle(paillier.StepClientSum, func(msg *runtime.Message) error {
+		log.WithField("session_key", msg.SessionKey).Info("Host starts to decrypt the sum")
+		return s.decryptSum(msg)
+	})
+	s.handle(paillier.StepShutdown, s.stopOnShutdown)
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+// addIDs accumulates the ids, since the whole set is used every round
+func (s *IntersectSumRuntime) addIDs(data []string) error {
+	ids := make(map[string]string)
+	for _, id := range data {
+		ids[id] = ""
+	}
+	if err := s.kv.HashPut("sum_ids", ids); err != nil {
+		log.WithField("error", err).Error("Failed to put ids to kv")
+		return err
+	}
+	return nil
+}
+
+// getIDs returns the accumulated ids in random order
+func (s *IntersectSumRuntime) getIDs() ([]string, error) {
+	ids, err := s.kv.HashGetAll("sum_ids")
+	if err != nil && !runtime.IsNotFound(err) {
+		log.WithField("error", err).Error("Failed to get ids from kv")
+		return nil, err
+	}
+	shuffled := make([][]byte, 0, len(ids))
+	for id := range ids {
+		shuffled = append(shuffled, []byte(id))
+	}
+	if err = ecdh.Shuffle(shuffled); err != nil {
+		log.WithField("error", err).Error("Failed to shuffle ids")
+		return nil, err
+	}
+	return bytesSliceToStringSlice(shuffled), nil
+}
+
+func (s *IntersectSumRuntime) pruneRounds() {
+	for sessionKey, round := range s.rounds {
+		if time.Since(round.createdAt) > time.Duration(s.connTimeout) * time.Second {
+			log.WithField("session_key", sessionKey).Warning("Round is not finished in time, drop it")
+			delete(s.rounds, sessionKey)
+		}
+	}
+}
+
+// startRound sends the encrypted ids of client with a fresh key
+func (s *IntersectSumRuntime) startRound() error {
+	intersect, err := s.intersect.Fork()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate the key of round")
+		return err
+	}
+	ids, err := s.getIDs()
+	if err != nil {
+		return err
+	}
+	encrypted, err := intersect.Encrypt(ids)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to encrypt data")
+		return err
+	}
+
+	step := paillier.StepClientEncrypt
+	sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+	s.rounds[sessionKey] = &sumRound{
+		intersect: intersect,
+		createdAt: time.Now(),
+	}
+
+	log.WithField("session_key", sessionKey).Info("Client started a new round")
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: step,
+		SessionKey: sessionKey,
+		Data: encrypted,
+	})
+}
+
+func (s *IntersectSumRuntime) receiveHostValues(msg *runtime.Message) error {
+	round, ok := s.rounds[msg.SessionKey]
+	if !ok {
+		err := errors.New(fmt.Sprintf("Round %s doesn't exist or is dropped", msg.SessionKey))
+		log.WithField("error", err).Error("Failed to receive the values of host")
+		return err
+	}
+	if len(msg.Key.N) == 0 {
+		log.WithField("session_key", msg.SessionKey).Error("The paillier key of host is missing")
+		return errors.New("The paillier key of host is missing")
+	}
+
+	pub := paillier.NewPublicKey(big.NewInt(0).SetBytes(msg.Key.N))
+	points, ciphertexts, err := pub.DecodePairs(msg.Data)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to decode the values of host")
+		return err
+	}
+	if round.points, err = round.intersect.ReEncrypt(points); err != nil {
+		log.WithField("error", err).Error("Failed to re-encrypt the ids of host")
+		return err
+	}
+	round.pub = pub
+	round.ciphertexts = ciphertexts
+	return nil
+}
+
+// sumMatched sends the encrypted sum once both messages of host arrive
+func (s *IntersectSumRuntime) sumMatched(sessionKey string) error {
+	round, ok := s.rounds[sessionKey]
+	if !ok || round.own == nil || round.pub == nil {
+		return nil
+	}
+	delete(s.rounds, sessionKey)
+
+	sum, count, err := round.pub.SumMatched(s.intersect.Finalize(round.own),
+		s.intersect.Finalize(round.points), round.ciphertexts)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to sum the matched values")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"cardinality": count,
+	}).Info("Client added up the values of the intersection")
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: paillier.StepClientSum,
+		SessionKey: sessionKey,
+		Data: [][]byte{sum.Bytes()},
+	})
+}
+
+// sendHostValues sends back the ids of client re-encrypted and shuffled, and
+// the encrypted ids of host paired with their encrypted values
+func (s *IntersectSumRuntime) sendHostValues(msg *runtime.Message) error {
+	intersect, err := s.intersect.Fork()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to generate the key of round")
+		return err
+	}
+
+	reEncrypted, err := intersect.ReEncrypt(msg.Data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to re-encrypt the ids of client")
+		return err
+	}
+	if err = ecdh.Shuffle(reEncrypted); err != nil {
+		log.WithField("error", err).Error("Failed to shuffle the ids of client")
+		return err
+	}
+
+	ids, err := s.getIDs()
+	if err != nil {
+		return err
+	}
+	ciphertexts, err := s.encryptValues(ids)
+	if err != nil {
+		return err
+	}
+	points, err := intersect.Encrypt(ids)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to encrypt data")
+		return err
+	}
+
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: paillier.StepHostReEncrypt,
+		SessionKey: msg.SessionKey,
+		Data: reEncrypted,
+	}); err != nil {
+		return err
+	}
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: paillier.StepHostEncrypt,
+		SessionKey: msg.SessionKey,
+		Data: paillier.EncodePairs(points, ciphertexts),
+		Key: runtime.Key{
+			N: s.key.N.Bytes(),
+		},
+	}); err != nil {
+		return err
+	}
+
+	s.sessions[msg.SessionKey] = time.Now()
+	return nil
+}
+
+// encryptValues reads the values of ids from graph, scales them to integers by
+// valueDecimals and encrypts them, an id without value counts as 0
+func (s *IntersectSumRuntime) encryptValues(ids []string) ([]*big.Int, error) {
+	values := make(map[string][]string)
+	if len(ids) > 0 {
+		var err error
+		if values, err = s.graphClient.GetValues(ids, s.valueSource); err != nil {
+			log.WithField("error", err).Error("Failed to read values from graph database")
+			return nil, err
+		}
+	}
+
+	scale := big.NewRat(1, 1).SetInt(big.NewInt(0).Exp(big.NewInt(10), big.NewInt(int64(s.valueDecimals)), nil))
+	ret := make([]*big.Int, len(ids))
+	for i, id := range ids {
+		total := big.NewRat(0, 1)
+		for _, value := range values[id] {
+			r, ok := big.NewRat(0, 1).SetString(value)
+			if !ok {
+				log.WithFields(log.Fields{
+					"id": id,
+					"value": value,
+				}).Warning("Value is not a number, skip")
+				continue
+			}
+			total.Add(total, r)
+		}
+		// the digits beyond valueDecimals are truncated
+		total.Mul(total, scale)
+		encoded, err := s.key.EncodeSigned(big.NewInt(0).Quo(total.Num(), total.Denom()))
+		if err != nil {
+			log.WithField("id", id).Error("Value is too large for paillier key")
+			return nil, err
+		}
+		if ret[i], err = s.key.Encrypt(encoded); err != nil {
+			log.WithField("error", err).Error("Failed to encrypt value")
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// decryptSum decrypts the sum of client, and exports it to the kv hash
+// "intersection_sum" (session key -> sum) and "intersection_sum_latest"
+func (s *IntersectSumRuntime) decryptSum(msg *runtime.Message) error {
+	if _, ok := s.sessions[msg.SessionKey]; !ok {
+		log.WithField("session_key", msg.SessionKey).Warning("Received a sum of unknown session, skip")
+		return nil
+	}
+	delete(s.sessions, msg.SessionKey)
+
+	if len(msg.Data) != 1 {
+		log.WithField("session_key", msg.SessionKey).Error("The sum message has wrong format")
+		return errors.New("Wrong format of sum message")
+	}
+	decrypted, err := s.key.Decrypt(big.NewInt(0).SetBytes(msg.Data[0]))
+	if err != nil {
+		log.WithField("error", err).Error("Failed to decrypt the sum")
+		return err
+	}
+
+	scale := big.NewInt(0).Exp(big.NewInt(10), big.NewInt(int64(s.valueDecimals)), nil)
+	sum := big.NewRat(0, 1).SetFrac(s.key.DecodeSigned(decrypted), scale).FloatString(s.valueDecimals)
+
+	if err = s.kv.HashPut("intersection_sum", map[string]string{msg.SessionKey: sum}); err != nil {
+		log.WithField("error", err).Error("Failed to put sum to kv")
+		return err
+	}
+	if err = s.kv.Put("intersection_sum_latest", sum); err != nil {
+		log.WithField("error", err).Error("Failed to put sum to kv")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"session_key": msg.SessionKey,
+		"sum": sum,
+	}).Info("Host got the sum over the intersection")
+	return nil
+}
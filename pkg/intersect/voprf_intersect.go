@@ -0,0 +1,362 @@
+package intersect
+
+import (
+	"fmt"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/knwng/ppgi/pkg/graph"
+	"github.com/knwng/ppgi/pkg/runtime"
+	"github.com/knwng/ppgi/pkg/algorithms/ecdh"
+	"github.com/knwng/ppgi/pkg/algorithms/voprf"
+)
+
+// the pubkey of host the client is pinned to
+const voprfPinnedKey = "voprf_pubkey"
+
+var errPubKeyChanged = errors.New("The pubkey of host changed without a rotation signed by the pinned key")
+
+// VOPRFRuntime follows the same flow as RSABlindRuntime, but the host attaches
+// a DLEQ proof to every evaluated batch, and the client rejects the session as
+// soon as a proof fails.
+//
+// The client pins the first pubkey of host in kv, so the host can't evaluate
+// the batches under different keys to link or partition them. Another pubkey
+// is only accepted along with the signature of the pinned key on it, and the
+// batches blinded under the old key are dropped.
+type VOPRFRuntime struct {
+	baseRuntime
+	intersect 			*voprf.VOPRFIntersect
+	// the key id of intersect, every batch is stamped with it
+	keyID 				string
+	// host only, the signature of the previous key on the pubkey
+	rotation 			[]byte
+}
+
+func NewVOPRFRuntime(role string, fetchInterval int, connTimeout int,
+		intersect *voprf.VOPRFIntersect, producer runtime.Producer,
+		consumer runtime.Consumer, kv runtime.KV, graphClient *graph.NebulaReadWriter,
+		graphDefinitionFn string) (*VOPRFRuntime, error) {
+
+	base, err := newBaseRuntime(role, "voprf", fetchInterval, connTimeout,
+		producer, consumer, kv, graphClient, graphDefinitionFn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &VOPRFRuntime{
+		baseRuntime: base,
+		intersect: intersect,
+	}
+	if role == "host" {
+		s.keyID = intersect.GetKeyID()
+	} else if err = s.loadPinnedKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetPreviousKey announces the pubkey of host as a rotation of the previous
+// key, which the client may be pinned to
+func (s *VOPRFRuntime) SetPreviousKey(previous *voprf.VOPRFIntersect) error {
+	rotation, err := previous.SignRotation(s.intersect.GetPubKey())
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"previous_key_id": previous.GetKeyID(),
+		"key_id": s.keyID,
+	}).Info("Host rotates its key")
+	s.rotation = rotation
+	return nil
+}
+
+// loadPinnedKey restores the pubkey of host the client is pinned to, so the
+// client goes on after restart without waiting for host to announce it again
+func (s *VOPRFRuntime) loadPinnedKey() error {
+	pinned, err := s.kv.Get(voprfPinnedKey)
+	if runtime.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.WithField("error", err).Error("Failed to get the pinned pubkey of host from kv")
+		return err
+	}
+	if err = s.intersect.SetPubKey([]byte(pinned)); err != nil {
+		log.WithField("error", err).Error("The pinned pubkey of host is invalid")
+		return err
+	}
+	s.keyID = ecdh.KeyFingerprint([]byte(pinned))
+	log.WithField("key_id", s.keyID).Info("Client loaded the pinned pubkey of host")
+	return nil
+}
+
+func (s *VOPRFRuntime) Run() error {
+	if s.role == "client" {
+		return s.runClient()
+	} else if s.role == "host" {
+		return s.runHost()
+	} else {
+		return errors.New(fmt.Sprintf("Unsupported role: %s", s.role))
+	}
+}
+
+func (s *VOPRFRuntime) runClient() error {
+	s.onFetch(func() error {
+		if !s.intersect.HasPubKey() {
+			log.Warn("The client hasn't got pubkey yet, skip")
+			return nil
+		}
+
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
+
+		blinded, blinds, err := s.intersect.Blind(data)
+		if err != nil {
+			log.WithField("data", data).Errorf("Blinding failed, err: %s", err)
+			return err
+		}
+
+		step := voprf.StepClientBlind
+		sessionKey := runtime.GenerateSessionKey(s.algorithm, step)
+
+		// the blinded elements are kept to verify the proof from host
+		if err = s.sendOriginData("", sessionKey, data); err != nil {
+			return err
+		}
+		if err = s.sendRands("", sessionKey, blinds); err != nil {
+			return err
+		}
+		if err = s.sendBlindedData("", sessionKey, blinded); err != nil {
+			return err
+		}
+
+		if err = s.sendMessageOrError(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: step,
+			SessionKey: sessionKey,
+			KeyID: s.keyID,
+			Data: blinded,
+		}); err != nil {
+			return err
+		}
+
+		s.lastGraphFetchTime = &newTime
+		log.Info("Client got new data from db, blind it, and send to host")
+		return nil
+	})
+
+	s.handle(voprf.StepHostSendPubKey, s.receivePubKey)
+	s.handle(voprf.StepHostEvaluate, func(msg *runtime.Message) error {
+		log.Info("Client starts to verify and finalize the evaluation from host")
+		if msg.KeyID != s.keyID {
+			log.WithFields(log.Fields{
+				"session_key": msg.SessionKey,
+				"key_id": msg.KeyID,
+			}).Warning("The batch is evaluated under a key the client isn't pinned to, drop it")
+			s.cleanSession(msg.SessionKey)
+			return nil
+		}
+		err := s.finalize(msg)
+		if err == voprf.ErrInvalidProof || err == voprf.ErrBatchSize {
+			s.rejectSession(msg.SessionKey, err)
+			return runtime.Stop(err)
+		}
+		return err
+	})
+	s.handle(voprf.StepHostHash, func(msg *runtime.Message) error {
+		log.Info("Client starts to compare hash from host")
+		return s.matchIDAndSendData(msg)
+	})
+	s.handle(voprf.StepExchangeData, s.loadDataToGraphDB)
+	s.handle(voprf.StepShutdown, s.stopOnShutdown)
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+func (s *VOPRFRuntime) runHost() error {
+	s.onFetch(func() error {
+		data, newTime, ok := s.fetchNewData()
+		if !ok {
+			return nil
+		}
+
+		ta, err := s.intersect.Evaluate(data)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to evaluate data from graph db")
+			return err
+		}
+
+		if err = s.createAndSendHashIDMap("", data, ta); err != nil {
+			return err
+		}
+
+		step := voprf.StepHostHash
+		if err = s.sendMessageOrError(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: step,
+			SessionKey: runtime.GenerateSessionKey(s.algorithm, step),
+			Data: ta,
+		}); err != nil {
+			return err
+		}
+
+		s.lastGraphFetchTime = &newTime
+		log.Info("Host got data from graph db, evaluated it and sent it to client")
+		return nil
+	})
+
+	s.handle(voprf.StepClientBlind, func(msg *runtime.Message) error {
+		log.Info("Host starts to evaluate blinded elements from client")
+		if msg.KeyID != s.keyID {
+			log.WithFields(log.Fields{
+				"session_key": msg.SessionKey,
+				"key_id": msg.KeyID,
+			}).Warning("The batch is blinded for another key of host, drop it")
+			return nil
+		}
+		evaluated, proof, err := s.intersect.BlindEvaluate(msg.Data)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"session_key": msg.SessionKey,
+				"error": err,
+			}).Error("Failed to evaluate blinded elements")
+			return err
+		}
+		return s.sendMessageOrError(&runtime.Message{
+			Algorithm: s.algorithm,
+			Step: voprf.StepHostEvaluate,
+			SessionKey: msg.SessionKey,
+			KeyID: s.keyID,
+			Data: evaluated,
+			Proof: proof,
+		})
+	})
+	s.handle(voprf.StepClientFinalize, func(msg *runtime.Message) error {
+		log.Info("Host starts to compare hash from client")
+		return s.matchIDAndSendData(msg)
+	})
+	s.handle(voprf.StepExchangeData, s.loadDataToGraphDB)
+	s.handle(voprf.StepShutdown, s.stopOnShutdown)
+
+	// pubkey exchange, StepClientRcvPubKey is handled by it
+	s.sendPubKeyAndWaitAck(voprf.StepHostSendPubKey, voprf.StepClientRcvPubKey, nil, s.rotation, runtime.Key{
+		Element: s.intersect.GetPubKey(),
+		ID: s.keyID,
+	})
+
+	log.Info("Waiting for incoming message")
+	return s.dispatcher.Run()
+}
+
+func (s *VOPRFRuntime) finalize(msg *runtime.Message) error {
+	data, err := s.getOriginData("", msg.SessionKey)
+	if err != nil {
+		return err
+	}
+	blinds, err := s.getRands("", msg.SessionKey)
+	if err != nil {
+		return err
+	}
+	blinded, err := s.getBlindedData("", msg.SessionKey)
+	if err != nil {
+		return err
+	}
+
+	tb, err := s.intersect.Finalize(data, blinds, blinded, msg.Data, msg.Proof)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to finalize the evaluation from host")
+		return err
+	}
+
+	if err = s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: voprf.StepClientFinalize,
+		SessionKey: msg.SessionKey,
+		Data: tb,
+	}); err != nil {
+		return err
+	}
+
+	if err = s.createAndSendHashIDMap("", data, tb); err != nil {
+		return err
+	}
+
+	s.cleanSession(msg.SessionKey)
+	log.Info("Client finalized the evaluation from host and sent the hash to host")
+	return nil
+}
+
+// receivePubKey pins the first pubkey of host, and only accepts another one
+// when it's signed by the pinned key
+func (s *VOPRFRuntime) receivePubKey(msg *runtime.Message) error {
+	log.Info("Client received pubkey from host")
+	keyID := ecdh.KeyFingerprint(msg.Key.Element)
+	if len(msg.Key.ID) > 0 && msg.Key.ID != keyID {
+		log.WithFields(log.Fields{
+			"key_id": msg.Key.ID,
+			"fingerprint": keyID,
+		}).Warning("The key id doesn't match the fingerprint of pubkey")
+		s.sendShutdown(msg.SessionKey, "key id mismatch")
+		return runtime.Stop(errors.New("The key id doesn't match the fingerprint of pubkey"))
+	}
+
+	if len(s.keyID) > 0 && keyID != s.keyID {
+		pinned := s.intersect.GetPubKey()
+		if len(msg.Proof) == 0 || !voprf.VerifyRotation(pinned, msg.Key.Element, msg.Proof) {
+			log.WithFields(log.Fields{
+				"pinned_key_id": s.keyID,
+				"key_id": keyID,
+			}).Error("Host announced another pubkey without a rotation, reject it")
+			s.sendShutdown(msg.SessionKey, errPubKeyChanged.Error())
+			return runtime.Stop(errPubKeyChanged)
+		}
+		log.WithFields(log.Fields{
+			"pinned_key_id": s.keyID,
+			"key_id": keyID,
+		}).Warning("Host rotated its key, the batches blinded under the old key are dropped")
+	}
+
+	if err := s.intersect.SetPubKey(msg.Key.Element); err != nil {
+		log.WithFields(log.Fields{
+			"msg": msg,
+			"error": err,
+		}).Warning("Client received invalid pubkey")
+		s.sendShutdown(msg.SessionKey, "invalid pubkey")
+		return runtime.Stop(err)
+	}
+	if err := s.kv.Put(voprfPinnedKey, string(msg.Key.Element)); err != nil {
+		log.WithField("error", err).Error("Failed to pin the pubkey of host in kv")
+		return err
+	}
+	s.keyID = keyID
+
+	return s.sendMessageOrError(&runtime.Message{
+		Algorithm: s.algorithm,
+		Step: voprf.StepClientRcvPubKey,
+		SessionKey: msg.SessionKey,
+	})
+}
+
+// rejectSession drops everything kept for the session and tells the host to stop
+func (s *VOPRFRuntime) rejectSession(sessionKey string, reason error) {
+	log.WithFields(log.Fields{
+		"session_key": sessionKey,
+		"error": reason,
+	}).Error("The evaluation from host is invalid, reject the session")
+	s.cleanSession(sessionKey)
+	s.sendShutdown(sessionKey, reason.Error())
+}
+
+func (s *VOPRFRuntime) cleanSession(sessionKey string) {
+	s.delRands("", sessionKey)
+	s.delOriginData("", sessionKey)
+	s.delBlindedData("", sessionKey)
+}
@@ -1,14 +1,25 @@
 package runtime
 
 import (
+	"errors"
 	"context"
 
 	"github.com/apache/pulsar-client-go/pulsar"
 )
 
+var errNoDelivery = errors.New("The message is not received from this consumer")
+
+// Consumer delivers every message at least once. Receive acks the message it
+// returns, since the caller has nothing to ack it with, while a message
+// returned by ReceiveStruct is delivered again until it's acked, so it should
+// be acked only after its effects are committed.
 type Consumer interface {
 	Receive() ([]byte, error)
 	ReceiveStruct() (Message, error)
+	// Ack tells the message is handled, it's never delivered again
+	Ack(msg *Message) error
+	// Nack tells the message failed to be handled, it's delivered again later
+	Nack(msg *Message) error
 	Close()
 }
 
@@ -19,7 +30,11 @@ type PulsarConsumer struct {
 
 func (c *PulsarConsumer) Receive() ([]byte, error) {
 	msg, err := c.consumer.Receive(context.Background())
-	return msg.Payload(), err
+	if err != nil {
+		return nil, err
+	}
+	c.consumer.Ack(msg)
+	return msg.Payload(), nil
 }
 
 func (c *PulsarConsumer) ReceiveStruct() (Message, error) {
@@ -28,8 +43,32 @@ func (c *PulsarConsumer) ReceiveStruct() (Message, error) {
 		return Message{}, err
 	}
 	var s Message
-	err = msg.GetSchemaValue(&s)
-	return s, err
+	if err = msg.GetSchemaValue(&s); err != nil {
+		// it would fail the same way every time
+		c.consumer.Ack(msg)
+		return Message{}, err
+	}
+	s.delivery = msg
+	return s, nil
+}
+
+func (c *PulsarConsumer) Ack(msg *Message) error {
+	delivery, ok := msg.delivery.(pulsar.Message)
+	if !ok {
+		return errNoDelivery
+	}
+	c.consumer.Ack(delivery)
+	return nil
+}
+
+// Nack makes pulsar deliver the message again after the redelivery delay
+func (c *PulsarConsumer) Nack(msg *Message) error {
+	delivery, ok := msg.delivery.(pulsar.Message)
+	if !ok {
+		return errNoDelivery
+	}
+	c.consumer.Nack(delivery)
+	return nil
 }
 
 func (c *PulsarConsumer) Close() {
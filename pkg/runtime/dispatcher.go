@@ -0,0 +1,418 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The dispatcher is the single reader of a consumer. It routes every message
+// by its algorithm and step to the handler registered for it, and runs the
+// periodic tasks, all on the goroutine of Run, so the handlers and tasks never
+// race with each other. A message is acked once its handler returns, and a
+// message handled before, e.g. delivered again after a crash, is dropped.
+//
+// A handler returns nil when the message is handled, Retry(err) to have it
+// delivered again later, Stop(err) to make Run return err, and any other error
+// to drop the message, which is logged by the handler.
+
+// Handler handles a message
+type Handler func(msg *Message) error
+
+// Task runs periodically, it returns errors the same way as Handler
+type Task func() error
+
+// UnhandledPolicy decides what is done with a message no handler is
+// registered for
+type UnhandledPolicy string
+
+const (
+	// UnhandledDrop acks and drops the message
+	UnhandledDrop 		UnhandledPolicy = "drop"
+	// UnhandledRetry nacks the message, so it's delivered again later
+	UnhandledRetry 		UnhandledPolicy = "retry"
+	// UnhandledFail makes Run return an error
+	UnhandledFail 		UnhandledPolicy = "fail"
+)
+
+const (
+	// the wait after a failed receive starts at minReceiveBackoff and doubles
+	// with every failure in a row up to maxReceiveBackoff
+	minReceiveBackoff 	= 10 * time.Millisecond
+	maxReceiveBackoff 	= 5 * time.Second
+)
+
+var errHandlerTimeout = errors.New("The handler didn't return in time")
+
+// ProcessedStore records the messages handled by their digests
+type ProcessedStore interface {
+	IsProcessed(msg *Message, digest string) (bool, error)
+	MarkProcessed(msg *Message, digest string) error
+}
+
+type retryError struct {
+	err 	error
+}
+
+func (e *retryError) Error() string {
+	return fmt.Sprintf("retry: %s", e.err)
+}
+
+// Retry makes the dispatcher nack the message instead of dropping it
+func Retry(err error) error {
+	return &retryError{err: err}
+}
+
+type stopError struct {
+	err 	error
+}
+
+func (e *stopError) Error() string {
+	return fmt.Sprintf("stop: %v", e.err)
+}
+
+// Stop makes Run return err, which can be nil
+func Stop(err error) error {
+	return &stopError{err: err}
+}
+
+// MessageDigest identifies a delivery of message, the same message delivered
+// again has the same digest
+func MessageDigest(msg *Message) (string, error) {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+type route struct {
+	handler 	Handler
+	timeout 	time.Duration
+}
+
+type Dispatcher struct {
+	consumer 		Consumer
+	processed 		ProcessedStore
+	unhandled 		UnhandledPolicy
+	// timeout is the default timeout of handlers, 0 means no timeout
+	timeout 		time.Duration
+	stepTimeouts 	map[Step]time.Duration
+	mu 				sync.Mutex
+	// algorithm -> step -> route
+	routes 			map[string]map[Step]*route
+	messages 		chan Message
+	tasks 			chan Task
+	done 			chan struct{}
+	startOnce 		sync.Once
+	stopOnce 		sync.Once
+}
+
+// NewDispatcher reads messages from consumer, processed can be nil to handle
+// every delivery
+func NewDispatcher(consumer Consumer, processed ProcessedStore) *Dispatcher {
+	return &Dispatcher{
+		consumer: consumer,
+		processed: processed,
+		unhandled: UnhandledDrop,
+		stepTimeouts: make(map[Step]time.Duration),
+		routes: make(map[string]map[Step]*route),
+		messages: make(chan Message),
+		tasks: make(chan Task),
+		done: make(chan struct{}),
+	}
+}
+
+func (d *Dispatcher) SetUnhandledPolicy(policy UnhandledPolicy) error {
+	switch policy {
+	case UnhandledDrop, UnhandledRetry, UnhandledFail:
+		d.unhandled = policy
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("Unsupported unhandled policy: %s", policy))
+	}
+}
+
+// SetTimeout sets the timeout of the handlers registered without one, and
+// of the ones of step if it's given. A handler not returning in time is
+// abandoned, its message is nacked and Run fails, since the handler may still
+// change the state shared with the others.
+func (d *Dispatcher) SetTimeout(timeout time.Duration, steps ...Step) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(steps) == 0 {
+		d.timeout = timeout
+		return
+	}
+	for _, step := range steps {
+		d.stepTimeouts[step] = timeout
+	}
+}
+
+// Handle registers handler for the messages of step of algorithm, it replaces
+// the one registered before
+func (d *Dispatcher) Handle(algorithm string, step Step, handler Handler) {
+	d.HandleWithTimeout(algorithm, step, 0, handler)
+}
+
+// HandleWithTimeout registers handler with its own timeout
+func (d *Dispatcher) HandleWithTimeout(algorithm string, step Step, timeout time.Duration, handler Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.routes[algorithm]; !ok {
+		d.routes[algorithm] = make(map[Step]*route)
+	}
+	d.routes[algorithm][step] = &route{handler: handler, timeout: timeout}
+}
+
+func (d *Dispatcher) lookup(msg *Message) (*route, time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.routes[msg.Algorithm][msg.Step]
+	if !ok {
+		return nil, 0, false
+	}
+	timeout := r.timeout
+	if timeout <= 0 {
+		if stepTimeout, ok := d.stepTimeouts[msg.Step]; ok {
+			timeout = stepTimeout
+		} else {
+			timeout = d.timeout
+		}
+	}
+	return r, timeout, true
+}
+
+// Every runs task every interval on the goroutine of Run
+func (d *Dispatcher) Every(interval time.Duration, task Task) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !d.schedule(task) {
+					return
+				}
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+// After runs task once after delay on the goroutine of Run
+func (d *Dispatcher) After(delay time.Duration, task Task) {
+	timer := time.NewTimer(delay)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			d.schedule(task)
+		case <-d.done:
+		}
+	}()
+}
+
+func (d *Dispatcher) schedule(task Task) bool {
+	select {
+	case d.tasks <- task:
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+func (d *Dispatcher) receive() {
+	backoff := minReceiveBackoff
+	for {
+		msg, err := d.consumer.ReceiveStruct()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"backoff": backoff,
+				"error": err,
+			}).Warning("Failed to receive message")
+			select {
+			case <-time.After(backoff):
+			case <-d.done:
+				return
+			}
+			if backoff *= 2; backoff > maxReceiveBackoff {
+				backoff = maxReceiveBackoff
+			}
+			continue
+		}
+		backoff = minReceiveBackoff
+		select {
+		case d.messages <- msg:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Run dispatches the messages and runs the tasks until a handler or task
+// stops it
+func (d *Dispatcher) Run() error {
+	d.startOnce.Do(func() {
+		go d.receive()
+	})
+	defer d.stopOnce.Do(func() {
+		close(d.done)
+	})
+
+	for {
+		var err error
+		select {
+		case msg := <-d.messages:
+			err = d.dispatch(&msg)
+		case task := <-d.tasks:
+			err = task()
+		}
+
+		if stop, ok := err.(*stopError); ok {
+			return stop.err
+		}
+		if err != nil {
+			log.WithField("error", err).Debug("Task failed")
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(msg *Message) error {
+	digest, err := MessageDigest(msg)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to digest message")
+		return nil
+	}
+	if d.processed != nil {
+		if processed, err := d.processed.IsProcessed(msg, digest); err != nil {
+			log.WithFields(log.Fields{
+				"session_key": msg.SessionKey,
+				"error": err,
+			}).Error("Failed to check whether the message is processed, process it")
+		} else if processed {
+			log.WithFields(log.Fields{
+				"step": msg.Step,
+				"session_key": msg.SessionKey,
+			}).Info("The message is processed already, drop it")
+			d.ack(msg)
+			return nil
+		}
+	}
+
+	r, timeout, ok := d.lookup(msg)
+	if !ok {
+		return d.dispatchUnhandled(msg)
+	}
+
+	err = d.call(r.handler, msg, timeout)
+	switch err.(type) {
+	case nil:
+		d.commit(msg, digest)
+		return nil
+	case *retryError:
+		log.WithFields(log.Fields{
+			"step": msg.Step,
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Warning("Failed to handle the message, it'll be delivered again")
+		d.nack(msg)
+		return nil
+	case *stopError:
+		d.commit(msg, digest)
+		return err
+	default:
+		if err == errHandlerTimeout {
+			log.WithFields(log.Fields{
+				"step": msg.Step,
+				"session_key": msg.SessionKey,
+				"timeout": timeout,
+			}).Error(err)
+			d.nack(msg)
+			return Stop(err)
+		}
+		// the handler has logged the failure
+		d.ack(msg)
+		return nil
+	}
+}
+
+func (d *Dispatcher) dispatchUnhandled(msg *Message) error {
+	fields := log.Fields{
+		"algorithm": msg.Algorithm,
+		"step": msg.Step,
+		"session_key": msg.SessionKey,
+	}
+	switch d.unhandled {
+	case UnhandledRetry:
+		log.WithFields(fields).Warning("No handler for the message, it'll be delivered again")
+		d.nack(msg)
+		return nil
+	case UnhandledFail:
+		log.WithFields(fields).Error("No handler for the message")
+		d.nack(msg)
+		return Stop(errors.New(fmt.Sprintf("No handler for step %s of %s", msg.Step, msg.Algorithm)))
+	default:
+		log.WithFields(fields).Warning("Received a message with wrong step, drop it")
+		d.ack(msg)
+		return nil
+	}
+}
+
+func (d *Dispatcher) call(handler Handler, msg *Message, timeout time.Duration) error {
+	if timeout <= 0 {
+		return handler(msg)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(msg)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errHandlerTimeout
+	}
+}
+
+// commit marks the message as processed before acking it, so it's never
+// handled twice even if the ack is lost
+func (d *Dispatcher) commit(msg *Message, digest string) {
+	if d.processed != nil {
+		if err := d.processed.MarkProcessed(msg, digest); err != nil {
+			log.WithFields(log.Fields{
+				"session_key": msg.SessionKey,
+				"error": err,
+			}).Error("Failed to mark message as processed, it may be processed again")
+		}
+	}
+	d.ack(msg)
+}
+
+func (d *Dispatcher) ack(msg *Message) {
+	if err := d.consumer.Ack(msg); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to ack message")
+	}
+}
+
+func (d *Dispatcher) nack(msg *Message) {
+	if err := d.consumer.Nack(msg); err != nil {
+		log.WithFields(log.Fields{
+			"session_key": msg.SessionKey,
+			"error": err,
+		}).Error("Failed to nack message")
+	}
+}
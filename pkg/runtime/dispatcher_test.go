@@ -0,0 +1,214 @@
+package runtime
+
+import (
+	"sync"
+	"time"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsumer delivers the messages sent to it, a nacked message is
+// delivered again
+type fakeConsumer struct {
+	messages 	chan Message
+	mu 			sync.Mutex
+	acked 		[]string
+	nacked 		[]string
+}
+
+func newFakeConsumer() *fakeConsumer {
+	return &fakeConsumer{messages: make(chan Message, 16)}
+}
+
+func (c *fakeConsumer) send(msgs ...Message) {
+	for _, msg := range msgs {
+		msg.delivery = msg.SessionKey
+		c.messages <- msg
+	}
+}
+
+func (c *fakeConsumer) Receive() ([]byte, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (c *fakeConsumer) ReceiveStruct() (Message, error) {
+	msg, ok := <-c.messages
+	if !ok {
+		return Message{}, errConsumerClosed
+	}
+	return msg, nil
+}
+
+func (c *fakeConsumer) Ack(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acked = append(c.acked, msg.SessionKey)
+	return nil
+}
+
+func (c *fakeConsumer) Nack(msg *Message) error {
+	c.mu.Lock()
+	c.nacked = append(c.nacked, msg.SessionKey)
+	c.mu.Unlock()
+	c.messages <- *msg
+	return nil
+}
+
+func (c *fakeConsumer) Close() {
+}
+
+func (c *fakeConsumer) results() ([]string, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.acked...), append([]string{}, c.nacked...)
+}
+
+type mapProcessedStore struct {
+	processed 	map[string]bool
+}
+
+func (p *mapProcessedStore) IsProcessed(msg *Message, digest string) (bool, error) {
+	return p.processed[digest], nil
+}
+
+func (p *mapProcessedStore) MarkProcessed(msg *Message, digest string) error {
+	p.processed[digest] = true
+	return nil
+}
+
+func TestDispatcherRouting(t *testing.T) {
+	consumer := newFakeConsumer()
+	dispatcher := NewDispatcher(consumer, &mapProcessedStore{processed: make(map[string]bool)})
+
+	var handled []string
+	dispatcher.Handle("rsa", "Blind", func(msg *Message) error {
+		handled = append(handled, "rsa-" + msg.SessionKey)
+		return nil
+	})
+	dispatcher.Handle("ecdh", "Blind", func(msg *Message) error {
+		handled = append(handled, "ecdh-" + msg.SessionKey)
+		return nil
+	})
+	dispatcher.Handle("rsa", StepShutdown, func(msg *Message) error {
+		return Stop(nil)
+	})
+
+	first := Message{Algorithm: "rsa", Step: "Blind", SessionKey: "session-0"}
+	consumer.send(
+		first,
+		Message{Algorithm: "ecdh", Step: "Blind", SessionKey: "session-1"},
+		// no handler, dropped
+		Message{Algorithm: "rsa", Step: "Unknown", SessionKey: "session-2"},
+		// delivered again, dropped
+		first,
+		Message{Algorithm: "rsa", Step: StepShutdown, SessionKey: "session-3"},
+	)
+
+	assert.NoError(t, dispatcher.Run())
+	assert.Equal(t, []string{"rsa-session-0", "ecdh-session-1"}, handled)
+	acked, nacked := consumer.results()
+	assert.Equal(t, []string{"session-0", "session-1", "session-2", "session-0", "session-3"}, acked)
+	assert.Empty(t, nacked)
+}
+
+func TestDispatcherRetryAndStop(t *testing.T) {
+	consumer := newFakeConsumer()
+	dispatcher := NewDispatcher(consumer, nil)
+
+	errFatal := errors.New("fatal")
+	attempts := 0
+	dispatcher.Handle("rsa", "Blind", func(msg *Message) error {
+		attempts++
+		if attempts == 1 {
+			return Retry(errors.New("not ready"))
+		}
+		return Stop(errFatal)
+	})
+	consumer.send(Message{Algorithm: "rsa", Step: "Blind", SessionKey: "session-0"})
+
+	assert.Equal(t, errFatal, dispatcher.Run())
+	assert.Equal(t, 2, attempts)
+	acked, nacked := consumer.results()
+	assert.Equal(t, []string{"session-0"}, acked)
+	assert.Equal(t, []string{"session-0"}, nacked)
+}
+
+func TestDispatcherUnhandledPolicy(t *testing.T) {
+	consumer := newFakeConsumer()
+	dispatcher := NewDispatcher(consumer, nil)
+	assert.Error(t, dispatcher.SetUnhandledPolicy("ignore"))
+	assert.NoError(t, dispatcher.SetUnhandledPolicy(UnhandledFail))
+
+	consumer.send(Message{Algorithm: "rsa", Step: "Unknown", SessionKey: "session-0"})
+	assert.Error(t, dispatcher.Run())
+	acked, nacked := consumer.results()
+	assert.Empty(t, acked)
+	assert.Equal(t, []string{"session-0"}, nacked)
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	consumer := newFakeConsumer()
+	dispatcher := NewDispatcher(consumer, nil)
+	dispatcher.SetTimeout(10 * time.Millisecond, "Slow")
+
+	release := make(chan struct{})
+	defer close(release)
+	dispatcher.Handle("rsa", "Slow", func(msg *Message) error {
+		<-release
+		return nil
+	})
+	consumer.send(Message{Algorithm: "rsa", Step: "Slow", SessionKey: "session-0"})
+
+	assert.Equal(t, errHandlerTimeout, dispatcher.Run())
+	_, nacked := consumer.results()
+	assert.Contains(t, nacked, "session-0")
+}
+
+func TestDispatcherTasks(t *testing.T) {
+	consumer := newFakeConsumer()
+	dispatcher := NewDispatcher(consumer, nil)
+
+	ticks := 0
+	dispatcher.Every(time.Millisecond, func() error {
+		ticks++
+		return errors.New("ignored")
+	})
+	errDone := errors.New("done")
+	dispatcher.After(20 * time.Millisecond, func() error {
+		return Stop(errDone)
+	})
+
+	assert.Equal(t, errDone, dispatcher.Run())
+	assert.Greater(t, ticks, 0)
+}
+
+type failingConsumer struct {
+	fakeConsumer
+	mu 			sync.Mutex
+	calls 		int
+}
+
+func (c *failingConsumer) ReceiveStruct() (Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return Message{}, errors.New("broken")
+}
+
+func TestDispatcherReceiveBackoff(t *testing.T) {
+	consumer := &failingConsumer{}
+	dispatcher := NewDispatcher(consumer, nil)
+
+	errDone := errors.New("done")
+	dispatcher.After(100 * time.Millisecond, func() error {
+		return Stop(errDone)
+	})
+
+	assert.Equal(t, errDone, dispatcher.Run())
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	// 10, 20, 40 and 80ms of backoff fit in 100ms
+	assert.LessOrEqual(t, consumer.calls, 5)
+}
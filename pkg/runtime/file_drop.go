@@ -0,0 +1,522 @@
+package runtime
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/json"
+	"crypto/ed25519"
+	"path/filepath"
+	"encoding/binary"
+)
+
+// The file-drop transport moves messages as files, for peers that can't be
+// reached over the network. The producer writes every message of a topic as
+// <topic>-<seq>.msg into the outbox, signed with the ed25519 key of this side
+// and numbered from 0 without gaps, and the files are carried to the inbox of
+// peer by hand or over SFTP. The consumer verifies the signature against the
+// key of peer and returns the files strictly in order of seq, a missing one is
+// waited for. Both sides keep the next seq in a hidden state file, so a file
+// carried twice is dropped. The consumer commits the messages acked in order
+// of seq, a message not acked when the process dies is received again after
+// restart, and a nacked one is received again after a poll interval together
+// with the ones after it that are not acked yet.
+//
+// Files are written under a hidden temporary name and renamed when complete,
+// only the *.msg files should be carried to the peer.
+
+const (
+	dropFileSuffix 		= ".msg"
+	dropDoneDir 		= "done"
+	dropRejectedDir 	= "rejected"
+	dropSignContext 	= "ppgi-file-drop-v1"
+	defaultDropPoll 	= time.Second
+)
+
+var errDropSignature = errors.New("Failed to verify the signature of message file")
+
+type dropEnvelope struct {
+	Topic 		string		`json:"topic"`
+	Seq 		uint64		`json:"seq"`
+	Payload 	[]byte		`json:"payload"`
+	Signature 	[]byte		`json:"signature"`
+}
+
+// signedBytes binds the payload to its topic and seq, so a file can't be
+// replayed under another name
+func (e *dropEnvelope) signedBytes() []byte {
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, e.Seq)
+	data := make([]byte, 0, len(dropSignContext) + len(e.Topic) + len(seq) + len(e.Payload) + 2)
+	data = append(data, dropSignContext...)
+	data = append(data, 0)
+	data = append(data, e.Topic...)
+	data = append(data, 0)
+	data = append(data, seq...)
+	return append(data, e.Payload...)
+}
+
+func dropFileName(topic string, seq uint64) string {
+	return fmt.Sprintf("%s-%020d%s", topic, seq, dropFileSuffix)
+}
+
+// parseDropFileName returns the seq of a message file of topic
+func parseDropFileName(topic, name string) (uint64, bool) {
+	prefix := topic + "-"
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, dropFileSuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), dropFileSuffix), 10, 64)
+	return seq, err == nil
+}
+
+func checkDropTopic(topic string) error {
+	if len(topic) == 0 || strings.ContainsAny(topic, `/\`) || strings.HasPrefix(topic, ".") {
+		return errors.New(fmt.Sprintf("The topic %s can't be used as a file name", topic))
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to file, so
+// a partial file is never seen under the name
+func writeFileAtomic(file string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(file), "." + filepath.Base(file) + ".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
+
+func writeFileSync(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readSeq reads the seq kept in file, 0 if it doesn't exist yet
+func readSeq(file string) (uint64, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func writeSeq(file string, seq uint64) error {
+	return writeFileAtomic(file, []byte(strconv.FormatUint(seq, 10)))
+}
+
+// LoadSignKey reads an ed25519 private key in PKCS#8 PEM, e.g. created by
+// `openssl genpkey -algorithm ed25519`
+func LoadSignKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	privKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an ed25519 private key", file))
+	}
+	return privKey, nil
+}
+
+// LoadVerifyKey reads an ed25519 public key in PKIX PEM, e.g. created by
+// `openssl pkey -pubout`
+func LoadVerifyKey(file string) (ed25519.PublicKey, error) {
+	der, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an ed25519 public key", file))
+	}
+	return pubKey, nil
+}
+
+func readPEM(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("No PEM block is found in %s", file))
+	}
+	return block.Bytes, nil
+}
+
+type FileProducer struct {
+	outbox 		string
+	topic 		string
+	key 		ed25519.PrivateKey
+	mu 			sync.Mutex
+	// seq of the next message
+	seq 		uint64
+}
+
+// NewFileProducer writes the messages of topic into outbox, signed with key
+func NewFileProducer(outbox, topic string, key ed25519.PrivateKey) (*FileProducer, error) {
+	if err := checkDropTopic(topic); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outbox, 0700); err != nil {
+		return nil, err
+	}
+
+	p := &FileProducer{
+		outbox: outbox,
+		topic: topic,
+		key: key,
+	}
+	seq, err := readSeq(p.stateFile())
+	if err != nil {
+		return nil, err
+	}
+	p.seq = seq
+	if err = p.recover(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileProducer) stateFile() string {
+	return filepath.Join(p.outbox, fmt.Sprintf(".%s.seq", p.topic))
+}
+
+func (p *FileProducer) tmpFile(seq uint64) string {
+	return filepath.Join(p.outbox, "." + dropFileName(p.topic, seq) + ".tmp")
+}
+
+// recover finishes the messages whose seq is taken before a crash, and drops
+// the ones whose Send didn't return
+func (p *FileProducer) recover() error {
+	for seq := p.seq; seq > 0; seq-- {
+		tmp := p.tmpFile(seq - 1)
+		if _, err := os.Stat(tmp); os.IsNotExist(err) {
+			break
+		}
+		if err := os.Rename(tmp, filepath.Join(p.outbox, dropFileName(p.topic, seq - 1))); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(p.tmpFile(p.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(p.outbox)
+}
+
+func (p *FileProducer) GetConnectionInfo() string {
+	return fmt.Sprintf("outbox: %s, topic: %s", p.outbox, p.topic)
+}
+
+// Send writes the message to a temporary file first, takes its seq, and then
+// renames it, so a seq is never given to two messages
+func (p *FileProducer) Send(payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	envelope := &dropEnvelope{
+		Topic: p.topic,
+		Seq: p.seq,
+		Payload: payload,
+	}
+	envelope.Signature = ed25519.Sign(p.key, envelope.signedBytes())
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.tmpFile(p.seq)
+	if err = writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err = writeSeq(p.stateFile(), p.seq + 1); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	p.seq++
+	if err = os.Rename(tmp, filepath.Join(p.outbox, dropFileName(p.topic, envelope.Seq))); err != nil {
+		return err
+	}
+	return syncDir(p.outbox)
+}
+
+func (p *FileProducer) SendStruct(msg *Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.Send(payload)
+}
+
+func (p *FileProducer) Close() {
+}
+
+type FileConsumer struct {
+	inbox 			string
+	topic 			string
+	key 			ed25519.PublicKey
+	pollInterval 	time.Duration
+	mu 				sync.Mutex
+	// seq of the next message to commit, kept in the state file
+	seq 			uint64
+	// seq of the next message to deliver
+	next 			uint64
+	// messages acked before the ones ahead of them
+	acked 			map[uint64]bool
+	// nacked delays the next delivery for a poll interval
+	nacked 			bool
+	closed 			chan struct{}
+	closeOnce 		sync.Once
+}
+
+// NewFileConsumer reads the messages of topic from inbox, signed by key of
+// peer, and looks for the next one every pollInterval
+func NewFileConsumer(inbox, topic string, key ed25519.PublicKey, pollInterval time.Duration) (*FileConsumer, error) {
+	if err := checkDropTopic(topic); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{inbox, filepath.Join(inbox, dropDoneDir), filepath.Join(inbox, dropRejectedDir)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if pollInterval <= 0 {
+		pollInterval = defaultDropPoll
+	}
+
+	c := &FileConsumer{
+		inbox: inbox,
+		topic: topic,
+		key: key,
+		pollInterval: pollInterval,
+		acked: make(map[uint64]bool),
+		closed: make(chan struct{}),
+	}
+	seq, err := readSeq(c.stateFile())
+	if err != nil {
+		return nil, err
+	}
+	c.seq, c.next = seq, seq
+	return c, nil
+}
+
+func (c *FileConsumer) stateFile() string {
+	return filepath.Join(c.inbox, fmt.Sprintf(".%s.next", c.topic))
+}
+
+// ack commits the messages acked without a gap from the last committed one,
+// the seq is kept before the files are moved so a crash in between only leaves
+// duplicates
+func (c *FileConsumer) ack(seq uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq < c.seq {
+		return nil
+	}
+	c.acked[seq] = true
+	committed := c.seq
+	for c.acked[committed] {
+		delete(c.acked, committed)
+		committed++
+	}
+	if committed == c.seq {
+		return nil
+	}
+	if err := writeSeq(c.stateFile(), committed); err != nil {
+		return err
+	}
+	for ; c.seq < committed; c.seq++ {
+		name := dropFileName(c.topic, c.seq)
+		if err := os.Rename(filepath.Join(c.inbox, name), filepath.Join(c.inbox, dropDoneDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropDuplicates removes the files carried again after they're committed
+func (c *FileConsumer) dropDuplicates() error {
+	files, err := ioutil.ReadDir(c.inbox)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if seq, ok := parseDropFileName(c.topic, f.Name()); ok && seq < c.seq {
+			if err = os.Remove(filepath.Join(c.inbox, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reject moves a file that fails to verify aside, and waits for a good copy
+func (c *FileConsumer) reject(file string, reason error) error {
+	name := fmt.Sprintf("%s.%d", filepath.Base(file), time.Now().UnixNano())
+	if err := os.Rename(file, filepath.Join(c.inbox, dropRejectedDir, name)); err != nil {
+		return err
+	}
+	return errors.New(fmt.Sprintf("Rejected %s: %s", filepath.Base(file), reason))
+}
+
+// readNext returns the seq and payload of the next file, nil if it's not
+// there yet
+func (c *FileConsumer) readNext() (uint64, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the ones acked after a nack are not delivered again
+	for c.acked[c.next] {
+		c.next++
+	}
+	file := filepath.Join(c.inbox, dropFileName(c.topic, c.next))
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil, c.dropDuplicates()
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	envelope := &dropEnvelope{}
+	if err = json.Unmarshal(data, envelope); err != nil {
+		return 0, nil, c.reject(file, err)
+	}
+	if envelope.Topic != c.topic || envelope.Seq != c.next {
+		return 0, nil, c.reject(file, errors.New("topic or seq doesn't match the name"))
+	}
+	if !ed25519.Verify(c.key, envelope.signedBytes(), envelope.Signature) {
+		return 0, nil, c.reject(file, errDropSignature)
+	}
+
+	c.next++
+	if envelope.Payload == nil {
+		return envelope.Seq, []byte{}, nil
+	}
+	return envelope.Seq, envelope.Payload, nil
+}
+
+func (c *FileConsumer) wait() bool {
+	select {
+	case <-c.closed:
+		return false
+	case <-time.After(c.pollInterval):
+		return true
+	}
+}
+
+func (c *FileConsumer) receive() (uint64, []byte, error) {
+	c.mu.Lock()
+	nacked := c.nacked
+	c.nacked = false
+	c.mu.Unlock()
+	if nacked && !c.wait() {
+		return 0, nil, errConsumerClosed
+	}
+
+	for {
+		seq, payload, err := c.readNext()
+		if err != nil || payload != nil {
+			return seq, payload, err
+		}
+		if !c.wait() {
+			return 0, nil, errConsumerClosed
+		}
+	}
+}
+
+func (c *FileConsumer) Receive() ([]byte, error) {
+	seq, payload, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	return payload, c.ack(seq)
+}
+
+func (c *FileConsumer) ReceiveStruct() (Message, error) {
+	seq, payload, err := c.receive()
+	if err != nil {
+		return Message{}, err
+	}
+	var msg Message
+	if err = json.Unmarshal(payload, &msg); err != nil {
+		// the file is signed by peer, it would fail the same way every time
+		c.ack(seq)
+		return Message{}, err
+	}
+	msg.delivery = seq
+	return msg, nil
+}
+
+func (c *FileConsumer) Ack(msg *Message) error {
+	seq, ok := msg.delivery.(uint64)
+	if !ok {
+		return errNoDelivery
+	}
+	return c.ack(seq)
+}
+
+// Nack delivers the message again after a poll interval, and the ones after
+// it that are not acked yet
+func (c *FileConsumer) Nack(msg *Message) error {
+	seq, ok := msg.delivery.(uint64)
+	if !ok {
+		return errNoDelivery
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq >= c.seq && seq < c.next {
+		c.next = seq
+		c.nacked = true
+	}
+	return nil
+}
+
+func (c *FileConsumer) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
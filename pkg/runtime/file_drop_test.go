@@ -0,0 +1,205 @@
+package runtime
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"testing"
+	"io/ioutil"
+	"crypto/rand"
+	"crypto/ed25519"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// carry moves the message files from outbox to inbox, like a manual transfer
+func carry(t *testing.T, outbox, inbox string) {
+	files, err := filepath.Glob(filepath.Join(outbox, "*" + dropFileSuffix))
+	assert.NoError(t, err)
+	for _, file := range files {
+		assert.NoError(t, os.Rename(file, filepath.Join(inbox, filepath.Base(file))))
+	}
+}
+
+func TestFileDrop(t *testing.T) {
+	outbox, inbox := t.TempDir(), t.TempDir()
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	producer, err := NewFileProducer(outbox, "client_to_host", privKey)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{SessionKey: fmt.Sprintf("session-%d", i)}))
+	}
+
+	// the producer continues the seq after restart
+	producer, err = NewFileProducer(outbox, "client_to_host", privKey)
+	assert.NoError(t, err)
+	for i := 5; i < 10; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{SessionKey: fmt.Sprintf("session-%d", i)}))
+	}
+	carry(t, outbox, inbox)
+
+	consumer, err := NewFileConsumer(inbox, "client_to_host", pubKey, time.Millisecond)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		msg, err := consumer.ReceiveStruct()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("session-%d", i), msg.SessionKey)
+		// the last one is never acked
+		if i < 4 {
+			assert.NoError(t, consumer.Ack(&msg))
+		}
+	}
+	consumer.Close()
+
+	// the message not acked is received again after restart, and the ones
+	// before are not
+	consumer, err = NewFileConsumer(inbox, "client_to_host", pubKey, time.Millisecond)
+	assert.NoError(t, err)
+	defer consumer.Close()
+	for i := 4; i < 10; i++ {
+		msg, err := consumer.ReceiveStruct()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("session-%d", i), msg.SessionKey)
+		assert.NoError(t, consumer.Ack(&msg))
+	}
+	done, err := ioutil.ReadDir(filepath.Join(inbox, dropDoneDir))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(done))
+}
+
+func TestFileDropNack(t *testing.T) {
+	outbox, inbox := t.TempDir(), t.TempDir()
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	producer, err := NewFileProducer(outbox, "topic", privKey)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{SessionKey: fmt.Sprintf("session-%d", i)}))
+	}
+	carry(t, outbox, inbox)
+
+	consumer, err := NewFileConsumer(inbox, "topic", pubKey, time.Millisecond)
+	assert.NoError(t, err)
+	defer consumer.Close()
+	msgs := make([]Message, 3)
+	for i := range msgs {
+		msgs[i], err = consumer.ReceiveStruct()
+		assert.NoError(t, err)
+	}
+
+	// the nacked one is received again, the acked one after it is not
+	assert.NoError(t, consumer.Ack(&msgs[2]))
+	assert.NoError(t, consumer.Nack(&msgs[0]))
+	assert.NoError(t, consumer.Ack(&msgs[1]))
+	msg, err := consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-0", msg.SessionKey)
+	assert.NoError(t, consumer.Ack(&msg))
+
+	seq, err := readSeq(consumer.stateFile())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+}
+
+func TestFileDropDuplicateAndGap(t *testing.T) {
+	outbox, inbox := t.TempDir(), t.TempDir()
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	producer, err := NewFileProducer(outbox, "topic", privKey)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, producer.Send([]byte(fmt.Sprintf("msg-%d", i))))
+	}
+	first, err := ioutil.ReadFile(filepath.Join(outbox, dropFileName("topic", 0)))
+	assert.NoError(t, err)
+
+	// the second file arrives first
+	assert.NoError(t, os.Rename(filepath.Join(outbox, dropFileName("topic", 1)), filepath.Join(inbox, dropFileName("topic", 1))))
+	consumer, err := NewFileConsumer(inbox, "topic", pubKey, time.Millisecond)
+	assert.NoError(t, err)
+
+	received := make(chan []byte)
+	go func() {
+		for i := 0; i < 3; i++ {
+			payload, err := consumer.Receive()
+			assert.NoError(t, err)
+			received <- payload
+		}
+		_, err := consumer.Receive()
+		assert.Equal(t, errConsumerClosed, err)
+		close(received)
+	}()
+
+	select {
+	case <-received:
+		t.Fatal("A message is received before the missing one")
+	case <-time.After(20 * time.Millisecond):
+	}
+	carry(t, outbox, inbox)
+	assert.Equal(t, []byte("msg-0"), <-received)
+	assert.Equal(t, []byte("msg-1"), <-received)
+
+	assert.Equal(t, []byte("msg-2"), <-received)
+
+	// a copy of a received file is dropped while waiting for the next one
+	duplicate := filepath.Join(inbox, dropFileName("topic", 0))
+	assert.NoError(t, ioutil.WriteFile(duplicate, first, 0600))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(duplicate)
+		return os.IsNotExist(err)
+	}, time.Second, time.Millisecond)
+	consumer.Close()
+	<-received
+}
+
+func TestFileDropRejectsForgedFile(t *testing.T) {
+	outbox, inbox := t.TempDir(), t.TempDir()
+	pubKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	producer, err := NewFileProducer(outbox, "topic", otherKey)
+	assert.NoError(t, err)
+	assert.NoError(t, producer.Send([]byte("forged")))
+	carry(t, outbox, inbox)
+
+	consumer, err := NewFileConsumer(inbox, "topic", pubKey, time.Millisecond)
+	assert.NoError(t, err)
+	defer consumer.Close()
+	_, err = consumer.Receive()
+	assert.Error(t, err)
+
+	rejected, err := ioutil.ReadDir(filepath.Join(inbox, dropRejectedDir))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rejected))
+}
+
+func TestFileProducerRecover(t *testing.T) {
+	outbox := t.TempDir()
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	producer, err := NewFileProducer(outbox, "topic", privKey)
+	assert.NoError(t, err)
+	assert.NoError(t, producer.Send([]byte("msg-0")))
+
+	// crashed after taking seq 0 but before the rename, and while writing seq 1
+	assert.NoError(t, os.Rename(filepath.Join(outbox, dropFileName("topic", 0)), producer.tmpFile(0)))
+	assert.NoError(t, ioutil.WriteFile(producer.tmpFile(1), []byte("partial"), 0600))
+
+	producer, err = NewFileProducer(outbox, "topic", privKey)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(outbox, dropFileName("topic", 0)))
+	assert.NoError(t, err)
+	_, err = os.Stat(producer.tmpFile(1))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, producer.Send([]byte("msg-1")))
+	_, err = os.Stat(filepath.Join(outbox, dropFileName("topic", 1)))
+	assert.NoError(t, err)
+}
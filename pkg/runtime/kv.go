@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"time"
 	"context"
 
 	"github.com/go-redis/redis/v8"
@@ -19,16 +20,28 @@ func GetExistingStringAndIndex(raw []interface{}) ([]string, []int) {
 	return str, index
 }
 
+// IsNotFound reports whether err means the key or field doesn't exist
+func IsNotFound(err error) bool {
+	return err == redis.Nil
+}
+
 type KV interface {
 	// TODO(zhuzilin) Currently, the go-redis library will return string by default.
 	// Find a way to return correct type of the val.
 	Put(key string, val string) error
 	Get(key string) (string, error)
 	Del(key string) error
+	// Expire deletes the key after ttl
+	Expire(key string, ttl time.Duration) error
 
 	HashPut(key string, data map[string]string) error
 	HashGet(key, field string) (string, error)
 	HashMultiGet(key string, fields []string) ([]interface{}, error)
+	HashGetAll(key string) (map[string]string, error)
+	// HashScan returns about count fields from cursor and the cursor to go on
+	// with, which is 0 after the last fields, so a big hash is read in pages
+	HashScan(key string, cursor uint64, count int64) (map[string]string, uint64, error)
+	HashLen(key string) (int64, error)
 	HashDel(key string, fields []string) error
 
 	SetAdd(key string, members []string) error
@@ -52,6 +65,10 @@ func (kv *RedisKV) Del(key string) error {
 	return kv.rdb.Del(context.Background(), key).Err()
 }
 
+func (kv *RedisKV) Expire(key string, ttl time.Duration) error {
+	return kv.rdb.Expire(context.Background(), key, ttl).Err()
+}
+
 func (kv *RedisKV) HashDel(key string, fields []string) error {
 	return kv.rdb.HDel(context.Background(), key, fields...).Err()
 }
@@ -68,6 +85,27 @@ func (kv *RedisKV) HashMultiGet(key string, fields []string) ([]interface{}, err
 	return kv.rdb.HMGet(context.Background(), key, fields...).Result()
 }
 
+func (kv *RedisKV) HashGetAll(key string) (map[string]string, error) {
+	return kv.rdb.HGetAll(context.Background(), key).Result()
+}
+
+func (kv *RedisKV) HashScan(key string, cursor uint64, count int64) (map[string]string, uint64, error) {
+	pairs, next, err := kv.rdb.HScan(context.Background(), key, cursor, "", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	// the fields and values are interleaved, a field may show up twice
+	data := make(map[string]string, len(pairs) / 2)
+	for i := 0; i + 1 < len(pairs); i += 2 {
+		data[pairs[i]] = pairs[i + 1]
+	}
+	return data, next, nil
+}
+
+func (kv *RedisKV) HashLen(key string) (int64, error) {
+	return kv.rdb.HLen(context.Background(), key).Result()
+}
+
 func (kv *RedisKV) SetAdd(key string, members []string) error {
 	return kv.rdb.SAdd(context.Background(), key, members).Err()
 }
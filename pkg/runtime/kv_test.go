@@ -64,3 +64,33 @@ func TestHashPutSet(t *testing.T) {
 	assert.Equal(t, targetVals, vals)
 	assert.Equal(t, targetIndices, indices)
 }
+
+func TestHashScan(t *testing.T) {
+	kv := NewRedisKV(redisURL, "", 0)
+	key := "test-scan"
+	assert.NoError(t, kv.Del(key))
+
+	maps := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		maps[fmt.Sprintf("skey-%d", i)] = fmt.Sprintf("sval-%d", i)
+	}
+	assert.NoError(t, kv.HashPut(key, maps))
+
+	size, err := kv.HashLen(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(maps)), size)
+
+	scanned := make(map[string]string)
+	cursor := uint64(0)
+	for {
+		page, next, err := kv.HashScan(key, cursor, 100)
+		assert.NoError(t, err)
+		for k, v := range page {
+			scanned[k] = v
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	assert.Equal(t, maps, scanned)
+}
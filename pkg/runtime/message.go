@@ -6,20 +6,42 @@ import (
 	"io/ioutil"
 	"crypto/sha256"
 	"encoding/base64"
-	"github.com/knwng/ppgi/pkg/algorithms/rsa_blind"
+)
+
+// Step identifies a protocol step, each algorithm declares its own steps
+type Step string
+
+// Steps shared by all the intersection runtimes
+const (
+	StepExchangeData	Step = "ExchangeData"
+	StepShutdown		Step = "Shutdown"
 )
 
 type Key struct {
-	N	[]byte	`json:"n"`
-	E	int		`json:"e"`
+	N		[]byte	`json:"n"`
+	E		int		`json:"e"`
+	// Element is the pubkey of the algorithms based on elliptic curves
+	Element	[]byte	`json:"element"`
+	// ID is the fingerprint of the pubkey, hashes are only comparable under the same key
+	ID		string	`json:"id"`
+	// validity window of the key in unix seconds, 0 means unbounded
+	NotBefore	int64	`json:"not_before"`
+	NotAfter	int64	`json:"not_after"`
 }
 
 type Message struct {
 	Algorithm 	string 				`json:"algorithm"`
-	Step		rsa_blind.RSAStep	`json:"step"`
+	Step		Step				`json:"step"`
 	SessionKey	string				`json:"session_key"`
 	Data		[][]byte 			`json:"data"`
 	Key			Key					`json:"key"`
+	Proof		[]byte				`json:"proof"`
+	// KeyID is the id of the key the data is computed with
+	KeyID		string				`json:"key_id"`
+	// Party is the id of the party the data belongs to, in multi-party protocols
+	Party		string				`json:"party"`
+	// delivery is set by the consumer the message is received from, to ack it
+	delivery	interface{}
 }
 
 func ReadSchema(filename string) (string, error) {
@@ -33,7 +55,7 @@ func ReadSchema(filename string) (string, error) {
 	return schemaStr, nil
 }
 
-func GenerateSessionKey(algorithm string, step rsa_blind.RSAStep) string {
+func GenerateSessionKey(algorithm string, step Step) string {
 	current := time.Now().String()
 	key := sha256.Sum256([]byte(strings.Join([]string{algorithm, string(step), current}, "-")))
 	return "" + base64.StdEncoding.EncodeToString(key[:])
@@ -0,0 +1,335 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The redis stream transport keeps the messages of each topic in a redis
+// stream, which is read by a consumer group. A message stays pending in the
+// group until it's acked, then it's deleted. The pending messages of a
+// consumer are delivered again when it restarts with the same name, and a
+// message nacked, or left pending by another consumer, is claimed once it's
+// idle for ClaimIdle.
+
+const streamPayloadField = "payload"
+
+const (
+	defaultStreamGroup 		= "ppgi"
+	defaultStreamBlock 		= 5 * time.Second
+	defaultStreamClaimIdle 	= time.Minute
+	streamReadCount 		= 16
+)
+
+// Client returns the redis client of kv, so that other components share its
+// connection settings and pool
+func (kv *RedisKV) Client() *redis.Client {
+	return kv.rdb
+}
+
+type RedisStreamProducer struct {
+	rdb 		*redis.Client
+	stream 		string
+}
+
+func NewRedisStreamProducer(rdb *redis.Client, stream string) *RedisStreamProducer {
+	return &RedisStreamProducer{
+		rdb: rdb,
+		stream: stream,
+	}
+}
+
+func (p *RedisStreamProducer) GetConnectionInfo() string {
+	return fmt.Sprintf("addr: %s, stream: %s", p.rdb.Options().Addr, p.stream)
+}
+
+func (p *RedisStreamProducer) Send(payload []byte) error {
+	return p.rdb.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: p.stream,
+		Values: map[string]interface{}{streamPayloadField: payload},
+	}).Err()
+}
+
+func (p *RedisStreamProducer) SendStruct(msg *Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.Send(payload)
+}
+
+// Close leaves the client to its owner
+func (p *RedisStreamProducer) Close() {
+}
+
+type RedisStreamConsumerOptions struct {
+	// Group is the consumer group, defaults to ppgi
+	Group 		string
+	// Consumer is the name of this consumer in the group, it should be kept
+	// across restarts to get back its pending messages
+	Consumer 	string
+	// ClaimIdle is how long a pending message of another consumer is left
+	// before it's claimed, defaults to a minute
+	ClaimIdle 	time.Duration
+}
+
+type RedisStreamConsumer struct {
+	rdb 		*redis.Client
+	stream 		string
+	group 		string
+	consumer 	string
+	claimIdle 	time.Duration
+	ctx 		context.Context
+	cancel 		context.CancelFunc
+	// messages read but not returned yet
+	buffer 		[]redis.XMessage
+	// backlog is set until own pending messages are read after start, which
+	// are read on from backlogFrom
+	backlog 	bool
+	backlogFrom string
+	// the pending list is claimed in pages from claimFrom, and again from the
+	// start ClaimIdle after lastClaim reached its end
+	claimFrom 	string
+	lastClaim 	time.Time
+	mu 			sync.Mutex
+	// messages returned by ReceiveStruct and not acked or nacked yet
+	inflight 	map[string]bool
+}
+
+func NewRedisStreamConsumer(rdb *redis.Client, stream string, options RedisStreamConsumerOptions) (*RedisStreamConsumer, error) {
+	if len(options.Consumer) == 0 {
+		return nil, errors.New("The name of consumer should be set")
+	}
+	if len(options.Group) == 0 {
+		options.Group = defaultStreamGroup
+	}
+	if options.ClaimIdle <= 0 {
+		options.ClaimIdle = defaultStreamClaimIdle
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := rdb.XGroupCreateMkStream(ctx, stream, options.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		cancel()
+		return nil, err
+	}
+
+	return &RedisStreamConsumer{
+		rdb: rdb,
+		stream: stream,
+		group: options.Group,
+		consumer: options.Consumer,
+		claimIdle: options.ClaimIdle,
+		ctx: ctx,
+		cancel: cancel,
+		backlog: true,
+		backlogFrom: "0",
+		claimFrom: "-",
+		inflight: make(map[string]bool),
+	}, nil
+}
+
+// ack acks and deletes the message, the stream has a single group so nobody
+// else needs it
+func (c *RedisStreamConsumer) ack(id string) error {
+	if err := c.rdb.XAck(c.ctx, c.stream, c.group, id).Err(); err != nil {
+		return err
+	}
+	return c.rdb.XDel(c.ctx, c.stream, id).Err()
+}
+
+func (c *RedisStreamConsumer) isInflight(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight[id]
+}
+
+// claim takes over the messages left pending for too long, by other consumers
+// or nacked by this one, own pending ones are left to the backlog after start.
+// The pending list is read page by page until some messages are claimed, and
+// the next claim goes on after the last page read.
+func (c *RedisStreamConsumer) claim() error {
+	var ids []string
+	for len(ids) == 0 {
+		pending, err := c.rdb.XPendingExt(c.ctx, &redis.XPendingExtArgs{
+			Stream: c.stream,
+			Group: c.group,
+			Idle: c.claimIdle,
+			Start: c.claimFrom,
+			End: "+",
+			Count: streamReadCount,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range pending {
+			if entry.Consumer == c.consumer && (c.backlog || c.isInflight(entry.ID)) {
+				continue
+			}
+			ids = append(ids, entry.ID)
+		}
+
+		if len(pending) < streamReadCount {
+			// the end of the list, start over after ClaimIdle
+			c.claimFrom = "-"
+			c.lastClaim = time.Now()
+			break
+		}
+		// "(" makes the start exclusive
+		c.claimFrom = "(" + pending[len(pending) - 1].ID
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	claimed, err := c.rdb.XClaim(c.ctx, &redis.XClaimArgs{
+		Stream: c.stream,
+		Group: c.group,
+		Consumer: c.consumer,
+		MinIdle: c.claimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	c.buffer = append(c.buffer, claimed...)
+	return nil
+}
+
+// read fills the buffer with own pending messages first, then with the ones
+// claimed, and the new ones at last
+func (c *RedisStreamConsumer) read() error {
+	if time.Since(c.lastClaim) >= c.claimIdle {
+		if err := c.claim(); err != nil {
+			return err
+		}
+		if len(c.buffer) > 0 {
+			return nil
+		}
+	}
+
+	id := ">"
+	block := defaultStreamBlock
+	if c.backlog {
+		// an id other than ">" returns the messages delivered to this consumer
+		// but not acked, after the id
+		id, block = c.backlogFrom, 0
+	}
+	streams, err := c.rdb.XReadGroup(c.ctx, &redis.XReadGroupArgs{
+		Group: c.group,
+		Consumer: c.consumer,
+		Streams: []string{c.stream, id},
+		Count: streamReadCount,
+		Block: block,
+	}).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	read := 0
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			read++
+			if c.backlog {
+				c.backlogFrom = msg.ID
+				if c.isInflight(msg.ID) {
+					continue
+				}
+			}
+			c.buffer = append(c.buffer, msg)
+		}
+	}
+	if c.backlog && read == 0 {
+		c.backlog = false
+	}
+	return nil
+}
+
+// next returns the id and payload of the next message
+func (c *RedisStreamConsumer) next() (string, []byte, error) {
+	for {
+		for len(c.buffer) > 0 {
+			msg := c.buffer[0]
+			c.buffer = c.buffer[1:]
+			payload, ok := msg.Values[streamPayloadField].(string)
+			if !ok {
+				// a message deleted while pending has no values, drop it
+				c.rdb.XAck(c.ctx, c.stream, c.group, msg.ID)
+				continue
+			}
+			return msg.ID, []byte(payload), nil
+		}
+
+		if err := c.read(); err != nil {
+			if c.ctx.Err() != nil {
+				return "", nil, errConsumerClosed
+			}
+			return "", nil, err
+		}
+	}
+}
+
+func (c *RedisStreamConsumer) Receive() ([]byte, error) {
+	id, payload, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	return payload, c.ack(id)
+}
+
+func (c *RedisStreamConsumer) ReceiveStruct() (Message, error) {
+	id, payload, err := c.next()
+	if err != nil {
+		return Message{}, err
+	}
+	var msg Message
+	if err = json.Unmarshal(payload, &msg); err != nil {
+		// it would fail the same way every time
+		c.ack(id)
+		return Message{}, err
+	}
+	msg.delivery = id
+	c.mu.Lock()
+	c.inflight[id] = true
+	c.mu.Unlock()
+	return msg, nil
+}
+
+func (c *RedisStreamConsumer) Ack(msg *Message) error {
+	id, ok := msg.delivery.(string)
+	if !ok {
+		return errNoDelivery
+	}
+	c.mu.Lock()
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	return c.ack(id)
+}
+
+// Nack leaves the message pending, it's claimed again after ClaimIdle
+func (c *RedisStreamConsumer) Nack(msg *Message) error {
+	id, ok := msg.delivery.(string)
+	if !ok {
+		return errNoDelivery
+	}
+	c.mu.Lock()
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	return nil
+}
+
+// Close stops the blocking read, the client is left to its owner
+func (c *RedisStreamConsumer) Close() {
+	c.cancel()
+}
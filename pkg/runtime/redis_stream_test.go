@@ -0,0 +1,89 @@
+package runtime
+
+import (
+	"fmt"
+	"time"
+	"testing"
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStream(t *testing.T) {
+	kv := NewRedisKV(redisURL, "", 0)
+	stream := fmt.Sprintf("test_stream_%d", time.Now().UnixNano())
+	defer kv.Client().Del(context.Background(), stream)
+
+	producer := NewRedisStreamProducer(kv.Client(), stream)
+	consumer, err := NewRedisStreamConsumer(kv.Client(), stream, RedisStreamConsumerOptions{Consumer: "test"})
+	assert.NoError(t, err)
+	defer consumer.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{
+			Step: "ClientBlind",
+			SessionKey: fmt.Sprintf("session-%d", i),
+		}))
+	}
+	for i := 0; i < 10; i++ {
+		msg, err := consumer.ReceiveStruct()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("session-%d", i), msg.SessionKey)
+	}
+}
+
+func TestRedisStreamPendingRecovery(t *testing.T) {
+	kv := NewRedisKV(redisURL, "", 0)
+	stream := fmt.Sprintf("test_stream_%d", time.Now().UnixNano())
+	defer kv.Client().Del(context.Background(), stream)
+
+	producer := NewRedisStreamProducer(kv.Client(), stream)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{SessionKey: fmt.Sprintf("session-%d", i)}))
+	}
+
+	// the first message is received but never acked
+	consumer, err := NewRedisStreamConsumer(kv.Client(), stream, RedisStreamConsumerOptions{Consumer: "dead"})
+	assert.NoError(t, err)
+	msg, err := consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-0", msg.SessionKey)
+	consumer.Close()
+
+	// restarting with the same name gets it back
+	consumer, err = NewRedisStreamConsumer(kv.Client(), stream, RedisStreamConsumerOptions{Consumer: "dead"})
+	assert.NoError(t, err)
+	msg, err = consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-0", msg.SessionKey)
+	consumer.Close()
+
+	// another consumer claims it once it's idle
+	time.Sleep(50 * time.Millisecond)
+	other, err := NewRedisStreamConsumer(kv.Client(), stream, RedisStreamConsumerOptions{
+		Consumer: "other",
+		ClaimIdle: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer other.Close()
+	msg, err = other.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-0", msg.SessionKey)
+	assert.NoError(t, other.Ack(&msg))
+
+	// a nacked message is claimed again by its own consumer
+	msg, err = other.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-1", msg.SessionKey)
+	assert.NoError(t, other.Nack(&msg))
+	time.Sleep(50 * time.Millisecond)
+	received := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		msg, err = other.ReceiveStruct()
+		assert.NoError(t, err)
+		received = append(received, msg.SessionKey)
+		assert.NoError(t, other.Ack(&msg))
+	}
+	// session-2 may be read together with session-1 before the nack
+	assert.ElementsMatch(t, []string{"session-1", "session-2"}, received)
+}
@@ -0,0 +1,491 @@
+package runtime
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"bufio"
+	"errors"
+	"time"
+	"strings"
+	"context"
+	"net/http"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"encoding/json"
+	"encoding/binary"
+)
+
+// The stream transport connects the two sides directly, without a shared
+// message queue. Each side listens for the stream of its peer, and opens one
+// stream to the listener of its peer, both over HTTP/2 with mutual TLS. Every
+// message is sent as a frame prefixed with its length, and the listener writes
+// it to a spool file before sending back an ack byte, so Send returns once the
+// message is safe on the peer, without waiting for it to be handled, and the
+// order of messages is kept. The spool file is removed when the message is
+// acked, so a message being handled or nacked when the consumer dies is
+// received again after restart, and a message whose ack is lost when the
+// stream breaks is sent twice.
+
+// maxFrameSize bounds the size of a single message
+const maxFrameSize = 256 << 20
+
+const frameAck byte = 1
+
+// nackDelay is how long a nacked message waits before it's received again
+const nackDelay = time.Second
+
+var errConsumerClosed = errors.New("The consumer is closed")
+
+// TLSConfig is the certificate of this side, the CA that signs the
+// certificates of both sides, and the name the certificate of peer is issued
+// to, either its common name or one of its DNS names
+type TLSConfig struct {
+	CertFile 	string
+	KeyFile 	string
+	CAFile 		string
+	PeerName 	string
+}
+
+func (c *TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	if len(c.PeerName) == 0 {
+		return tls.Certificate{}, nil, errors.New("The name of peer should be set")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	caPEM, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return tls.Certificate{}, nil, errors.New(fmt.Sprintf("No certificate is found in %s", c.CAFile))
+	}
+	return cert, pool, nil
+}
+
+// verifyPeerName checks the verified certificate of peer is issued to name
+func verifyPeerName(state tls.ConnectionState, name string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("The peer presented no certificate")
+	}
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName == name {
+		return nil
+	}
+	for _, dnsName := range cert.DNSNames {
+		if dnsName == name {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("The certificate of peer is not issued to %s", name))
+}
+
+func writeFrame(w io.Writer, payload []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		return nil, errors.New(fmt.Sprintf("Frame of %d bytes exceeds the limit", size))
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// StreamProducer sends messages over one long-lived stream to the listener of
+// peer, and opens a new stream when the old one breaks
+type StreamProducer struct {
+	client 		*http.Client
+	url 		string
+	mu 			sync.Mutex
+	body 		*io.PipeWriter
+	resp 		*http.Response
+	acks 		*bufio.Reader
+}
+
+// NewStreamProducer takes the address of the listener of peer, e.g.
+// https://peer.example.com:9443, and the topic the peer consumes
+func NewStreamProducer(address, topic string, config TLSConfig) (*StreamProducer, error) {
+	cert, pool, err := config.load()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs: pool,
+			ServerName: config.PeerName,
+			MinVersion: tls.VersionTLS12,
+		},
+		ForceAttemptHTTP2: true,
+	}
+
+	return &StreamProducer{
+		client: &http.Client{Transport: transport},
+		url: strings.TrimRight(address, "/") + "/topics/" + topic,
+	}, nil
+}
+
+func (p *StreamProducer) GetConnectionInfo() string {
+	return fmt.Sprintf("url: %s", p.url)
+}
+
+func (p *StreamProducer) connect() error {
+	reader, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, p.url, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		writer.Close()
+		resp.Body.Close()
+		return errors.New(fmt.Sprintf("The peer refused the stream, status: %s", resp.Status))
+	}
+	if resp.ProtoMajor != 2 {
+		writer.Close()
+		resp.Body.Close()
+		return errors.New(fmt.Sprintf("The peer doesn't speak HTTP/2, got %s", resp.Proto))
+	}
+
+	p.body, p.resp, p.acks = writer, resp, bufio.NewReader(resp.Body)
+	return nil
+}
+
+func (p *StreamProducer) disconnect() {
+	if p.body != nil {
+		p.body.Close()
+		p.resp.Body.Close()
+		p.body, p.resp, p.acks = nil, nil, nil
+	}
+}
+
+// Send returns once the peer acks the message, a broken stream is reopened
+// once before giving up
+func (p *StreamProducer) Send(payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if p.body == nil {
+			if err = p.connect(); err != nil {
+				continue
+			}
+		}
+		if err = p.sendFrame(payload); err == nil {
+			return nil
+		}
+		p.disconnect()
+	}
+	return err
+}
+
+func (p *StreamProducer) sendFrame(payload []byte) error {
+	if err := writeFrame(p.body, payload); err != nil {
+		return err
+	}
+	ack, err := p.acks.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ack != frameAck {
+		return errors.New("Wrong ack from peer")
+	}
+	return nil
+}
+
+func (p *StreamProducer) SendStruct(msg *Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.Send(payload)
+}
+
+func (p *StreamProducer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disconnect()
+	p.client.CloseIdleConnections()
+}
+
+// streamDelivery is a message spooled as seq
+type streamDelivery struct {
+	seq 		uint64
+	payload 	[]byte
+}
+
+// StreamConsumer listens for the streams of peer, only the clients with a
+// certificate issued to the name of peer are accepted. The messages are
+// spooled to files before they're acked to the peer.
+type StreamConsumer struct {
+	server 		*http.Server
+	listener 	net.Listener
+	path 		string
+	topic 		string
+	spool 		string
+	mu 			sync.Mutex
+	nextSeq 	uint64
+	queue 		[]*streamDelivery
+	// ready is signaled when the queue gets a message
+	ready 		chan struct{}
+	closed 		chan struct{}
+	closeOnce 	sync.Once
+}
+
+// NewStreamConsumer listens on address, e.g. :9443, for the messages of topic,
+// and spools them in the directory spool. The messages spooled and not acked
+// before a restart are received again.
+func NewStreamConsumer(address, topic, spool string, config TLSConfig) (*StreamConsumer, error) {
+	if err := checkDropTopic(topic); err != nil {
+		return nil, err
+	}
+	if len(spool) == 0 {
+		return nil, errors.New("The spool directory should be set")
+	}
+	if err := os.MkdirAll(spool, 0700); err != nil {
+		return nil, err
+	}
+	cert, pool, err := config.load()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &StreamConsumer{
+		path: "/topics/" + topic,
+		topic: topic,
+		spool: spool,
+		ready: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	if err = c.recover(); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c.listener = listener
+	c.server = &http.Server{
+		Handler: http.HandlerFunc(c.handleStream),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs: pool,
+			MinVersion: tls.VersionTLS12,
+			VerifyConnection: func(state tls.ConnectionState) error {
+				return verifyPeerName(state, config.PeerName)
+			},
+		},
+	}
+	go c.server.ServeTLS(listener, "", "")
+
+	return c, nil
+}
+
+// recover queues the messages spooled before a restart in order
+func (c *StreamConsumer) recover() error {
+	files, err := ioutil.ReadDir(c.spool)
+	if err != nil {
+		return err
+	}
+	seqs := make([]uint64, 0, len(files))
+	for _, file := range files {
+		if seq, ok := parseDropFileName(c.topic, file.Name()); ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for _, seq := range seqs {
+		payload, err := ioutil.ReadFile(c.spoolFile(seq))
+		if err != nil {
+			return err
+		}
+		c.queue = append(c.queue, &streamDelivery{seq: seq, payload: payload})
+		c.nextSeq = seq + 1
+	}
+	return nil
+}
+
+func (c *StreamConsumer) spoolFile(seq uint64) string {
+	return filepath.Join(c.spool, dropFileName(c.topic, seq))
+}
+
+// Addr is the address the consumer listens on
+func (c *StreamConsumer) Addr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *StreamConsumer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != c.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "HTTP/2 is required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		payload, err := readFrame(r.Body)
+		if err != nil {
+			return
+		}
+		// the frame is acked once it's spooled, so the peer never waits for
+		// the handlers of this side
+		if err = c.spoolMessage(payload); err != nil {
+			return
+		}
+		if _, err = w.Write([]byte{frameAck}); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// spoolMessage writes the message to the spool and queues it
+func (c *StreamConsumer) spoolMessage(payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq := c.nextSeq
+	if err := writeFileAtomic(c.spoolFile(seq), payload); err != nil {
+		return err
+	}
+	c.nextSeq++
+	c.push(&streamDelivery{seq: seq, payload: payload})
+	return nil
+}
+
+// push queues the delivery, c.mu should be held
+func (c *StreamConsumer) push(delivery *streamDelivery) {
+	c.queue = append(c.queue, delivery)
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (c *StreamConsumer) receive() (*streamDelivery, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			delivery := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return delivery, nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.ready:
+		case <-c.closed:
+			return nil, errConsumerClosed
+		}
+	}
+}
+
+// ack removes the message from the spool
+func (c *StreamConsumer) ack(delivery *streamDelivery) error {
+	if err := os.Remove(c.spoolFile(delivery.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *StreamConsumer) Receive() ([]byte, error) {
+	delivery, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	return delivery.payload, c.ack(delivery)
+}
+
+func (c *StreamConsumer) ReceiveStruct() (Message, error) {
+	delivery, err := c.receive()
+	if err != nil {
+		return Message{}, err
+	}
+	var msg Message
+	if err = json.Unmarshal(delivery.payload, &msg); err != nil {
+		// it would fail the same way every time
+		c.ack(delivery)
+		return Message{}, err
+	}
+	msg.delivery = delivery
+	return msg, nil
+}
+
+func (c *StreamConsumer) Ack(msg *Message) error {
+	delivery, ok := msg.delivery.(*streamDelivery)
+	if !ok {
+		return errNoDelivery
+	}
+	return c.ack(delivery)
+}
+
+// Nack queues the message again after nackDelay, it stays in the spool until
+// then, so it's received again after a restart too
+func (c *StreamConsumer) Nack(msg *Message) error {
+	delivery, ok := msg.delivery.(*streamDelivery)
+	if !ok {
+		return errNoDelivery
+	}
+	go func() {
+		timer := time.NewTimer(nackDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return
+		}
+		c.mu.Lock()
+		c.push(delivery)
+		c.mu.Unlock()
+	}()
+	return nil
+}
+
+func (c *StreamConsumer) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.server.Close()
+	})
+}
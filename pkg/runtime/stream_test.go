@@ -0,0 +1,210 @@
+package runtime
+
+import (
+	"fmt"
+	"time"
+	"testing"
+	"math/big"
+	"io/ioutil"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"path/filepath"
+	"crypto/x509/pkix"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert 	*x509.Certificate
+	key 	*ecdsa.PrivateKey
+	file 	string
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(file, data, 0600))
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "ppgi test ca"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	file := filepath.Join(dir, "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate issued to name, for both server and client auth
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, name + ".pem")
+	keyFile := filepath.Join(dir, name + ".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func TestStreamTransport(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	hostCert, hostKey := ca.issue(t, dir, "host.ppgi", 2)
+	clientCert, clientKey := ca.issue(t, dir, "client.ppgi", 3)
+
+	consumer, err := NewStreamConsumer("127.0.0.1:0", "client_to_host", filepath.Join(dir, "spool"), TLSConfig{
+		CertFile: hostCert, KeyFile: hostKey, CAFile: ca.file, PeerName: "client.ppgi",
+	})
+	assert.NoError(t, err)
+	defer consumer.Close()
+
+	producer, err := NewStreamProducer(fmt.Sprintf("https://%s", consumer.Addr()), "client_to_host", TLSConfig{
+		CertFile: clientCert, KeyFile: clientKey, CAFile: ca.file, PeerName: "host.ppgi",
+	})
+	assert.NoError(t, err)
+	defer producer.Close()
+
+	received := make(chan Message)
+	go func() {
+		for i := 0; i < 10; i++ {
+			msg, err := consumer.ReceiveStruct()
+			assert.NoError(t, err)
+			assert.NoError(t, consumer.Ack(&msg))
+			received <- msg
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{
+			Algorithm: "rsa",
+			Step: "ClientBlind",
+			SessionKey: fmt.Sprintf("session-%d", i),
+			Data: [][]byte{[]byte("hello")},
+		}))
+		msg := <-received
+		// messages arrive in order
+		assert.Equal(t, fmt.Sprintf("session-%d", i), msg.SessionKey)
+		assert.Equal(t, Step("ClientBlind"), msg.Step)
+		assert.Equal(t, [][]byte{[]byte("hello")}, msg.Data)
+	}
+}
+
+func TestStreamTransportSpool(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	ca := newTestCA(t, dir)
+	hostCert, hostKey := ca.issue(t, dir, "host.ppgi", 2)
+	clientCert, clientKey := ca.issue(t, dir, "client.ppgi", 3)
+	hostConfig := TLSConfig{
+		CertFile: hostCert, KeyFile: hostKey, CAFile: ca.file, PeerName: "client.ppgi",
+	}
+
+	consumer, err := NewStreamConsumer("127.0.0.1:0", "client_to_host", spool, hostConfig)
+	assert.NoError(t, err)
+
+	producer, err := NewStreamProducer(fmt.Sprintf("https://%s", consumer.Addr()), "client_to_host", TLSConfig{
+		CertFile: clientCert, KeyFile: clientKey, CAFile: ca.file, PeerName: "host.ppgi",
+	})
+	assert.NoError(t, err)
+	defer producer.Close()
+
+	// Send doesn't wait for the message to be received
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, producer.SendStruct(&Message{
+			Algorithm: "rsa",
+			Step: "HostHash",
+			SessionKey: fmt.Sprintf("session-%d", i),
+		}))
+	}
+
+	msg, err := consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-0", msg.SessionKey)
+	assert.NoError(t, consumer.Ack(&msg))
+
+	// the nacked message is received again after the ones queued
+	msg, err = consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-1", msg.SessionKey)
+	assert.NoError(t, consumer.Nack(&msg))
+	msg, err = consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-2", msg.SessionKey)
+	msg, err = consumer.ReceiveStruct()
+	assert.NoError(t, err)
+	assert.Equal(t, "session-1", msg.SessionKey)
+	assert.Equal(t, errNoDelivery, consumer.Nack(&Message{}))
+	consumer.Close()
+
+	// the messages not acked are received again after restart, in order
+	consumer, err = NewStreamConsumer("127.0.0.1:0", "client_to_host", spool, hostConfig)
+	assert.NoError(t, err)
+	defer consumer.Close()
+	for _, sessionKey := range []string{"session-1", "session-2"} {
+		msg, err = consumer.ReceiveStruct()
+		assert.NoError(t, err)
+		assert.Equal(t, sessionKey, msg.SessionKey)
+		assert.NoError(t, consumer.Ack(&msg))
+	}
+	files, err := ioutil.ReadDir(spool)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestStreamTransportRejectsUnknownPeer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	hostCert, hostKey := ca.issue(t, dir, "host.ppgi", 2)
+	otherCert, otherKey := ca.issue(t, dir, "other.ppgi", 3)
+
+	consumer, err := NewStreamConsumer("127.0.0.1:0", "client_to_host", filepath.Join(dir, "spool"), TLSConfig{
+		CertFile: hostCert, KeyFile: hostKey, CAFile: ca.file, PeerName: "client.ppgi",
+	})
+	assert.NoError(t, err)
+	defer consumer.Close()
+
+	// the certificate is signed by the same CA, but not issued to the peer
+	producer, err := NewStreamProducer(fmt.Sprintf("https://%s", consumer.Addr()), "client_to_host", TLSConfig{
+		CertFile: otherCert, KeyFile: otherKey, CAFile: ca.file, PeerName: "host.ppgi",
+	})
+	assert.NoError(t, err)
+	defer producer.Close()
+	assert.Error(t, producer.Send([]byte("hello")))
+
+	// the server must be the expected peer too
+	producer, err = NewStreamProducer(fmt.Sprintf("https://%s", consumer.Addr()), "client_to_host", TLSConfig{
+		CertFile: otherCert, KeyFile: otherKey, CAFile: ca.file, PeerName: "someone.ppgi",
+	})
+	assert.NoError(t, err)
+	defer producer.Close()
+	assert.Error(t, producer.Send([]byte("hello")))
+}